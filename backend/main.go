@@ -1,12 +1,20 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"mime"
+	"net"
 	"net/http"
 	"os"
-	"path/filepath"
+	"os/signal"
+	"sort"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -32,6 +40,41 @@ func main() {
 	}
 	systemService := services.NewSystemService()
 	storageService := services.NewStorageService()
+	encryptionService := services.NewEncryptionService(storageService)
+	go encryptionService.UnlockAtBoot()
+	snapshotScheduler := services.NewSnapshotScheduler(storageService)
+	snapshotScheduler.Start()
+	defer snapshotScheduler.Stop()
+	replicationService := services.NewReplicationService(storageService)
+	scrubScheduler := services.NewScrubScheduler(storageService)
+	scrubScheduler.Start()
+	defer scrubScheduler.Stop()
+	smartTestScheduler := services.NewSmartTestScheduler(storageService)
+	smartTestScheduler.Start()
+	defer smartTestScheduler.Stop()
+	diskHistory := services.NewDiskHistoryRecorder(storageService)
+	diskHistory.Start()
+	defer diskHistory.Stop()
+	powerMonitor := services.NewPowerMonitor(storageService)
+	powerMonitor.Start()
+	defer powerMonitor.Stop()
+	capacityMonitor := services.NewCapacityMonitor(storageService)
+	capacityMonitor.Start()
+	defer capacityMonitor.Stop()
+	ledService := services.NewLEDService(storageService)
+	defer ledService.Stop()
+	burnInService := services.NewBurnInService(storageService)
+	wipeService := services.NewWipeService(storageService)
+	hotplugWatcher := services.NewHotplugWatcher(storageService)
+	hotplugWatcher.Start()
+	defer hotplugWatcher.Stop()
+	uploadService := services.NewUploadService(storageService)
+	uploadService.Start()
+	defer uploadService.Stop()
+	transferService := services.NewTransferService(storageService)
+	recycleBin := services.NewRecycleBin(storageService)
+	recycleBin.Start()
+	defer recycleBin.Stop()
 
 	// Initialize router
 	router := gin.Default()
@@ -39,9 +82,9 @@ func main() {
 	// CORS configuration
 	router.Use(cors.New(cors.Config{
 		AllowOrigins:     []string{"http://localhost:5173"},
-		AllowMethods:     []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowHeaders:     []string{"Origin", "Content-Type", "Authorization"},
-		ExposeHeaders:    []string{"Content-Length"},
+		AllowMethods:     []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
+		AllowHeaders:     []string{"Origin", "Content-Type", "Authorization", "Range", "If-Range", "If-None-Match", "If-Modified-Since", "Tus-Resumable", "Upload-Length", "Upload-Offset", "Upload-Metadata", "Upload-Checksum"},
+		ExposeHeaders:    []string{"Content-Length", "Content-Range", "Content-Disposition", "Accept-Ranges", "ETag", "Last-Modified", "Location", "Tus-Resumable", "Tus-Version", "Tus-Extension", "Tus-Checksum-Algorithm", "Upload-Length", "Upload-Offset", "Upload-Expires"},
 		AllowCredentials: true,
 		MaxAge:           12 * time.Hour,
 	}))
@@ -67,6 +110,52 @@ func main() {
 		c.JSON(http.StatusOK, gin.H{"token": token})
 	})
 
+	// Peer routes, used by another A1Nas replicating into this one
+	peer := router.Group("/api/peer")
+	peer.Use(middleware.PeerAuthMiddleware(replicationService))
+	{
+		peer.GET("/replication/state", func(c *gin.Context) {
+			dataset := c.Query("dataset")
+			if !services.DatasetWithin(dataset, c.GetString("peerDataset")) {
+				c.JSON(http.StatusForbidden, gin.H{"error": "dataset not allowed for this peer key"})
+				return
+			}
+			state, err := storageService.ReplicationState(dataset)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(http.StatusOK, state)
+		})
+
+		peer.POST("/replication/receive", func(c *gin.Context) {
+			dataset := c.Query("dataset")
+			if !services.DatasetWithin(dataset, c.GetString("peerDataset")) {
+				c.JSON(http.StatusForbidden, gin.H{"error": "dataset not allowed for this peer key"})
+				return
+			}
+			incremental := c.Query("incremental") == "true"
+			if err := storageService.ReceivePeerStream(c.Request.Context(), dataset, incremental, c.Request.Body); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(http.StatusOK, gin.H{"message": "Stream received"})
+		})
+
+		peer.POST("/replication/prune", func(c *gin.Context) {
+			dataset := c.Query("dataset")
+			if !services.DatasetWithin(dataset, c.GetString("peerDataset")) {
+				c.JSON(http.StatusForbidden, gin.H{"error": "dataset not allowed for this peer key"})
+				return
+			}
+			if err := storageService.PruneReplica(dataset, c.Query("prefix"), c.Query("keep")); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(http.StatusOK, gin.H{"message": "Snapshots pruned"})
+		})
+	}
+
 	// Protected routes
 	api := router.Group("/api")
 	api.Use(middleware.AuthMiddleware(authService))
@@ -80,205 +169,1561 @@ func main() {
 					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 					return
 				}
-				c.JSON(http.StatusOK, gin.H{"pools": pools})
+				c.JSON(http.StatusOK, gin.H{"pools": pools})
+			})
+
+			storage.POST("/pools", func(c *gin.Context) {
+				var data struct {
+					Name     string   `json:"name" binding:"required"`
+					RaidType string   `json:"raidType" binding:"required"`
+					Devices  []string `json:"devices" binding:"required"`
+				}
+
+				if err := c.ShouldBindJSON(&data); err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+					return
+				}
+
+				err := storageService.CreatePool(data.Name, data.Devices, data.RaidType)
+				if err != nil {
+					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+					return
+				}
+
+				c.JSON(http.StatusOK, gin.H{"message": "Pool created"})
+			})
+
+			// Pool planner: /pools/plan is a dry run; /pools/plan/apply
+			// creates the pool if the command still matches the dry run.
+			storage.POST("/pools/plan", func(c *gin.Context) {
+				var plan services.PoolPlan
+				if err := c.ShouldBindJSON(&plan); err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+					return
+				}
+				result, err := storageService.PlanPool(plan)
+				if err != nil {
+					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+					return
+				}
+				c.JSON(http.StatusOK, result)
+			})
+
+			storage.POST("/pools/plan/apply", func(c *gin.Context) {
+				var input struct {
+					services.PoolPlan
+					CommandLine string `json:"commandLine" binding:"required"`
+				}
+				if err := c.ShouldBindJSON(&input); err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+					return
+				}
+				result, err := storageService.CreatePlannedPool(input.PoolPlan, input.CommandLine)
+				switch {
+				case errors.Is(err, services.ErrPlanChanged):
+					c.JSON(http.StatusConflict, gin.H{"error": err.Error(), "plan": result})
+				case err != nil && result != nil && !result.Valid:
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "plan": result})
+				case err != nil:
+					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				default:
+					c.JSON(http.StatusOK, gin.H{"message": "Pool created", "plan": result})
+				}
+			})
+
+			storage.GET("/pools/:id/status", func(c *gin.Context) {
+				status, err := storageService.GetPoolStatus(c.Param("id"))
+				if err != nil {
+					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+					return
+				}
+				c.JSON(http.StatusOK, status)
+			})
+
+			// Device replacement and vdev routes
+			storage.POST("/pools/:id/replace", func(c *gin.Context) {
+				var input struct {
+					Device    string `json:"device" binding:"required"`
+					NewDevice string `json:"newDevice"`
+				}
+				if err := c.ShouldBindJSON(&input); err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+					return
+				}
+				if err := storageService.ReplaceDevice(c.Param("id"), input.Device, input.NewDevice); err != nil {
+					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+					return
+				}
+				c.JSON(http.StatusOK, gin.H{"message": "Replacement started"})
+			})
+
+			storage.POST("/pools/:id/attach", func(c *gin.Context) {
+				var input struct {
+					Device    string `json:"device" binding:"required"`
+					NewDevice string `json:"newDevice" binding:"required"`
+				}
+				if err := c.ShouldBindJSON(&input); err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+					return
+				}
+				if err := storageService.AttachDevice(c.Param("id"), input.Device, input.NewDevice); err != nil {
+					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+					return
+				}
+				c.JSON(http.StatusOK, gin.H{"message": "Device attached"})
+			})
+
+			storage.POST("/pools/:id/detach", func(c *gin.Context) {
+				var input struct {
+					Device string `json:"device" binding:"required"`
+				}
+				if err := c.ShouldBindJSON(&input); err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+					return
+				}
+				if err := storageService.DetachDevice(c.Param("id"), input.Device); err != nil {
+					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+					return
+				}
+				c.JSON(http.StatusOK, gin.H{"message": "Device detached"})
+			})
+
+			storage.POST("/pools/:id/vdevs", func(c *gin.Context) {
+				var input struct {
+					Class   string   `json:"class"`
+					Layout  string   `json:"layout"`
+					Devices []string `json:"devices" binding:"required"`
+				}
+				if err := c.ShouldBindJSON(&input); err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+					return
+				}
+				if err := storageService.AddVdev(c.Param("id"), input.Class, input.Layout, input.Devices); err != nil {
+					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+					return
+				}
+				c.JSON(http.StatusOK, gin.H{"message": "Vdev added"})
+			})
+
+			storage.POST("/pools/:id/offline", func(c *gin.Context) {
+				var input struct {
+					Device    string `json:"device" binding:"required"`
+					Temporary bool   `json:"temporary"`
+				}
+				if err := c.ShouldBindJSON(&input); err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+					return
+				}
+				if err := storageService.OfflineDevice(c.Param("id"), input.Device, input.Temporary); err != nil {
+					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+					return
+				}
+				c.JSON(http.StatusOK, gin.H{"message": "Device offline"})
+			})
+
+			storage.POST("/pools/:id/online", func(c *gin.Context) {
+				var input struct {
+					Device string `json:"device" binding:"required"`
+					Expand bool   `json:"expand"`
+				}
+				if err := c.ShouldBindJSON(&input); err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+					return
+				}
+				if err := storageService.OnlineDevice(c.Param("id"), input.Device, input.Expand); err != nil {
+					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+					return
+				}
+				c.JSON(http.StatusOK, gin.H{"message": "Device online"})
+			})
+
+			storage.POST("/pools/:id/clear", func(c *gin.Context) {
+				var input struct {
+					Device string `json:"device"`
+				}
+				c.ShouldBindJSON(&input)
+				if err := storageService.ClearErrors(c.Param("id"), input.Device); err != nil {
+					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+					return
+				}
+				c.JSON(http.StatusOK, gin.H{"message": "Errors cleared"})
+			})
+
+			// Pool import/export routes
+			storage.GET("/pools/import", func(c *gin.Context) {
+				pools, err := storageService.FindImportablePools(c.Query("dir"))
+				if err != nil {
+					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+					return
+				}
+				c.JSON(http.StatusOK, gin.H{"pools": pools})
+			})
+
+			storage.POST("/pools/import", func(c *gin.Context) {
+				var input struct {
+					Pool string `json:"pool" binding:"required"`
+					services.PoolImportOptions
+				}
+				if err := c.ShouldBindJSON(&input); err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+					return
+				}
+				if err := storageService.ImportPool(input.Pool, input.PoolImportOptions); err != nil {
+					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+					return
+				}
+				c.JSON(http.StatusOK, gin.H{"message": "Pool imported"})
+			})
+
+			storage.POST("/pools/:id/export", func(c *gin.Context) {
+				var input struct {
+					Force bool `json:"force"`
+				}
+				c.ShouldBindJSON(&input)
+				if err := storageService.ExportPool(c.Param("id"), input.Force); err != nil {
+					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+					return
+				}
+				c.JSON(http.StatusOK, gin.H{"message": "Pool exported"})
+			})
+
+			// Scrub routes
+			storage.POST("/pools/:id/scrub", func(c *gin.Context) {
+				if err := storageService.StartScrub(c.Param("id")); err != nil {
+					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+					return
+				}
+				c.JSON(http.StatusOK, gin.H{"message": "Scrub started"})
+			})
+
+			storage.POST("/pools/:id/scrub/pause", func(c *gin.Context) {
+				if err := storageService.PauseScrub(c.Param("id")); err != nil {
+					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+					return
+				}
+				c.JSON(http.StatusOK, gin.H{"message": "Scrub paused"})
+			})
+
+			storage.POST("/pools/:id/scrub/cancel", func(c *gin.Context) {
+				if err := storageService.CancelScrub(c.Param("id")); err != nil {
+					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+					return
+				}
+				c.JSON(http.StatusOK, gin.H{"message": "Scrub canceled"})
+			})
+
+			storage.GET("/pools/:id/scrub/history", func(c *gin.Context) {
+				c.JSON(http.StatusOK, gin.H{"history": scrubScheduler.History(c.Param("id"))})
+			})
+
+			// Capacity routes
+			storage.GET("/capacity", func(c *gin.Context) {
+				pools, err := capacityMonitor.Pools()
+				if err != nil {
+					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+					return
+				}
+				c.JSON(http.StatusOK, gin.H{"pools": pools, "alerts": capacityMonitor.Alerts()})
+			})
+
+			storage.GET("/capacity/alerts", func(c *gin.Context) {
+				c.JSON(http.StatusOK, gin.H{"alerts": capacityMonitor.Alerts()})
+			})
+
+			storage.GET("/capacity/settings", func(c *gin.Context) {
+				c.JSON(http.StatusOK, capacityMonitor.Settings())
+			})
+
+			storage.PUT("/capacity/settings", func(c *gin.Context) {
+				var input services.CapacitySettings
+				if err := c.ShouldBindJSON(&input); err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+					return
+				}
+				settings, err := capacityMonitor.SetSettings(input)
+				if err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+					return
+				}
+				c.JSON(http.StatusOK, settings)
+			})
+
+			storage.GET("/pools/:id/capacity", func(c *gin.Context) {
+				capacity, err := capacityMonitor.Pool(c.Param("id"))
+				if errors.Is(err, services.ErrNotFound) {
+					c.JSON(http.StatusNotFound, gin.H{"error": "pool not found"})
+					return
+				}
+				if err != nil {
+					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+					return
+				}
+				c.JSON(http.StatusOK, capacity)
+			})
+
+			// Same range parameters as the disk history, defaulting to 30d.
+			storage.GET("/pools/:id/capacity/history", func(c *gin.Context) {
+				to := time.Now()
+				if v := c.Query("to"); v != "" {
+					t, err := time.Parse(time.RFC3339, v)
+					if err != nil {
+						c.JSON(http.StatusBadRequest, gin.H{"error": "invalid to: " + err.Error()})
+						return
+					}
+					to = t
+				}
+				span, err := services.ParseHistoryDuration(c.DefaultQuery("range", "30d"))
+				if err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+					return
+				}
+				from := to.Add(-span)
+				if v := c.Query("from"); v != "" {
+					t, err := time.Parse(time.RFC3339, v)
+					if err != nil {
+						c.JSON(http.StatusBadRequest, gin.H{"error": "invalid from: " + err.Error()})
+						return
+					}
+					from = t
+				}
+				var step time.Duration
+				if v := c.Query("step"); v != "" {
+					if step, err = services.ParseHistoryDuration(v); err != nil {
+						c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+						return
+					}
+				}
+				history, err := capacityMonitor.History(c.Param("id"), from, to, step)
+				if errors.Is(err, services.ErrNotFound) {
+					c.JSON(http.StatusNotFound, gin.H{"error": "no history for this pool"})
+					return
+				}
+				if err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+					return
+				}
+				c.JSON(http.StatusOK, history)
+			})
+
+			storage.GET("/scrub-schedules", func(c *gin.Context) {
+				c.JSON(http.StatusOK, gin.H{"schedules": scrubScheduler.ListSchedules()})
+			})
+
+			storage.PUT("/scrub-schedules/:pool", func(c *gin.Context) {
+				var input struct {
+					IntervalDays int  `json:"intervalDays" binding:"required"`
+					Enabled      bool `json:"enabled"`
+				}
+				if err := c.ShouldBindJSON(&input); err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+					return
+				}
+				schedule, err := scrubScheduler.SetSchedule(c.Param("pool"), input.IntervalDays, input.Enabled)
+				if err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+					return
+				}
+				c.JSON(http.StatusOK, schedule)
+			})
+
+			storage.DELETE("/scrub-schedules/:pool", func(c *gin.Context) {
+				if err := scrubScheduler.DeleteSchedule(c.Param("pool")); err != nil {
+					c.JSON(http.StatusNotFound, gin.H{"error": "schedule not found"})
+					return
+				}
+				c.Status(http.StatusNoContent)
+			})
+
+			storage.GET("/storage/pools", func(c *gin.Context) {
+				pools, err := storageService.ListPools()
+				if err != nil {
+					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+					return
+				}
+				c.JSON(http.StatusOK, pools)
+			})
+
+			storage.POST("/storage/pools", func(c *gin.Context) {
+				var input struct {
+					Name    string   `json:"name" binding:"required"`
+					Devices []string `json:"devices" binding:"required"`
+					RaidType string  `json:"raidType" binding:"required"`
+				}
+				if err := c.ShouldBindJSON(&input); err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+					return
+				}
+				if err := storageService.CreatePool(input.Name, input.Devices, input.RaidType); err != nil {
+					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+					return
+				}
+				c.Status(http.StatusCreated)
+			})
+
+			storage.GET("/storage/pools/:name/status", func(c *gin.Context) {
+				status, err := storageService.GetPoolStatus(c.Param("name"))
+				if err != nil {
+					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+					return
+				}
+				c.JSON(http.StatusOK, status)
+			})
+
+			storage.DELETE("/storage/pools/:name", func(c *gin.Context) {
+				if err := storageService.DestroyPool(c.Param("name")); err != nil {
+					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+					return
+				}
+				c.Status(http.StatusNoContent)
+			})
+
+			// Both listings are served from the hotplug watcher, which
+			// refreshes them when a disk is added or removed.
+			storage.GET("/storage/devices", func(c *gin.Context) {
+				disks, err := hotplugWatcher.Disks()
+				if err != nil {
+					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+					return
+				}
+				devices := []string{}
+				for _, d := range disks {
+					devices = append(devices, d.Path)
+				}
+				c.JSON(http.StatusOK, devices)
+			})
+
+			// Disk inventory, keyed by serial (or WWN)
+			storage.GET("/disks", func(c *gin.Context) {
+				disks, err := hotplugWatcher.Disks()
+				if err != nil {
+					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+					return
+				}
+				c.JSON(http.StatusOK, gin.H{"disks": disks})
+			})
+
+			storage.GET("/disks/:id", func(c *gin.Context) {
+				disk, err := storageService.GetDisk(c.Param("id"))
+				if errors.Is(err, services.ErrNotFound) {
+					c.JSON(http.StatusNotFound, gin.H{"error": "disk not found"})
+					return
+				}
+				if err != nil {
+					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+					return
+				}
+				c.JSON(http.StatusOK, disk)
+			})
+
+			// Hotplug routes. /events streams disk-added and disk-removed
+			// events as server-sent events; /hotplug/events serves the same
+			// events to pollers.
+			storage.GET("/events", func(c *gin.Context) {
+				events, unsubscribe := hotplugWatcher.Subscribe()
+				defer unsubscribe()
+				c.Stream(func(w io.Writer) bool {
+					select {
+					case event := <-events:
+						c.SSEvent(event.Type, event)
+						return true
+					case <-c.Request.Context().Done():
+						return false
+					}
+				})
+			})
+
+			storage.GET("/hotplug/events", func(c *gin.Context) {
+				var since uint64
+				if v := c.Query("since"); v != "" {
+					if _, err := fmt.Sscan(v, &since); err != nil {
+						c.JSON(http.StatusBadRequest, gin.H{"error": "invalid since"})
+						return
+					}
+				}
+				c.JSON(http.StatusOK, gin.H{"events": hotplugWatcher.Events(since)})
+			})
+
+			storage.GET("/hotplug/missing", func(c *gin.Context) {
+				c.JSON(http.StatusOK, gin.H{"missing": hotplugWatcher.Missing()})
+			})
+
+			storage.DELETE("/hotplug/missing/:id", func(c *gin.Context) {
+				if err := hotplugWatcher.Dismiss(c.Param("id")); err != nil {
+					c.JSON(http.StatusNotFound, gin.H{"error": "no missing disk with this id"})
+					return
+				}
+				c.Status(http.StatusNoContent)
+			})
+
+			// Dataset routes
+			storage.GET("/datasets", func(c *gin.Context) {
+				datasets, err := storageService.ListDatasets(c.Query("parent"))
+				if err != nil {
+					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+					return
+				}
+				c.JSON(http.StatusOK, gin.H{"datasets": datasets})
+			})
+
+			storage.POST("/datasets", func(c *gin.Context) {
+				var input struct {
+					Name       string                      `json:"name" binding:"required"`
+					Properties map[string]string           `json:"properties"`
+					Encryption *services.EncryptionOptions `json:"encryption"`
+				}
+				if err := c.ShouldBindJSON(&input); err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+					return
+				}
+				var err error
+				if input.Encryption != nil {
+					err = encryptionService.CreateEncryptedDataset(input.Name, input.Properties, *input.Encryption)
+				} else {
+					err = storageService.CreateDataset(input.Name, input.Properties)
+				}
+				if err != nil {
+					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+					return
+				}
+				c.Status(http.StatusCreated)
+			})
+
+			storage.POST("/datasets/rename", func(c *gin.Context) {
+				var input struct {
+					Name    string `json:"name" binding:"required"`
+					NewName string `json:"newName" binding:"required"`
+				}
+				if err := c.ShouldBindJSON(&input); err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+					return
+				}
+				if err := storageService.RenameDataset(input.Name, input.NewName); err != nil {
+					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+					return
+				}
+				if err := encryptionService.Rename(input.Name, input.NewName); err != nil {
+					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+					return
+				}
+				c.Status(http.StatusOK)
+			})
+
+			// Dataset names contain slashes, so they are passed as a query
+			// parameter rather than a path segment.
+			storage.DELETE("/datasets", func(c *gin.Context) {
+				recursive := c.Query("recursive") == "true"
+				if err := storageService.DestroyDataset(c.Query("name"), recursive); err != nil {
+					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+					return
+				}
+				if err := encryptionService.Forget(c.Query("name")); err != nil {
+					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+					return
+				}
+				c.Status(http.StatusNoContent)
+			})
+
+			storage.GET("/datasets/properties", func(c *gin.Context) {
+				props, err := storageService.GetDatasetProperties(c.Query("name"))
+				if err != nil {
+					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+					return
+				}
+				c.JSON(http.StatusOK, props)
+			})
+
+			storage.PUT("/datasets/properties", func(c *gin.Context) {
+				var input struct {
+					Name       string            `json:"name" binding:"required"`
+					Properties map[string]string `json:"properties" binding:"required"`
+				}
+				if err := c.ShouldBindJSON(&input); err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+					return
+				}
+				if err := storageService.SetDatasetProperties(input.Name, input.Properties); err != nil {
+					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+					return
+				}
+				c.Status(http.StatusOK)
+			})
+
+			// Encryption routes
+			storage.GET("/datasets/encryption", func(c *gin.Context) {
+				if name := c.Query("name"); name != "" {
+					status, err := encryptionService.Status(name)
+					if errors.Is(err, services.ErrNotFound) {
+						c.JSON(http.StatusNotFound, gin.H{"error": "dataset not found"})
+						return
+					}
+					if err != nil {
+						c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+						return
+					}
+					c.JSON(http.StatusOK, status)
+					return
+				}
+				statuses, err := encryptionService.ListStatus(c.Query("parent"))
+				if err != nil {
+					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+					return
+				}
+				c.JSON(http.StatusOK, gin.H{"datasets": statuses})
+			})
+
+			storage.POST("/datasets/load-key", func(c *gin.Context) {
+				var input struct {
+					Name       string `json:"name" binding:"required"`
+					Passphrase string `json:"passphrase"`
+					Mount      bool   `json:"mount"`
+				}
+				if err := c.ShouldBindJSON(&input); err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+					return
+				}
+				if err := encryptionService.LoadKey(input.Name, input.Passphrase, input.Mount); err != nil {
+					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+					return
+				}
+				c.Status(http.StatusOK)
+			})
+
+			storage.POST("/datasets/unload-key", func(c *gin.Context) {
+				var input struct {
+					Name string `json:"name" binding:"required"`
+				}
+				if err := c.ShouldBindJSON(&input); err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+					return
+				}
+				if err := encryptionService.UnloadKey(input.Name); err != nil {
+					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+					return
+				}
+				c.Status(http.StatusOK)
+			})
+
+			storage.POST("/datasets/change-key", func(c *gin.Context) {
+				var input struct {
+					Name string `json:"name" binding:"required"`
+					services.EncryptionOptions
+				}
+				if err := c.ShouldBindJSON(&input); err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+					return
+				}
+				if err := encryptionService.ChangeKey(input.Name, input.EncryptionOptions); err != nil {
+					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+					return
+				}
+				c.Status(http.StatusOK)
+			})
+
+			storage.PUT("/datasets/auto-unlock", func(c *gin.Context) {
+				var input struct {
+					Name       string `json:"name" binding:"required"`
+					Enabled    bool   `json:"enabled"`
+					Passphrase string `json:"passphrase"`
+				}
+				if err := c.ShouldBindJSON(&input); err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+					return
+				}
+				if err := encryptionService.SetAutoUnlock(input.Name, input.Enabled, input.Passphrase); err != nil {
+					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+					return
+				}
+				c.Status(http.StatusOK)
+			})
+
+			// Snapshot routes
+			storage.GET("/snapshots", func(c *gin.Context) {
+				snapshots, err := storageService.ListSnapshots(c.Query("dataset"))
+				if err != nil {
+					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+					return
+				}
+				c.JSON(http.StatusOK, gin.H{"snapshots": snapshots})
+			})
+
+			storage.POST("/snapshots", func(c *gin.Context) {
+				var input struct {
+					Dataset   string `json:"dataset" binding:"required"`
+					Name      string `json:"name" binding:"required"`
+					Recursive bool   `json:"recursive"`
+				}
+				if err := c.ShouldBindJSON(&input); err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+					return
+				}
+				if err := storageService.CreateSnapshot(input.Dataset, input.Name, input.Recursive); err != nil {
+					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+					return
+				}
+				c.Status(http.StatusCreated)
+			})
+
+			storage.DELETE("/snapshots", func(c *gin.Context) {
+				recursive := c.Query("recursive") == "true"
+				if err := storageService.DestroySnapshot(c.Query("name"), recursive); err != nil {
+					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+					return
+				}
+				c.Status(http.StatusNoContent)
+			})
+
+			storage.POST("/snapshots/rollback", func(c *gin.Context) {
+				var input struct {
+					Name         string `json:"name" binding:"required"`
+					DestroyNewer bool   `json:"destroyNewer"`
+				}
+				if err := c.ShouldBindJSON(&input); err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+					return
+				}
+				if err := storageService.RollbackSnapshot(input.Name, input.DestroyNewer); err != nil {
+					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+					return
+				}
+				c.Status(http.StatusOK)
+			})
+
+			storage.POST("/snapshots/clone", func(c *gin.Context) {
+				var input struct {
+					Name       string            `json:"name" binding:"required"`
+					Target     string            `json:"target" binding:"required"`
+					Properties map[string]string `json:"properties"`
+				}
+				if err := c.ShouldBindJSON(&input); err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+					return
+				}
+				if err := storageService.CloneSnapshot(input.Name, input.Target, input.Properties); err != nil {
+					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+					return
+				}
+				c.Status(http.StatusCreated)
+			})
+
+			storage.GET("/snapshots/diff", func(c *gin.Context) {
+				diff, err := storageService.DiffSnapshots(c.Query("from"), c.Query("to"))
+				if err != nil {
+					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+					return
+				}
+				c.JSON(http.StatusOK, diff)
+			})
+
+			// Snapshot policy routes
+			storage.GET("/snapshot-policies", func(c *gin.Context) {
+				c.JSON(http.StatusOK, gin.H{"policies": snapshotScheduler.ListPolicies()})
+			})
+
+			storage.POST("/snapshot-policies", func(c *gin.Context) {
+				var input services.SnapshotPolicy
+				if err := c.ShouldBindJSON(&input); err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+					return
+				}
+				policy, err := snapshotScheduler.CreatePolicy(input)
+				if err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+					return
+				}
+				c.JSON(http.StatusCreated, policy)
+			})
+
+			storage.GET("/snapshot-policies/:id", func(c *gin.Context) {
+				policy, err := snapshotScheduler.GetPolicy(c.Param("id"))
+				if errors.Is(err, services.ErrNotFound) {
+					c.JSON(http.StatusNotFound, gin.H{"error": "policy not found"})
+					return
+				}
+				c.JSON(http.StatusOK, policy)
+			})
+
+			storage.PUT("/snapshot-policies/:id", func(c *gin.Context) {
+				var input services.SnapshotPolicy
+				if err := c.ShouldBindJSON(&input); err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+					return
+				}
+				policy, err := snapshotScheduler.UpdatePolicy(c.Param("id"), input)
+				if errors.Is(err, services.ErrNotFound) {
+					c.JSON(http.StatusNotFound, gin.H{"error": "policy not found"})
+					return
+				}
+				if err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+					return
+				}
+				c.JSON(http.StatusOK, policy)
+			})
+
+			storage.DELETE("/snapshot-policies/:id", func(c *gin.Context) {
+				err := snapshotScheduler.DeletePolicy(c.Param("id"))
+				if errors.Is(err, services.ErrNotFound) {
+					c.JSON(http.StatusNotFound, gin.H{"error": "policy not found"})
+					return
+				}
+				if err != nil {
+					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+					return
+				}
+				c.Status(http.StatusNoContent)
+			})
+
+			storage.GET("/snapshot-policies/:id/runs", func(c *gin.Context) {
+				runs, err := snapshotScheduler.ListRuns(c.Param("id"))
+				if errors.Is(err, services.ErrNotFound) {
+					c.JSON(http.StatusNotFound, gin.H{"error": "policy not found"})
+					return
+				}
+				c.JSON(http.StatusOK, gin.H{"runs": runs})
+			})
+
+			storage.POST("/snapshot-policies/:id/run", func(c *gin.Context) {
+				run, err := snapshotScheduler.RunPolicy(c.Param("id"))
+				if errors.Is(err, services.ErrNotFound) {
+					c.JSON(http.StatusNotFound, gin.H{"error": "policy not found"})
+					return
+				}
+				if err != nil {
+					c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+					return
+				}
+				c.JSON(http.StatusOK, run)
+			})
+
+			// File management routes. Paths are resolved beneath the storage
+			// root; escapes and removing shares are refused.
+			fileError := func(c *gin.Context, err error) {
+				status := http.StatusInternalServerError
+				switch {
+				case errors.Is(err, services.ErrPathEscape), errors.Is(err, services.ErrShareRoot):
+					status = http.StatusForbidden
+				case errors.Is(err, services.ErrInvalidPath):
+					status = http.StatusBadRequest
+				case errors.Is(err, os.ErrNotExist):
+					status = http.StatusNotFound
+				}
+				c.JSON(status, gin.H{"error": err.Error()})
+			}
+
+			storage.GET("/storage/files/*path", func(c *gin.Context) {
+				path := strings.TrimPrefix(c.Param("path"), "/")
+				files, err := storageService.ListFiles(path)
+				if err != nil {
+					fileError(c, err)
+					return
+				}
+				c.JSON(http.StatusOK, files)
+			})
+
+			storage.POST("/storage/files/*path", func(c *gin.Context) {
+				path := strings.TrimPrefix(c.Param("path"), "/")
+				file, err := c.FormFile("file")
+				if err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": "No file uploaded"})
+					return
+				}
+				if err := storageService.UploadFile(path, file); err != nil {
+					fileError(c, err)
+					return
+				}
+				c.Status(http.StatusCreated)
+			})
+
+			// Downloads stream from disk with Range, If-Range and conditional
+			// GET support; ?inline=1 lets browsers play media in place.
+			download := func(c *gin.Context) {
+				path := strings.TrimPrefix(c.Param("path"), "/")
+				f, info, err := storageService.OpenFile(path)
+				if errors.Is(err, services.ErrNotRegularFile) {
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+					return
+				}
+				if err != nil {
+					fileError(c, err)
+					return
+				}
+				defer f.Close()
+				disposition := "attachment"
+				if c.Query("inline") == "1" {
+					disposition = "inline"
+				}
+				c.Header("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": info.Name()}))
+				c.Header("ETag", services.FileETag(info))
+				c.Header("Accept-Ranges", "bytes")
+				c.Header("X-Content-Type-Options", "nosniff")
+				c.Header("Content-Security-Policy", "sandbox")
+				if contentType := services.ContentType(info.Name()); contentType != "" {
+					c.Header("Content-Type", contentType)
+				}
+				http.ServeContent(c.Writer, c.Request, info.Name(), info.ModTime(), f)
+			}
+			storage.GET("/storage/download/*path", download)
+			storage.HEAD("/storage/download/*path", download)
+
+			// Deleting moves the item to the recycle bin of its share and
+			// returns it so the UI can offer to undo; ?permanent=1 removes
+			// it for good.
+			storage.DELETE("/storage/files/*path", func(c *gin.Context) {
+				path := strings.TrimPrefix(c.Param("path"), "/")
+				if c.Query("permanent") == "1" {
+					if err := storageService.DeleteItem(path); err != nil {
+						fileError(c, err)
+						return
+					}
+					c.Status(http.StatusNoContent)
+					return
+				}
+				item, err := recycleBin.Delete(path, c.GetString("username"))
+				if err != nil {
+					fileError(c, err)
+					return
+				}
+				c.JSON(http.StatusOK, item)
+			})
+
+			storage.GET("/recycle", func(c *gin.Context) {
+				c.JSON(http.StatusOK, gin.H{"items": recycleBin.List(c.Query("share"))})
+			})
+
+			// Restores to the original path; conflict is rename (the
+			// default) or overwrite.
+			storage.POST("/recycle/:id/restore", func(c *gin.Context) {
+				var input struct {
+					Conflict string `json:"conflict"`
+				}
+				if c.Request.ContentLength > 0 {
+					if err := c.ShouldBindJSON(&input); err != nil {
+						c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+						return
+					}
+				}
+				if input.Conflict != "" && !services.RestorePolicies[input.Conflict] {
+					c.JSON(http.StatusBadRequest, gin.H{"error": "invalid conflict policy"})
+					return
+				}
+				item, err := recycleBin.Restore(c.Param("id"), input.Conflict)
+				if errors.Is(err, services.ErrNotFound) {
+					c.JSON(http.StatusNotFound, gin.H{"error": "item not found"})
+					return
+				}
+				if err != nil {
+					fileError(c, err)
+					return
+				}
+				c.JSON(http.StatusOK, item)
+			})
+
+			storage.DELETE("/recycle/:id", func(c *gin.Context) {
+				err := recycleBin.Purge(c.Param("id"))
+				if errors.Is(err, services.ErrNotFound) {
+					c.JSON(http.StatusNotFound, gin.H{"error": "item not found"})
+					return
+				}
+				if err != nil {
+					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+					return
+				}
+				c.Status(http.StatusNoContent)
+			})
+
+			// Empties the bin of ?share=, or every bin.
+			storage.DELETE("/recycle", func(c *gin.Context) {
+				if err := recycleBin.Empty(c.Query("share")); err != nil {
+					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+					return
+				}
+				c.Status(http.StatusNoContent)
+			})
+
+			storage.GET("/recycle/settings", func(c *gin.Context) {
+				c.JSON(http.StatusOK, recycleBin.Settings())
+			})
+
+			storage.PUT("/recycle/settings", func(c *gin.Context) {
+				var input services.RecycleSettings
+				if err := c.ShouldBindJSON(&input); err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+					return
+				}
+				settings, err := recycleBin.SetSettings(input)
+				if err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+					return
+				}
+				c.JSON(http.StatusOK, settings)
+			})
+
+			// Resumable uploads (tus 1.0). Upload-Metadata carries the
+			// destination as "path" (a directory) and "filename".
+			tus := func(c *gin.Context) bool {
+				c.Header("Tus-Resumable", "1.0.0")
+				if c.GetHeader("Tus-Resumable") != "1.0.0" {
+					c.Header("Tus-Version", "1.0.0")
+					c.AbortWithStatus(http.StatusPreconditionFailed)
+					return false
+				}
+				return true
+			}
+			uploadError := func(c *gin.Context, err error) {
+				switch {
+				case errors.Is(err, services.ErrNotFound):
+					c.AbortWithStatus(http.StatusNotFound)
+				case errors.Is(err, services.ErrUploadOffset):
+					c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+				case errors.Is(err, services.ErrUploadBusy):
+					c.JSON(http.StatusLocked, gin.H{"error": err.Error()})
+				case errors.Is(err, services.ErrUploadTooLarge):
+					c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": err.Error()})
+				case errors.Is(err, services.ErrChecksumMismatch):
+					// 460 Checksum Mismatch, defined by the tus checksum extension.
+					c.JSON(460, gin.H{"error": err.Error()})
+				case errors.Is(err, services.ErrUnknownChecksum), errors.Is(err, services.ErrUploadOutsideShare):
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				default:
+					fileError(c, err)
+				}
+			}
+			uploadHeaders := func(c *gin.Context, upload *services.Upload) {
+				c.Header("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+				c.Header("Upload-Length", strconv.FormatInt(upload.Length, 10))
+				c.Header("Upload-Expires", upload.Expires().UTC().Format(http.TimeFormat))
+				c.Header("Cache-Control", "no-store")
+			}
+
+			storage.OPTIONS("/uploads", func(c *gin.Context) {
+				algorithms := []string{}
+				for name := range services.UploadChecksumAlgorithms {
+					algorithms = append(algorithms, name)
+				}
+				sort.Strings(algorithms)
+				c.Header("Tus-Resumable", "1.0.0")
+				c.Header("Tus-Version", "1.0.0")
+				c.Header("Tus-Extension", "creation,termination,checksum,expiration")
+				c.Header("Tus-Checksum-Algorithm", strings.Join(algorithms, ","))
+				c.Status(http.StatusNoContent)
+			})
+
+			storage.POST("/uploads", func(c *gin.Context) {
+				if !tus(c) {
+					return
+				}
+				length, err := strconv.ParseInt(c.GetHeader("Upload-Length"), 10, 64)
+				if err != nil || length < 0 {
+					c.JSON(http.StatusBadRequest, gin.H{"error": "Upload-Length is required"})
+					return
+				}
+				metadata, err := services.ParseUploadMetadata(c.GetHeader("Upload-Metadata"))
+				if err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+					return
+				}
+				upload, err := uploadService.Create(metadata["path"], metadata["filename"], length, metadata)
+				if err != nil {
+					uploadError(c, err)
+					return
+				}
+				uploadHeaders(c, upload)
+				c.Header("Location", strings.TrimSuffix(c.Request.URL.Path, "/")+"/"+upload.ID)
+				c.Status(http.StatusCreated)
+			})
+
+			storage.HEAD("/uploads/:id", func(c *gin.Context) {
+				if !tus(c) {
+					return
+				}
+				upload, err := uploadService.Get(c.Param("id"))
+				if err != nil {
+					uploadError(c, err)
+					return
+				}
+				uploadHeaders(c, upload)
+				c.Status(http.StatusOK)
+			})
+
+			storage.PATCH("/uploads/:id", func(c *gin.Context) {
+				if !tus(c) {
+					return
+				}
+				if c.ContentType() != "application/offset+octet-stream" {
+					c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "Content-Type must be application/offset+octet-stream"})
+					return
+				}
+				offset, err := strconv.ParseInt(c.GetHeader("Upload-Offset"), 10, 64)
+				if err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": "Upload-Offset is required"})
+					return
+				}
+				upload, err := uploadService.Write(c.Param("id"), offset, c.Request.Body, c.GetHeader("Upload-Checksum"))
+				if err != nil {
+					uploadError(c, err)
+					return
+				}
+				uploadHeaders(c, upload)
+				c.Status(http.StatusNoContent)
+			})
+
+			storage.DELETE("/uploads/:id", func(c *gin.Context) {
+				if !tus(c) {
+					return
+				}
+				if err := uploadService.Terminate(c.Param("id")); err != nil {
+					uploadError(c, err)
+					return
+				}
+				c.Status(http.StatusNoContent)
+			})
+
+			storage.POST("/storage/directories/*path", func(c *gin.Context) {
+				path := strings.TrimPrefix(c.Param("path"), "/")
+				if err := storageService.CreateDirectory(path); err != nil {
+					fileError(c, err)
+					return
+				}
+				c.Status(http.StatusCreated)
+			})
+
+			// Copy and move run as background jobs; conflict is skip (the
+			// default), overwrite or rename.
+			transfer := func(operation string) gin.HandlerFunc {
+				return func(c *gin.Context) {
+					var input struct {
+						Source      string `json:"source" binding:"required"`
+						Destination string `json:"destination" binding:"required"`
+						Conflict    string `json:"conflict"`
+					}
+					if err := c.ShouldBindJSON(&input); err != nil {
+						c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+						return
+					}
+					job, err := transferService.Start(operation, input.Source, input.Destination, input.Conflict)
+					if err != nil {
+						if errors.Is(err, services.ErrPathEscape) || errors.Is(err, services.ErrShareRoot) || errors.Is(err, os.ErrNotExist) {
+							fileError(c, err)
+						} else {
+							c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+						}
+						return
+					}
+					c.JSON(http.StatusAccepted, job)
+				}
+			}
+			storage.POST("/storage/move", transfer("move"))
+			storage.POST("/storage/copy", transfer("copy"))
+
+			storage.GET("/transfers", func(c *gin.Context) {
+				c.JSON(http.StatusOK, gin.H{"jobs": transferService.ListJobs()})
+			})
+
+			storage.GET("/transfers/:id", func(c *gin.Context) {
+				job, err := transferService.GetJob(c.Param("id"))
+				if err != nil {
+					c.JSON(http.StatusNotFound, gin.H{"error": "job not found"})
+					return
+				}
+				c.JSON(http.StatusOK, job)
+			})
+
+			storage.POST("/transfers/:id/cancel", func(c *gin.Context) {
+				if err := transferService.CancelJob(c.Param("id")); err != nil {
+					c.JSON(http.StatusNotFound, gin.H{"error": "no running job with this id"})
+					return
+				}
+				c.JSON(http.StatusOK, gin.H{"message": "Transfer canceled"})
+			})
+
+			// Spin down disks endpoint
+			storage.POST("/spin-down", func(c *gin.Context) {
+				err := storageService.SpinDownDisks()
+				if err != nil {
+					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+					return
+				}
+				c.JSON(http.StatusOK, gin.H{"message": "All unprotected disks spun down"})
+			})
+
+			// Spin up disks endpoint
+			storage.POST("/spin-up", func(c *gin.Context) {
+				err := storageService.SpinUpDisks()
+				if err != nil {
+					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+					return
+				}
+				c.JSON(http.StatusOK, gin.H{"message": "All disks spun up"})
+			})
+
+			// Disk power routes
+			storage.GET("/devices/power", func(c *gin.Context) {
+				statuses, err := powerMonitor.Status()
+				if err != nil {
+					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+					return
+				}
+				c.JSON(http.StatusOK, gin.H{"devices": statuses})
+			})
+
+			storage.POST("/devices/power/standby", func(c *gin.Context) {
+				var input struct {
+					Device string `json:"device" binding:"required"`
+				}
+				if err := c.ShouldBindJSON(&input); err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+					return
+				}
+				if err := storageService.StandbyDisk(input.Device); err != nil {
+					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+					return
+				}
+				c.Status(http.StatusOK)
 			})
 
-			storage.POST("/pools", func(c *gin.Context) {
-				var data struct {
-					Name     string   `json:"name" binding:"required"`
-					RaidType string   `json:"raidType" binding:"required"`
-					Devices  []string `json:"devices" binding:"required"`
-				}
+			storage.GET("/power-policies", func(c *gin.Context) {
+				c.JSON(http.StatusOK, gin.H{"policies": powerMonitor.ListPolicies()})
+			})
 
-				if err := c.ShouldBindJSON(&data); err != nil {
+			storage.PUT("/power-policies/:serial", func(c *gin.Context) {
+				var input services.DiskPowerPolicy
+				if err := c.ShouldBindJSON(&input); err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+					return
+				}
+				input.Serial = c.Param("serial")
+				policy, err := powerMonitor.SetPolicy(input)
+				if err != nil {
 					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 					return
 				}
+				c.JSON(http.StatusOK, policy)
+			})
 
-				err := storageService.CreatePool(data.Name, data.Devices, data.RaidType)
+			storage.DELETE("/power-policies/:serial", func(c *gin.Context) {
+				err := powerMonitor.DeletePolicy(c.Param("serial"))
+				if errors.Is(err, services.ErrNotFound) {
+					c.JSON(http.StatusNotFound, gin.H{"error": "policy not found"})
+					return
+				}
 				if err != nil {
 					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 					return
 				}
-
-				c.JSON(http.StatusOK, gin.H{"message": "Pool created"})
+				c.Status(http.StatusNoContent)
 			})
 
-			storage.GET("/pools/:id/status", func(c *gin.Context) {
-				status, err := storageService.GetPoolStatus(c.Param("id"))
+			// Device info endpoint
+			storage.GET("/devices/info", func(c *gin.Context) {
+				infos, err := storageService.GetDeviceInfo()
 				if err != nil {
 					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 					return
 				}
-				c.JSON(http.StatusOK, status)
+				c.JSON(http.StatusOK, infos)
 			})
 
-			storage.GET("/storage/pools", func(c *gin.Context) {
-				pools, err := storageService.ListPools()
+			// SMART routes. Device paths contain slashes, so they are passed
+			// as a query parameter or in the body.
+			storage.GET("/devices/smart", func(c *gin.Context) {
+				data, err := storageService.GetSmartData(c.Query("device"))
 				if err != nil {
 					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 					return
 				}
-				c.JSON(http.StatusOK, pools)
+				c.JSON(http.StatusOK, data)
 			})
 
-			storage.POST("/storage/pools", func(c *gin.Context) {
+			storage.POST("/devices/smart/test", func(c *gin.Context) {
 				var input struct {
-					Name    string   `json:"name" binding:"required"`
-					Devices []string `json:"devices" binding:"required"`
-					RaidType string  `json:"raidType" binding:"required"`
+					Device string `json:"device" binding:"required"`
+					Type   string `json:"type" binding:"required"`
 				}
 				if err := c.ShouldBindJSON(&input); err != nil {
 					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 					return
 				}
-				if err := storageService.CreatePool(input.Name, input.Devices, input.RaidType); err != nil {
+				if err := storageService.StartSelfTest(input.Device, input.Type); err != nil {
 					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 					return
 				}
-				c.Status(http.StatusCreated)
+				c.Status(http.StatusAccepted)
 			})
 
-			storage.GET("/storage/pools/:name/status", func(c *gin.Context) {
-				status, err := storageService.GetPoolStatus(c.Param("name"))
-				if err != nil {
+			storage.POST("/devices/smart/abort", func(c *gin.Context) {
+				var input struct {
+					Device string `json:"device" binding:"required"`
+				}
+				if err := c.ShouldBindJSON(&input); err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+					return
+				}
+				if err := storageService.AbortSelfTest(input.Device); err != nil {
 					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 					return
 				}
-				c.JSON(http.StatusOK, status)
+				c.Status(http.StatusOK)
 			})
 
-			storage.DELETE("/storage/pools/:name", func(c *gin.Context) {
-				if err := storageService.DestroyPool(c.Param("name")); err != nil {
-					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			storage.GET("/smart-schedules", func(c *gin.Context) {
+				c.JSON(http.StatusOK, gin.H{"schedules": smartTestScheduler.ListSchedules()})
+			})
+
+			storage.POST("/smart-schedules", func(c *gin.Context) {
+				var input services.SmartTestSchedule
+				if err := c.ShouldBindJSON(&input); err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 					return
 				}
-				c.Status(http.StatusNoContent)
+				schedule, err := smartTestScheduler.CreateSchedule(input)
+				if err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+					return
+				}
+				c.JSON(http.StatusCreated, schedule)
 			})
 
-			storage.GET("/storage/devices", func(c *gin.Context) {
-				devices, err := storageService.GetAvailableDevices()
+			storage.PUT("/smart-schedules/:id", func(c *gin.Context) {
+				var input services.SmartTestSchedule
+				if err := c.ShouldBindJSON(&input); err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+					return
+				}
+				schedule, err := smartTestScheduler.UpdateSchedule(c.Param("id"), input)
+				if errors.Is(err, services.ErrNotFound) {
+					c.JSON(http.StatusNotFound, gin.H{"error": "schedule not found"})
+					return
+				}
 				if err != nil {
-					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 					return
 				}
-				c.JSON(http.StatusOK, devices)
+				c.JSON(http.StatusOK, schedule)
 			})
 
-			// File management routes
-			storage.GET("/storage/files/*path", func(c *gin.Context) {
-				path := strings.TrimPrefix(c.Param("path"), "/")
-				files, err := storageService.ListFiles(path)
+			storage.DELETE("/smart-schedules/:id", func(c *gin.Context) {
+				err := smartTestScheduler.DeleteSchedule(c.Param("id"))
+				if errors.Is(err, services.ErrNotFound) {
+					c.JSON(http.StatusNotFound, gin.H{"error": "schedule not found"})
+					return
+				}
 				if err != nil {
 					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 					return
 				}
-				c.JSON(http.StatusOK, files)
+				c.Status(http.StatusNoContent)
 			})
 
-			storage.POST("/storage/files/*path", func(c *gin.Context) {
-				path := strings.TrimPrefix(c.Param("path"), "/")
-				file, err := c.FormFile("file")
+			// Disk history routes. The range is either range=7d (ending now)
+			// or from/to in RFC 3339; step=1h downsamples.
+			storage.GET("/devices/:serial/history", func(c *gin.Context) {
+				to := time.Now()
+				if v := c.Query("to"); v != "" {
+					t, err := time.Parse(time.RFC3339, v)
+					if err != nil {
+						c.JSON(http.StatusBadRequest, gin.H{"error": "invalid to: " + err.Error()})
+						return
+					}
+					to = t
+				}
+				span, err := services.ParseHistoryDuration(c.DefaultQuery("range", "24h"))
 				if err != nil {
-					c.JSON(http.StatusBadRequest, gin.H{"error": "No file uploaded"})
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 					return
 				}
-				if err := storageService.UploadFile(path, file); err != nil {
-					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				from := to.Add(-span)
+				if v := c.Query("from"); v != "" {
+					t, err := time.Parse(time.RFC3339, v)
+					if err != nil {
+						c.JSON(http.StatusBadRequest, gin.H{"error": "invalid from: " + err.Error()})
+						return
+					}
+					from = t
+				}
+				var step time.Duration
+				if v := c.Query("step"); v != "" {
+					if step, err = services.ParseHistoryDuration(v); err != nil {
+						c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+						return
+					}
+				}
+				history, err := diskHistory.Query(c.Param("serial"), from, to, step)
+				if errors.Is(err, services.ErrNotFound) {
+					c.JSON(http.StatusNotFound, gin.H{"error": "no history for this device"})
 					return
 				}
-				c.Status(http.StatusCreated)
+				if err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+					return
+				}
+				c.JSON(http.StatusOK, history)
 			})
 
-			storage.GET("/storage/files/*path/download", func(c *gin.Context) {
-				path := strings.TrimPrefix(c.Param("path"), "/")
-				data, err := storageService.DownloadFile(path)
+			storage.GET("/device-history/settings", func(c *gin.Context) {
+				c.JSON(http.StatusOK, diskHistory.Settings())
+			})
+
+			storage.PUT("/device-history/settings", func(c *gin.Context) {
+				var input services.DiskHistorySettings
+				if err := c.ShouldBindJSON(&input); err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+					return
+				}
+				settings, err := diskHistory.SetSettings(input)
 				if err != nil {
-					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 					return
 				}
-				c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%s", filepath.Base(path)))
-				c.Data(http.StatusOK, "application/octet-stream", data)
+				c.JSON(http.StatusOK, settings)
 			})
 
-			storage.DELETE("/storage/files/*path", func(c *gin.Context) {
-				path := strings.TrimPrefix(c.Param("path"), "/")
-				if err := storageService.DeleteItem(path); err != nil {
-					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			// Burn-in routes
+			storage.GET("/burn-in", func(c *gin.Context) {
+				c.JSON(http.StatusOK, gin.H{"jobs": burnInService.ListJobs()})
+			})
+
+			storage.POST("/burn-in", func(c *gin.Context) {
+				var input struct {
+					Disk string `json:"disk" binding:"required"`
+				}
+				if err := c.ShouldBindJSON(&input); err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 					return
 				}
-				c.Status(http.StatusNoContent)
+				job, err := burnInService.Start(input.Disk)
+				if err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+					return
+				}
+				c.JSON(http.StatusAccepted, job)
 			})
 
-			storage.POST("/storage/directories/*path", func(c *gin.Context) {
-				path := strings.TrimPrefix(c.Param("path"), "/")
-				if err := storageService.CreateDirectory(path); err != nil {
-					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			storage.GET("/burn-in/:id", func(c *gin.Context) {
+				job, err := burnInService.GetJob(c.Param("id"))
+				if err != nil {
+					c.JSON(http.StatusNotFound, gin.H{"error": "job not found"})
 					return
 				}
-				c.Status(http.StatusCreated)
+				c.JSON(http.StatusOK, job)
+			})
+
+			storage.POST("/burn-in/:id/cancel", func(c *gin.Context) {
+				if err := burnInService.CancelJob(c.Param("id")); err != nil {
+					c.JSON(http.StatusNotFound, gin.H{"error": "no running job with this id"})
+					return
+				}
+				c.JSON(http.StatusOK, gin.H{"message": "Burn-in canceled"})
+			})
+
+			storage.DELETE("/burn-in/:id", func(c *gin.Context) {
+				err := burnInService.DeleteJob(c.Param("id"))
+				if errors.Is(err, services.ErrNotFound) {
+					c.JSON(http.StatusNotFound, gin.H{"error": "job not found"})
+					return
+				}
+				if err != nil {
+					c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+					return
+				}
+				c.Status(http.StatusNoContent)
+			})
+
+			// Disk wipe routes. A wipe needs a confirmation token from
+			// /wipe/token that names the disk and mode.
+			storage.GET("/wipe", func(c *gin.Context) {
+				c.JSON(http.StatusOK, gin.H{"jobs": wipeService.ListJobs()})
 			})
 
-			storage.POST("/storage/move", func(c *gin.Context) {
+			storage.POST("/wipe/token", func(c *gin.Context) {
 				var input struct {
-					Source      string `json:"source" binding:"required"`
-					Destination string `json:"destination" binding:"required"`
+					Disk string `json:"disk" binding:"required"`
+					Mode string `json:"mode" binding:"required"`
 				}
 				if err := c.ShouldBindJSON(&input); err != nil {
 					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 					return
 				}
-				if err := storageService.MoveItem(input.Source, input.Destination); err != nil {
-					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				token, err := wipeService.RequestToken(input.Disk, input.Mode)
+				if err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 					return
 				}
-				c.Status(http.StatusOK)
+				c.JSON(http.StatusOK, token)
 			})
 
-			storage.POST("/storage/copy", func(c *gin.Context) {
+			storage.POST("/wipe", func(c *gin.Context) {
 				var input struct {
-					Source      string `json:"source" binding:"required"`
-					Destination string `json:"destination" binding:"required"`
+					Disk  string `json:"disk" binding:"required"`
+					Mode  string `json:"mode" binding:"required"`
+					Token string `json:"token" binding:"required"`
 				}
 				if err := c.ShouldBindJSON(&input); err != nil {
 					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 					return
 				}
-				if err := storageService.CopyItem(input.Source, input.Destination); err != nil {
-					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				job, err := wipeService.Start(input.Disk, input.Mode, input.Token)
+				if err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 					return
 				}
-				c.Status(http.StatusOK)
+				c.JSON(http.StatusAccepted, job)
 			})
 
-			// Spin down disks endpoint
-			storage.POST("/spin-down", func(c *gin.Context) {
-				err := storageService.SpinDownDisks()
+			storage.GET("/wipe/:id", func(c *gin.Context) {
+				job, err := wipeService.GetJob(c.Param("id"))
 				if err != nil {
-					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+					c.JSON(http.StatusNotFound, gin.H{"error": "job not found"})
 					return
 				}
-				c.JSON(http.StatusOK, gin.H{"message": "All disks spun down"})
+				c.JSON(http.StatusOK, job)
 			})
 
-			// Spin up disks endpoint
-			storage.POST("/spin-up", func(c *gin.Context) {
-				err := storageService.SpinUpDisks()
+			storage.POST("/wipe/:id/cancel", func(c *gin.Context) {
+				err := wipeService.CancelJob(c.Param("id"))
+				if errors.Is(err, services.ErrNotFound) {
+					c.JSON(http.StatusNotFound, gin.H{"error": "no running job with this id"})
+					return
+				}
 				if err != nil {
-					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+					c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
 					return
 				}
-				c.JSON(http.StatusOK, gin.H{"message": "All disks spun up"})
+				c.JSON(http.StatusOK, gin.H{"message": "Wipe canceled"})
 			})
 
-			// Device info endpoint
-			storage.GET("/devices/info", func(c *gin.Context) {
-				infos, err := storageService.GetDeviceInfo()
+			// Enclosure routes
+			storage.GET("/enclosures", func(c *gin.Context) {
+				enclosures, err := ledService.Enclosures()
 				if err != nil {
 					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 					return
 				}
-				c.JSON(http.StatusOK, infos)
+				c.JSON(http.StatusOK, gin.H{"enclosures": enclosures})
+			})
+
+			storage.POST("/enclosures/led", func(c *gin.Context) {
+				var req struct {
+					services.LEDTarget
+					LED string `json:"led" binding:"required"` // ident or fault
+					On  bool   `json:"on"`
+					// Duration in seconds after which a lit LED is switched
+					// off again; 0 keeps it on.
+					Duration int `json:"duration"`
+				}
+				if err := c.ShouldBindJSON(&req); err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+					return
+				}
+				err := ledService.SetLED(req.LEDTarget, req.LED, req.On, time.Duration(req.Duration)*time.Second)
+				if errors.Is(err, services.ErrNotFound) {
+					c.JSON(http.StatusNotFound, gin.H{"error": "slot not found"})
+					return
+				}
+				if err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+					return
+				}
+				c.JSON(http.StatusOK, gin.H{"message": "LED updated"})
 			})
 
 			// Blink drive LED endpoint
@@ -288,7 +1733,7 @@ func main() {
 					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 					return
 				}
-				err := storageService.BlinkDrive(req.Device)
+				err := ledService.SetLED(services.LEDTarget{Disk: req.Device}, "ident", true, services.DefaultIdentDuration)
 				if err != nil {
 					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 					return
@@ -297,6 +1742,136 @@ func main() {
 			})
 		}
 
+		// Replication routes
+		replication := api.Group("/replication")
+		{
+			replication.GET("/tasks", func(c *gin.Context) {
+				c.JSON(http.StatusOK, gin.H{"tasks": replicationService.ListTasks()})
+			})
+
+			replication.POST("/tasks", func(c *gin.Context) {
+				var input services.ReplicationTask
+				if err := c.ShouldBindJSON(&input); err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+					return
+				}
+				task, err := replicationService.CreateTask(input)
+				if err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+					return
+				}
+				c.JSON(http.StatusCreated, task)
+			})
+
+			replication.GET("/tasks/:id", func(c *gin.Context) {
+				task, err := replicationService.GetTask(c.Param("id"))
+				if err != nil {
+					c.JSON(http.StatusNotFound, gin.H{"error": "task not found"})
+					return
+				}
+				c.JSON(http.StatusOK, task)
+			})
+
+			replication.PUT("/tasks/:id", func(c *gin.Context) {
+				var input services.ReplicationTask
+				if err := c.ShouldBindJSON(&input); err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+					return
+				}
+				task, err := replicationService.UpdateTask(c.Param("id"), input)
+				if errors.Is(err, services.ErrNotFound) {
+					c.JSON(http.StatusNotFound, gin.H{"error": "task not found"})
+					return
+				}
+				if err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+					return
+				}
+				c.JSON(http.StatusOK, task)
+			})
+
+			replication.DELETE("/tasks/:id", func(c *gin.Context) {
+				err := replicationService.DeleteTask(c.Param("id"))
+				if errors.Is(err, services.ErrNotFound) {
+					c.JSON(http.StatusNotFound, gin.H{"error": "task not found"})
+					return
+				}
+				if err != nil {
+					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+					return
+				}
+				c.Status(http.StatusNoContent)
+			})
+
+			replication.POST("/tasks/:id/run", func(c *gin.Context) {
+				job, err := replicationService.RunTask(c.Param("id"))
+				if errors.Is(err, services.ErrNotFound) {
+					c.JSON(http.StatusNotFound, gin.H{"error": "task not found"})
+					return
+				}
+				if err != nil {
+					c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+					return
+				}
+				c.JSON(http.StatusAccepted, job)
+			})
+
+			replication.GET("/jobs", func(c *gin.Context) {
+				c.JSON(http.StatusOK, gin.H{"jobs": replicationService.ListJobs(c.Query("task"))})
+			})
+
+			replication.GET("/jobs/:id", func(c *gin.Context) {
+				job, err := replicationService.GetJob(c.Param("id"))
+				if err != nil {
+					c.JSON(http.StatusNotFound, gin.H{"error": "job not found"})
+					return
+				}
+				c.JSON(http.StatusOK, job)
+			})
+
+			replication.POST("/jobs/:id/cancel", func(c *gin.Context) {
+				if err := replicationService.CancelJob(c.Param("id")); err != nil {
+					c.JSON(http.StatusNotFound, gin.H{"error": "no running job with this id"})
+					return
+				}
+				c.JSON(http.StatusOK, gin.H{"message": "Job canceled"})
+			})
+
+			replication.GET("/keys", func(c *gin.Context) {
+				c.JSON(http.StatusOK, gin.H{"keys": replicationService.ListPeerKeys()})
+			})
+
+			replication.POST("/keys", func(c *gin.Context) {
+				var input struct {
+					Name    string `json:"name" binding:"required"`
+					Dataset string `json:"dataset" binding:"required"`
+				}
+				if err := c.ShouldBindJSON(&input); err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+					return
+				}
+				key, secret, err := replicationService.CreatePeerKey(input.Name, input.Dataset)
+				if err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+					return
+				}
+				c.JSON(http.StatusCreated, gin.H{"key": key, "secret": secret})
+			})
+
+			replication.DELETE("/keys/:id", func(c *gin.Context) {
+				err := replicationService.DeletePeerKey(c.Param("id"))
+				if errors.Is(err, services.ErrNotFound) {
+					c.JSON(http.StatusNotFound, gin.H{"error": "key not found"})
+					return
+				}
+				if err != nil {
+					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+					return
+				}
+				c.Status(http.StatusNoContent)
+			})
+		}
+
 		// Docker routes
 		docker := api.Group("/docker")
 		{
@@ -359,14 +1934,42 @@ func main() {
 					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 					return
 				}
+				// disk covers the root filesystem only; pools are reported
+				// from zpool list.
+				if pools, err := capacityMonitor.Pools(); err == nil {
+					usage["pools"] = pools
+				}
 				c.JSON(http.StatusOK, usage)
 			})
 		}
 	}
 
-	// Start server
+	// Start server. On SIGTERM or SIGINT it stops accepting connections and
+	// main returns, so the deferred Stop calls above run, e.g. switching off
+	// timed LEDs.
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	server := &http.Server{
+		Addr:    ":8080",
+		Handler: router,
+		// Requests see the signal too, so /events streams end rather than
+		// hold up the shutdown.
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- server.ListenAndServe()
+	}()
 	log.Println("Starting A1Nas server on :8080")
-	if err := router.Run(":8080"); err != nil {
+	select {
+	case err := <-serveErr:
 		log.Fatal(err)
+	case <-ctx.Done():
+	}
+	log.Println("Shutting down A1Nas server")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Error shutting down server: %v", err)
 	}
 } 
\ No newline at end of file
@@ -0,0 +1,33 @@
+package middleware
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/your-org/a1nas/services"
+)
+
+// PeerAuthMiddleware authenticates another A1Nas using a replication peer
+// key instead of a user token. The dataset the key is scoped to is stored
+// in the context as "peerDataset".
+func PeerAuthMiddleware(replicationService *services.ReplicationService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		parts := strings.Split(c.GetHeader("Authorization"), " ")
+		if len(parts) != 2 || parts[0] != "Bearer" {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid authorization header format"})
+			c.Abort()
+			return
+		}
+
+		dataset, err := replicationService.ValidatePeerKey(parts[1])
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid peer key"})
+			c.Abort()
+			return
+		}
+
+		c.Set("peerDataset", dataset)
+		c.Next()
+	}
+}
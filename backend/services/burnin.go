@@ -0,0 +1,454 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BurnInJob qualifies a new drive before it joins a vdev: a SMART long
+// self-test, a destructive four-pattern badblocks write/verify pass over
+// the whole disk, and a comparison of the SMART error counters before and
+// after.
+type BurnInJob struct {
+	ID            string       `json:"id"`
+	Disk          string       `json:"disk"`
+	Serial        string       `json:"serial"`
+	Model         string       `json:"model,omitempty"`
+	Size          uint64       `json:"size"`
+	State         string       `json:"state"`    // running, completed, failed, canceled
+	Phase         string       `json:"phase"`    // smart-long, badblocks, smart-compare, done
+	Progress      float64      `json:"progress"` // percent of the current phase
+	Pass          int          `json:"pass,omitempty"`
+	Passes        int          `json:"passes,omitempty"`
+	Throughput    float64      `json:"throughput,omitempty"` // bytes per second of the current pass
+	ReadErrors    int          `json:"readErrors"`
+	WriteErrors   int          `json:"writeErrors"`
+	CompareErrors int          `json:"compareErrors"`
+	BadBlocks     int          `json:"badBlocks"`
+	SmartBefore   *BurnInSmart `json:"smartBefore,omitempty"`
+	SmartAfter    *BurnInSmart `json:"smartAfter,omitempty"`
+	Verdict       string       `json:"verdict,omitempty"` // pass or fail
+	Reasons       []string     `json:"reasons,omitempty"`
+	Started       time.Time    `json:"started"`
+	Finished      *time.Time   `json:"finished,omitempty"`
+	Error         string       `json:"error,omitempty"`
+}
+
+// BurnInSmart holds the SMART counters that must not grow during a
+// burn-in.
+type BurnInSmart struct {
+	Health   string            `json:"health"`
+	Counters map[string]uint64 `json:"counters"`
+}
+
+const maxBurnInJobs = 100
+
+// badblocksPatterns is the number of patterns badblocks -w writes; each
+// is written and then read back.
+const badblocksPatterns = 4
+
+var burnInPollInterval = time.Minute
+
+var (
+	badblocksPassRe     = regexp.MustCompile(`Testing with pattern|Reading and comparing`)
+	badblocksProgressRe = regexp.MustCompile(`([\d.]+)% done, [\d:]+ elapsed\. \((\d+)/(\d+)/(\d+) errors\)`)
+)
+
+type BurnInService struct {
+	storage *StorageService
+	path    string
+
+	mu      sync.Mutex
+	jobs    []*BurnInJob
+	cancels map[string]context.CancelFunc
+}
+
+func NewBurnInService(storage *StorageService) *BurnInService {
+	s := &BurnInService{
+		storage: storage,
+		path:    filepath.Join(DataDir(), "burnin.json"),
+		jobs:    []*BurnInJob{},
+		cancels: map[string]context.CancelFunc{},
+	}
+	var state struct {
+		Jobs []*BurnInJob `json:"jobs"`
+	}
+	if err := loadJSON(s.path, &state); err != nil {
+		log.Printf("Error loading burn-in jobs: %v", err)
+	}
+	for _, job := range state.Jobs {
+		// badblocks cannot resume; the disk has to be tested again.
+		if job.State == "running" {
+			now := time.Now()
+			job.State, job.Error, job.Finished = "failed", "interrupted by daemon restart", &now
+		}
+		s.jobs = append(s.jobs, job)
+	}
+	return s
+}
+
+// trimJobs drops the oldest finished jobs beyond maxBurnInJobs. Running jobs
+// are kept however many there are. It must be called with s.mu held.
+func (s *BurnInService) trimJobs() {
+	excess := len(s.jobs) - maxBurnInJobs
+	if excess <= 0 {
+		return
+	}
+	kept := make([]*BurnInJob, 0, len(s.jobs))
+	for _, job := range s.jobs {
+		if excess > 0 && job.State != "running" {
+			excess--
+			continue
+		}
+		kept = append(kept, job)
+	}
+	s.jobs = kept
+}
+
+// save must be called with s.mu held.
+func (s *BurnInService) save() error {
+	return saveJSON(s.path, map[string]interface{}{"jobs": s.jobs})
+}
+
+// ListJobs returns burn-in jobs, newest first.
+func (s *BurnInService) ListJobs() []BurnInJob {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	jobs := []BurnInJob{}
+	for i := len(s.jobs) - 1; i >= 0; i-- {
+		jobs = append(jobs, *s.jobs[i])
+	}
+	return jobs
+}
+
+func (s *BurnInService) GetJob(id string) (*BurnInJob, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, job := range s.jobs {
+		if job.ID == id {
+			out := *job
+			return &out, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (s *BurnInService) CancelJob(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cancel, ok := s.cancels[id]
+	if !ok {
+		return ErrNotFound
+	}
+	cancel()
+	return nil
+}
+
+// Start begins a burn-in of disk (serial, WWN or device name). Everything
+// on the disk is destroyed, so disks in a pool, in use by the system or
+// carrying any signature are refused.
+func (s *BurnInService) Start(disk string) (*BurnInJob, error) {
+	d, err := s.storage.unusedDisk(disk)
+	if err != nil {
+		return nil, err
+	}
+	signatures, err := s.storage.diskSignatures(d)
+	if err != nil {
+		return nil, err
+	}
+	if len(signatures) > 0 {
+		return nil, fmt.Errorf("disk %s carries signatures (%s); wipe it first", d.ID, strings.Join(signatures, ", "))
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	release, err := s.storage.claimDisk(d, "a burn-in")
+	if err != nil {
+		return nil, err
+	}
+	job := &BurnInJob{
+		ID:      newID(),
+		Disk:    d.Path,
+		Serial:  d.Serial,
+		Model:   d.Model,
+		Size:    d.Size,
+		State:   "running",
+		Phase:   "smart-long",
+		Started: time.Now(),
+	}
+	s.jobs = append(s.jobs, job)
+	s.trimJobs()
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancels[job.ID] = cancel
+	if err := s.save(); err != nil {
+		log.Printf("Error saving burn-in jobs: %v", err)
+	}
+
+	go func() {
+		reasons, err := s.burnIn(ctx, job)
+		release()
+		canceled := ctx.Err() != nil
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		cancel()
+		delete(s.cancels, job.ID)
+		now := time.Now()
+		job.Finished = &now
+		job.Reasons = reasons
+		switch {
+		case err == nil:
+			job.State, job.Phase = "completed", "done"
+			job.Verdict = "pass"
+			if len(reasons) > 0 {
+				job.Verdict = "fail"
+			}
+		case canceled:
+			job.State, job.Error = "canceled", "canceled"
+		default:
+			job.State, job.Error = "failed", err.Error()
+			log.Printf("Burn-in of %s failed: %v", job.Disk, err)
+		}
+		if err := s.save(); err != nil {
+			log.Printf("Error saving burn-in jobs: %v", err)
+		}
+	}()
+
+	out := *job
+	return &out, nil
+}
+
+func (s *BurnInService) setJob(job *BurnInJob, update func(*BurnInJob)) {
+	s.mu.Lock()
+	update(job)
+	s.mu.Unlock()
+}
+
+// burnIn runs the phases in turn and returns the reasons the disk failed
+// qualification. A disk that fails the self-test is not tested further.
+func (s *BurnInService) burnIn(ctx context.Context, job *BurnInJob) ([]string, error) {
+	before, err := s.storage.GetSmartData(job.Disk)
+	if err != nil {
+		return nil, err
+	}
+	s.setJob(job, func(j *BurnInJob) { j.SmartBefore = burnInSmart(before) })
+
+	reason, err := s.longSelfTest(ctx, job)
+	if err != nil {
+		return nil, err
+	}
+	if reason != "" {
+		return []string{reason}, nil
+	}
+
+	s.setJob(job, func(j *BurnInJob) {
+		j.Phase, j.Progress, j.Passes = "badblocks", 0, 2*badblocksPatterns
+	})
+	badBlocks, err := s.badblocks(ctx, job)
+	if err != nil {
+		return nil, err
+	}
+
+	s.setJob(job, func(j *BurnInJob) { j.Phase, j.Progress, j.Throughput = "smart-compare", 0, 0 })
+	after, err := s.storage.GetSmartData(job.Disk)
+	if err != nil {
+		return nil, err
+	}
+	s.setJob(job, func(j *BurnInJob) { j.SmartAfter, j.Progress = burnInSmart(after), 100 })
+
+	var reasons []string
+	if badBlocks > 0 {
+		reasons = append(reasons, fmt.Sprintf("badblocks found %d bad blocks", badBlocks))
+	}
+	reasons = append(reasons, compareBurnInSmart(burnInSmart(before), burnInSmart(after))...)
+	return reasons, nil
+}
+
+// longSelfTest runs a SMART long self-test and waits for it to finish. A
+// non-empty reason means the drive failed it.
+func (s *BurnInService) longSelfTest(ctx context.Context, job *BurnInJob) (string, error) {
+	if err := s.storage.StartSelfTest(job.Disk, "long"); err != nil {
+		return "", err
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			if err := s.storage.AbortSelfTest(job.Disk); err != nil {
+				log.Printf("Error aborting self-test of %s: %v", job.Disk, err)
+			}
+			return "", ctx.Err()
+		case <-time.After(burnInPollInterval):
+		}
+		data, err := s.storage.GetSmartData(job.Disk)
+		if err != nil {
+			return "", err
+		}
+		if data.SelfTest != nil {
+			s.setJob(job, func(j *BurnInJob) { j.Progress = float64(100 - data.SelfTest.RemainingPercent) })
+			continue
+		}
+		s.setJob(job, func(j *BurnInJob) { j.Progress = 100 })
+		if len(data.SelfTests) > 0 && !data.SelfTests[0].Passed {
+			return "SMART long self-test failed: " + data.SelfTests[0].Status, nil
+		}
+		return "", nil
+	}
+}
+
+// badblocksBlockSize picks the smallest block size that keeps the block
+// count within badblocks' 32-bit limit.
+func badblocksBlockSize(size uint64) uint64 {
+	bs := uint64(4096)
+	for size/bs >= 1<<32 {
+		bs *= 2
+	}
+	return bs
+}
+
+// badblocks runs the destructive write/verify pass and returns the number
+// of bad blocks found. Progress is read from badblocks' stderr.
+func (s *BurnInService) badblocks(ctx context.Context, job *BurnInJob) (int, error) {
+	monitor := &badblocksMonitor{}
+	passStart := time.Now()
+	monitor.onPass = func() {
+		passStart = time.Now()
+		s.setJob(job, func(j *BurnInJob) { j.Pass++ })
+	}
+	monitor.onProgress = func(percent float64, errs [3]int) {
+		elapsed := time.Since(passStart).Seconds()
+		s.setJob(job, func(j *BurnInJob) {
+			pass := j.Pass
+			if pass < 1 {
+				pass = 1
+			}
+			j.Progress = (float64(pass-1) + percent/100) / float64(j.Passes) * 100
+			if elapsed > 0 {
+				j.Throughput = float64(j.Size) * percent / 100 / elapsed
+			}
+			j.ReadErrors, j.WriteErrors, j.CompareErrors = errs[0], errs[1], errs[2]
+		})
+	}
+
+	var stdout bytes.Buffer
+	bs := strconv.FormatUint(badblocksBlockSize(job.Size), 10)
+	err := s.storage.runner.Stream(withStderr(ctx, monitor), nil, &stdout, "badblocks", "-b", bs, "-w", "-s", "-v", job.Disk)
+	if err != nil {
+		return 0, fmt.Errorf("badblocks failed: %v", err)
+	}
+	// Bad blocks are listed on stdout, one block number per line.
+	count := 0
+	for _, line := range strings.Split(stdout.String(), "\n") {
+		if _, err := strconv.ParseUint(strings.TrimSpace(line), 10, 64); err == nil {
+			count++
+		}
+	}
+	s.setJob(job, func(j *BurnInJob) { j.BadBlocks, j.Progress = count, 100 })
+	return count, nil
+}
+
+// badblocksMonitor parses the progress badblocks -s writes to stderr. Each
+// update is overwritten in place with backspaces.
+type badblocksMonitor struct {
+	buf        []byte
+	onPass     func()
+	onProgress func(percent float64, errs [3]int)
+}
+
+func (m *badblocksMonitor) Write(p []byte) (int, error) {
+	m.buf = append(m.buf, p...)
+	for {
+		i := bytes.IndexAny(m.buf, "\b\r\n")
+		if i < 0 {
+			break
+		}
+		m.segment(string(m.buf[:i]))
+		m.buf = m.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+func (m *badblocksMonitor) segment(text string) {
+	if badblocksPassRe.MatchString(text) {
+		m.onPass()
+	}
+	match := badblocksProgressRe.FindStringSubmatch(text)
+	if match == nil {
+		return
+	}
+	percent, _ := strconv.ParseFloat(match[1], 64)
+	var errs [3]int
+	for i := range errs {
+		errs[i], _ = strconv.Atoi(match[i+2])
+	}
+	m.onProgress(percent, errs)
+}
+
+// burnInSmart extracts the counters of a drive's protocol that indicate
+// media problems.
+func burnInSmart(d *SmartData) *BurnInSmart {
+	out := &BurnInSmart{Health: d.Health, Counters: map[string]uint64{}}
+	for _, attr := range d.Attributes {
+		if name, ok := smartCriticalAttributes[attr.ID]; ok {
+			out.Counters[name] = attr.Raw
+		}
+	}
+	if d.NVMeHealth != nil {
+		out.Counters["media errors"] = d.NVMeHealth.MediaErrors
+		out.Counters["critical warnings"] = uint64(d.NVMeHealth.CriticalWarning)
+	}
+	if d.GrownDefects != nil {
+		out.Counters["grown defects"] = *d.GrownDefects
+	}
+	if d.SASErrors != nil {
+		for name, c := range map[string]*SASErrorCounter{"read": d.SASErrors.Read, "write": d.SASErrors.Write, "verify": d.SASErrors.Verify} {
+			if c != nil {
+				out.Counters["uncorrected "+name+" errors"] = c.TotalUncorrected
+			}
+		}
+	}
+	return out
+}
+
+func compareBurnInSmart(before, after *BurnInSmart) []string {
+	var reasons []string
+	if after.Health == "Failed" {
+		reasons = append(reasons, "SMART health is Failed")
+	}
+	var names []string
+	for name := range after.Counters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if after.Counters[name] > before.Counters[name] {
+			reasons = append(reasons, fmt.Sprintf("%s increased from %d to %d", name, before.Counters[name], after.Counters[name]))
+		}
+	}
+	return reasons
+}
+
+// DeleteJob removes a finished job from the history.
+func (s *BurnInService) DeleteJob(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, job := range s.jobs {
+		if job.ID != id {
+			continue
+		}
+		if job.State == "running" {
+			return errors.New("job is still running; cancel it first")
+		}
+		s.jobs = append(s.jobs[:i], s.jobs[i+1:]...)
+		return s.save()
+	}
+	return ErrNotFound
+}
@@ -0,0 +1,455 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PoolCapacitySample is one measurement of a pool as reported by zpool
+// list. For raidz pools Size and Allocated include parity, so only their
+// ratio and rate of change are comparable with the usable space of the
+// datasets.
+type PoolCapacitySample struct {
+	Time          time.Time `json:"t"`
+	Size          uint64    `json:"size"`
+	Allocated     uint64    `json:"alloc"`
+	Free          uint64    `json:"free"`
+	Fragmentation *int      `json:"frag,omitempty"` // unset when zpool reports "-"
+	Capacity      int       `json:"cap"`
+}
+
+// PoolCapacity is the latest sample of a pool with its fill-rate trend.
+// FillRate is in bytes per day over the trend window; the projected dates
+// are only set while the pool is filling up.
+type PoolCapacity struct {
+	Pool          string     `json:"pool"`
+	SampledAt     time.Time  `json:"sampledAt"`
+	Size          uint64     `json:"size"`
+	Allocated     uint64     `json:"allocated"`
+	Free          uint64     `json:"free"`
+	Fragmentation *int       `json:"fragmentation,omitempty"`
+	Capacity      int        `json:"capacity"`
+	Level         string     `json:"level"` // ok, warning or critical
+	FillRate      *float64   `json:"fillRate,omitempty"`
+	TrendSamples  int        `json:"trendSamples"`
+	WarningBy     *time.Time `json:"warningBy,omitempty"`
+	CriticalBy    *time.Time `json:"criticalBy,omitempty"`
+	FullBy        *time.Time `json:"fullBy,omitempty"`
+}
+
+// PoolCapacityAlert is raised when a pool crosses a threshold or is
+// projected to be full within the forecast window.
+type PoolCapacityAlert struct {
+	Pool     string     `json:"pool"`
+	Level    string     `json:"level"` // warning or critical
+	Reason   string     `json:"reason"`
+	Capacity int        `json:"capacity"`
+	FullBy   *time.Time `json:"fullBy,omitempty"`
+	Since    time.Time  `json:"since"`
+}
+
+type PoolCapacityHistory struct {
+	Pool    string               `json:"pool"`
+	From    time.Time            `json:"from"`
+	To      time.Time            `json:"to"`
+	Step    string               `json:"step,omitempty"`
+	Samples []PoolCapacitySample `json:"samples"`
+}
+
+// CapacitySettings configures sampling and alerting. ForecastDays of zero
+// disables the alert for pools projected to fill up soon.
+type CapacitySettings struct {
+	IntervalMinutes int `json:"intervalMinutes"`
+	RetentionDays   int `json:"retentionDays"`
+	TrendDays       int `json:"trendDays"`
+	WarningPercent  int `json:"warningPercent"`
+	CriticalPercent int `json:"criticalPercent"`
+	ForecastDays    int `json:"forecastDays"`
+}
+
+var defaultCapacitySettings = CapacitySettings{
+	IntervalMinutes: 60,
+	RetentionDays:   365,
+	TrendDays:       30,
+	WarningPercent:  80,
+	CriticalPercent: 90,
+	ForecastDays:    30,
+}
+
+// minTrendSpan is the shortest history a fill rate is computed from, so a
+// single large copy does not predict a pool full by tomorrow.
+const minTrendSpan = 24 * time.Hour
+
+// CapacityMonitor samples the space of every pool, keeps a history per
+// pool as JSON lines and raises alerts when pools fill up.
+type CapacityMonitor struct {
+	storage  *StorageService
+	path     string
+	samples  *timeSeries
+	settings CapacitySettings
+
+	mu     sync.Mutex
+	latest map[string]PoolCapacitySample
+	alerts map[string]PoolCapacityAlert
+	stop   chan struct{}
+}
+
+func NewCapacityMonitor(storage *StorageService) *CapacityMonitor {
+	m := &CapacityMonitor{
+		storage:  storage,
+		path:     filepath.Join(DataDir(), "capacity.json"),
+		samples:  newTimeSeries(filepath.Join(DataDir(), "capacity-history"), "Capacity"),
+		settings: defaultCapacitySettings,
+		latest:   map[string]PoolCapacitySample{},
+		alerts:   map[string]PoolCapacityAlert{},
+	}
+	if err := loadJSON(m.path, &m.settings); err != nil {
+		log.Printf("Error loading capacity settings: %v", err)
+	}
+	return m
+}
+
+// Start samples pools whenever the interval has passed until Stop is called.
+func (m *CapacityMonitor) Start() {
+	m.stop = make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		for {
+			m.tick(time.Now())
+			select {
+			case <-ticker.C:
+			case <-m.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (m *CapacityMonitor) Stop() {
+	if m.stop != nil {
+		close(m.stop)
+	}
+}
+
+func (m *CapacityMonitor) tick(now time.Time) {
+	settings := m.Settings()
+	sample, compact := m.samples.due(now, time.Duration(settings.IntervalMinutes)*time.Minute)
+	if sample {
+		m.sample(now)
+	}
+	if compact {
+		m.samples.compact(now.AddDate(0, 0, -settings.RetentionDays))
+	}
+}
+
+// poolSpace lists the size, allocation and fragmentation of every pool.
+func (s *StorageService) poolSpace(now time.Time) (map[string]PoolCapacitySample, error) {
+	output, err := s.run("zpool", "list", "-H", "-p", "-o", "name,size,allocated,free,fragmentation,capacity")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list pool space: %v", err)
+	}
+	samples := map[string]PoolCapacitySample{}
+	for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		fields := strings.Split(line, "\t")
+		if len(fields) < 6 {
+			continue
+		}
+		sample := PoolCapacitySample{Time: now.UTC()}
+		sample.Size, _ = strconv.ParseUint(fields[1], 10, 64)
+		sample.Allocated, _ = strconv.ParseUint(fields[2], 10, 64)
+		sample.Free, _ = strconv.ParseUint(fields[3], 10, 64)
+		if frag, err := strconv.Atoi(strings.TrimSuffix(fields[4], "%")); err == nil {
+			sample.Fragmentation = &frag
+		}
+		sample.Capacity, _ = strconv.Atoi(strings.TrimSuffix(fields[5], "%"))
+		samples[fields[0]] = sample
+	}
+	return samples, nil
+}
+
+// sample records one sample per pool and updates the alerts.
+func (m *CapacityMonitor) sample(now time.Time) {
+	samples, err := m.storage.poolSpace(now)
+	if err != nil {
+		log.Printf("Capacity: %v", err)
+		return
+	}
+	for pool, sample := range samples {
+		if err := m.samples.append(pool, sample); err != nil {
+			log.Printf("Capacity: failed to record %s: %v", pool, err)
+		}
+	}
+
+	m.mu.Lock()
+	m.latest = samples
+	settings := m.settings
+	m.mu.Unlock()
+
+	alerts := map[string]PoolCapacityAlert{}
+	for pool, sample := range samples {
+		capacity := m.forecast(pool, sample, settings, now)
+		if alert := capacityAlert(capacity, settings, now); alert != nil {
+			alerts[pool] = *alert
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for pool, alert := range alerts {
+		previous, ok := m.alerts[pool]
+		if ok && previous.Level == alert.Level {
+			alert.Since = previous.Since
+		} else {
+			log.Printf("Capacity %s: pool %s: %s", alert.Level, pool, alert.Reason)
+		}
+		alerts[pool] = alert
+	}
+	for pool := range m.alerts {
+		if _, ok := alerts[pool]; !ok {
+			log.Printf("Capacity: alert for pool %s cleared", pool)
+		}
+	}
+	m.alerts = alerts
+}
+
+// capacityAlert returns the alert for a pool, if any. Crossing a threshold
+// takes precedence over the forecast.
+func capacityAlert(capacity *PoolCapacity, settings CapacitySettings, now time.Time) *PoolCapacityAlert {
+	alert := &PoolCapacityAlert{Pool: capacity.Pool, Capacity: capacity.Capacity, FullBy: capacity.FullBy, Since: now}
+	switch {
+	case capacity.Level == "critical":
+		alert.Level = "critical"
+		alert.Reason = fmt.Sprintf("%d%% full, at or above %d%%", capacity.Capacity, settings.CriticalPercent)
+	case capacity.Level == "warning":
+		alert.Level = "warning"
+		alert.Reason = fmt.Sprintf("%d%% full, at or above %d%%", capacity.Capacity, settings.WarningPercent)
+	case settings.ForecastDays > 0 && capacity.FullBy != nil &&
+		capacity.FullBy.Before(now.AddDate(0, 0, settings.ForecastDays)):
+		alert.Level = "warning"
+		alert.Reason = fmt.Sprintf("projected to be full by %s", capacity.FullBy.Format("2006-01-02"))
+	default:
+		return nil
+	}
+	return alert
+}
+
+func capacityLevel(capacity int, settings CapacitySettings) string {
+	switch {
+	case capacity >= settings.CriticalPercent:
+		return "critical"
+	case capacity >= settings.WarningPercent:
+		return "warning"
+	}
+	return "ok"
+}
+
+// forecast fits a line through the allocation samples of the trend window
+// and projects when the pool reaches the thresholds and fills up.
+func (m *CapacityMonitor) forecast(pool string, latest PoolCapacitySample, settings CapacitySettings, now time.Time) *PoolCapacity {
+	capacity := &PoolCapacity{
+		Pool:          pool,
+		SampledAt:     latest.Time,
+		Size:          latest.Size,
+		Allocated:     latest.Allocated,
+		Free:          latest.Free,
+		Fragmentation: latest.Fragmentation,
+		Capacity:      latest.Capacity,
+		Level:         capacityLevel(latest.Capacity, settings),
+	}
+
+	// Least squares on days since the first sample against allocated bytes.
+	from := now.AddDate(0, 0, -settings.TrendDays)
+	var first, last time.Time
+	var n, sumX, sumY, sumXX, sumXY float64
+	err := m.readSamples(pool, func(sample PoolCapacitySample) {
+		if sample.Time.Before(from) {
+			return
+		}
+		if first.IsZero() {
+			first = sample.Time
+		}
+		last = sample.Time
+		x := sample.Time.Sub(first).Hours() / 24
+		y := float64(sample.Allocated)
+		n++
+		sumX += x
+		sumY += y
+		sumXX += x * x
+		sumXY += x * y
+	})
+	capacity.TrendSamples = int(n)
+	if err != nil || n < 2 || last.Sub(first) < minTrendSpan {
+		return capacity
+	}
+	rate := (n*sumXY - sumX*sumY) / (n*sumXX - sumX*sumX)
+	if math.IsNaN(rate) || math.IsInf(rate, 0) {
+		return capacity
+	}
+	capacity.FillRate = &rate
+	if rate <= 0 {
+		return capacity
+	}
+
+	project := func(percent int) *time.Time {
+		target := float64(latest.Size) * float64(percent) / 100
+		if float64(latest.Allocated) >= target {
+			return nil
+		}
+		days := (target - float64(latest.Allocated)) / rate
+		if days > 100*365 {
+			return nil
+		}
+		t := latest.Time.Add(time.Duration(days * 24 * float64(time.Hour))).Truncate(time.Hour)
+		return &t
+	}
+	capacity.WarningBy = project(settings.WarningPercent)
+	capacity.CriticalBy = project(settings.CriticalPercent)
+	capacity.FullBy = project(100)
+	return capacity
+}
+
+// readSamples calls fn for each sample of a pool in chronological order.
+func (m *CapacityMonitor) readSamples(pool string, fn func(PoolCapacitySample)) error {
+	if validPoolName(pool) != nil {
+		return ErrNotFound
+	}
+	return m.samples.read(pool, func(line []byte) {
+		var sample PoolCapacitySample
+		if json.Unmarshal(line, &sample) == nil {
+			fn(sample)
+		}
+	})
+}
+
+// latestSamples returns the last samples, taking them now if no sample was
+// taken since the daemon started.
+func (m *CapacityMonitor) latestSamples(now time.Time) (map[string]PoolCapacitySample, CapacitySettings, error) {
+	m.mu.Lock()
+	latest, settings := m.latest, m.settings
+	m.mu.Unlock()
+	if len(latest) > 0 {
+		return latest, settings, nil
+	}
+	latest, err := m.storage.poolSpace(now)
+	return latest, settings, err
+}
+
+// Pools returns the capacity and forecast of every pool.
+func (m *CapacityMonitor) Pools() ([]PoolCapacity, error) {
+	now := time.Now()
+	latest, settings, err := m.latestSamples(now)
+	if err != nil {
+		return nil, err
+	}
+	pools := []PoolCapacity{}
+	for pool, sample := range latest {
+		pools = append(pools, *m.forecast(pool, sample, settings, now))
+	}
+	sort.Slice(pools, func(i, j int) bool { return pools[i].Pool < pools[j].Pool })
+	return pools, nil
+}
+
+// Pool returns the capacity and forecast of one pool.
+func (m *CapacityMonitor) Pool(pool string) (*PoolCapacity, error) {
+	now := time.Now()
+	latest, settings, err := m.latestSamples(now)
+	if err != nil {
+		return nil, err
+	}
+	sample, ok := latest[pool]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return m.forecast(pool, sample, settings, now), nil
+}
+
+// Alerts returns the pools currently above a threshold or projected to
+// fill up within the forecast window.
+func (m *CapacityMonitor) Alerts() []PoolCapacityAlert {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	alerts := []PoolCapacityAlert{}
+	for _, alert := range m.alerts {
+		alerts = append(alerts, alert)
+	}
+	sort.Slice(alerts, func(i, j int) bool { return alerts[i].Pool < alerts[j].Pool })
+	return alerts
+}
+
+// History returns the samples of a pool between from and to. With a step
+// the last sample of each step is returned.
+func (m *CapacityMonitor) History(pool string, from, to time.Time, step time.Duration) (*PoolCapacityHistory, error) {
+	if !from.Before(to) {
+		return nil, errors.New("from must be before to")
+	}
+	if step > 0 && to.Sub(from)/step > maxHistoryPoints {
+		return nil, fmt.Errorf("step is too small for the range; at most %d points are returned", maxHistoryPoints)
+	}
+	history := &PoolCapacityHistory{Pool: pool, From: from, To: to, Samples: []PoolCapacitySample{}}
+	if step > 0 {
+		history.Step = step.String()
+	}
+	var bucket time.Time
+	err := m.readSamples(pool, func(sample PoolCapacitySample) {
+		if sample.Time.Before(from) || !sample.Time.Before(to) {
+			return
+		}
+		if step > 0 {
+			b := from.Add(sample.Time.Sub(from) / step * step)
+			if len(history.Samples) > 0 && b.Equal(bucket) {
+				history.Samples[len(history.Samples)-1] = sample
+				return
+			}
+			bucket = b
+		}
+		history.Samples = append(history.Samples, sample)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(history.Samples) > maxHistoryPoints {
+		return nil, fmt.Errorf("range holds %d samples; use a step to downsample", len(history.Samples))
+	}
+	return history, nil
+}
+
+func (m *CapacityMonitor) Settings() CapacitySettings {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.settings
+}
+
+func (m *CapacityMonitor) SetSettings(settings CapacitySettings) (*CapacitySettings, error) {
+	if settings.IntervalMinutes < 1 || settings.IntervalMinutes > 24*60 {
+		return nil, errors.New("interval must be between 1 and 1440 minutes")
+	}
+	if settings.RetentionDays < 1 {
+		return nil, errors.New("retention must be at least one day")
+	}
+	if settings.TrendDays < 2 || settings.TrendDays > settings.RetentionDays {
+		return nil, errors.New("trend window must be at least two days and within the retention")
+	}
+	if settings.WarningPercent < 1 || settings.WarningPercent >= settings.CriticalPercent || settings.CriticalPercent > 100 {
+		return nil, errors.New("thresholds must satisfy 0 < warning < critical <= 100")
+	}
+	if settings.ForecastDays < 0 {
+		return nil, errors.New("forecast window cannot be negative")
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.settings = settings
+	if err := saveJSON(m.path, m.settings); err != nil {
+		return nil, fmt.Errorf("failed to save settings: %v", err)
+	}
+	return &settings, nil
+}
@@ -0,0 +1,149 @@
+package services
+
+import (
+	"testing"
+	"time"
+)
+
+// capacityHistory returns a monitor with one daily sample of tank per
+// entry in allocated, in GB, the last taken at now.
+func capacityHistory(t *testing.T, now time.Time, allocated ...uint64) *CapacityMonitor {
+	t.Helper()
+	t.Setenv("A1NAS_DATA_DIR", t.TempDir())
+	m := NewCapacityMonitor(nil)
+	for i, alloc := range allocated {
+		sample := PoolCapacitySample{
+			Time:      now.AddDate(0, 0, i+1-len(allocated)),
+			Size:      1000e9,
+			Allocated: alloc * 1e9,
+			Free:      (1000 - alloc) * 1e9,
+			Capacity:  int(alloc / 10),
+		}
+		if err := m.samples.append("tank", sample); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return m
+}
+
+func latestCapacity(t *testing.T, m *CapacityMonitor, now time.Time) *PoolCapacity {
+	t.Helper()
+	var latest PoolCapacitySample
+	if err := m.readSamples("tank", func(s PoolCapacitySample) { latest = s }); err != nil {
+		t.Fatal(err)
+	}
+	return m.forecast("tank", latest, defaultCapacitySettings, now)
+}
+
+func TestCapacityForecast(t *testing.T) {
+	now := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+	// 10 GB a day for ten days, with noise that cancels out in the fit,
+	// and a sample outside the 30 day trend window that would flatten it.
+	m := capacityHistory(t, now.AddDate(0, 0, -40), 0)
+	for i, alloc := range []uint64{500, 512, 518, 528, 542, 552, 558, 568, 582, 590} {
+		sample := PoolCapacitySample{Time: now.AddDate(0, 0, i-9), Size: 1000e9, Allocated: alloc * 1e9, Capacity: int(alloc / 10)}
+		if err := m.samples.append("tank", sample); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	capacity := latestCapacity(t, m, now)
+	if capacity.TrendSamples != 10 {
+		t.Errorf("trend from %d samples, want 10", capacity.TrendSamples)
+	}
+	if capacity.FillRate == nil || *capacity.FillRate < 9.99e9 || *capacity.FillRate > 10.01e9 {
+		t.Fatalf("got fill rate %v, want 10 GB a day", capacity.FillRate)
+	}
+	for _, tt := range []struct {
+		name string
+		got  *time.Time
+		days int
+	}{
+		{"warning", capacity.WarningBy, 21},
+		{"critical", capacity.CriticalBy, 31},
+		{"full", capacity.FullBy, 41},
+	} {
+		want := now.AddDate(0, 0, tt.days)
+		if tt.got == nil || tt.got.Sub(want).Abs() > time.Hour {
+			t.Errorf("%s by %v, want %v", tt.name, tt.got, want)
+		}
+	}
+	if capacity.Level != "ok" || capacity.Capacity != 59 {
+		t.Errorf("got level %s at %d%%", capacity.Level, capacity.Capacity)
+	}
+}
+
+func TestCapacityForecastNeedsATrend(t *testing.T) {
+	now := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name      string
+		allocated []uint64
+		rate      bool // a fill rate is reported
+	}{
+		{"one sample", []uint64{500}, false},
+		{"shrinking", []uint64{600, 550, 500}, true},
+		{"flat", []uint64{500, 500, 500}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			capacity := latestCapacity(t, capacityHistory(t, now, tt.allocated...), now)
+			if (capacity.FillRate != nil) != tt.rate {
+				t.Errorf("got fill rate %v", capacity.FillRate)
+			}
+			if capacity.WarningBy != nil || capacity.CriticalBy != nil || capacity.FullBy != nil {
+				t.Errorf("projected %v, %v, %v for a pool that is not filling up", capacity.WarningBy, capacity.CriticalBy, capacity.FullBy)
+			}
+		})
+	}
+
+	// Samples less than a day apart predict nothing.
+	t.Setenv("A1NAS_DATA_DIR", t.TempDir())
+	m := NewCapacityMonitor(nil)
+	for i := 0; i < 12; i++ {
+		sample := PoolCapacitySample{Time: now.Add(time.Duration(i-11) * time.Hour), Size: 1000e9, Allocated: uint64(500+10*i) * 1e9}
+		if err := m.samples.append("tank", sample); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if capacity := latestCapacity(t, m, now); capacity.FillRate != nil || capacity.TrendSamples != 12 {
+		t.Errorf("got fill rate %v from %d samples within a day", capacity.FillRate, capacity.TrendSamples)
+	}
+}
+
+func TestCapacityAlert(t *testing.T) {
+	now := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+	soon, later := now.AddDate(0, 0, 10), now.AddDate(0, 0, 60)
+	noForecast := defaultCapacitySettings
+	noForecast.ForecastDays = 0
+	tests := []struct {
+		name     string
+		capacity PoolCapacity
+		settings CapacitySettings
+		level    string // "" for no alert
+		reason   string
+	}{
+		{"ok", PoolCapacity{Capacity: 50, Level: "ok"}, defaultCapacitySettings, "", ""},
+		{"warning", PoolCapacity{Capacity: 85, Level: "warning"}, defaultCapacitySettings, "warning", "85% full, at or above 80%"},
+		{"critical over forecast", PoolCapacity{Capacity: 95, Level: "critical", FullBy: &soon}, defaultCapacitySettings, "critical", "95% full, at or above 90%"},
+		{"full soon", PoolCapacity{Capacity: 50, Level: "ok", FullBy: &soon}, defaultCapacitySettings, "warning", "projected to be full by 2026-03-11"},
+		{"full later", PoolCapacity{Capacity: 50, Level: "ok", FullBy: &later}, defaultCapacitySettings, "", ""},
+		{"forecast disabled", PoolCapacity{Capacity: 50, Level: "ok", FullBy: &soon}, noForecast, "", ""},
+	}
+	for _, tt := range tests {
+		tt.capacity.Pool = "tank"
+		alert := capacityAlert(&tt.capacity, tt.settings, now)
+		if tt.level == "" {
+			if alert != nil {
+				t.Errorf("%s: got alert %+v", tt.name, *alert)
+			}
+			continue
+		}
+		if alert == nil {
+			t.Errorf("%s: no alert", tt.name)
+			continue
+		}
+		if alert.Level != tt.level || alert.Reason != tt.reason || alert.Pool != "tank" || !alert.Since.Equal(now) {
+			t.Errorf("%s: got %+v", tt.name, *alert)
+		}
+	}
+}
@@ -0,0 +1,282 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Dataset is a ZFS filesystem as reported by `zfs list`.
+type Dataset struct {
+	Name       string `json:"name"`
+	Pool       string `json:"pool"`
+	Used       uint64 `json:"used"`
+	Available  uint64 `json:"available"`
+	Referenced uint64 `json:"referenced"`
+	Mountpoint string `json:"mountpoint"`
+}
+
+// DatasetProperty is a single property value and where it was set.
+type DatasetProperty struct {
+	Value  string `json:"value"`
+	Source string `json:"source"`
+}
+
+// DatasetProperties lists the properties the API allows to be read and set.
+var DatasetProperties = []string{
+	"compression", "recordsize", "atime", "quota", "refquota", "reservation", "sync", "xattr",
+}
+
+var (
+	datasetNameRe = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.:-]*(/[A-Za-z0-9_.:-]+)*$`)
+	zfsSizeRe     = regexp.MustCompile(`^[0-9]+(\.[0-9]+)?[KMGTPE]?$`)
+	compressionRe = regexp.MustCompile(`^(on|off|lz4|lzjb|zle|gzip(-[1-9])?|zstd(-([1-9]|1[0-9]))?|zstd-fast(-[0-9]+)?)$`)
+)
+
+func validDatasetName(name string) error {
+	if !datasetNameRe.MatchString(name) || len(name) > 255 {
+		return fmt.Errorf("invalid dataset name: %q", name)
+	}
+	return nil
+}
+
+// validateDatasetProperty checks a property assignment before it is handed
+// to `zfs set`/`zfs create -o` so bad input fails with a useful message.
+func validateDatasetProperty(prop, value string) error {
+	switch prop {
+	case "compression":
+		if !compressionRe.MatchString(value) {
+			return fmt.Errorf("invalid compression: %q", value)
+		}
+	case "recordsize":
+		n, ok := parseZFSSize(value)
+		if !ok || !zfsSizeRe.MatchString(value) || n < 512 || n > 16<<20 || n&(n-1) != 0 {
+			return fmt.Errorf("recordsize must be a power of two between 512 and 16M: %q", value)
+		}
+	case "atime":
+		if value != "on" && value != "off" {
+			return fmt.Errorf("atime must be on or off: %q", value)
+		}
+	case "quota", "refquota", "reservation":
+		if value != "none" && !zfsSizeRe.MatchString(value) {
+			return fmt.Errorf("invalid %s: %q", prop, value)
+		}
+	case "sync":
+		if value != "standard" && value != "always" && value != "disabled" {
+			return fmt.Errorf("sync must be standard, always or disabled: %q", value)
+		}
+	case "xattr":
+		if value != "on" && value != "off" && value != "sa" && value != "dir" {
+			return fmt.Errorf("xattr must be on, off, sa or dir: %q", value)
+		}
+	default:
+		return fmt.Errorf("unsupported property: %q", prop)
+	}
+	return nil
+}
+
+// poolOf returns the pool a dataset, volume or snapshot belongs to.
+func poolOf(name string) string {
+	if i := strings.IndexAny(name, "/@"); i >= 0 {
+		return name[:i]
+	}
+	return name
+}
+
+// DatasetWithin reports whether dataset is parent or one of its descendants.
+func DatasetWithin(dataset, parent string) bool {
+	return dataset == parent || strings.HasPrefix(dataset, parent+"/")
+}
+
+// propertyArgs turns a property map into sorted "-o key=value" arguments.
+func propertyArgs(props map[string]string) ([]string, error) {
+	keys := make([]string, 0, len(props))
+	for k := range props {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var args []string
+	for _, k := range keys {
+		if err := validateDatasetProperty(k, props[k]); err != nil {
+			return nil, err
+		}
+		args = append(args, "-o", k+"="+props[k])
+	}
+	return args, nil
+}
+
+// ListDatasets lists filesystems, optionally limited to a pool or parent dataset.
+func (s *StorageService) ListDatasets(parent string) ([]Dataset, error) {
+	args := []string{"list", "-H", "-p", "-t", "filesystem", "-o", "name,used,avail,refer,mountpoint"}
+	if parent != "" {
+		if err := validDatasetName(parent); err != nil {
+			return nil, err
+		}
+		args = append(args, "-r", parent)
+	}
+	output, err := s.run("zfs", args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list datasets: %v", err)
+	}
+
+	datasets := []Dataset{}
+	for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		fields := strings.Split(line, "\t")
+		if len(fields) < 5 {
+			continue
+		}
+		ds := Dataset{
+			Name:       fields[0],
+			Pool:       poolOf(fields[0]),
+			Mountpoint: fields[4],
+		}
+		ds.Used, _ = strconv.ParseUint(fields[1], 10, 64)
+		ds.Available, _ = strconv.ParseUint(fields[2], 10, 64)
+		ds.Referenced, _ = strconv.ParseUint(fields[3], 10, 64)
+		datasets = append(datasets, ds)
+	}
+	return datasets, nil
+}
+
+// CreateDataset creates a filesystem (and any missing parents) with the
+// given properties.
+func (s *StorageService) CreateDataset(name string, props map[string]string) error {
+	if err := validDatasetName(name); err != nil {
+		return err
+	}
+	if !strings.Contains(name, "/") {
+		return errors.New("dataset name must include the pool, e.g. tank/share")
+	}
+	opts, err := propertyArgs(props)
+	if err != nil {
+		return err
+	}
+
+	args := append([]string{"create", "-p"}, opts...)
+	args = append(args, name)
+	if _, err := s.run("zfs", args...); err != nil {
+		return fmt.Errorf("failed to create dataset: %v", err)
+	}
+	return nil
+}
+
+func (s *StorageService) RenameDataset(name, newName string) error {
+	if err := validDatasetName(name); err != nil {
+		return err
+	}
+	if err := validDatasetName(newName); err != nil {
+		return err
+	}
+	if !strings.Contains(name, "/") {
+		return errors.New("use pool import to rename a pool")
+	}
+	if poolOf(name) != poolOf(newName) {
+		return errors.New("datasets cannot be renamed across pools")
+	}
+	if _, err := s.run("zfs", "rename", name, newName); err != nil {
+		return fmt.Errorf("failed to rename dataset: %v", err)
+	}
+	return nil
+}
+
+// DestroyDataset destroys a dataset. Children and snapshots are only
+// removed when recursive is set; the pool's root dataset is never destroyed.
+func (s *StorageService) DestroyDataset(name string, recursive bool) error {
+	if err := validDatasetName(name); err != nil {
+		return err
+	}
+	if !strings.Contains(name, "/") {
+		return errors.New("refusing to destroy a pool's root dataset")
+	}
+	args := []string{"destroy"}
+	if recursive {
+		args = append(args, "-r")
+	}
+	args = append(args, name)
+	if _, err := s.run("zfs", args...); err != nil {
+		return fmt.Errorf("failed to destroy dataset: %v", err)
+	}
+	return nil
+}
+
+// GetDatasetProperties returns the managed properties of a dataset.
+func (s *StorageService) GetDatasetProperties(name string) (map[string]DatasetProperty, error) {
+	if err := validDatasetName(name); err != nil {
+		return nil, err
+	}
+	output, err := s.run("zfs", "get", "-H", "-p", "-o", "property,value,source",
+		strings.Join(DatasetProperties, ","), name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get dataset properties: %v", err)
+	}
+
+	props := map[string]DatasetProperty{}
+	for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		fields := strings.Split(line, "\t")
+		if len(fields) < 3 {
+			continue
+		}
+		props[fields[0]] = DatasetProperty{Value: fields[1], Source: fields[2]}
+	}
+	return props, nil
+}
+
+// SetDatasetProperties sets one or more managed properties. A value of
+// "inherit" reverts the property to the inherited value.
+func (s *StorageService) SetDatasetProperties(name string, props map[string]string) error {
+	if err := validDatasetName(name); err != nil {
+		return err
+	}
+	if len(props) == 0 {
+		return errors.New("no properties given")
+	}
+
+	for k := range props {
+		if !isDatasetProperty(k) {
+			return fmt.Errorf("unsupported property: %q", k)
+		}
+	}
+
+	var inherit []string
+	set := []string{"set"}
+	for _, k := range DatasetProperties {
+		v, ok := props[k]
+		if !ok {
+			continue
+		}
+		if v == "inherit" {
+			inherit = append(inherit, k)
+			continue
+		}
+		if err := validateDatasetProperty(k, v); err != nil {
+			return err
+		}
+		set = append(set, k+"="+v)
+	}
+
+	for _, k := range inherit {
+		if _, err := s.run("zfs", "inherit", k, name); err != nil {
+			return fmt.Errorf("failed to inherit %s: %v", k, err)
+		}
+	}
+	if len(set) > 1 {
+		set = append(set, name)
+		if _, err := s.run("zfs", set...); err != nil {
+			return fmt.Errorf("failed to set dataset properties: %v", err)
+		}
+	}
+	return nil
+}
+
+func isDatasetProperty(prop string) bool {
+	for _, p := range DatasetProperties {
+		if p == prop {
+			return true
+		}
+	}
+	return false
+}
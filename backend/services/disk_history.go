@@ -0,0 +1,362 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DiskSample is one recorded measurement of a drive. Drives in standby
+// are not woken, so their samples only carry Standby.
+type DiskSample struct {
+	Time         time.Time `json:"t"`
+	Temperature  *int      `json:"temp,omitempty"`
+	PowerOnHours *uint64   `json:"poh,omitempty"`
+	Reallocated  *uint64   `json:"realloc,omitempty"`
+	Pending      *uint64   `json:"pending,omitempty"`
+	Standby      bool      `json:"standby,omitempty"`
+}
+
+// DiskHistoryPoint aggregates the samples of one step. Counters report the
+// highest value seen, temperatures the mean and range, and Standby the
+// fraction of samples taken while the drive was asleep.
+type DiskHistoryPoint struct {
+	Time           time.Time `json:"time"`
+	Samples        int       `json:"samples"`
+	Temperature    *float64  `json:"temperature,omitempty"`
+	TemperatureMin *int      `json:"temperatureMin,omitempty"`
+	TemperatureMax *int      `json:"temperatureMax,omitempty"`
+	PowerOnHours   *uint64   `json:"powerOnHours,omitempty"`
+	Reallocated    *uint64   `json:"reallocated,omitempty"`
+	Pending        *uint64   `json:"pending,omitempty"`
+	Standby        float64   `json:"standby"`
+}
+
+type DiskHistory struct {
+	Serial string             `json:"serial"`
+	From   time.Time          `json:"from"`
+	To     time.Time          `json:"to"`
+	Step   string             `json:"step,omitempty"`
+	Points []DiskHistoryPoint `json:"points"`
+}
+
+type DiskHistorySettings struct {
+	IntervalMinutes int `json:"intervalMinutes"`
+	RetentionDays   int `json:"retentionDays"`
+}
+
+var defaultDiskHistorySettings = DiskHistorySettings{IntervalMinutes: 10, RetentionDays: 365}
+
+// maxHistoryPoints bounds a single query so a year of raw samples is never
+// sent in one response.
+const maxHistoryPoints = 5000
+
+var unsafeSerialChars = regexp.MustCompile(`[^A-Za-z0-9_.:-]`)
+
+// diskKey maps a serial to the name of its history file.
+func diskKey(serial string) string {
+	key := unsafeSerialChars.ReplaceAllString(strings.TrimSpace(serial), "_")
+	if key == "" || strings.Trim(key, ".") == "" {
+		return ""
+	}
+	return key
+}
+
+// DiskHistoryRecorder samples every drive at a configurable interval and
+// appends the samples to one JSON-lines file per serial.
+type DiskHistoryRecorder struct {
+	storage  *StorageService
+	path     string
+	samples  *timeSeries
+	settings DiskHistorySettings
+
+	mu   sync.Mutex
+	stop chan struct{}
+}
+
+func NewDiskHistoryRecorder(storage *StorageService) *DiskHistoryRecorder {
+	r := &DiskHistoryRecorder{
+		storage:  storage,
+		path:     filepath.Join(DataDir(), "disk-history.json"),
+		samples:  newTimeSeries(filepath.Join(DataDir(), "disk-history"), "Disk history"),
+		settings: defaultDiskHistorySettings,
+	}
+	if err := loadJSON(r.path, &r.settings); err != nil {
+		log.Printf("Error loading disk history settings: %v", err)
+	}
+	return r
+}
+
+// Start samples drives whenever the interval has passed until Stop is called.
+func (r *DiskHistoryRecorder) Start() {
+	r.stop = make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		for {
+			r.tick(time.Now())
+			select {
+			case <-ticker.C:
+			case <-r.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (r *DiskHistoryRecorder) Stop() {
+	if r.stop != nil {
+		close(r.stop)
+	}
+}
+
+func (r *DiskHistoryRecorder) tick(now time.Time) {
+	settings := r.Settings()
+	sample, compact := r.samples.due(now, time.Duration(settings.IntervalMinutes)*time.Minute)
+	if sample {
+		r.sample(now)
+	}
+	if compact {
+		r.samples.compact(now.AddDate(0, 0, -settings.RetentionDays))
+	}
+}
+
+// sample records one sample per drive.
+func (r *DiskHistoryRecorder) sample(now time.Time) {
+	disks, err := r.storage.listDisks()
+	if err != nil {
+		log.Printf("Disk history: %v", err)
+		return
+	}
+	for _, disk := range disks {
+		dev, serial := "/dev/"+disk.Name, disk.Serial
+		key := diskKey(serial)
+		if key == "" {
+			continue
+		}
+		sample := DiskSample{Time: now.UTC()}
+		data, err := r.storage.PeekSmartData(dev)
+		switch {
+		case errors.Is(err, ErrDeviceStandby):
+			sample.Standby = true
+		case err != nil:
+			log.Printf("Disk history: %v", err)
+			continue
+		default:
+			sample.Temperature = data.Temperature
+			if data.PowerOnHours > 0 {
+				poh := data.PowerOnHours
+				sample.PowerOnHours = &poh
+			}
+			sample.Reallocated, sample.Pending = sectorCounts(data)
+		}
+		if err := r.samples.append(key, sample); err != nil {
+			log.Printf("Disk history: failed to record %s: %v", serial, err)
+		}
+	}
+}
+
+// sectorCounts returns the reallocated and pending sector counts of a
+// drive, where the protocol has them.
+func sectorCounts(data *SmartData) (*uint64, *uint64) {
+	var reallocated, pending *uint64
+	for _, a := range data.Attributes {
+		raw := a.Raw
+		switch a.ID {
+		case 5:
+			reallocated = &raw
+		case 197:
+			pending = &raw
+		}
+	}
+	if data.GrownDefects != nil {
+		reallocated = data.GrownDefects
+	}
+	return reallocated, pending
+}
+
+// blockDisk is a whole disk as listed by lsblk.
+type blockDisk struct {
+	Name       string    `json:"name"`
+	Serial     string    `json:"serial"`
+	Type       string    `json:"type"`
+	Rotational lsblkBool `json:"rota"`
+}
+
+// lsblkBool accepts both the booleans of newer lsblk versions and the "1"
+// and "0" strings of older ones.
+type lsblkBool bool
+
+func (b *lsblkBool) UnmarshalJSON(data []byte) error {
+	switch strings.Trim(string(data), `"`) {
+	case "true", "1":
+		*b = true
+	default:
+		*b = false
+	}
+	return nil
+}
+
+// listDisks lists whole disks from sysfs via lsblk, so sleeping drives are
+// not woken.
+func (s *StorageService) listDisks() ([]blockDisk, error) {
+	output, err := s.run("lsblk", "-J", "-d", "-o", "NAME,SERIAL,TYPE,ROTA")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list disks: %v", err)
+	}
+	var out struct {
+		Blockdevices []blockDisk `json:"blockdevices"`
+	}
+	if err := json.Unmarshal(output, &out); err != nil {
+		return nil, fmt.Errorf("invalid lsblk output: %v", err)
+	}
+	disks := []blockDisk{}
+	for _, d := range out.Blockdevices {
+		if d.Type == "disk" {
+			d.Serial = strings.TrimSpace(d.Serial)
+			disks = append(disks, d)
+		}
+	}
+	return disks, nil
+}
+
+// readSamples calls fn for each sample of a drive in chronological order.
+func (r *DiskHistoryRecorder) readSamples(key string, fn func(DiskSample)) error {
+	return r.samples.read(key, func(line []byte) {
+		var sample DiskSample
+		if json.Unmarshal(line, &sample) == nil {
+			fn(sample)
+		}
+	})
+}
+
+// ParseHistoryDuration parses a Go duration that may also use a d (day)
+// or w (week) suffix, e.g. 90m, 24h, 7d or 2w.
+func ParseHistoryDuration(s string) (time.Duration, error) {
+	for suffix, unit := range map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour} {
+		if strings.HasSuffix(s, suffix) {
+			n, err := strconv.Atoi(strings.TrimSuffix(s, suffix))
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("invalid duration: %q", s)
+			}
+			return time.Duration(n) * unit, nil
+		}
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid duration: %q", s)
+	}
+	return d, nil
+}
+
+// Query returns the history of a drive between from and to. A step of zero
+// returns raw samples, otherwise samples are averaged into buckets of step.
+func (r *DiskHistoryRecorder) Query(serial string, from, to time.Time, step time.Duration) (*DiskHistory, error) {
+	key := diskKey(serial)
+	if key == "" {
+		return nil, fmt.Errorf("invalid serial: %q", serial)
+	}
+	if !from.Before(to) {
+		return nil, errors.New("from must be before to")
+	}
+	if step > 0 && to.Sub(from)/step > maxHistoryPoints {
+		return nil, fmt.Errorf("step is too small for the range; at most %d points are returned", maxHistoryPoints)
+	}
+
+	history := &DiskHistory{Serial: serial, From: from, To: to, Points: []DiskHistoryPoint{}}
+	if step > 0 {
+		history.Step = step.String()
+	}
+	var current *DiskHistoryPoint
+	var tempSum float64
+	var tempCount, standby int
+	flush := func() {
+		if current == nil {
+			return
+		}
+		if tempCount > 0 {
+			mean := tempSum / float64(tempCount)
+			current.Temperature = &mean
+		}
+		current.Standby = float64(standby) / float64(current.Samples)
+		history.Points = append(history.Points, *current)
+		current, tempSum, tempCount, standby = nil, 0, 0, 0
+	}
+
+	err := r.readSamples(key, func(sample DiskSample) {
+		if sample.Time.Before(from) || !sample.Time.Before(to) {
+			return
+		}
+		bucket := sample.Time
+		if step > 0 {
+			bucket = from.Add(sample.Time.Sub(from) / step * step)
+		}
+		if current != nil && !current.Time.Equal(bucket) {
+			flush()
+		}
+		if current == nil {
+			current = &DiskHistoryPoint{Time: bucket}
+		}
+		current.Samples++
+		if sample.Standby {
+			standby++
+		}
+		if t := sample.Temperature; t != nil {
+			tempSum += float64(*t)
+			tempCount++
+			if current.TemperatureMin == nil || *t < *current.TemperatureMin {
+				current.TemperatureMin = t
+			}
+			if current.TemperatureMax == nil || *t > *current.TemperatureMax {
+				current.TemperatureMax = t
+			}
+		}
+		current.PowerOnHours = maxCounter(current.PowerOnHours, sample.PowerOnHours)
+		current.Reallocated = maxCounter(current.Reallocated, sample.Reallocated)
+		current.Pending = maxCounter(current.Pending, sample.Pending)
+	})
+	if err != nil {
+		return nil, err
+	}
+	flush()
+	if len(history.Points) > maxHistoryPoints {
+		return nil, fmt.Errorf("range holds %d samples; use a step to downsample", len(history.Points))
+	}
+	return history, nil
+}
+
+func maxCounter(a, b *uint64) *uint64 {
+	if a == nil || (b != nil && *b > *a) {
+		return b
+	}
+	return a
+}
+
+func (r *DiskHistoryRecorder) Settings() DiskHistorySettings {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.settings
+}
+
+func (r *DiskHistoryRecorder) SetSettings(settings DiskHistorySettings) (*DiskHistorySettings, error) {
+	if settings.IntervalMinutes < 1 || settings.IntervalMinutes > 24*60 {
+		return nil, errors.New("interval must be between 1 and 1440 minutes")
+	}
+	if settings.RetentionDays < 1 {
+		return nil, errors.New("retention must be at least one day")
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.settings = settings
+	if err := saveJSON(r.path, r.settings); err != nil {
+		return nil, fmt.Errorf("failed to save settings: %v", err)
+	}
+	return &settings, nil
+}
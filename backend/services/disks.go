@@ -0,0 +1,501 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Disk is a physical disk, identified by serial number (or WWN when the
+// serial is missing) rather than by its /dev/sdX name, which can change
+// between boots.
+type Disk struct {
+	ID         string      `json:"id"`
+	Serial     string      `json:"serial,omitempty"`
+	WWN        string      `json:"wwn,omitempty"`
+	Name       string      `json:"name"`
+	Path       string      `json:"path"`
+	ByID       string      `json:"byId,omitempty"`
+	ByIDPaths  []string    `json:"byIdPaths"`
+	Model      string      `json:"model,omitempty"`
+	Vendor     string      `json:"vendor,omitempty"`
+	Type       string      `json:"type"` // hdd, ssd or nvme
+	Rotational bool        `json:"rotational"`
+	Transport  string      `json:"transport,omitempty"` // sata, sas, nvme, usb, ...
+	Size       uint64      `json:"size"`
+	FSType     string      `json:"fstype,omitempty"` // signature on the whole disk
+	Partitions []Partition `json:"partitions"`
+	Pool       string      `json:"pool,omitempty"`
+	Vdev       string      `json:"vdev,omitempty"`
+	VdevClass  string      `json:"vdevClass,omitempty"` // data, logs, cache, spares, special or dedup
+	State      string      `json:"state,omitempty"`     // member state from zpool status
+}
+
+type Partition struct {
+	Name     string `json:"name"`
+	Path     string `json:"path"`
+	ByID     string `json:"byId,omitempty"`
+	Size     uint64 `json:"size"`
+	FSType   string `json:"fstype,omitempty"`
+	Label    string `json:"label,omitempty"`
+	PartUUID string `json:"partuuid,omitempty"`
+}
+
+const diskByIDDir = "/dev/disk/by-id"
+
+type lsblkDevice struct {
+	Name     string        `json:"name"`
+	Path     string        `json:"path"`
+	Serial   string        `json:"serial"`
+	WWN      string        `json:"wwn"`
+	Model    string        `json:"model"`
+	Vendor   string        `json:"vendor"`
+	Rota     lsblkBool     `json:"rota"`
+	Tran     string        `json:"tran"`
+	Size     lsblkSize     `json:"size"`
+	Type     string        `json:"type"`
+	FSType   string        `json:"fstype"`
+	Label    string        `json:"label"`
+	PartUUID string        `json:"partuuid"`
+	Children []lsblkDevice `json:"children"`
+}
+
+// lsblkSize accepts sizes printed as numbers or, by older lsblk versions,
+// as strings.
+type lsblkSize uint64
+
+func (s *lsblkSize) UnmarshalJSON(data []byte) error {
+	var n uint64
+	if _, err := fmt.Sscan(strings.Trim(string(data), `"`), &n); err == nil {
+		*s = lsblkSize(n)
+	}
+	return nil
+}
+
+// byIDLinks maps each device path to its /dev/disk/by-id links, sorted.
+func byIDLinks() map[string][]string {
+	links := map[string][]string{}
+	entries, err := os.ReadDir(diskByIDDir)
+	if err != nil {
+		return links
+	}
+	for _, entry := range entries {
+		link := filepath.Join(diskByIDDir, entry.Name())
+		target, err := filepath.EvalSymlinks(link)
+		if err != nil {
+			continue
+		}
+		links[target] = append(links[target], link)
+	}
+	for _, l := range links {
+		sort.Strings(l)
+	}
+	return links
+}
+
+// preferredByID picks the by-id link ZFS should use: the one naming the
+// serial (ata-MODEL_SERIAL, nvme-MODEL_SERIAL, ...), else the WWN link.
+func preferredByID(links []string, serial string) string {
+	if serial != "" {
+		for _, link := range links {
+			if strings.Contains(filepath.Base(link), serial) {
+				return link
+			}
+		}
+	}
+	for _, link := range links {
+		if strings.HasPrefix(filepath.Base(link), "wwn-") {
+			return link
+		}
+	}
+	if len(links) > 0 {
+		return links[0]
+	}
+	return ""
+}
+
+func diskType(d lsblkDevice) string {
+	switch {
+	case d.Tran == "nvme" || strings.HasPrefix(d.Name, "nvme"):
+		return "nvme"
+	case bool(d.Rota):
+		return "hdd"
+	default:
+		return "ssd"
+	}
+}
+
+// DiskInventory lists every physical disk with its identity, layout and
+// pool membership.
+func (s *StorageService) DiskInventory() ([]Disk, error) {
+	output, err := s.run("lsblk", "-J", "-b", "-o", "NAME,PATH,SERIAL,WWN,MODEL,VENDOR,ROTA,TRAN,SIZE,TYPE,FSTYPE,LABEL,PARTUUID")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list disks: %v", err)
+	}
+	var out struct {
+		Blockdevices []lsblkDevice `json:"blockdevices"`
+	}
+	if err := json.Unmarshal(output, &out); err != nil {
+		return nil, fmt.Errorf("invalid lsblk output: %v", err)
+	}
+
+	links := byIDLinks()
+	disks := []Disk{}
+	for _, d := range out.Blockdevices {
+		if d.Type != "disk" {
+			continue
+		}
+		if d.Path == "" {
+			d.Path = "/dev/" + d.Name
+		}
+		disk := Disk{
+			Serial:     strings.TrimSpace(d.Serial),
+			WWN:        d.WWN,
+			Name:       d.Name,
+			Path:       d.Path,
+			ByIDPaths:  links[d.Path],
+			Model:      strings.TrimSpace(d.Model),
+			Vendor:     strings.TrimSpace(d.Vendor),
+			Type:       diskType(d),
+			Rotational: bool(d.Rota),
+			Transport:  d.Tran,
+			Size:       uint64(d.Size),
+			FSType:     d.FSType,
+			Partitions: []Partition{},
+		}
+		if disk.ByIDPaths == nil {
+			disk.ByIDPaths = []string{}
+		}
+		disk.ByID = preferredByID(disk.ByIDPaths, disk.Serial)
+		switch {
+		case disk.Serial != "":
+			disk.ID = disk.Serial
+		case disk.WWN != "":
+			disk.ID = disk.WWN
+		default:
+			disk.ID = disk.Name
+		}
+		for _, p := range d.Children {
+			if p.Type != "part" {
+				continue
+			}
+			if p.Path == "" {
+				p.Path = "/dev/" + p.Name
+			}
+			disk.Partitions = append(disk.Partitions, Partition{
+				Name:     p.Name,
+				Path:     p.Path,
+				ByID:     preferredByID(links[p.Path], disk.Serial),
+				Size:     uint64(p.Size),
+				FSType:   p.FSType,
+				Label:    p.Label,
+				PartUUID: p.PartUUID,
+			})
+		}
+		disks = append(disks, disk)
+	}
+	s.addPoolMembership(disks)
+	return disks, nil
+}
+
+// matches reports whether a device name as used in zpool status or by a
+// client (sdb, /dev/sdb1, ata-X, /dev/disk/by-id/ata-X-part1, a partuuid)
+// refers to the disk or one of its partitions.
+func (d *Disk) matches(name string) bool {
+	base := filepath.Base(name)
+	if base == d.Name || name == d.Path || base == d.ID {
+		return true
+	}
+	for _, link := range d.ByIDPaths {
+		if base == filepath.Base(link) || strings.HasPrefix(base, filepath.Base(link)+"-part") {
+			return true
+		}
+	}
+	for _, p := range d.Partitions {
+		if base == p.Name || (p.PartUUID != "" && base == p.PartUUID) {
+			return true
+		}
+	}
+	return false
+}
+
+// addPoolMembership fills in the pool and vdev of every disk that is part
+// of an imported pool.
+func (s *StorageService) addPoolMembership(disks []Disk) {
+	pools, err := s.ListPools()
+	if err != nil {
+		return
+	}
+	for _, pool := range pools {
+		if pool == "" {
+			continue
+		}
+		status, err := s.GetPoolStatus(pool)
+		if err != nil {
+			continue
+		}
+		// vdev is the top-level vdev, so both sides of a replacing-N
+		// group inside mirror-0 report mirror-0.
+		var walk func(v *VdevStatus, vdev, class string)
+		walk = func(v *VdevStatus, vdev, class string) {
+			if vdev == "" {
+				vdev = v.Name
+			}
+			for _, child := range v.Children {
+				walk(child, vdev, class)
+			}
+			if len(v.Children) > 0 {
+				return
+			}
+			for i := range disks {
+				if disks[i].Pool == "" && disks[i].matches(v.Name) {
+					disks[i].Pool, disks[i].Vdev, disks[i].VdevClass, disks[i].State = pool, vdev, class, v.State
+				}
+			}
+		}
+		if status.Config != nil {
+			for _, v := range status.Config.Children {
+				walk(v, "", "data")
+			}
+		}
+		classes := map[string][]*VdevStatus{
+			"logs": status.Logs, "cache": status.Cache, "spares": status.Spares,
+			"special": status.Special, "dedup": status.Dedup,
+		}
+		for class, vdevs := range classes {
+			for _, v := range vdevs {
+				walk(v, "", class)
+			}
+		}
+	}
+}
+
+// GetDisk finds a disk by serial, WWN, device name or path.
+func (s *StorageService) GetDisk(id string) (*Disk, error) {
+	disks, err := s.DiskInventory()
+	if err != nil {
+		return nil, err
+	}
+	for i := range disks {
+		if disks[i].ID == id || disks[i].Serial == id || (disks[i].WWN != "" && disks[i].WWN == id) ||
+			disks[i].Name == id || disks[i].Path == id {
+			return &disks[i], nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// stablePath returns the by-id path of dev, which names this disk or one of
+// its partitions, or dev itself when there is none.
+func (d *Disk) stablePath(dev string) string {
+	if filepath.Base(dev) == d.Name || dev == d.Path || dev == d.ID {
+		if d.ByID != "" {
+			return d.ByID
+		}
+		return dev
+	}
+	for _, p := range d.Partitions {
+		if (filepath.Base(dev) == p.Name || dev == p.Path) && p.ByID != "" {
+			return p.ByID
+		}
+	}
+	return dev
+}
+
+// stableDevices maps the devices of a new vdev to their /dev/disk/by-id
+// paths so the pool survives sdX renames, and refuses disks that already
+// belong to a pool. Devices the inventory does not know are passed through.
+func (s *StorageService) stableDevices(devices []string) ([]string, error) {
+	for _, dev := range devices {
+		if err := validDevice(dev); err != nil {
+			return nil, err
+		}
+	}
+	// Without the inventory membership and busy disks cannot be checked,
+	// so nothing is added.
+	disks, err := s.DiskInventory()
+	if err != nil {
+		return nil, err
+	}
+	stable := make([]string, len(devices))
+	for i, dev := range devices {
+		stable[i] = dev
+		for _, disk := range disks {
+			if !disk.matches(dev) {
+				continue
+			}
+			if disk.Pool != "" {
+				return nil, fmt.Errorf("device %s is already part of pool %s", dev, disk.Pool)
+			}
+			if use := s.diskBusy(disk.Path); use != "" {
+				return nil, fmt.Errorf("device %s is busy with %s", dev, use)
+			}
+			stable[i] = disk.stablePath(dev)
+			break
+		}
+	}
+	return stable, nil
+}
+
+const mountsPath = "/proc/self/mounts"
+
+// mountedDevices returns the device paths that have a mounted filesystem.
+func mountedDevices() map[string]bool {
+	mounted := map[string]bool{}
+	data, err := os.ReadFile(mountsPath)
+	if err != nil {
+		return mounted
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if fields := strings.Fields(line); len(fields) > 0 && strings.HasPrefix(fields[0], "/dev/") {
+			mounted[fields[0]] = true
+			if target, err := filepath.EvalSymlinks(fields[0]); err == nil {
+				mounted[target] = true
+			}
+		}
+	}
+	return mounted
+}
+
+// claimDisk marks a disk as busy with use (e.g. "a wipe") until release is
+// called, refusing a disk another job already holds. Wipe and burn-in
+// claim their disk for the whole job; unusedDisk, the pool planner and
+// stableDevices refuse busy disks.
+func (s *StorageService) claimDisk(d *Disk, use string) (release func(), err error) {
+	s.busyMu.Lock()
+	defer s.busyMu.Unlock()
+	if current, ok := s.busy[d.Path]; ok {
+		return nil, fmt.Errorf("disk %s is busy with %s", d.ID, current)
+	}
+	if s.busy == nil {
+		s.busy = map[string]string{}
+	}
+	s.busy[d.Path] = use
+	return func() {
+		s.busyMu.Lock()
+		delete(s.busy, d.Path)
+		s.busyMu.Unlock()
+	}, nil
+}
+
+// diskBusy returns what a disk is busy with, or "".
+func (s *StorageService) diskBusy(path string) string {
+	s.busyMu.Lock()
+	defer s.busyMu.Unlock()
+	return s.busy[path]
+}
+
+// swapsPath is a variable so tests can point it at a fixture.
+var swapsPath = "/proc/swaps"
+
+// swapDevices returns the block devices with active swap.
+func swapDevices() map[string]bool {
+	swaps := map[string]bool{}
+	data, err := os.ReadFile(swapsPath)
+	if err != nil {
+		return swaps
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if fields := strings.Fields(line); len(fields) > 1 && fields[1] == "partition" {
+			swaps[fields[0]] = true
+		}
+	}
+	return swaps
+}
+
+// diskUse reports what uses a disk or its partitions from above: a
+// device-mapper target (LVM, LUKS), an md array, a mount or swap. lsblk
+// lists the holders from /sys/class/block all the way up, so a mount on a
+// logical volume on a partition is found; mountedDevices only sees the
+// disk and its partitions. It returns "" for a disk nothing uses.
+func (s *StorageService) diskUse(disk *Disk) (string, error) {
+	out, err := s.run("lsblk", "-rnpo", "NAME,TYPE,MOUNTPOINT", disk.Path)
+	if err != nil {
+		return "", fmt.Errorf("failed to list the holders of %s: %v", disk.Path, err)
+	}
+	swaps := swapDevices()
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		name, typ := fields[0], fields[1]
+		switch {
+		case typ != "disk" && typ != "part":
+			return fmt.Sprintf("held by %s (%s)", name, typ), nil
+		case len(fields) > 2 && fields[2] == "[SWAP]":
+			return fmt.Sprintf("in use as swap on %s", name), nil
+		case len(fields) > 2:
+			return fmt.Sprintf("mounted on %s at %s", name, fields[2]), nil
+		}
+		resolved, _ := filepath.EvalSymlinks(name)
+		if swaps[name] || swaps[resolved] {
+			return fmt.Sprintf("in use as swap on %s", name), nil
+		}
+	}
+	return "", nil
+}
+
+// unusedDisk looks up a disk for a destructive operation and refuses it
+// while it is a member of an imported pool, holds the system, has a
+// mounted filesystem or swap, or is held by LVM, LUKS or md.
+func (s *StorageService) unusedDisk(id string) (*Disk, error) {
+	disk, err := s.GetDisk(id)
+	if errors.Is(err, ErrNotFound) {
+		return nil, fmt.Errorf("unknown disk: %s", id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if disk.Pool != "" {
+		return nil, fmt.Errorf("disk %s is part of pool %s", disk.ID, disk.Pool)
+	}
+	if use := s.diskBusy(disk.Path); use != "" {
+		return nil, fmt.Errorf("disk %s is busy with %s", disk.ID, use)
+	}
+	if reason, ok := s.ProtectedDisks()[disk.Path]; ok {
+		return nil, fmt.Errorf("disk %s is in use as %s", disk.ID, reason)
+	}
+	mounted := mountedDevices()
+	if mounted[disk.Path] {
+		return nil, fmt.Errorf("disk %s is mounted", disk.ID)
+	}
+	for _, p := range disk.Partitions {
+		if mounted[p.Path] {
+			return nil, fmt.Errorf("partition %s of disk %s is mounted", p.Name, disk.ID)
+		}
+	}
+	use, err := s.diskUse(disk)
+	if err != nil {
+		return nil, err
+	}
+	if use != "" {
+		return nil, fmt.Errorf("disk %s is %s", disk.ID, use)
+	}
+	return disk, nil
+}
+
+// diskSignatures lists the filesystem, RAID, ZFS and partition table
+// signatures on a disk and its partitions.
+func (s *StorageService) diskSignatures(disk *Disk) ([]string, error) {
+	var signatures []string
+	for _, p := range disk.Partitions {
+		if p.FSType != "" {
+			signatures = append(signatures, p.FSType+" on "+p.Name)
+		}
+	}
+	out, err := s.run("wipefs", "--no-act", "--noheadings", "--output", "TYPE", disk.Path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to probe signatures: %v", err)
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		if t := strings.TrimSpace(line); t != "" {
+			signatures = append(signatures, t)
+		}
+	}
+	return signatures, nil
+}
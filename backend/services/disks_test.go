@@ -0,0 +1,79 @@
+package services
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestUnusedDiskRefusesProtectedDisks(t *testing.T) {
+	t.Setenv("A1NAS_DATA_DIR", t.TempDir())
+	s, _ := fixtureStorage(t)
+
+	// nvme0n1 holds / and /boot/efi in the fixtures.
+	for _, id := range []string{"nvme0n1", "/dev/nvme0n1", "S4EVNX0N123456A"} {
+		if _, err := s.unusedDisk(id); err == nil || !strings.Contains(err.Error(), "in use as boot disk") {
+			t.Errorf("%s: got %v, want the boot disk refused", id, err)
+		}
+	}
+	if _, err := NewWipeService(s).RequestToken("nvme0n1", "quick"); err == nil || !strings.Contains(err.Error(), "boot disk") {
+		t.Errorf("got %v requesting a wipe of the boot disk", err)
+	}
+	if _, err := NewBurnInService(s).Start("nvme0n1"); err == nil || !strings.Contains(err.Error(), "boot disk") {
+		t.Errorf("got %v starting a burn-in of the boot disk", err)
+	}
+
+	if _, err := s.unusedDisk("sda"); err == nil || !strings.Contains(err.Error(), "part of pool tank") {
+		t.Errorf("got %v for a pool member", err)
+	}
+	if disk, err := s.unusedDisk("sdw"); err != nil || disk.Name != "sdw" {
+		t.Errorf("got %v for an unused disk", err)
+	}
+}
+
+func TestUnusedDiskRefusesDisksUnderLVMRoot(t *testing.T) {
+	t.Setenv("A1NAS_DATA_DIR", t.TempDir())
+	s, fake := lvmRootStorage(t)
+
+	// / is on vg0-root, on md1, on sdw1 and sdu1.
+	for _, id := range []string{"sdw", "sdu"} {
+		if _, err := s.unusedDisk(id); err == nil || !strings.Contains(err.Error(), "in use as boot disk") {
+			t.Errorf("%s: got %v, want the boot disk refused", id, err)
+		}
+	}
+	if _, err := NewWipeService(s).RequestToken("sdu", "quick"); err == nil {
+		t.Error("issued a wipe token for a disk under the root volume")
+	}
+	for _, call := range fake.Calls() {
+		if strings.HasPrefix(call, "wipefs --all") || strings.HasPrefix(call, "dd ") {
+			t.Errorf("ran %q", call)
+		}
+	}
+}
+
+func TestUnusedDiskRefusesHeldAndSwapDisks(t *testing.T) {
+	t.Setenv("A1NAS_DATA_DIR", t.TempDir())
+	s, _ := lvmRootStorage(t)
+	defer func(path string) { swapsPath = path }(swapsPath)
+	swapsPath = "testdata/lvm-root/swaps"
+
+	// sdb is also a member of tank, which unusedDisk checks first.
+	if use, err := s.diskUse(&Disk{Path: "/dev/sdb"}); err != nil || use != "held by /dev/mapper/backup (crypt)" {
+		t.Errorf("got %q, %v for a LUKS member", use, err)
+	}
+	if _, err := s.unusedDisk("sdv"); err == nil || !strings.Contains(err.Error(), "swap on /dev/sdv1") {
+		t.Errorf("got %v for a disk with active swap", err)
+	}
+	swapsPath = filepath.Join(t.TempDir(), "missing")
+	if _, err := s.unusedDisk("sdv"); err != nil {
+		t.Errorf("got %v once swap is off", err)
+	}
+}
+
+func TestStableDevicesFailsWithoutInventory(t *testing.T) {
+	s, fake := fixtureStorage(t)
+	fake.Add("lsblk -J -b -o NAME,PATH,SERIAL,WWN,MODEL,VENDOR,ROTA,TRAN,SIZE,TYPE,FSTYPE,LABEL,PARTUUID", FakeResponse{ExitCode: 1})
+	if devices, err := s.stableDevices([]string{"sdw", "sdv"}); err == nil {
+		t.Errorf("got %q without a disk inventory", devices)
+	}
+}
@@ -0,0 +1,332 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Enclosure is a SES enclosure (typically a SAS backplane behind an HBA)
+// as exposed by the kernel's ses driver under /sys/class/enclosure.
+type Enclosure struct {
+	ID        string          `json:"id"`        // sysfs name, the SCSI address e.g. 0:0:32:0
+	LogicalID string          `json:"logicalId"` // enclosure SAS address
+	Vendor    string          `json:"vendor,omitempty"`
+	Model     string          `json:"model,omitempty"`
+	Device    string          `json:"device,omitempty"` // /dev/sgN used by sg_ses
+	Slots     []EnclosureSlot `json:"slots"`
+}
+
+// EnclosureSlot is one drive bay. Disk is empty when the bay is empty.
+type EnclosureSlot struct {
+	Enclosure  string     `json:"enclosure"`
+	Slot       int        `json:"slot"`
+	Component  string     `json:"component"`
+	Status     string     `json:"status,omitempty"`
+	Disk       string     `json:"disk,omitempty"`
+	Serial     string     `json:"serial,omitempty"`
+	Pool       string     `json:"pool,omitempty"`
+	Ident      bool       `json:"ident"`
+	Fault      bool       `json:"fault"`
+	IdentOffAt *time.Time `json:"identOffAt,omitempty"`
+	FaultOffAt *time.Time `json:"faultOffAt,omitempty"`
+
+	// numbered is set when Slot is the bay number the enclosure reports
+	// rather than the bay's position in the listing.
+	numbered bool
+}
+
+var enclosureRoot = "/sys/class/enclosure"
+
+// ledAttrs maps LED names to the ses sysfs attribute and sg_ses element.
+var ledAttrs = map[string]string{"ident": "locate", "fault": "fault"}
+
+var slotNumberRe = regexp.MustCompile(`\d+`)
+
+func readSysfs(path string) string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// Enclosures lists SES enclosures and maps each bay to the disk in it. It
+// needs the ses kernel module; without it no enclosures are listed.
+func (s *StorageService) Enclosures() ([]Enclosure, error) {
+	enclosures := []Enclosure{}
+	entries, err := os.ReadDir(enclosureRoot)
+	if os.IsNotExist(err) {
+		return enclosures, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to list enclosures: %v", err)
+	}
+
+	disks, _ := s.DiskInventory()
+	byName := map[string]Disk{}
+	for _, d := range disks {
+		byName[d.Name] = d
+	}
+
+	for _, entry := range entries {
+		dir := filepath.Join(enclosureRoot, entry.Name())
+		enc := Enclosure{
+			ID:        entry.Name(),
+			LogicalID: readSysfs(filepath.Join(dir, "id")),
+			Vendor:    readSysfs(filepath.Join(dir, "device", "vendor")),
+			Model:     readSysfs(filepath.Join(dir, "device", "model")),
+			Slots:     []EnclosureSlot{},
+		}
+		if sg, err := os.ReadDir(filepath.Join(dir, "device", "scsi_generic")); err == nil && len(sg) > 0 {
+			enc.Device = "/dev/" + sg[0].Name()
+		}
+		components, err := os.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, comp := range components {
+			cdir := filepath.Join(dir, comp.Name())
+			if comp.Name() == "device" || comp.Name() == "subsystem" || comp.Name() == "power" {
+				continue
+			}
+			switch readSysfs(filepath.Join(cdir, "type")) {
+			case "array device", "device":
+			default:
+				continue
+			}
+			slot := EnclosureSlot{
+				Enclosure: enc.ID,
+				Slot:      len(enc.Slots),
+				Component: comp.Name(),
+				Status:    readSysfs(filepath.Join(cdir, "status")),
+				Ident:     readSysfs(filepath.Join(cdir, "locate")) == "1",
+				Fault:     readSysfs(filepath.Join(cdir, "fault")) == "1",
+			}
+			// Older kernels have no slot attribute; the component is then
+			// named after the bay, e.g. "Slot 07" or "ArrayDevice07".
+			if n, err := strconv.Atoi(readSysfs(filepath.Join(cdir, "slot"))); err == nil {
+				slot.Slot, slot.numbered = n, true
+			} else if n, err := strconv.Atoi(slotNumberRe.FindString(comp.Name())); err == nil {
+				slot.Slot, slot.numbered = n, true
+			}
+			if block, err := os.ReadDir(filepath.Join(cdir, "device", "block")); err == nil && len(block) > 0 {
+				slot.Disk = block[0].Name()
+				if d, ok := byName[slot.Disk]; ok {
+					slot.Serial, slot.Pool = d.Serial, d.Pool
+				}
+			}
+			enc.Slots = append(enc.Slots, slot)
+		}
+		sort.Slice(enc.Slots, func(i, j int) bool { return enc.Slots[i].Slot < enc.Slots[j].Slot })
+		enclosures = append(enclosures, enc)
+	}
+	return enclosures, nil
+}
+
+// LEDTarget names either a disk (serial, name or path) or an enclosure bay.
+type LEDTarget struct {
+	Disk      string `json:"disk"`
+	Enclosure string `json:"enclosure"`
+	Slot      *int   `json:"slot"`
+}
+
+// findSlot resolves a target to its bay. A disk outside any enclosure
+// returns a nil slot and its device path.
+func (s *StorageService) findSlot(target LEDTarget) (*Enclosure, *EnclosureSlot, string, error) {
+	enclosures, err := s.Enclosures()
+	if err != nil {
+		return nil, nil, "", err
+	}
+	if target.Disk == "" {
+		if target.Enclosure == "" || target.Slot == nil {
+			return nil, nil, "", errors.New("a disk or an enclosure and slot are required")
+		}
+		for i := range enclosures {
+			enc := &enclosures[i]
+			if enc.ID != target.Enclosure && enc.LogicalID != target.Enclosure {
+				continue
+			}
+			for j := range enc.Slots {
+				if enc.Slots[j].Slot == *target.Slot {
+					return enc, &enc.Slots[j], "", nil
+				}
+			}
+		}
+		return nil, nil, "", ErrNotFound
+	}
+
+	name := filepath.Base(target.Disk)
+	if disk, err := s.GetDisk(target.Disk); err == nil {
+		name = disk.Name
+	} else if err := validDevice(target.Disk); err != nil {
+		return nil, nil, "", err
+	}
+	for i := range enclosures {
+		enc := &enclosures[i]
+		for j := range enc.Slots {
+			if enc.Slots[j].Disk == name {
+				return enc, &enc.Slots[j], "", nil
+			}
+		}
+	}
+	return nil, nil, "/dev/" + name, nil
+}
+
+// setLED switches a bay LED through sysfs, falling back to sg_ses when the
+// attribute is missing or read-only and the bay number is known. Disks
+// outside an enclosure go through ledctl.
+func (s *StorageService) setLED(enc *Enclosure, slot *EnclosureSlot, dev, led string, on bool) error {
+	attr, ok := ledAttrs[led]
+	if !ok {
+		return fmt.Errorf("invalid LED: %q", led)
+	}
+	if slot == nil {
+		pattern := map[string][2]string{"ident": {"locate_off", "locate"}, "fault": {"normal", "failure"}}[led]
+		arg := pattern[0]
+		if on {
+			arg = pattern[1]
+		}
+		if _, err := s.run("ledctl", arg+"="+dev); err != nil {
+			return fmt.Errorf("%s is not in a SES enclosure and ledctl failed: %v", dev, err)
+		}
+		return nil
+	}
+
+	value := "0"
+	if on {
+		value = "1"
+	}
+	path := filepath.Join(enclosureRoot, enc.ID, slot.Component, attr)
+	if err := os.WriteFile(path, []byte(value), 0644); err == nil {
+		return nil
+	} else if enc.Device == "" || !slot.numbered {
+		// sg_ses addresses bays by number; guessing one could light
+		// the wrong bay.
+		return fmt.Errorf("failed to set %s LED: %v", led, err)
+	}
+	op := "--clear="
+	if on {
+		op = "--set="
+	}
+	if _, err := s.run("sg_ses", "--dev-slot-num="+strconv.Itoa(slot.Slot), op+led, enc.Device); err != nil {
+		return fmt.Errorf("failed to set %s LED: %v", led, err)
+	}
+	return nil
+}
+
+// DefaultIdentDuration is how long a drive identify LED stays lit when the
+// caller does not say.
+const DefaultIdentDuration = 5 * time.Minute
+
+type ledTimer struct {
+	timer *time.Timer
+	offAt time.Time
+	off   func() error
+}
+
+// LEDService switches enclosure LEDs and turns timed ones off again.
+type LEDService struct {
+	storage *StorageService
+
+	mu     sync.Mutex
+	timers map[string]*ledTimer
+}
+
+func NewLEDService(storage *StorageService) *LEDService {
+	return &LEDService{storage: storage, timers: map[string]*ledTimer{}}
+}
+
+// SetLED switches a LED on or off. A lit LED with a positive duration is
+// switched off again once it expires.
+func (l *LEDService) SetLED(target LEDTarget, led string, on bool, duration time.Duration) error {
+	if _, ok := ledAttrs[led]; !ok {
+		return fmt.Errorf("invalid LED: %q", led)
+	}
+	if duration < 0 {
+		return errors.New("duration must not be negative")
+	}
+	enc, slot, dev, err := l.storage.findSlot(target)
+	if err != nil {
+		return err
+	}
+	key := dev + "/" + led
+	if slot != nil {
+		key = enc.ID + "/" + slot.Component + "/" + led
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if t, ok := l.timers[key]; ok {
+		t.timer.Stop()
+		delete(l.timers, key)
+	}
+	if err := l.storage.setLED(enc, slot, dev, led, on); err != nil {
+		return err
+	}
+	if on && duration > 0 {
+		t := &ledTimer{offAt: time.Now().Add(duration)}
+		t.off = func() error { return l.storage.setLED(enc, slot, dev, led, false) }
+		t.timer = time.AfterFunc(duration, func() {
+			l.mu.Lock()
+			if l.timers[key] != t {
+				l.mu.Unlock()
+				return
+			}
+			delete(l.timers, key)
+			l.mu.Unlock()
+			if err := t.off(); err != nil {
+				log.Printf("Error switching off %s LED: %v", key, err)
+			}
+		})
+		l.timers[key] = t
+	}
+	return nil
+}
+
+// Enclosures lists enclosures with the expiry of timed LEDs filled in.
+func (l *LEDService) Enclosures() ([]Enclosure, error) {
+	enclosures, err := l.storage.Enclosures()
+	if err != nil {
+		return nil, err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i := range enclosures {
+		for j := range enclosures[i].Slots {
+			slot := &enclosures[i].Slots[j]
+			prefix := slot.Enclosure + "/" + slot.Component + "/"
+			if t, ok := l.timers[prefix+"ident"]; ok {
+				offAt := t.offAt
+				slot.IdentOffAt = &offAt
+			}
+			if t, ok := l.timers[prefix+"fault"]; ok {
+				offAt := t.offAt
+				slot.FaultOffAt = &offAt
+			}
+		}
+	}
+	return enclosures, nil
+}
+
+// Stop switches off every LED that is still waiting for its timer, so none
+// stays lit after shutdown.
+func (l *LEDService) Stop() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for key, t := range l.timers {
+		t.timer.Stop()
+		if err := t.off(); err != nil {
+			log.Printf("Error switching off %s LED: %v", key, err)
+		}
+		delete(l.timers, key)
+	}
+}
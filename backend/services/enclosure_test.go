@@ -0,0 +1,64 @@
+package services
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// enclosureTree builds a sysfs enclosure with the given bay components.
+// Their LED attributes are directories, so writing them fails as a
+// read-only attribute would.
+func enclosureTree(t *testing.T, components ...string) {
+	t.Helper()
+	root := t.TempDir()
+	old := enclosureRoot
+	enclosureRoot = root
+	t.Cleanup(func() { enclosureRoot = old })
+	enc := filepath.Join(root, "0:0:32:0")
+	mustWrite := func(path, data string) {
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range components {
+		dir := filepath.Join(enc, name)
+		for _, sub := range []string{"device/block", "locate", "fault"} {
+			if err := os.MkdirAll(filepath.Join(dir, sub), 0755); err != nil {
+				t.Fatal(err)
+			}
+		}
+		mustWrite(filepath.Join(dir, "type"), "array device\n")
+	}
+	if err := os.MkdirAll(filepath.Join(enc, "device", "scsi_generic", "sg5"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	mustWrite(filepath.Join(enc, "id"), "0x500304801f2a3b7f\n")
+}
+
+func TestSetLEDFallsBackToSgSesOnlyForNumberedBays(t *testing.T) {
+	enclosureTree(t, "Slot 07", "Disk")
+	s, fake := fixtureStorage(t)
+	fake.Add("sg_ses --dev-slot-num=7 --set=ident /dev/sg5", FakeResponse{})
+	l := NewLEDService(s)
+
+	seven := 7
+	if err := l.SetLED(LEDTarget{Enclosure: "0:0:32:0", Slot: &seven}, "ident", true, 0); err != nil {
+		t.Fatal(err)
+	}
+	// The unnumbered bay is listed at position 0.
+	zero := 0
+	if err := l.SetLED(LEDTarget{Enclosure: "0:0:32:0", Slot: &zero}, "ident", true, 0); err == nil {
+		t.Error("no error for a bay without a number")
+	}
+	var sgSes []string
+	for _, call := range fake.Calls() {
+		if strings.HasPrefix(call, "sg_ses") {
+			sgSes = append(sgSes, call)
+		}
+	}
+	if len(sgSes) != 1 || sgSes[0] != "sg_ses --dev-slot-num=7 --set=ident /dev/sg5" {
+		t.Errorf("got sg_ses calls %q", sgSes)
+	}
+}
@@ -0,0 +1,504 @@
+package services
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// EncryptionCipher is used for every encrypted dataset created by the API.
+const EncryptionCipher = "aes-256-gcm"
+
+// EncryptionOptions selects how an encrypted dataset is keyed. A keyfile
+// is a random 256-bit raw key generated into the key store.
+type EncryptionOptions struct {
+	KeyFormat  string `json:"keyFormat"` // passphrase or keyfile
+	Passphrase string `json:"passphrase,omitempty"`
+	AutoUnlock bool   `json:"autoUnlock"`
+}
+
+// EncryptionStatus is the encryption and key state of a dataset. A locked
+// dataset has its key unloaded and cannot be mounted.
+type EncryptionStatus struct {
+	Dataset        string `json:"dataset"`
+	Encryption     string `json:"encryption"`
+	EncryptionRoot string `json:"encryptionRoot,omitempty"`
+	KeyFormat      string `json:"keyFormat,omitempty"`
+	KeyLocation    string `json:"keyLocation,omitempty"`
+	KeyStatus      string `json:"keyStatus,omitempty"`
+	Locked         bool   `json:"locked"`
+	Mounted        bool   `json:"mounted"`
+	AutoUnlock     bool   `json:"autoUnlock"`
+}
+
+// storedKey is an encryption root whose key material is in the key store.
+// Keyfiles are always kept; passphrases only when auto-unlock is enabled.
+type storedKey struct {
+	Dataset    string `json:"dataset"`
+	KeyFormat  string `json:"keyFormat"`
+	File       string `json:"file,omitempty"`
+	AutoUnlock bool   `json:"autoUnlock"`
+}
+
+// EncryptionService manages keys of encrypted datasets. Key material lives
+// in DataDir()/keys, readable by root only; keyfiles exist nowhere else, so
+// that directory must be part of any backup.
+type EncryptionService struct {
+	storage *StorageService
+	path    string
+	keyDir  string
+
+	mu   sync.Mutex
+	keys []*storedKey
+}
+
+func NewEncryptionService(storage *StorageService) *EncryptionService {
+	s := &EncryptionService{
+		storage: storage,
+		path:    filepath.Join(DataDir(), "encryption.json"),
+		keyDir:  filepath.Join(DataDir(), "keys"),
+		keys:    []*storedKey{},
+	}
+	var state struct {
+		Keys []*storedKey `json:"keys"`
+	}
+	if err := loadJSON(s.path, &state); err != nil {
+		log.Printf("Error loading encryption state: %v", err)
+	}
+	if state.Keys != nil {
+		s.keys = state.Keys
+	}
+	return s
+}
+
+// save must be called with s.mu held.
+func (s *EncryptionService) save() error {
+	return saveJSON(s.path, map[string]interface{}{"keys": s.keys})
+}
+
+// find must be called with s.mu held.
+func (s *EncryptionService) find(dataset string) *storedKey {
+	for _, k := range s.keys {
+		if k.Dataset == dataset {
+			return k
+		}
+	}
+	return nil
+}
+
+// put replaces the stored key of a dataset, removing the old key file. Must
+// be called with s.mu held.
+func (s *EncryptionService) put(key *storedKey) error {
+	for i, k := range s.keys {
+		if k.Dataset == key.Dataset {
+			if k.File != "" && k.File != key.File {
+				os.Remove(k.File)
+			}
+			s.keys = append(s.keys[:i], s.keys[i+1:]...)
+			break
+		}
+	}
+	s.keys = append(s.keys, key)
+	return s.save()
+}
+
+func validPassphrase(passphrase string) error {
+	if len(passphrase) < 8 || len(passphrase) > 512 {
+		return errors.New("passphrase must be between 8 and 512 characters")
+	}
+	return nil
+}
+
+// writeKey stores key material in a new file of the key store.
+func (s *EncryptionService) writeKey(data []byte, ext string) (string, error) {
+	if err := os.MkdirAll(s.keyDir, 0700); err != nil {
+		return "", fmt.Errorf("failed to create key store: %v", err)
+	}
+	path := filepath.Join(s.keyDir, newID()+ext)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", fmt.Errorf("failed to write key: %v", err)
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(path)
+		return "", fmt.Errorf("failed to write key: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(path)
+		return "", fmt.Errorf("failed to write key: %v", err)
+	}
+	return path, nil
+}
+
+func (s *EncryptionService) generateKeyFile() (string, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	return s.writeKey(key, ".key")
+}
+
+// keyArgs returns the zfs options and stdin for new key material, and the
+// key store entry to record once zfs accepted it.
+func (s *EncryptionService) keyArgs(dataset string, opts EncryptionOptions) ([]string, string, *storedKey, error) {
+	key := &storedKey{Dataset: dataset, KeyFormat: opts.KeyFormat, AutoUnlock: opts.AutoUnlock}
+	switch opts.KeyFormat {
+	case "passphrase":
+		if err := validPassphrase(opts.Passphrase); err != nil {
+			return nil, "", nil, err
+		}
+		if opts.AutoUnlock {
+			file, err := s.writeKey([]byte(opts.Passphrase), ".passphrase")
+			if err != nil {
+				return nil, "", nil, err
+			}
+			key.File = file
+		}
+		return []string{"-o", "keyformat=passphrase", "-o", "keylocation=prompt"}, opts.Passphrase, key, nil
+	case "keyfile":
+		file, err := s.generateKeyFile()
+		if err != nil {
+			return nil, "", nil, err
+		}
+		key.File = file
+		return []string{"-o", "keyformat=raw", "-o", "keylocation=file://" + file}, "", key, nil
+	default:
+		return nil, "", nil, fmt.Errorf("invalid key format: %q", opts.KeyFormat)
+	}
+}
+
+// CreateEncryptedDataset creates a dataset encrypted with aes-256-gcm. It
+// becomes its own encryption root and starts out unlocked and mounted.
+func (s *EncryptionService) CreateEncryptedDataset(name string, props map[string]string, opts EncryptionOptions) error {
+	if err := validDatasetName(name); err != nil {
+		return err
+	}
+	if !strings.Contains(name, "/") {
+		return errors.New("dataset name must include the pool, e.g. tank/share")
+	}
+	propArgs, err := propertyArgs(props)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keyOpts, input, key, err := s.keyArgs(name, opts)
+	if err != nil {
+		return err
+	}
+	args := append([]string{"create", "-p", "-o", "encryption=" + EncryptionCipher}, keyOpts...)
+	args = append(args, propArgs...)
+	args = append(args, name)
+	if _, err := s.storage.runInput(input, "zfs", args...); err != nil {
+		if key.File != "" {
+			os.Remove(key.File)
+		}
+		return fmt.Errorf("failed to create encrypted dataset: %v", err)
+	}
+	if key.File == "" {
+		return nil
+	}
+	if err := s.put(key); err != nil {
+		return fmt.Errorf("dataset created but its key could not be recorded: %v", err)
+	}
+	return nil
+}
+
+// ListStatus returns the encryption status of every filesystem, optionally
+// limited to a parent dataset.
+func (s *EncryptionService) ListStatus(parent string) ([]EncryptionStatus, error) {
+	args := []string{"list", "-H", "-t", "filesystem", "-o", "name,encryption,encryptionroot,keyformat,keylocation,keystatus,mounted"}
+	if parent != "" {
+		if err := validDatasetName(parent); err != nil {
+			return nil, err
+		}
+		args = append(args, "-r", parent)
+	}
+	output, err := s.storage.run("zfs", args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get encryption status: %v", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	statuses := []EncryptionStatus{}
+	for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		fields := strings.Split(line, "\t")
+		if len(fields) < 7 {
+			continue
+		}
+		for i, f := range fields {
+			if f == "-" {
+				fields[i] = ""
+			}
+		}
+		status := EncryptionStatus{
+			Dataset:        fields[0],
+			Encryption:     fields[1],
+			EncryptionRoot: fields[2],
+			KeyFormat:      fields[3],
+			KeyLocation:    fields[4],
+			KeyStatus:      fields[5],
+			Locked:         fields[5] == "unavailable",
+			Mounted:        fields[6] == "yes",
+		}
+		if status.KeyFormat == "none" {
+			status.KeyFormat = ""
+		}
+		if status.KeyLocation == "none" {
+			status.KeyLocation = ""
+		}
+		if key := s.find(status.EncryptionRoot); key != nil {
+			status.AutoUnlock = key.AutoUnlock
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+// Status returns the encryption status of a single dataset.
+func (s *EncryptionService) Status(dataset string) (*EncryptionStatus, error) {
+	if err := validDatasetName(dataset); err != nil {
+		return nil, err
+	}
+	statuses, err := s.ListStatus(dataset)
+	if err != nil {
+		return nil, err
+	}
+	for _, status := range statuses {
+		if status.Dataset == dataset {
+			return &status, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// encryptionRoot returns the status of dataset after checking that it is
+// an encryption root, the only place keys can be loaded or changed.
+func (s *EncryptionService) encryptionRoot(dataset string) (*EncryptionStatus, error) {
+	status, err := s.Status(dataset)
+	if err != nil {
+		return nil, err
+	}
+	if status.Encryption == "" || status.Encryption == "off" {
+		return nil, fmt.Errorf("%s is not encrypted", dataset)
+	}
+	if status.EncryptionRoot != dataset {
+		return nil, fmt.Errorf("the key of %s is managed by its encryption root %s", dataset, status.EncryptionRoot)
+	}
+	return status, nil
+}
+
+// LoadKey loads the key of an encryption root, from passphrase if given or
+// else from the key store, and optionally mounts its filesystems.
+func (s *EncryptionService) LoadKey(dataset, passphrase string, mount bool) error {
+	status, err := s.encryptionRoot(dataset)
+	if err != nil {
+		return err
+	}
+	if status.Locked {
+		s.mu.Lock()
+		key := s.find(dataset)
+		s.mu.Unlock()
+
+		switch {
+		case passphrase != "":
+			if status.KeyFormat != "passphrase" {
+				return fmt.Errorf("%s is not keyed by a passphrase", dataset)
+			}
+			_, err = s.storage.runInput(passphrase, "zfs", "load-key", "-L", "prompt", dataset)
+		case key != nil && key.File != "":
+			_, err = s.storage.run("zfs", "load-key", "-L", "file://"+key.File, dataset)
+		case strings.HasPrefix(status.KeyLocation, "file://"):
+			_, err = s.storage.run("zfs", "load-key", dataset)
+		default:
+			return errors.New("a passphrase is required to unlock this dataset")
+		}
+		if err != nil {
+			return fmt.Errorf("failed to load key: %v", err)
+		}
+	}
+	if mount {
+		return s.mountAll(dataset)
+	}
+	return nil
+}
+
+// mountAll mounts dataset and the filesystems below it that mount
+// automatically, parents first.
+func (s *EncryptionService) mountAll(dataset string) error {
+	output, err := s.storage.run("zfs", "list", "-H", "-r", "-t", "filesystem", "-o", "name,canmount,mounted", dataset)
+	if err != nil {
+		return fmt.Errorf("failed to list filesystems: %v", err)
+	}
+	for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		fields := strings.Split(line, "\t")
+		if len(fields) < 3 || fields[1] != "on" || fields[2] == "yes" {
+			continue
+		}
+		if _, err := s.storage.run("zfs", "mount", fields[0]); err != nil {
+			return fmt.Errorf("failed to mount %s: %v", fields[0], err)
+		}
+	}
+	return nil
+}
+
+// UnloadKey unmounts an encryption root and everything below it, then
+// unloads its key. Busy filesystems are not forced.
+func (s *EncryptionService) UnloadKey(dataset string) error {
+	status, err := s.encryptionRoot(dataset)
+	if err != nil {
+		return err
+	}
+	if status.Locked {
+		return nil
+	}
+	if _, err := s.storage.run("zfs", "unmount", dataset); err != nil && status.Mounted {
+		return fmt.Errorf("failed to unmount dataset: %v", err)
+	}
+	if _, err := s.storage.run("zfs", "unload-key", dataset); err != nil {
+		return fmt.Errorf("failed to unload key: %v", err)
+	}
+	return nil
+}
+
+// ChangeKey replaces the wrapping key of an unlocked encryption root. The
+// data itself is not re-encrypted.
+func (s *EncryptionService) ChangeKey(dataset string, opts EncryptionOptions) error {
+	status, err := s.encryptionRoot(dataset)
+	if err != nil {
+		return err
+	}
+	if status.Locked {
+		return errors.New("dataset must be unlocked to change its key")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keyOpts, input, key, err := s.keyArgs(dataset, opts)
+	if err != nil {
+		return err
+	}
+	args := append([]string{"change-key"}, keyOpts...)
+	args = append(args, dataset)
+	if _, err := s.storage.runInput(input, "zfs", args...); err != nil {
+		if key.File != "" {
+			os.Remove(key.File)
+		}
+		return fmt.Errorf("failed to change key: %v", err)
+	}
+	if key.File == "" {
+		s.forget(dataset, false)
+		return s.save()
+	}
+	if err := s.put(key); err != nil {
+		return fmt.Errorf("key changed but could not be recorded: %v", err)
+	}
+	return nil
+}
+
+// SetAutoUnlock controls whether an encryption root is unlocked and
+// mounted when the daemon starts. Passphrase-keyed datasets need the
+// passphrase to be stored for that.
+func (s *EncryptionService) SetAutoUnlock(dataset string, enabled bool, passphrase string) error {
+	status, err := s.encryptionRoot(dataset)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := s.find(dataset)
+	if status.KeyFormat != "passphrase" {
+		if key == nil {
+			return errors.New("the key of this dataset is not in the key store")
+		}
+		key.AutoUnlock = enabled
+		return s.save()
+	}
+	if !enabled {
+		s.forget(dataset, false)
+		return s.save()
+	}
+	if err := validPassphrase(passphrase); err != nil {
+		return err
+	}
+	// zfs load-key -n refuses a key that is already loaded, and a
+	// passphrase stored unchecked would only fail at the next boot.
+	if !status.Locked {
+		return errors.New("the passphrase can only be checked while the dataset is locked; lock it and enable auto-unlock again")
+	}
+	file, err := s.writeKey([]byte(passphrase), ".passphrase")
+	if err != nil {
+		return err
+	}
+	// Check the passphrase without loading the key.
+	if _, err := s.storage.run("zfs", "load-key", "-n", "-L", "file://"+file, dataset); err != nil {
+		os.Remove(file)
+		return fmt.Errorf("passphrase rejected: %v", err)
+	}
+	return s.put(&storedKey{Dataset: dataset, KeyFormat: "passphrase", File: file, AutoUnlock: true})
+}
+
+// forget drops the stored keys of dataset, and of its descendants if
+// recursive. Must be called with s.mu held.
+func (s *EncryptionService) forget(dataset string, recursive bool) {
+	kept := s.keys[:0]
+	for _, k := range s.keys {
+		if k.Dataset == dataset || (recursive && DatasetWithin(k.Dataset, dataset)) {
+			if k.File != "" {
+				os.Remove(k.File)
+			}
+			continue
+		}
+		kept = append(kept, k)
+	}
+	s.keys = kept
+}
+
+// Forget removes the stored keys of a destroyed dataset and its children.
+func (s *EncryptionService) Forget(dataset string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.forget(dataset, true)
+	return s.save()
+}
+
+// Rename moves stored keys along with a renamed dataset.
+func (s *EncryptionService) Rename(dataset, newName string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, k := range s.keys {
+		if DatasetWithin(k.Dataset, dataset) {
+			k.Dataset = newName + strings.TrimPrefix(k.Dataset, dataset)
+		}
+	}
+	return s.save()
+}
+
+// UnlockAtBoot loads the keys of auto-unlock datasets and mounts them.
+func (s *EncryptionService) UnlockAtBoot() {
+	s.mu.Lock()
+	var datasets []string
+	for _, k := range s.keys {
+		if k.AutoUnlock {
+			datasets = append(datasets, k.Dataset)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, dataset := range datasets {
+		if err := s.LoadKey(dataset, "", true); err != nil {
+			log.Printf("Failed to unlock %s: %v", dataset, err)
+			continue
+		}
+		log.Printf("Unlocked encrypted dataset %s", dataset)
+	}
+}
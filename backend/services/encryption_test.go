@@ -0,0 +1,40 @@
+package services
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestSetAutoUnlockChecksPassphrase(t *testing.T) {
+	t.Setenv("A1NAS_DATA_DIR", t.TempDir())
+	fake := NewFakeRunner()
+	e := NewEncryptionService(NewStorageServiceWithRunner(t.TempDir(), fake))
+	list := "zfs list -H -t filesystem -o name,encryption,encryptionroot,keyformat,keylocation,keystatus,mounted -r tank/secret"
+
+	// zfs load-key -n cannot check the passphrase of an unlocked dataset.
+	fake.Add(list, FakeResponse{Stdout: "tank/secret\taes-256-gcm\ttank/secret\tpassphrase\tprompt\tavailable\tyes\n"})
+	if err := e.SetAutoUnlock("tank/secret", true, "correct horse"); err == nil || !strings.Contains(err.Error(), "while the dataset is locked") {
+		t.Errorf("got %v enabling auto-unlock on an unlocked dataset", err)
+	}
+
+	// Locked: a passphrase zfs rejects is not stored.
+	fake.Add(list, FakeResponse{Stdout: "tank/secret\taes-256-gcm\ttank/secret\tpassphrase\tprompt\tunavailable\tno\n"})
+	if err := e.SetAutoUnlock("tank/secret", true, "wrong horse"); err == nil || !strings.Contains(err.Error(), "passphrase rejected") {
+		t.Errorf("got %v for a rejected passphrase", err)
+	}
+	var checked bool
+	for _, call := range fake.Calls() {
+		checked = checked || strings.HasPrefix(call, "zfs load-key -n -L file://")
+	}
+	if !checked {
+		t.Error("the passphrase was not checked with zfs load-key -n")
+	}
+
+	if key := e.find("tank/secret"); key != nil {
+		t.Errorf("stored %+v", key)
+	}
+	if files, _ := os.ReadDir(e.keyDir); len(files) != 0 {
+		t.Errorf("left %d files in the key store", len(files))
+	}
+}
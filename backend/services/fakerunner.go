@@ -0,0 +1,152 @@
+package services
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// FakeResponse is the recorded result of one command line.
+type FakeResponse struct {
+	Stdout   string
+	Stderr   string
+	ExitCode int
+}
+
+// FakeRunner replays recorded command output instead of running tools, so
+// the storage API can be exercised on machines without ZFS or disks.
+// Commands are matched on their exact command line; unknown commands fail
+// like a missing binary would.
+type FakeRunner struct {
+	mu        sync.Mutex
+	responses map[string]FakeResponse
+	calls     []string
+}
+
+func NewFakeRunner() *FakeRunner {
+	return &FakeRunner{responses: map[string]FakeResponse{}}
+}
+
+// LoadFakeRunner loads every *.txt fixture in dir. A fixture starts with
+// "# key: value" header lines followed by the recorded stdout:
+//
+//	# command: zpool status -v tank
+//	# exit: 0
+//	# stderr:
+//	  pool: tank
+//	  ...
+func LoadFakeRunner(dir string) (*FakeRunner, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.txt"))
+	if err != nil {
+		return nil, err
+	}
+	f := NewFakeRunner()
+	for _, file := range files {
+		command, resp, err := parseFixture(file)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", filepath.Base(file), err)
+		}
+		f.Add(command, resp)
+	}
+	return f, nil
+}
+
+func parseFixture(path string) (string, FakeResponse, error) {
+	var resp FakeResponse
+	file, err := os.Open(path)
+	if err != nil {
+		return "", resp, err
+	}
+	defer file.Close()
+
+	command := ""
+	var stdout []string
+	inHeader := true
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16<<20)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if inHeader && strings.HasPrefix(line, "# ") {
+			kv := strings.SplitN(line[2:], ":", 2)
+			if len(kv) == 2 {
+				value := strings.TrimSpace(kv[1])
+				switch strings.TrimSpace(kv[0]) {
+				case "command":
+					command = value
+				case "exit":
+					resp.ExitCode, _ = strconv.Atoi(value)
+				case "stderr":
+					resp.Stderr = value
+				}
+				continue
+			}
+		}
+		inHeader = false
+		stdout = append(stdout, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return "", resp, err
+	}
+	if command == "" {
+		return "", resp, errors.New("missing # command: header")
+	}
+	if len(stdout) > 0 {
+		resp.Stdout = strings.Join(stdout, "\n") + "\n"
+	}
+	return command, resp, nil
+}
+
+// Add registers the response for a command line such as "zpool list -H -o name".
+func (f *FakeRunner) Add(command string, resp FakeResponse) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.responses[strings.Join(strings.Fields(command), " ")] = resp
+}
+
+// Calls returns the command lines run so far, in order.
+func (f *FakeRunner) Calls() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.calls...)
+}
+
+func (f *FakeRunner) Run(ctx context.Context, name string, args ...string) ([]byte, error) {
+	var stdout strings.Builder
+	err := f.Stream(ctx, nil, &stdout, name, args...)
+	return []byte(stdout.String()), err
+}
+
+func (f *FakeRunner) Stream(ctx context.Context, stdin io.Reader, stdout io.Writer, name string, args ...string) error {
+	command := strings.Join(append([]string{name}, args...), " ")
+	f.mu.Lock()
+	f.calls = append(f.calls, command)
+	resp, ok := f.responses[command]
+	f.mu.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return &CommandError{Name: name, Args: args, ExitCode: -1, Err: err}
+	}
+	if !ok {
+		return &CommandError{Name: name, Args: args, ExitCode: 127, Stderr: "no fixture for: " + command, Err: errors.New("exit status 127")}
+	}
+	if stdin != nil {
+		io.Copy(io.Discard, stdin)
+	}
+	if stdout != nil {
+		io.WriteString(stdout, resp.Stdout)
+	}
+	if w := stderrWatcher(ctx); w != nil {
+		io.WriteString(w, resp.Stderr)
+	}
+	if resp.ExitCode != 0 {
+		return &CommandError{Name: name, Args: args, ExitCode: resp.ExitCode, Stderr: resp.Stderr, Err: fmt.Errorf("exit status %d", resp.ExitCode)}
+	}
+	return nil
+}
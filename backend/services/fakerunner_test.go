@@ -0,0 +1,174 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// fixtureStorage returns a StorageService on a temporary base path whose
+// commands are answered from testdata/commands.
+func fixtureStorage(t *testing.T) (*StorageService, *FakeRunner) {
+	t.Helper()
+	fake, err := LoadFakeRunner("testdata/commands")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewStorageServiceWithRunner(t.TempDir(), fake), fake
+}
+
+func TestFakeRunnerUnknownCommand(t *testing.T) {
+	_, fake := fixtureStorage(t)
+	_, err := fake.Run(context.Background(), "zpool", "destroy", "tank")
+	var cmdErr *CommandError
+	if !errors.As(err, &cmdErr) || cmdErr.ExitCode != 127 {
+		t.Fatalf("got %v, want exit status 127", err)
+	}
+	if calls := fake.Calls(); len(calls) != 1 || calls[0] != "zpool destroy tank" {
+		t.Errorf("got calls %q", calls)
+	}
+}
+
+func TestFixturePools(t *testing.T) {
+	s, fake := fixtureStorage(t)
+	pools, err := s.ListPools()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(pools, ",") != "tank,media,vault,archive" {
+		t.Fatalf("got pools %q", pools)
+	}
+	states := map[string]string{"tank": "DEGRADED", "media": "ONLINE", "vault": "ONLINE", "archive": "ONLINE"}
+	for _, pool := range pools {
+		status, err := s.GetPoolStatus(pool)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status.State != states[pool] {
+			t.Errorf("%s: got state %q, want %q", pool, status.State, states[pool])
+		}
+	}
+	if _, err := s.GetPoolStatus("missing"); err == nil || !strings.Contains(err.Error(), "no such pool") {
+		t.Errorf("got %v for a missing pool", err)
+	}
+
+	importable, err := s.FindImportablePools("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(importable) != 1 {
+		t.Errorf("got %d importable pools, want 1", len(importable))
+	}
+
+	if err := s.StartScrub("media"); err == nil || !strings.Contains(err.Error(), "currently scrubbing") {
+		t.Errorf("got %v starting a scrub on a scrubbing pool", err)
+	}
+	if err := s.StartScrub("vault"); err != nil {
+		t.Error(err)
+	}
+	if calls := fake.Calls(); calls[len(calls)-1] != "zpool scrub vault" {
+		t.Errorf("got last call %q", calls[len(calls)-1])
+	}
+}
+
+func TestFixtureDatasets(t *testing.T) {
+	s, fake := fixtureStorage(t)
+	datasets, err := s.ListDatasets("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(datasets) != 6 {
+		t.Fatalf("got %d datasets, want 6", len(datasets))
+	}
+	home := datasets[1]
+	if home.Name != "tank/home" || home.Pool != "tank" || home.Used != 1<<40 || home.Available != 2<<40 || home.Mountpoint != "/tank/home" {
+		t.Errorf("got %+v", home)
+	}
+
+	snapshots, err := s.ListSnapshots("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshots) != 3 {
+		t.Errorf("got %d snapshots, want 3", len(snapshots))
+	}
+
+	fake.Add("zfs create -p -o compression=lz4 -o recordsize=1M tank/media", FakeResponse{})
+	if err := s.CreateDataset("tank/media", map[string]string{"recordsize": "1M", "compression": "lz4"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CreateDataset("tank", nil); err == nil {
+		t.Error("created a dataset without a pool")
+	}
+	if err := s.CreateDataset("tank/bad", map[string]string{"mountpoint": "/etc"}); err == nil {
+		t.Error("accepted a property outside the allowed list")
+	}
+}
+
+func TestFixtureSmart(t *testing.T) {
+	s, _ := fixtureStorage(t)
+	tests := []struct {
+		dev      string
+		protocol string
+		serial   string
+		health   string
+	}{
+		{"sda", "ATA", "WD-WCC7K1234567", "Healthy"},
+		{"/dev/sdb", "ATA", "ZDH1ABCD", "Warning"},
+		{"nvme0n1", "NVMe", "S4EVNX0N123456A", "Healthy"},
+		{"sdu", "SCSI", "2EKA1234", "Healthy"},
+	}
+	for _, tt := range tests {
+		data, err := s.GetSmartData(tt.dev)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.dev, err)
+		}
+		if data.Protocol != tt.protocol || data.Serial != tt.serial || data.Health != tt.health {
+			t.Errorf("%s: got %s %s %s", tt.dev, data.Protocol, data.Serial, data.Health)
+		}
+	}
+	if _, err := s.PeekSmartData("sdu"); err != ErrDeviceStandby {
+		t.Errorf("got %v peeking at a drive in standby", err)
+	}
+	if _, err := s.GetSmartData("sdz"); err == nil {
+		t.Error("expected an error for a disk without fixture")
+	}
+}
+
+func TestFixtureDisks(t *testing.T) {
+	s, _ := fixtureStorage(t)
+	disks, err := s.DiskInventory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(disks) != 6 {
+		t.Fatalf("got %d disks, want 6", len(disks))
+	}
+	sda := disks[0]
+	if sda.Name != "sda" || sda.ID != "WD-WCC7K1234567" || sda.Pool != "tank" || sda.Vdev != "mirror-0" || sda.State != "ONLINE" {
+		t.Errorf("got %+v", sda)
+	}
+	if disks[1].State != "UNAVAIL" {
+		t.Errorf("got sdb state %q", disks[1].State)
+	}
+
+	disk, err := s.GetDisk("2EKA1234")
+	if err != nil || disk.Name != "sdu" || disk.Transport != "sas" {
+		t.Errorf("got %+v, %v looking up a serial", disk, err)
+	}
+	if _, err := s.GetDisk("sdz"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("got %v for an unknown disk", err)
+	}
+
+	protected := s.ProtectedDisks()
+	want := map[string]string{"/dev/nvme0n1": "boot disk", "/dev/sdd": "SLOG of pool tank", "/dev/sde": "L2ARC of pool tank"}
+	if len(protected) != len(want) {
+		t.Errorf("got protected disks %v", protected)
+	}
+	for dev, reason := range want {
+		if protected[dev] != reason {
+			t.Errorf("got %q for %s, want %q", protected[dev], dev, reason)
+		}
+	}
+}
@@ -0,0 +1,271 @@
+package services
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// HotplugEvent reports a disk that appeared or disappeared. Pool is set
+// when a removed disk was a member of an imported pool.
+type HotplugEvent struct {
+	Seq  uint64    `json:"seq"`
+	Type string    `json:"type"` // disk-added or disk-removed
+	Time time.Time `json:"time"`
+	Disk Disk      `json:"disk"`
+	Pool string    `json:"pool,omitempty"`
+}
+
+const maxHotplugEvents = 200
+
+// hotplugSettle is how long to wait after a uevent before listing disks
+// again, so udev has created the by-id links and a burst of events (one
+// per partition) causes a single refresh.
+const hotplugSettle = 2 * time.Second
+
+// hotplugPollInterval is the fallback refresh for events the netlink
+// socket missed or when it cannot be opened.
+var hotplugPollInterval = time.Minute
+
+var errUeventTimeout = errors.New("uevent receive timed out")
+
+// ueventSource receives raw kernel uevents. Receive returns
+// errUeventTimeout regularly so the reader can notice Stop.
+type ueventSource interface {
+	Receive(buf []byte) (int, error)
+	Close() error
+}
+
+// HotplugWatcher listens for block device uevents and keeps a current
+// disk listing, emitting an event for every disk added or removed.
+type HotplugWatcher struct {
+	storage *StorageService
+
+	mu          sync.Mutex
+	disks       []Disk
+	listed      bool // disks holds a listing
+	events      []HotplugEvent
+	seq         uint64
+	missing     map[string]HotplugEvent
+	subscribers map[chan HotplugEvent]bool
+	refresh     chan struct{}
+	stop        chan struct{}
+}
+
+func NewHotplugWatcher(storage *StorageService) *HotplugWatcher {
+	return &HotplugWatcher{
+		storage:     storage,
+		disks:       []Disk{},
+		events:      []HotplugEvent{},
+		missing:     map[string]HotplugEvent{},
+		subscribers: map[chan HotplugEvent]bool{},
+		refresh:     make(chan struct{}, 1),
+	}
+}
+
+// Start takes the initial disk listing and watches for changes until Stop
+// is called.
+func (w *HotplugWatcher) Start() {
+	w.stop = make(chan struct{})
+	if disks, err := w.storage.DiskInventory(); err == nil {
+		w.mu.Lock()
+		w.disks, w.listed = disks, true
+		w.mu.Unlock()
+	} else {
+		log.Printf("Error listing disks: %v", err)
+	}
+
+	if source, err := openUevents(); err != nil {
+		log.Printf("Hotplug: cannot listen for uevents, polling instead: %v", err)
+	} else {
+		go w.readUevents(source)
+	}
+
+	go func() {
+		ticker := time.NewTicker(hotplugPollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-w.refresh:
+				select {
+				case <-time.After(hotplugSettle):
+				case <-w.stop:
+					return
+				}
+				// Events that arrived while settling are covered too.
+				select {
+				case <-w.refresh:
+				default:
+				}
+			case <-ticker.C:
+			case <-w.stop:
+				return
+			}
+			w.rescan(time.Now())
+		}
+	}()
+}
+
+func (w *HotplugWatcher) Stop() {
+	if w.stop != nil {
+		close(w.stop)
+	}
+}
+
+func (w *HotplugWatcher) readUevents(source ueventSource) {
+	defer source.Close()
+	buf := make([]byte, 64*1024)
+	for {
+		select {
+		case <-w.stop:
+			return
+		default:
+		}
+		n, err := source.Receive(buf)
+		if errors.Is(err, errUeventTimeout) {
+			continue
+		}
+		if err != nil {
+			log.Printf("Hotplug: reading uevents failed, polling instead: %v", err)
+			return
+		}
+		if event := parseUevent(buf[:n]); event["SUBSYSTEM"] == "block" && event["DEVTYPE"] == "disk" &&
+			(event["ACTION"] == "add" || event["ACTION"] == "remove" || event["ACTION"] == "change") {
+			select {
+			case w.refresh <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// parseUevent decodes a kernel uevent: an "action@devpath" header followed
+// by NUL-separated KEY=value pairs.
+func parseUevent(data []byte) map[string]string {
+	event := map[string]string{}
+	for i, field := range bytes.Split(data, []byte{0}) {
+		if i == 0 {
+			continue
+		}
+		if kv := bytes.SplitN(field, []byte("="), 2); len(kv) == 2 {
+			event[string(kv[0])] = string(kv[1])
+		}
+	}
+	return event
+}
+
+// rescan lists the disks again and emits events for the differences.
+func (w *HotplugWatcher) rescan(now time.Time) {
+	disks, err := w.storage.DiskInventory()
+	if err != nil {
+		log.Printf("Error listing disks: %v", err)
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	current := map[string]bool{}
+	for _, d := range disks {
+		current[d.ID] = true
+	}
+	previous := map[string]bool{}
+	for _, d := range w.disks {
+		previous[d.ID] = true
+		if !current[d.ID] {
+			event := w.emit(HotplugEvent{Type: "disk-removed", Time: now, Disk: d, Pool: d.Pool})
+			if d.Pool != "" {
+				log.Printf("Hotplug: disk %s (%s) of pool %s was removed", d.ID, d.Name, d.Pool)
+				w.missing[d.ID] = event
+			}
+		}
+	}
+	for _, d := range disks {
+		if !previous[d.ID] {
+			w.emit(HotplugEvent{Type: "disk-added", Time: now, Disk: d})
+			delete(w.missing, d.ID)
+		}
+	}
+	w.disks, w.listed = disks, true
+}
+
+// emit must be called with w.mu held.
+func (w *HotplugWatcher) emit(event HotplugEvent) HotplugEvent {
+	w.seq++
+	event.Seq = w.seq
+	w.events = append(w.events, event)
+	if len(w.events) > maxHotplugEvents {
+		w.events = w.events[len(w.events)-maxHotplugEvents:]
+	}
+	for ch := range w.subscribers {
+		// A slow subscriber misses events rather than stalling the watcher.
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+	return event
+}
+
+// Disks returns the listing as of the last change, so the API does not run
+// lsblk and smartctl on every request. Until the watcher has a listing it
+// lists the disks itself.
+func (w *HotplugWatcher) Disks() ([]Disk, error) {
+	w.mu.Lock()
+	if w.listed {
+		defer w.mu.Unlock()
+		return append([]Disk{}, w.disks...), nil
+	}
+	w.mu.Unlock()
+	return w.storage.DiskInventory()
+}
+
+// Events returns the recent events with a sequence number above since.
+func (w *HotplugWatcher) Events(since uint64) []HotplugEvent {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	events := []HotplugEvent{}
+	for _, event := range w.events {
+		if event.Seq > since {
+			events = append(events, event)
+		}
+	}
+	return events
+}
+
+// Missing lists pool members that were removed and have not come back.
+func (w *HotplugWatcher) Missing() []HotplugEvent {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	missing := []HotplugEvent{}
+	for _, event := range w.missing {
+		missing = append(missing, event)
+	}
+	return missing
+}
+
+// Dismiss forgets a missing pool member, e.g. after it was replaced.
+func (w *HotplugWatcher) Dismiss(id string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, ok := w.missing[id]; !ok {
+		return ErrNotFound
+	}
+	delete(w.missing, id)
+	return nil
+}
+
+// Subscribe delivers new events on the returned channel until the cancel
+// function is called.
+func (w *HotplugWatcher) Subscribe() (<-chan HotplugEvent, func()) {
+	ch := make(chan HotplugEvent, 16)
+	w.mu.Lock()
+	w.subscribers[ch] = true
+	w.mu.Unlock()
+	return ch, func() {
+		w.mu.Lock()
+		delete(w.subscribers, ch)
+		w.mu.Unlock()
+	}
+}
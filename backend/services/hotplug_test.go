@@ -0,0 +1,163 @@
+package services
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseUevent(t *testing.T) {
+	data := "add@/devices/pci0000:00/0000:00:17.0/ata3/host2/target2:0:0/2:0:0:0/block/sdc\x00" +
+		"ACTION=add\x00DEVPATH=/devices/pci0000:00/0000:00:17.0/ata3/host2/target2:0:0/2:0:0:0/block/sdc\x00" +
+		"SUBSYSTEM=block\x00MAJOR=8\x00MINOR=32\x00DEVNAME=sdc\x00DEVTYPE=disk\x00DISKSEQ=12\x00SEQNUM=4711\x00" +
+		"NOVALUE\x00EMPTY=\x00"
+	event := parseUevent([]byte(data))
+	want := map[string]string{
+		"ACTION":    "add",
+		"SUBSYSTEM": "block",
+		"DEVNAME":   "sdc",
+		"DEVTYPE":   "disk",
+		"EMPTY":     "",
+	}
+	for key, value := range want {
+		if got, ok := event[key]; !ok || got != value {
+			t.Errorf("%s: got %q, want %q", key, got, value)
+		}
+	}
+	if _, ok := event["NOVALUE"]; ok {
+		t.Error("kept a field without a value")
+	}
+	if _, ok := event["add@/devices/pci0000:00/0000:00:17.0/ata3/host2/target2:0:0/2:0:0:0/block/sdc"]; ok {
+		t.Error("parsed the header as a field")
+	}
+	if len(parseUevent(nil)) != 0 {
+		t.Error("parsed fields from an empty uevent")
+	}
+}
+
+// setInventory answers the inventory lsblk call with the fixture's devices,
+// minus those named in remove, plus the devices in add.
+func setInventory(t *testing.T, fake *FakeRunner, remove []string, add ...string) {
+	t.Helper()
+	cmd, resp, err := parseFixture("testdata/commands/lsblk-inventory.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out struct {
+		Blockdevices []json.RawMessage `json:"blockdevices"`
+	}
+	if err := json.Unmarshal([]byte(resp.Stdout), &out); err != nil {
+		t.Fatal(err)
+	}
+	devices := []json.RawMessage{}
+	for _, d := range out.Blockdevices {
+		var dev struct{ Name string }
+		if err := json.Unmarshal(d, &dev); err != nil {
+			t.Fatal(err)
+		}
+		if !containsString(remove, dev.Name) {
+			devices = append(devices, d)
+		}
+	}
+	for _, d := range add {
+		devices = append(devices, json.RawMessage(d))
+	}
+	out.Blockdevices = devices
+	data, err := json.Marshal(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake.Add(cmd, FakeResponse{Stdout: string(data)})
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func eventSummary(events []HotplugEvent) string {
+	var parts []string
+	for _, e := range events {
+		part := e.Type + " " + e.Disk.ID
+		if e.Pool != "" {
+			part += " of " + e.Pool
+		}
+		parts = append(parts, part)
+	}
+	return strings.Join(parts, ", ")
+}
+
+func TestHotplugRescan(t *testing.T) {
+	s, fake := fixtureStorage(t)
+	w := NewHotplugWatcher(s)
+	start := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	w.rescan(start)
+	initial := len(w.Events(0))
+	disks, err := w.Disks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(disks) != initial {
+		t.Fatalf("%d disks but %d events for the first listing", len(disks), initial)
+	}
+
+	// The pool member sdb is pulled and a new disk is plugged in.
+	setInventory(t, fake, []string{"sdb"},
+		`{"name": "sdc", "path": "/dev/sdc", "serial": "NEWDISK01", "rota": true, "tran": "sata", "size": 8001563222016, "type": "disk"}`)
+	w.rescan(start.Add(time.Minute))
+	events := w.Events(uint64(initial))
+	if got, want := eventSummary(events), "disk-removed ZDH1ABCD of tank, disk-added NEWDISK01"; got != want {
+		t.Fatalf("got events %q, want %q", got, want)
+	}
+	if !events[0].Time.Equal(start.Add(time.Minute)) || events[1].Seq != events[0].Seq+1 {
+		t.Errorf("bad time or sequence: %+v", events)
+	}
+	if got := eventSummary(w.Missing()); got != "disk-removed ZDH1ABCD of tank" {
+		t.Errorf("got missing %q", got)
+	}
+	disks, _ = w.Disks()
+	if len(disks) != initial {
+		t.Errorf("listing has %d disks, want %d", len(disks), initial)
+	}
+
+	// Nothing changed: no events.
+	w.rescan(start.Add(2 * time.Minute))
+	if events := w.Events(uint64(initial) + 2); len(events) != 0 {
+		t.Errorf("got events %q without a change", eventSummary(events))
+	}
+
+	// The pool member comes back.
+	setInventory(t, fake, nil,
+		`{"name": "sdc", "path": "/dev/sdc", "serial": "NEWDISK01", "rota": true, "tran": "sata", "size": 8001563222016, "type": "disk"}`)
+	w.rescan(start.Add(3 * time.Minute))
+	if got := eventSummary(w.Events(uint64(initial) + 2)); got != "disk-added ZDH1ABCD" {
+		t.Errorf("got events %q", got)
+	}
+	if missing := w.Missing(); len(missing) != 0 {
+		t.Errorf("still missing %q", eventSummary(missing))
+	}
+}
+
+func TestHotplugDisksBeforeFirstListing(t *testing.T) {
+	s, fake := fixtureStorage(t)
+	w := NewHotplugWatcher(s)
+	disks, err := w.Disks()
+	if err != nil || len(disks) == 0 {
+		t.Fatalf("got %d disks, %v", len(disks), err)
+	}
+	fake.Add("lsblk -J -b -o NAME,PATH,SERIAL,WWN,MODEL,VENDOR,ROTA,TRAN,SIZE,TYPE,FSTYPE,LABEL,PARTUUID", FakeResponse{ExitCode: 1})
+	if _, err := w.Disks(); err == nil {
+		t.Error("no error when listing fails")
+	}
+	setInventory(t, fake, nil)
+	w.rescan(time.Now())
+	fake.Add("lsblk -J -b -o NAME,PATH,SERIAL,WWN,MODEL,VENDOR,ROTA,TRAN,SIZE,TYPE,FSTYPE,LABEL,PARTUUID", FakeResponse{ExitCode: 1})
+	if again, err := w.Disks(); err != nil || len(again) != len(disks) {
+		t.Errorf("got %d disks, %v from the watcher's listing", len(again), err)
+	}
+}
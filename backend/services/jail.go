@@ -0,0 +1,266 @@
+package services
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// File operations resolve user paths beneath basePath with the helpers
+// below, with the semantics of openat2's RESOLVE_BENEATH: ".." and symlinks
+// may move around inside the base but never out of it, and absolute
+// symlinks are refused. Every step opens relative to the descriptor of the
+// previous one, so renaming directories or swapping in symlinks while an
+// operation runs cannot redirect it outside the base.
+
+var (
+	// ErrPathEscape is returned for paths that resolve outside basePath.
+	ErrPathEscape = errors.New("path escapes the storage root")
+	// ErrInvalidPath is returned for names that cannot be created, e.g. ".."
+	// as the last component or an upload named "a/b".
+	ErrInvalidPath = errors.New("invalid path")
+	// ErrShareRoot is returned when removing or moving basePath itself, a
+	// share (a directory directly beneath basePath) or a mounted dataset.
+	ErrShareRoot = errors.New("share roots cannot be removed or moved")
+)
+
+// maxSymlinks matches the kernel's limit on symlinks followed in one lookup.
+const maxSymlinks = 40
+
+// openat2Disabled makes openBeneath use walkBeneath even where openat2
+// works, so the tests can run every case through both.
+var openat2Disabled = false
+
+// jailError keeps the jail's own errors so the API can tell them apart and
+// adds the operation and user path to anything else.
+func jailError(op, path string, err error) error {
+	if errors.Is(err, ErrPathEscape) || errors.Is(err, ErrInvalidPath) || errors.Is(err, ErrShareRoot) {
+		return err
+	}
+	return &os.PathError{Op: op, Path: "/" + strings.Join(splitPath(path), "/"), Err: err}
+}
+
+// splitPath splits a user path into components. ".." is kept: it is
+// resolved against the directories actually walked, not lexically.
+func splitPath(path string) []string {
+	var parts []string
+	for _, part := range strings.Split(filepath.ToSlash(path), "/") {
+		if part != "" && part != "." {
+			parts = append(parts, part)
+		}
+	}
+	return parts
+}
+
+// openRoot opens basePath, the anchor of every lookup.
+func (s *StorageService) openRoot() (*os.File, error) {
+	fd, err := unix.Open(s.basePath, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: s.basePath, Err: err}
+	}
+	return os.NewFile(uintptr(fd), s.basePath), nil
+}
+
+// openBeneath opens path relative to root, following symlinks only while
+// they stay beneath root.
+func openBeneath(root *os.File, path string, flags int, perm uint32) (*os.File, error) {
+	if flags&unix.O_CREAT == 0 {
+		perm = 0
+	}
+	// User paths are relative to root even with a leading slash.
+	path = strings.Join(splitPath(path), "/")
+	fd, err := -1, errNoOpenat2
+	if !openat2Disabled {
+		fd, err = openat2Beneath(int(root.Fd()), path, flags|unix.O_CLOEXEC, perm)
+	}
+	if errors.Is(err, errNoOpenat2) {
+		fd, err = walkBeneath(int(root.Fd()), path, flags|unix.O_CLOEXEC, perm)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return os.NewFile(uintptr(fd), filepath.Join(root.Name(), path)), nil
+}
+
+// walkBeneath resolves path one component at a time for kernels without
+// openat2. The stack holds a descriptor per directory walked so ".." returns
+// to the directory the walk came from and fails at root.
+func walkBeneath(root int, path string, flags int, perm uint32) (int, error) {
+	dirs := []int{root}
+	defer func() {
+		for _, fd := range dirs[1:] {
+			unix.Close(fd)
+		}
+	}()
+	parts := splitPath(path)
+	links := 0
+	for len(parts) > 0 {
+		part := parts[0]
+		parts = parts[1:]
+		dir := dirs[len(dirs)-1]
+		if part == ".." {
+			if len(dirs) == 1 {
+				return -1, ErrPathEscape
+			}
+			unix.Close(dir)
+			dirs = dirs[:len(dirs)-1]
+			continue
+		}
+
+		var st unix.Stat_t
+		err := unix.Fstatat(dir, part, &st, unix.AT_SYMLINK_NOFOLLOW)
+		if err == nil && st.Mode&unix.S_IFMT == unix.S_IFLNK {
+			if links++; links > maxSymlinks {
+				return -1, unix.ELOOP
+			}
+			target, err := readlinkat(dir, part)
+			if err != nil {
+				return -1, err
+			}
+			if strings.HasPrefix(target, "/") {
+				return -1, ErrPathEscape
+			}
+			parts = append(splitPath(target), parts...)
+			continue
+		}
+		// O_NOFOLLOW makes a symlink swapped in since the Fstatat fail
+		// rather than be followed.
+		if len(parts) == 0 {
+			return unix.Openat(dir, part, flags|unix.O_NOFOLLOW, perm)
+		}
+		if err != nil {
+			return -1, err
+		}
+		fd, err := unix.Openat(dir, part, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+		if err != nil {
+			return -1, err
+		}
+		dirs = append(dirs, fd)
+	}
+	// The path named a directory on the stack, e.g. "", "." or "a/..".
+	return unix.Openat(dirs[len(dirs)-1], ".", flags, perm)
+}
+
+func readlinkat(dir int, name string) (string, error) {
+	for size := 256; ; size *= 2 {
+		buf := make([]byte, size)
+		n, err := unix.Readlinkat(dir, name, buf)
+		if err != nil {
+			return "", err
+		}
+		if n < size {
+			return string(buf[:n]), nil
+		}
+	}
+}
+
+// openParent opens the directory holding path and returns it with the last
+// component, which is not followed if it is a symlink.
+func openParent(root *os.File, path string) (*os.File, string, error) {
+	parts := splitPath(path)
+	if len(parts) == 0 {
+		return nil, "", ErrShareRoot
+	}
+	name := parts[len(parts)-1]
+	if name == ".." {
+		return nil, "", ErrInvalidPath
+	}
+	dir, err := openBeneath(root, strings.Join(parts[:len(parts)-1], "/"), unix.O_RDONLY|unix.O_DIRECTORY, 0)
+	if err != nil {
+		return nil, "", err
+	}
+	return dir, name, nil
+}
+
+// checkNotShareRoot refuses entries directly beneath root and mount points,
+// i.e. the shares and the datasets mounted in them.
+func checkNotShareRoot(root, dir *os.File, name string) error {
+	var rootSt, dirSt, st unix.Stat_t
+	if err := unix.Fstat(int(root.Fd()), &rootSt); err != nil {
+		return err
+	}
+	if err := unix.Fstat(int(dir.Fd()), &dirSt); err != nil {
+		return err
+	}
+	if dirSt.Dev == rootSt.Dev && dirSt.Ino == rootSt.Ino {
+		return ErrShareRoot
+	}
+	if err := unix.Fstatat(int(dir.Fd()), name, &st, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		return err
+	}
+	if st.Dev != dirSt.Dev {
+		return ErrShareRoot
+	}
+	return nil
+}
+
+// removeAllAt removes name in dir and everything below it without following
+// symlinks. It stops at mount points rather than emptying a dataset
+// mounted inside the tree.
+func removeAllAt(dir int, name string) error {
+	err := unix.Unlinkat(dir, name, 0)
+	if err == nil || errors.Is(err, unix.ENOENT) {
+		return nil
+	}
+	if !errors.Is(err, unix.EISDIR) && !errors.Is(err, unix.EPERM) {
+		return err
+	}
+	var dirSt, st unix.Stat_t
+	if err := unix.Fstat(dir, &dirSt); err != nil {
+		return err
+	}
+	if err := unix.Fstatat(dir, name, &st, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		return err
+	}
+	if st.Mode&unix.S_IFMT != unix.S_IFDIR {
+		return unix.EPERM
+	}
+	if st.Dev != dirSt.Dev {
+		return ErrShareRoot
+	}
+	fd, err := unix.Openat(dir, name, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	child := os.NewFile(uintptr(fd), name)
+	defer child.Close()
+	for {
+		names, err := child.Readdirnames(256)
+		for _, n := range names {
+			if err := removeAllAt(fd, n); err != nil {
+				return err
+			}
+		}
+		if err != nil || len(names) == 0 {
+			break
+		}
+		// Entries were removed, so read the directory from the start again.
+		if _, err := child.Seek(0, 0); err != nil {
+			return err
+		}
+	}
+	return unix.Unlinkat(dir, name, unix.AT_REMOVEDIR)
+}
+
+// mkdirAllBeneath creates path and any missing parents beneath root.
+func mkdirAllBeneath(root *os.File, path string, perm uint32) error {
+	parts := splitPath(path)
+	for i, part := range parts {
+		if part == ".." {
+			continue
+		}
+		dir, err := openBeneath(root, strings.Join(parts[:i], "/"), unix.O_RDONLY|unix.O_DIRECTORY, 0)
+		if err != nil {
+			return err
+		}
+		err = unix.Mkdirat(int(dir.Fd()), part, perm)
+		dir.Close()
+		if err != nil && !errors.Is(err, unix.EEXIST) {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+//go:build linux
+
+package services
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+var errNoOpenat2 = errors.New("openat2 is not available")
+
+// openat2Beneath lets the kernel do the lookup where it supports openat2
+// (Linux 5.6). Magic links such as /proc/self/fd/N are refused as well.
+func openat2Beneath(root int, path string, flags int, perm uint32) (int, error) {
+	if path == "" {
+		path = "."
+	}
+	how := unix.OpenHow{
+		Flags:   uint64(flags),
+		Mode:    uint64(perm),
+		Resolve: unix.RESOLVE_BENEATH | unix.RESOLVE_NO_MAGICLINKS,
+	}
+	for {
+		fd, err := unix.Openat2(root, path, &how)
+		switch {
+		case errors.Is(err, unix.EINTR):
+			continue
+		case errors.Is(err, unix.ENOSYS), errors.Is(err, unix.EAGAIN):
+			// EAGAIN means a concurrent rename made the kernel give up.
+			return -1, errNoOpenat2
+		case errors.Is(err, unix.EXDEV):
+			return -1, ErrPathEscape
+		}
+		return fd, err
+	}
+}
+
+func statModTime(st *unix.Stat_t) time.Time {
+	return time.Unix(st.Mtim.Unix())
+}
+
+func statTimes(st *unix.Stat_t) []unix.Timespec {
+	return []unix.Timespec{st.Atim, st.Mtim}
+}
+
+// copyXattrs copies the extended attributes of from to to, including POSIX
+// ACLs (system.posix_acl_*). Attributes the target rejects are skipped.
+func copyXattrs(from, to int) {
+	size, err := unix.Flistxattr(from, nil)
+	if err != nil || size == 0 {
+		return
+	}
+	names := make([]byte, size)
+	if size, err = unix.Flistxattr(from, names); err != nil {
+		return
+	}
+	for _, name := range strings.Split(strings.TrimRight(string(names[:size]), "\x00"), "\x00") {
+		n, err := unix.Fgetxattr(from, name, nil)
+		if err != nil {
+			continue
+		}
+		value := make([]byte, n)
+		if n, err = unix.Fgetxattr(from, name, value); err != nil {
+			continue
+		}
+		unix.Fsetxattr(to, name, value[:n], 0)
+	}
+}
@@ -0,0 +1,27 @@
+//go:build !linux
+
+package services
+
+import (
+	"errors"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+var errNoOpenat2 = errors.New("openat2 is only available on Linux")
+
+func openat2Beneath(root int, path string, flags int, perm uint32) (int, error) {
+	return -1, errNoOpenat2
+}
+
+func statModTime(st *unix.Stat_t) time.Time {
+	return time.Unix(st.Mtim.Unix())
+}
+
+func statTimes(st *unix.Stat_t) []unix.Timespec {
+	return []unix.Timespec{st.Atim, st.Mtim}
+}
+
+// copyXattrs is only implemented on Linux.
+func copyXattrs(from, to int) {}
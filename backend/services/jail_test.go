@@ -0,0 +1,318 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// forEachResolver runs test with openat2 and with the walkBeneath fallback.
+// The openat2 run is skipped where the kernel does not support it.
+func forEachResolver(t *testing.T, test func(t *testing.T)) {
+	t.Run("openat2", func(t *testing.T) {
+		fd, err := openat2Beneath(unix.AT_FDCWD, ".", unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+		if errors.Is(err, errNoOpenat2) {
+			t.Skip("openat2 is not available")
+		}
+		if err == nil {
+			unix.Close(fd)
+		}
+		test(t)
+	})
+	t.Run("walk", func(t *testing.T) {
+		openat2Disabled = true
+		defer func() { openat2Disabled = false }()
+		test(t)
+	})
+}
+
+// jailTree builds a storage root with one share and symlinks that try to
+// leave it, next to a directory outside the root holding a secret.
+func jailTree(t *testing.T) (base, outside string, s *StorageService) {
+	t.Helper()
+	base, outside = t.TempDir(), t.TempDir()
+	mustWrite := func(path, data string) {
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mustLink := func(target, path string) {
+		if err := os.Symlink(target, path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mustWrite(filepath.Join(outside, "secret"), "secret")
+	if err := os.MkdirAll(filepath.Join(base, "share/dir/sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	mustWrite(filepath.Join(base, "share/dir/f"), "hello")
+	mustLink(outside, filepath.Join(base, "share/abs"))
+	mustLink(filepath.Join(outside, "secret"), filepath.Join(base, "share/dir/abslink"))
+	mustLink("../../..", filepath.Join(base, "share/dir/up"))
+	mustLink("../../"+filepath.Base(outside), filepath.Join(base, "share/sibling"))
+	mustLink("../../dir", filepath.Join(base, "share/dir/sub/rel"))
+	mustLink("/proc/self/root", filepath.Join(base, "share/magic"))
+	mustLink("loop", filepath.Join(base, "share/loop"))
+	mustLink("ping", filepath.Join(base, "share/pong"))
+	mustLink("pong", filepath.Join(base, "share/ping"))
+	return base, outside, NewStorageServiceWithRunner(base, nil)
+}
+
+func openTestRoot(t *testing.T, s *StorageService) *os.File {
+	t.Helper()
+	root, err := s.openRoot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { root.Close() })
+	return root
+}
+
+func TestOpenBeneath(t *testing.T) {
+	tests := []struct {
+		path string
+		want error // nil when the open succeeds
+	}{
+		{"share/dir/f", nil},
+		{"/share/dir/f", nil},
+		{"share/dir/../dir/f", nil},
+		{"share/../share/dir/f", nil},
+		{"share/dir/sub/rel/f", nil},
+		{"", nil},
+		{"/", nil},
+		{"..", ErrPathEscape},
+		{"/../etc/passwd", ErrPathEscape},
+		{"share/../../etc/passwd", ErrPathEscape},
+		{"share/dir/sub/../../../..", ErrPathEscape},
+		{"share/abs/secret", ErrPathEscape},
+		{"share/dir/abslink", ErrPathEscape},
+		{"share/dir/up/etc/passwd", ErrPathEscape},
+		{"share/sibling/secret", ErrPathEscape},
+		{"share/magic/etc/passwd", ErrPathEscape},
+		{"share/loop", unix.ELOOP},
+		{"share/ping", unix.ELOOP},
+		{"share/missing", unix.ENOENT},
+	}
+	forEachResolver(t, func(t *testing.T) {
+		_, _, s := jailTree(t)
+		root := openTestRoot(t, s)
+		for _, tt := range tests {
+			f, err := openBeneath(root, tt.path, unix.O_RDONLY, 0)
+			if err == nil {
+				f.Close()
+			}
+			if tt.want == nil && err != nil || tt.want != nil && !errors.Is(err, tt.want) {
+				t.Errorf("%q: got %v, want %v", tt.path, err, tt.want)
+			}
+		}
+	})
+}
+
+func TestOpenBeneathCreate(t *testing.T) {
+	forEachResolver(t, func(t *testing.T) {
+		base, outside, s := jailTree(t)
+		root := openTestRoot(t, s)
+		f, err := openBeneath(root, "share/dir/sub/rel/new", unix.O_WRONLY|unix.O_CREAT|unix.O_EXCL, 0640)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+		if _, err := os.Stat(filepath.Join(base, "share/dir/new")); err != nil {
+			t.Error(err)
+		}
+		if _, err := openBeneath(root, "share/abs/new", unix.O_WRONLY|unix.O_CREAT, 0644); !errors.Is(err, ErrPathEscape) {
+			t.Errorf("got %v creating through an absolute symlink", err)
+		}
+		if _, err := os.Stat(filepath.Join(outside, "new")); !os.IsNotExist(err) {
+			t.Error("created a file outside the root")
+		}
+	})
+}
+
+func TestWalkBeneathStopsAtSymlinkLimit(t *testing.T) {
+	base, _, s := jailTree(t)
+	root := openTestRoot(t, s)
+	// A chain longer than the kernel allows, none of it a loop.
+	if err := os.WriteFile(filepath.Join(base, "share/end"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	prev := "end"
+	for i := 0; i <= maxSymlinks; i++ {
+		name := fmt.Sprintf("link%d", i)
+		if err := os.Symlink(prev, filepath.Join(base, "share", name)); err != nil {
+			t.Fatal(err)
+		}
+		prev = name
+	}
+	if _, err := walkBeneath(int(root.Fd()), "share/"+prev, unix.O_RDONLY, 0); !errors.Is(err, unix.ELOOP) {
+		t.Errorf("got %v following %d symlinks", err, maxSymlinks+1)
+	}
+	fd, err := walkBeneath(int(root.Fd()), "share/link1", unix.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unix.Close(fd)
+}
+
+func TestOpenParent(t *testing.T) {
+	tests := []struct {
+		path string
+		name string
+		want error
+	}{
+		{"share/dir/f", "f", nil},
+		{"/share/dir/missing", "missing", nil},
+		{"share/dir/up", "up", nil},
+		{"", "", ErrShareRoot},
+		{"/", "", ErrShareRoot},
+		{".", "", ErrShareRoot},
+		{"share/dir/..", "", ErrInvalidPath},
+		{"share/dir/up/x", "", ErrPathEscape},
+		{"share/abs/secret", "", ErrPathEscape},
+		{"share/nothing/x", "", unix.ENOENT},
+	}
+	forEachResolver(t, func(t *testing.T) {
+		_, _, s := jailTree(t)
+		root := openTestRoot(t, s)
+		for _, tt := range tests {
+			dir, name, err := openParent(root, tt.path)
+			if err == nil {
+				dir.Close()
+			}
+			if tt.want == nil && err != nil || tt.want != nil && !errors.Is(err, tt.want) || name != tt.name {
+				t.Errorf("%q: got %q, %v, want %q, %v", tt.path, name, err, tt.name, tt.want)
+			}
+		}
+	})
+}
+
+func TestCheckNotShareRoot(t *testing.T) {
+	forEachResolver(t, func(t *testing.T) {
+		_, _, s := jailTree(t)
+		root := openTestRoot(t, s)
+		for path, want := range map[string]error{"share": ErrShareRoot, "share/dir": nil, "share/dir/f": nil, "share/abs": nil} {
+			dir, name, err := openParent(root, path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = checkNotShareRoot(root, dir, name)
+			dir.Close()
+			if err != want {
+				t.Errorf("%q: got %v, want %v", path, err, want)
+			}
+		}
+	})
+}
+
+// procMount opens / and checks that /proc is a separate mount, to stand in
+// for a dataset mounted inside a share.
+func procMount(t *testing.T) *os.File {
+	t.Helper()
+	var rootSt, procSt unix.Stat_t
+	if unix.Stat("/", &rootSt) != nil || unix.Stat("/proc", &procSt) != nil || rootSt.Dev == procSt.Dev {
+		t.Skip("/proc is not a mount point")
+	}
+	dir, err := os.Open("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { dir.Close() })
+	return dir
+}
+
+func TestCheckNotShareRootRefusesMountPoints(t *testing.T) {
+	dir := procMount(t)
+	root, err := os.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer root.Close()
+	if err := checkNotShareRoot(root, dir, "proc"); err != ErrShareRoot {
+		t.Errorf("got %v for a mount point", err)
+	}
+}
+
+func TestRemoveAllAt(t *testing.T) {
+	base, outside, s := jailTree(t)
+	root := openTestRoot(t, s)
+	// More entries than one Readdirnames batch.
+	for i := 0; i < 300; i++ {
+		if err := os.WriteFile(filepath.Join(base, "share/dir/sub", fmt.Sprintf("f%d", i)), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(outside, filepath.Join(base, "share/dir/sub/out")); err != nil {
+		t.Fatal(err)
+	}
+	share, err := openBeneath(root, "share", unix.O_RDONLY|unix.O_DIRECTORY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer share.Close()
+
+	if err := removeAllAt(int(share.Fd()), "dir"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Lstat(filepath.Join(base, "share/dir")); !os.IsNotExist(err) {
+		t.Errorf("dir was not removed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(outside, "secret")); err != nil {
+		t.Errorf("removal followed a symlink out of the root: %v", err)
+	}
+	// Removing a symlink to a directory removes the link only.
+	if err := removeAllAt(int(share.Fd()), "abs"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(outside, "secret")); err != nil {
+		t.Errorf("removing a symlink removed its target: %v", err)
+	}
+	if err := removeAllAt(int(share.Fd()), "missing"); err != nil {
+		t.Errorf("got %v removing a missing entry", err)
+	}
+}
+
+func TestRemoveAllAtStopsAtMountPoints(t *testing.T) {
+	dir := procMount(t)
+	if err := removeAllAt(int(dir.Fd()), "proc"); err != ErrShareRoot {
+		t.Errorf("got %v for a mount point", err)
+	}
+}
+
+func TestFileOperationsStayBeneathRoot(t *testing.T) {
+	forEachResolver(t, func(t *testing.T) {
+		base, outside, s := jailTree(t)
+		for _, path := range []string{"", "/", "share", "/share/", "share/dir/.."} {
+			if err := s.DeleteItem(path); !errors.Is(err, ErrShareRoot) && !errors.Is(err, ErrInvalidPath) {
+				t.Errorf("DeleteItem(%q): got %v", path, err)
+			}
+		}
+		if _, err := os.Stat(filepath.Join(base, "share/dir/f")); err != nil {
+			t.Fatal("share was touched")
+		}
+		if err := s.DeleteItem("share/dir/up/x"); !errors.Is(err, ErrPathEscape) {
+			t.Errorf("got %v deleting through an escaping symlink", err)
+		}
+		if err := s.CreateDirectory("share/abs/evil"); !errors.Is(err, ErrPathEscape) {
+			t.Errorf("got %v creating a directory through an absolute symlink", err)
+		}
+		if _, err := s.ListFiles("share/dir/up"); !errors.Is(err, ErrPathEscape) {
+			t.Errorf("got %v listing through an escaping symlink", err)
+		}
+		if _, _, err := s.OpenFile("share/dir/abslink"); !errors.Is(err, ErrPathEscape) {
+			t.Errorf("got %v opening an absolute symlink", err)
+		}
+		if err := s.DeleteItem("share/abs"); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.DeleteItem("share/dir"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(filepath.Join(outside, "secret")); err != nil {
+			t.Errorf("a file outside the root was removed: %v", err)
+		}
+	})
+}
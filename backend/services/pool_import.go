@@ -0,0 +1,130 @@
+package services
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// PoolImportOptions are the options accepted by ImportPool.
+type PoolImportOptions struct {
+	NewName  string `json:"newName"`
+	Readonly bool   `json:"readonly"`
+	Force    bool   `json:"force"`
+	AltRoot  string `json:"altroot"`
+	// Dir is the directory searched for devices, e.g. /dev/disk/by-id.
+	Dir string `json:"dir"`
+}
+
+var poolIDRe = regexp.MustCompile(`^[0-9]+$`)
+
+func validSearchDir(dir string) error {
+	if dir != "" && (!filepath.IsAbs(dir) || filepath.Clean(dir) != dir) {
+		return fmt.Errorf("invalid device directory: %q", dir)
+	}
+	return nil
+}
+
+// FindImportablePools lists pools that `zpool import` can see but that are
+// not imported, with their state and device tree.
+func (s *StorageService) FindImportablePools(dir string) ([]*PoolStatus, error) {
+	if err := validSearchDir(dir); err != nil {
+		return nil, err
+	}
+	args := []string{"import"}
+	if dir != "" {
+		args = append(args, "-d", dir)
+	}
+	output, err := s.run("zpool", args...)
+	var cmdErr *CommandError
+	if err != nil && !(errors.As(err, &cmdErr) && strings.Contains(cmdErr.Stderr, "no pools available")) {
+		return nil, fmt.Errorf("failed to search for pools: %v", err)
+	}
+	return parseZpoolImport(string(output))
+}
+
+// parseZpoolImport splits `zpool import` output into one block per pool
+// and parses each like `zpool status`.
+func parseZpoolImport(output string) ([]*PoolStatus, error) {
+	var blocks []string
+	var current []string
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if key, _, ok := splitStatusKey(line); ok && key == "pool" && len(current) > 0 {
+			blocks = append(blocks, strings.Join(current, "\n"))
+			current = nil
+		}
+		if len(current) > 0 || strings.HasPrefix(strings.TrimSpace(line), "pool:") {
+			current = append(current, line)
+		}
+	}
+	if len(current) > 0 {
+		blocks = append(blocks, strings.Join(current, "\n"))
+	}
+
+	pools := []*PoolStatus{}
+	for _, block := range blocks {
+		pool, err := ParseZpoolStatus(block)
+		if err != nil {
+			return nil, err
+		}
+		pools = append(pools, pool)
+	}
+	return pools, nil
+}
+
+// ImportPool imports a pool by name or numeric id.
+func (s *StorageService) ImportPool(pool string, opts PoolImportOptions) error {
+	if !poolIDRe.MatchString(pool) {
+		if err := validPoolName(pool); err != nil {
+			return err
+		}
+	}
+	if opts.NewName != "" {
+		if err := validPoolName(opts.NewName); err != nil {
+			return err
+		}
+	}
+	if opts.AltRoot != "" && (!filepath.IsAbs(opts.AltRoot) || filepath.Clean(opts.AltRoot) != opts.AltRoot || opts.AltRoot == "/") {
+		return fmt.Errorf("invalid altroot: %q", opts.AltRoot)
+	}
+	if err := validSearchDir(opts.Dir); err != nil {
+		return err
+	}
+	args := []string{"import"}
+	if opts.Force {
+		args = append(args, "-f")
+	}
+	if opts.Readonly {
+		args = append(args, "-o", "readonly=on")
+	}
+	if opts.AltRoot != "" {
+		args = append(args, "-R", opts.AltRoot)
+	}
+	if opts.Dir != "" {
+		args = append(args, "-d", opts.Dir)
+	}
+	args = append(args, pool)
+	if opts.NewName != "" {
+		args = append(args, opts.NewName)
+	}
+	return s.runZpool("import pool", args...)
+}
+
+// ExportPool cleanly exports a pool so it can be moved to another system.
+// With force, datasets are unmounted even if they are busy.
+func (s *StorageService) ExportPool(pool string, force bool) error {
+	if err := validPoolName(pool); err != nil {
+		return err
+	}
+	args := []string{"export"}
+	if force {
+		args = append(args, "-f")
+	}
+	args = append(args, pool)
+	return s.runZpool("export pool", args...)
+}
@@ -0,0 +1,448 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// PoolPlan describes a pool to create. Data vdevs are either listed in
+// Vdevs or built by splitting Devices into vdevs of Width disks with
+// Layout.
+type PoolPlan struct {
+	Name    string     `json:"name"`
+	Layout  string     `json:"layout"` // stripe, mirror, raidz1, raidz2 or raidz3
+	Width   int        `json:"width"`
+	Devices []string   `json:"devices"`
+	Vdevs   []PlanVdev `json:"vdevs"`
+	Ashift  int        `json:"ashift"` // 0 for 12 (4 KiB sectors)
+
+	Special []PlanVdev `json:"special"`
+	Dedup   []PlanVdev `json:"dedup"`
+	Log     []PlanVdev `json:"log"`
+	Cache   []string   `json:"cache"`
+	Spares  []string   `json:"spares"`
+
+	// Properties are pool properties (zpool create -o); FSProperties are
+	// set on the root dataset (-O), e.g. compression=lz4.
+	Properties   map[string]string `json:"properties"`
+	FSProperties map[string]string `json:"fsProperties"`
+}
+
+type PlanVdev struct {
+	Layout  string   `json:"layout"`
+	Devices []string `json:"devices"`
+}
+
+// PoolPlanResult is what creating the pool would do. Nothing is created
+// while Errors is non-empty.
+type PoolPlanResult struct {
+	Valid       bool          `json:"valid"`
+	Errors      []string      `json:"errors"`
+	Warnings    []string      `json:"warnings"`
+	Command     []string      `json:"command"`
+	CommandLine string        `json:"commandLine"`
+	Vdevs       []PlannedVdev `json:"vdevs"`
+	// RawCapacity is the sum of all data disks; UsableCapacity subtracts
+	// parity, mirror copies and the space ZFS holds back (1/32), before
+	// compression.
+	RawCapacity    uint64 `json:"rawCapacity"`
+	UsableCapacity uint64 `json:"usableCapacity"`
+	// FaultTolerance is how many disks can fail anywhere without losing
+	// the pool; each vdev may survive more on its own.
+	FaultTolerance int `json:"faultTolerance"`
+}
+
+type PlannedVdev struct {
+	Class          string   `json:"class"` // data, special, dedup, log, cache or spare
+	Layout         string   `json:"layout"`
+	Devices        []string `json:"devices"`
+	DiskSize       uint64   `json:"diskSize"` // smallest member; larger members are cut to it
+	UsableCapacity uint64   `json:"usableCapacity"`
+	FaultTolerance int      `json:"faultTolerance"`
+}
+
+// Minimum widths the planner accepts. zpool allows a two-disk raidz1, but
+// it is a slower mirror with the same redundancy.
+var planMinDevices = map[string]int{"stripe": 1, "mirror": 2, "raidz1": 3, "raidz2": 4, "raidz3": 5}
+
+var layoutParity = map[string]int{"raidz1": 1, "raidz2": 2, "raidz3": 3}
+
+var poolPropertyRe = regexp.MustCompile(`^[a-z][a-z0-9_.:]*$`)
+
+const defaultAshift = 12
+
+// planDevice is a device of the plan resolved against the disk inventory.
+type planDevice struct {
+	path   string
+	size   uint64
+	rota   bool
+	fstype string
+}
+
+type poolPlanner struct {
+	disks    []Disk
+	used     map[string]string // disk ID -> where the plan already uses it
+	result   *PoolPlanResult
+	allRota  []bool
+	protects map[string]string
+	mounted  map[string]bool
+	busy     func(path string) string
+}
+
+func (p *poolPlanner) errorf(format string, args ...interface{}) {
+	p.result.Errors = append(p.result.Errors, fmt.Sprintf(format, args...))
+}
+
+func (p *poolPlanner) warnf(format string, args ...interface{}) {
+	p.result.Warnings = append(p.result.Warnings, fmt.Sprintf(format, args...))
+}
+
+// resolve finds dev in the inventory and checks it is free to use.
+func (p *poolPlanner) resolve(dev, where string) *planDevice {
+	if err := validDevice(dev); err != nil {
+		p.errorf("%v", err)
+		return nil
+	}
+	for i := range p.disks {
+		disk := &p.disks[i]
+		if !disk.matches(dev) {
+			continue
+		}
+		if prev, ok := p.used[disk.ID]; ok {
+			p.errorf("disk %s is used twice (%s and %s)", disk.ID, prev, where)
+			return nil
+		}
+		p.used[disk.ID] = where
+		switch {
+		case disk.Pool != "":
+			p.errorf("disk %s is already part of pool %s", disk.ID, disk.Pool)
+		case p.protects[disk.Path] != "":
+			p.errorf("disk %s is in use as %s", disk.ID, p.protects[disk.Path])
+		case p.mounted[disk.Path]:
+			p.errorf("disk %s is mounted", disk.ID)
+		case p.busy(disk.Path) != "":
+			p.errorf("disk %s is busy with %s", disk.ID, p.busy(disk.Path))
+		}
+		pd := &planDevice{path: disk.stablePath(dev), size: disk.Size, rota: disk.Rotational, fstype: disk.FSType}
+		for _, part := range disk.Partitions {
+			if p.mounted[part.Path] {
+				p.errorf("partition %s of disk %s is mounted", part.Name, disk.ID)
+			}
+			if filepath.Base(dev) == part.Name || dev == part.Path {
+				pd.size, pd.fstype = part.Size, part.FSType
+				break
+			}
+			if pd.fstype == "" && part.FSType != "" {
+				pd.fstype = part.FSType + " on " + part.Name
+			}
+		}
+		if pd.fstype != "" {
+			p.warnf("%s carries a %s signature; wipe it first or zpool create will refuse it", dev, pd.fstype)
+		}
+		return pd
+	}
+	p.errorf("unknown device: %s", dev)
+	return nil
+}
+
+// vdev validates one vdev and adds it to the result.
+func (p *poolPlanner) vdev(class string, v PlanVdev, index int) []string {
+	layout := normalizeLayout(v.Layout)
+	if layout == "" {
+		layout = "stripe"
+	}
+	where := fmt.Sprintf("%s vdev %d", class, index+1)
+	min, ok := planMinDevices[layout]
+	if !ok {
+		p.errorf("%s: invalid layout %q", where, v.Layout)
+		return nil
+	}
+	if len(v.Devices) < min {
+		p.errorf("%s: %s needs at least %d disks, got %d", where, layout, min, len(v.Devices))
+	}
+
+	planned := PlannedVdev{Class: class, Layout: layout, Devices: []string{}}
+	var devices []*planDevice
+	for _, dev := range v.Devices {
+		if pd := p.resolve(dev, where); pd != nil {
+			devices = append(devices, pd)
+			planned.Devices = append(planned.Devices, pd.path)
+		}
+	}
+	if len(devices) == 0 {
+		p.result.Vdevs = append(p.result.Vdevs, planned)
+		return nil
+	}
+
+	var maxSize uint64
+	rota := 0
+	planned.DiskSize = devices[0].size
+	for _, d := range devices {
+		if d.size < planned.DiskSize {
+			planned.DiskSize = d.size
+		}
+		if d.size > maxSize {
+			maxSize = d.size
+		}
+		if d.rota {
+			rota++
+		}
+		if class == "data" {
+			p.allRota = append(p.allRota, d.rota)
+			p.result.RawCapacity += d.size
+		}
+	}
+	if layout != "stripe" && maxSize-planned.DiskSize > maxSize/100 {
+		p.warnf("%s mixes disk sizes; every disk is used only up to %s", where, formatBytes(planned.DiskSize))
+	}
+	if rota > 0 && rota < len(devices) {
+		p.warnf("%s mixes rotational disks and SSDs; it runs at the speed of the slowest", where)
+	}
+	if (class == "special" || class == "dedup" || class == "log") && rota > 0 {
+		p.warnf("%s is on rotational disks; %s vdevs should be SSDs", where, class)
+	}
+
+	n := uint64(len(devices))
+	switch layout {
+	case "stripe":
+		var sum uint64
+		for _, d := range devices {
+			sum += d.size
+		}
+		planned.UsableCapacity = sum
+	case "mirror":
+		planned.UsableCapacity = planned.DiskSize
+		planned.FaultTolerance = len(devices) - 1
+	default:
+		parity := layoutParity[layout]
+		if n > uint64(parity) {
+			planned.UsableCapacity = planned.DiskSize * (n - uint64(parity))
+		}
+		planned.FaultTolerance = parity
+	}
+	p.result.Vdevs = append(p.result.Vdevs, planned)
+
+	args := []string{}
+	if arg := vdevLayoutArg[layout]; arg != "" {
+		args = append(args, arg)
+	}
+	return append(args, planned.Devices...)
+}
+
+// PlanPool validates a pool layout and works out the zpool create command,
+// capacity and fault tolerance without touching any disk.
+func (s *StorageService) PlanPool(plan PoolPlan) (*PoolPlanResult, error) {
+	disks, err := s.DiskInventory()
+	if err != nil {
+		return nil, err
+	}
+	result := &PoolPlanResult{Errors: []string{}, Warnings: []string{}, Vdevs: []PlannedVdev{}}
+	p := &poolPlanner{
+		disks:    disks,
+		used:     map[string]string{},
+		result:   result,
+		protects: s.ProtectedDisks(),
+		mounted:  mountedDevices(),
+		busy:     s.diskBusy,
+	}
+
+	if err := validPoolName(plan.Name); err != nil {
+		p.errorf("%v", err)
+	} else if pools, err := s.ListPools(); err == nil {
+		for _, pool := range pools {
+			if pool == plan.Name {
+				p.errorf("pool %s already exists", plan.Name)
+			}
+		}
+	}
+
+	data := plan.Vdevs
+	if len(plan.Devices) > 0 {
+		if len(data) > 0 {
+			p.errorf("give either devices or vdevs, not both")
+		}
+		width := plan.Width
+		if width == 0 {
+			width = len(plan.Devices)
+		}
+		if width < 0 || len(plan.Devices)%width != 0 {
+			p.errorf("%d devices cannot be split into vdevs of %d", len(plan.Devices), width)
+		} else {
+			for i := 0; i < len(plan.Devices); i += width {
+				data = append(data, PlanVdev{Layout: plan.Layout, Devices: plan.Devices[i : i+width]})
+			}
+		}
+	}
+	if len(data) == 0 {
+		p.errorf("the pool needs at least one data vdev")
+	}
+
+	ashift := plan.Ashift
+	if ashift == 0 {
+		ashift = defaultAshift
+	}
+	if ashift < 9 || ashift > 16 {
+		p.errorf("ashift must be between 9 and 16")
+	} else if ashift < 12 {
+		p.warnf("ashift %d is slow on disks with 4 KiB sectors and cannot be changed later", ashift)
+	}
+
+	cmd := []string{"zpool", "create", "-o", "ashift=" + strconv.Itoa(ashift)}
+	for _, props := range []struct {
+		flag  string
+		props map[string]string
+	}{{"-o", plan.Properties}, {"-O", plan.FSProperties}} {
+		for _, key := range sortedKeys(props.props) {
+			value := props.props[key]
+			if !poolPropertyRe.MatchString(key) || (key == "ashift" && props.flag == "-o") || value == "" || strings.ContainsAny(value, " \t\n") {
+				p.errorf("invalid property %s=%q", key, value)
+				continue
+			}
+			cmd = append(cmd, props.flag, key+"="+value)
+		}
+	}
+	cmd = append(cmd, plan.Name)
+
+	// Data vdevs should all share one layout and width, or the pool's
+	// redundancy is that of its weakest vdev.
+	layouts := map[string]bool{}
+	widths := map[int]bool{}
+	for i, v := range data {
+		cmd = append(cmd, p.vdev("data", v, i)...)
+		layout := normalizeLayout(v.Layout)
+		if layout == "" {
+			layout = "stripe"
+		}
+		layouts[layout] = true
+		widths[len(v.Devices)] = true
+	}
+	if len(layouts) > 1 {
+		p.errorf("data vdevs mix layouts; use the same layout for all of them")
+	} else if len(widths) > 1 {
+		p.warnf("data vdevs have different widths; space and performance will be uneven")
+	}
+	rota := 0
+	for _, r := range p.allRota {
+		if r {
+			rota++
+		}
+	}
+	if len(data) > 1 && rota > 0 && rota < len(p.allRota) {
+		p.warnf("data vdevs mix rotational disks and SSDs")
+	}
+
+	tolerance := -1
+	for _, v := range result.Vdevs {
+		result.UsableCapacity += v.UsableCapacity
+		if tolerance < 0 || v.FaultTolerance < tolerance {
+			tolerance = v.FaultTolerance
+		}
+	}
+	if tolerance > 0 {
+		result.FaultTolerance = tolerance
+	}
+	result.UsableCapacity -= result.UsableCapacity / 32
+
+	// Losing a special or dedup vdev loses the pool, so it needs at least
+	// the redundancy of the data vdevs.
+	for _, class := range []struct {
+		name  string
+		vdevs []PlanVdev
+	}{{"special", plan.Special}, {"dedup", plan.Dedup}, {"log", plan.Log}} {
+		for i, v := range class.vdevs {
+			if strings.HasPrefix(normalizeLayout(v.Layout), "raidz") {
+				p.errorf("%s vdevs can only be single disks or mirrors", class.name)
+				continue
+			}
+			args := p.vdev(class.name, v, i)
+			if len(args) == 0 {
+				continue
+			}
+			planned := result.Vdevs[len(result.Vdevs)-1]
+			if class.name != "log" && planned.FaultTolerance < result.FaultTolerance {
+				p.errorf("%s vdev %d survives %d disk failures but the data vdevs survive %d; losing it loses the pool",
+					class.name, i+1, planned.FaultTolerance, result.FaultTolerance)
+			}
+			if class.name == "log" && planned.Layout == "stripe" && result.FaultTolerance > 0 {
+				p.warnf("an unmirrored log device loses in-flight synchronous writes if it fails during a crash")
+			}
+			cmd = append(cmd, class.name)
+			cmd = append(cmd, args...)
+		}
+	}
+	for _, aux := range []struct {
+		name    string
+		devices []string
+	}{{"cache", plan.Cache}, {"spare", plan.Spares}} {
+		if len(aux.devices) == 0 {
+			continue
+		}
+		cmd = append(cmd, aux.name)
+		planned := PlannedVdev{Class: aux.name, Layout: "stripe", Devices: []string{}}
+		for _, dev := range aux.devices {
+			if pd := p.resolve(dev, aux.name); pd != nil {
+				cmd = append(cmd, pd.path)
+				planned.Devices = append(planned.Devices, pd.path)
+				if aux.name == "spare" && len(result.Vdevs) > 0 && pd.size < result.Vdevs[0].DiskSize {
+					p.warnf("spare %s is smaller than the data disks and cannot replace them", dev)
+				}
+			}
+		}
+		result.Vdevs = append(result.Vdevs, planned)
+	}
+
+	result.Command = cmd
+	result.CommandLine = strings.Join(cmd, " ")
+	result.Valid = len(result.Errors) == 0
+	return result, nil
+}
+
+// ErrPlanChanged is returned when the disks changed between the dry run and
+// the creation of a pool.
+var ErrPlanChanged = errors.New("the plan changed since the dry run; review it again")
+
+// CreatePlannedPool plans the pool again and creates it. commandLine must
+// be the command the dry run showed, so disks that changed in between are
+// not written to by surprise.
+func (s *StorageService) CreatePlannedPool(plan PoolPlan, commandLine string) (*PoolPlanResult, error) {
+	result, err := s.PlanPool(plan)
+	if err != nil {
+		return nil, err
+	}
+	if !result.Valid {
+		return result, fmt.Errorf("invalid pool layout: %s", strings.Join(result.Errors, "; "))
+	}
+	if commandLine != result.CommandLine {
+		return result, ErrPlanChanged
+	}
+	if _, err := s.run(result.Command[0], result.Command[1:]...); err != nil {
+		return result, fmt.Errorf("failed to create pool: %v", err)
+	}
+	return result, nil
+}
+
+// formatBytes renders a size with binary units for messages.
+func formatBytes(n uint64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB", "PiB"}
+	value := float64(n)
+	i := 0
+	for value >= 1024 && i < len(units)-1 {
+		value /= 1024
+		i++
+	}
+	return strconv.FormatFloat(value, 'f', 1, 64) + " " + units[i]
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,38 @@
+package services
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPlanPool(t *testing.T) {
+	s, _ := fixtureStorage(t)
+	result, err := s.PlanPool(PoolPlan{Name: "new", Layout: "mirror", Devices: []string{"sdw", "sdu"}, Cache: []string{"sdv"},
+		FSProperties: map[string]string{"compression": "lz4"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Valid || result.FaultTolerance != 1 {
+		t.Errorf("got valid %v tolerance %d, errors %q", result.Valid, result.FaultTolerance, result.Errors)
+	}
+	if result.CommandLine != "zpool create -o ashift=12 -O compression=lz4 new mirror sdw sdu cache sdv" {
+		t.Errorf("got %q", result.CommandLine)
+	}
+}
+
+func TestPlanPoolRefusesDisksInUse(t *testing.T) {
+	s, _ := fixtureStorage(t)
+	result, err := s.PlanPool(PoolPlan{Name: "new", Layout: "mirror", Devices: []string{"sda", "sdw"}, Special: []PlanVdev{{Devices: []string{"nvme0n1"}}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Valid {
+		t.Fatal("plan with disks in use is valid")
+	}
+	errors := strings.Join(result.Errors, "\n")
+	for _, want := range []string{"is already part of pool tank", "is in use as boot disk"} {
+		if !strings.Contains(errors, want) {
+			t.Errorf("errors %q do not mention %q", result.Errors, want)
+		}
+	}
+}
@@ -0,0 +1,441 @@
+package services
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DiskPowerPolicy is the power management of one disk, keyed by serial so
+// it follows the disk across device renames.
+type DiskPowerPolicy struct {
+	Serial      string `json:"serial"`
+	IdleMinutes int    `json:"idleMinutes"`   // 0 never spins the disk down
+	APM         int    `json:"apm,omitempty"` // hdparm -B level 1-255; 0 leaves the drive's setting
+	Exclude     bool   `json:"exclude"`
+}
+
+// DiskPowerStatus is the power state of a disk. State comes from CHECK
+// POWER MODE, which does not wake a drive in standby.
+type DiskPowerStatus struct {
+	Device          string           `json:"device"`
+	Serial          string           `json:"serial"`
+	Rotational      bool             `json:"rotational"`
+	State           string           `json:"state"` // active, idle, standby or unknown
+	LastIO          *time.Time       `json:"lastIo,omitempty"`
+	IdleSeconds     int64            `json:"idleSeconds"`
+	Policy          *DiskPowerPolicy `json:"policy,omitempty"`
+	Protected       bool             `json:"protected"`
+	ProtectedReason string           `json:"protectedReason,omitempty"`
+}
+
+const diskstatsPath = "/proc/diskstats"
+
+// readDiskstats returns the number of completed reads and writes per block
+// device. Any change means the device saw I/O.
+func readDiskstats() (map[string]uint64, error) {
+	f, err := os.Open(diskstatsPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	stats := map[string]uint64{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 8 {
+			continue
+		}
+		reads, _ := strconv.ParseUint(fields[3], 10, 64)
+		writes, _ := strconv.ParseUint(fields[7], 10, 64)
+		stats[fields[2]] = reads + writes
+	}
+	return stats, scanner.Err()
+}
+
+// wholeDisks resolves a device as named by zpool status or findmnt (sdb1,
+// ata-X-part1, /dev/nvme0n1p2, /dev/mapper/vg-root) to the paths of the
+// disks holding it. lsblk -s follows the slaves down through LVM, LUKS and
+// md, so a root on a mirrored LVM volume resolves to both disks.
+func (s *StorageService) wholeDisks(name string) []string {
+	path := name
+	if !strings.HasPrefix(path, "/") {
+		path = "/dev/" + name
+		for _, dir := range []string{"/dev", "/dev/disk/by-id", "/dev/disk/by-path", "/dev/disk/by-partuuid", "/dev/disk/by-uuid"} {
+			if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+				path = filepath.Join(dir, name)
+				break
+			}
+		}
+	}
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		path = resolved
+	}
+	out, err := s.run("lsblk", "-rsnpo", "NAME,TYPE", path)
+	if err != nil {
+		return []string{path}
+	}
+	var disks []string
+	seen := map[string]bool{}
+	for _, line := range strings.Split(string(out), "\n") {
+		if fields := strings.Fields(line); len(fields) == 2 && fields[1] == "disk" && !seen[fields[0]] {
+			seen[fields[0]] = true
+			disks = append(disks, fields[0])
+		}
+	}
+	if disks == nil {
+		return []string{path}
+	}
+	return disks
+}
+
+func vdevLeaves(v *VdevStatus) []string {
+	if len(v.Children) == 0 {
+		return []string{v.Name}
+	}
+	var leaves []string
+	for _, child := range v.Children {
+		leaves = append(leaves, vdevLeaves(child)...)
+	}
+	return leaves
+}
+
+// ProtectedDisks returns the disks that must never be spun down, with the
+// reason: disks holding /, /boot or /boot/efi (or the whole pool for a ZFS
+// root), and SLOG and L2ARC devices, which ZFS expects to answer at once.
+func (s *StorageService) ProtectedDisks() map[string]string {
+	protected := map[string]string{}
+	protect := func(name, reason string) {
+		for _, disk := range s.wholeDisks(name) {
+			protected[disk] = reason
+		}
+	}
+	for _, mnt := range []string{"/", "/boot", "/boot/efi"} {
+		out, err := s.run("findmnt", "-n", "-o", "SOURCE", mnt)
+		if err != nil {
+			continue
+		}
+		// btrfs subvolumes are listed as /dev/sda2[/@].
+		source := strings.TrimSpace(string(out))
+		if i := strings.Index(source, "["); i > 0 {
+			source = source[:i]
+		}
+		if strings.HasPrefix(source, "/dev/") {
+			protect(source, "boot disk")
+			continue
+		}
+		if source == "" {
+			continue
+		}
+		if status, err := s.GetPoolStatus(poolOf(source)); err == nil && status.Config != nil {
+			for _, leaf := range vdevLeaves(status.Config) {
+				protect(leaf, "boot pool "+status.Name)
+			}
+		}
+	}
+
+	pools, err := s.ListPools()
+	if err != nil {
+		return protected
+	}
+	for _, pool := range pools {
+		if pool == "" {
+			continue
+		}
+		status, err := s.GetPoolStatus(pool)
+		if err != nil {
+			continue
+		}
+		for _, v := range status.Logs {
+			for _, leaf := range vdevLeaves(v) {
+				protect(leaf, "SLOG of pool "+pool)
+			}
+		}
+		for _, v := range status.Cache {
+			for _, leaf := range vdevLeaves(v) {
+				protect(leaf, "L2ARC of pool "+pool)
+			}
+		}
+	}
+	return protected
+}
+
+// PowerState reports active, idle, standby or unknown without waking the
+// drive.
+func (s *StorageService) PowerState(dev string) string {
+	out, err := s.run("hdparm", "-C", dev)
+	if err != nil {
+		return "unknown"
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		if _, state, ok := strings.Cut(line, "drive state is:"); ok {
+			switch state = strings.TrimSpace(state); {
+			case strings.Contains(state, "standby"), strings.Contains(state, "sleeping"):
+				return "standby"
+			case strings.Contains(state, "active"):
+				return "active"
+			case strings.Contains(state, "idle"):
+				return "idle"
+			}
+		}
+	}
+	return "unknown"
+}
+
+// StandbyDisk spins a single disk down, refusing protected disks.
+func (s *StorageService) StandbyDisk(dev string) error {
+	path, err := devicePath(dev)
+	if err != nil {
+		return err
+	}
+	protected := s.ProtectedDisks()
+	for _, disk := range s.wholeDisks(path) {
+		if reason, ok := protected[disk]; ok {
+			return fmt.Errorf("%s is protected from spin-down: %s", path, reason)
+		}
+	}
+	if _, err := s.run("hdparm", "-y", path); err != nil {
+		return fmt.Errorf("failed to spin down %s: %v", path, err)
+	}
+	return nil
+}
+
+type diskActivity struct {
+	ios      uint64
+	lastIO   time.Time
+	spunDown bool
+}
+
+// PowerMonitor tracks disk I/O from /proc/diskstats and spins disks down
+// once they have been idle for their policy's timeout.
+type PowerMonitor struct {
+	storage *StorageService
+	path    string
+
+	mu       sync.Mutex
+	policies []*DiskPowerPolicy
+	activity map[string]*diskActivity // by device name
+	stop     chan struct{}
+}
+
+func NewPowerMonitor(storage *StorageService) *PowerMonitor {
+	m := &PowerMonitor{
+		storage:  storage,
+		path:     filepath.Join(DataDir(), "disk-power.json"),
+		policies: []*DiskPowerPolicy{},
+		activity: map[string]*diskActivity{},
+	}
+	var state struct {
+		Policies []*DiskPowerPolicy `json:"policies"`
+	}
+	if err := loadJSON(m.path, &state); err != nil {
+		log.Printf("Error loading disk power policies: %v", err)
+	}
+	if state.Policies != nil {
+		m.policies = state.Policies
+	}
+	return m
+}
+
+// save must be called with m.mu held.
+func (m *PowerMonitor) save() error {
+	return saveJSON(m.path, map[string]interface{}{"policies": m.policies})
+}
+
+// Start applies APM levels, then checks idleness once a minute until Stop
+// is called.
+func (m *PowerMonitor) Start() {
+	m.stop = make(chan struct{})
+	go func() {
+		m.applyAPM("")
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		for {
+			m.refresh(time.Now(), true)
+			select {
+			case <-ticker.C:
+			case <-m.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (m *PowerMonitor) Stop() {
+	if m.stop != nil {
+		close(m.stop)
+	}
+}
+
+// policy must be called with m.mu held.
+func (m *PowerMonitor) policy(serial string) *DiskPowerPolicy {
+	for _, p := range m.policies {
+		if serial != "" && p.Serial == serial {
+			return p
+		}
+	}
+	return nil
+}
+
+// refresh updates the activity of every disk and returns its status. With
+// enforce, disks idle beyond their timeout are spun down.
+func (m *PowerMonitor) refresh(now time.Time, enforce bool) ([]DiskPowerStatus, error) {
+	disks, err := m.storage.listDisks()
+	if err != nil {
+		return nil, err
+	}
+	stats, err := readDiskstats()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read disk statistics: %v", err)
+	}
+	protected := m.storage.ProtectedDisks()
+
+	statuses := []DiskPowerStatus{}
+	for _, disk := range disks {
+		dev := "/dev/" + disk.Name
+		status := DiskPowerStatus{Device: dev, Serial: disk.Serial, Rotational: bool(disk.Rotational), State: "active"}
+		if reason, ok := protected[dev]; ok {
+			status.Protected, status.ProtectedReason = true, reason
+		}
+		if disk.Rotational {
+			status.State = m.storage.PowerState(dev)
+		}
+
+		m.mu.Lock()
+		act := m.activity[disk.Name]
+		ios := stats[disk.Name]
+		if act == nil {
+			act = &diskActivity{ios: ios, lastIO: now}
+			m.activity[disk.Name] = act
+		} else if ios != act.ios {
+			act.ios, act.lastIO, act.spunDown = ios, now, false
+		}
+		var policy *DiskPowerPolicy
+		if p := m.policy(disk.Serial); p != nil {
+			copied := *p
+			policy = &copied
+			if p.Exclude && !status.Protected {
+				status.Protected, status.ProtectedReason = true, "excluded"
+			}
+		}
+		lastIO := act.lastIO
+		spunDown := act.spunDown
+		m.mu.Unlock()
+
+		status.Policy = policy
+		status.LastIO = &lastIO
+		status.IdleSeconds = int64(now.Sub(lastIO).Seconds())
+
+		if enforce && policy != nil && policy.IdleMinutes > 0 && status.Rotational && !status.Protected &&
+			!spunDown && status.State != "standby" && now.Sub(lastIO) >= time.Duration(policy.IdleMinutes)*time.Minute {
+			if _, err := m.storage.run("hdparm", "-y", dev); err != nil {
+				log.Printf("Failed to spin down idle disk %s: %v", dev, err)
+			} else {
+				status.State = "standby"
+				m.mu.Lock()
+				act.spunDown = true
+				m.mu.Unlock()
+			}
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+// Status reports the power state of every disk without waking any of them.
+func (m *PowerMonitor) Status() ([]DiskPowerStatus, error) {
+	return m.refresh(time.Now(), false)
+}
+
+// applyAPM sets the APM level of the disk with serial, or of every disk
+// with a policy when serial is empty. Drives forget it on power loss.
+func (m *PowerMonitor) applyAPM(serial string) error {
+	disks, err := m.storage.listDisks()
+	if err != nil {
+		return err
+	}
+	var errs []string
+	for _, disk := range disks {
+		if serial != "" && disk.Serial != serial {
+			continue
+		}
+		m.mu.Lock()
+		p := m.policy(disk.Serial)
+		level := 0
+		if p != nil {
+			level = p.APM
+		}
+		m.mu.Unlock()
+		if level == 0 || !disk.Rotational {
+			continue
+		}
+		if _, err := m.storage.run("hdparm", "-B", strconv.Itoa(level), "/dev/"+disk.Name); err != nil {
+			log.Printf("Failed to set APM level of %s: %v", disk.Name, err)
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func (m *PowerMonitor) ListPolicies() []DiskPowerPolicy {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	policies := []DiskPowerPolicy{}
+	for _, p := range m.policies {
+		policies = append(policies, *p)
+	}
+	return policies
+}
+
+// SetPolicy creates or replaces the policy of a disk and applies its APM
+// level right away.
+func (m *PowerMonitor) SetPolicy(policy DiskPowerPolicy) (*DiskPowerPolicy, error) {
+	if diskKey(policy.Serial) != policy.Serial {
+		return nil, fmt.Errorf("invalid serial: %q", policy.Serial)
+	}
+	if policy.IdleMinutes < 0 {
+		return nil, errors.New("idle timeout cannot be negative")
+	}
+	if policy.APM < 0 || policy.APM > 255 {
+		return nil, errors.New("APM level must be between 1 and 255")
+	}
+
+	m.mu.Lock()
+	existing := m.policy(policy.Serial)
+	if existing == nil {
+		existing = &DiskPowerPolicy{Serial: policy.Serial}
+		m.policies = append(m.policies, existing)
+	}
+	*existing = policy
+	err := m.save()
+	m.mu.Unlock()
+	if err != nil {
+		return nil, fmt.Errorf("failed to save policy: %v", err)
+	}
+	if err := m.applyAPM(policy.Serial); err != nil {
+		return nil, fmt.Errorf("policy saved but APM level could not be set: %v", err)
+	}
+	return &policy, nil
+}
+
+func (m *PowerMonitor) DeletePolicy(serial string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, p := range m.policies {
+		if p.Serial == serial {
+			m.policies = append(m.policies[:i], m.policies[i+1:]...)
+			return m.save()
+		}
+	}
+	return ErrNotFound
+}
@@ -0,0 +1,54 @@
+package services
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// lvmRootStorage is fixtureStorage with / on an LVM volume on an md mirror
+// of sdw1 and sdu1.
+func lvmRootStorage(t *testing.T) (*StorageService, *FakeRunner) {
+	t.Helper()
+	s, fake := fixtureStorage(t)
+	files, err := filepath.Glob("testdata/lvm-root/*.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		command, resp, err := parseFixture(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fake.Add(command, resp)
+	}
+	return s, fake
+}
+
+func TestProtectedDisks(t *testing.T) {
+	s, _ := fixtureStorage(t)
+	protected := s.ProtectedDisks()
+	for disk, want := range map[string]string{"/dev/nvme0n1": "boot disk", "/dev/sdd": "SLOG of pool tank", "/dev/sde": "L2ARC of pool tank"} {
+		if protected[disk] != want {
+			t.Errorf("%s: got %q, want %q", disk, protected[disk], want)
+		}
+	}
+}
+
+func TestProtectedDisksFollowLVMRootToEveryDisk(t *testing.T) {
+	s, fake := lvmRootStorage(t)
+	protected := s.ProtectedDisks()
+	for _, disk := range []string{"/dev/sdw", "/dev/sdu", "/dev/nvme0n1"} {
+		if protected[disk] != "boot disk" {
+			t.Errorf("%s: got %q, want boot disk", disk, protected[disk])
+		}
+	}
+	if err := s.StandbyDisk("sdu"); err == nil || !strings.Contains(err.Error(), "protected") {
+		t.Errorf("got %v spinning down a disk under the root volume", err)
+	}
+	for _, call := range fake.Calls() {
+		if strings.HasPrefix(call, "hdparm -y") {
+			t.Errorf("ran %q", call)
+		}
+	}
+}
@@ -0,0 +1,391 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// recycleDir is the recycle bin of a share. Deleted items are renamed into
+// it, so deleting is instant and restoring keeps every attribute.
+const recycleDir = ".a1nas-recycle"
+
+// RecycleItem is a deleted file or directory. Path is where it was deleted
+// from and where it is restored to.
+type RecycleItem struct {
+	ID      string    `json:"id"`
+	Share   string    `json:"share"`
+	Path    string    `json:"path"`
+	Name    string    `json:"name"`
+	Type    string    `json:"type"` // file, directory or symlink
+	Size    int64     `json:"size"`
+	Files   int64     `json:"files"`
+	User    string    `json:"user,omitempty"`
+	Deleted time.Time `json:"deleted"`
+}
+
+// RecycleSettings bound the recycle bins. Items older than RetentionDays
+// are purged, and the oldest items of a share are purged while its bin is
+// larger than QuotaBytes. Zero disables either limit.
+type RecycleSettings struct {
+	RetentionDays int   `json:"retentionDays"`
+	QuotaBytes    int64 `json:"quotaBytes"`
+}
+
+var defaultRecycleSettings = RecycleSettings{RetentionDays: 30}
+
+// RestorePolicies are the ConflictPolicies that make sense for restoring;
+// skipping would leave the item half restored.
+var RestorePolicies = map[string]bool{"overwrite": true, "rename": true}
+
+type RecycleBin struct {
+	storage *StorageService
+	path    string
+
+	mu       sync.Mutex
+	settings RecycleSettings
+	items    []*RecycleItem
+	stop     chan struct{}
+	// collecting serializes purges started by the timer and by deletions.
+	collecting sync.Mutex
+}
+
+func NewRecycleBin(storage *StorageService) *RecycleBin {
+	b := &RecycleBin{
+		storage:  storage,
+		path:     filepath.Join(DataDir(), "recycle.json"),
+		settings: defaultRecycleSettings,
+		items:    []*RecycleItem{},
+	}
+	state := struct {
+		Settings *RecycleSettings `json:"settings"`
+		Items    []*RecycleItem   `json:"items"`
+	}{Settings: &b.settings}
+	if err := loadJSON(b.path, &state); err != nil {
+		log.Printf("Error loading recycle bin: %v", err)
+	}
+	if state.Items != nil {
+		b.items = state.Items
+	}
+	return b
+}
+
+// save must be called with b.mu held.
+func (b *RecycleBin) save() error {
+	return saveJSON(b.path, map[string]interface{}{"settings": b.settings, "items": b.items})
+}
+
+// Start purges expired items hourly until Stop is called.
+func (b *RecycleBin) Start() {
+	b.stop = make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(time.Hour)
+		defer ticker.Stop()
+		for {
+			b.collect(time.Now(), "")
+			select {
+			case <-ticker.C:
+			case <-b.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (b *RecycleBin) Stop() {
+	if b.stop != nil {
+		close(b.stop)
+	}
+}
+
+// internalPath reports whether a user path goes through a directory the
+// daemon manages inside the shares. ".." is refused too, so the first
+// component of the path is the share the item is in.
+func internalPath(parts []string) bool {
+	for _, part := range parts {
+		if part == recycleDir || part == uploadStagingDir || part == ".." {
+			return true
+		}
+	}
+	return false
+}
+
+// Delete moves path into the recycle bin of its share. An item on a dataset
+// mounted inside the share is copied into the bin and then removed, which
+// takes as long as copying it.
+func (b *RecycleBin) Delete(path, user string) (*RecycleItem, error) {
+	parts := splitPath(path)
+	if internalPath(parts) {
+		return nil, ErrInvalidPath
+	}
+	root, err := b.storage.openRoot()
+	if err != nil {
+		return nil, err
+	}
+	defer root.Close()
+	dir, name, err := openParent(root, path)
+	if err != nil {
+		return nil, jailError("remove", path, err)
+	}
+	defer dir.Close()
+	if err := checkNotShareRoot(root, dir, name); err != nil {
+		return nil, jailError("remove", path, err)
+	}
+	var st unix.Stat_t
+	if err := unix.Fstatat(int(dir.Fd()), name, &st, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		return nil, jailError("remove", path, err)
+	}
+
+	share := parts[0]
+	if err := mkdirAllBeneath(root, filepath.Join(share, recycleDir), 0700); err != nil {
+		return nil, jailError("create recycle bin", share, err)
+	}
+	bin, err := openBeneath(root, filepath.Join(share, recycleDir), unix.O_RDONLY|unix.O_DIRECTORY, 0)
+	if err != nil {
+		return nil, jailError("open recycle bin", share, err)
+	}
+	defer bin.Close()
+
+	item := &RecycleItem{
+		ID:      newID(),
+		Share:   share,
+		Path:    "/" + strings.Join(parts, "/"),
+		Name:    name,
+		Type:    "file",
+		User:    user,
+		Deleted: time.Now(),
+	}
+	switch st.Mode & unix.S_IFMT {
+	case unix.S_IFDIR:
+		item.Type = "directory"
+	case unix.S_IFLNK:
+		item.Type = "symlink"
+	}
+	t := &transfer{s: &TransferService{}, ctx: context.Background(), job: &TransferJob{}, move: true, conflict: "overwrite"}
+	if err := t.entry(dir, name, bin, item.ID, item.Path); err != nil {
+		return nil, fmt.Errorf("failed to move %s to the recycle bin: %v", item.Path, err)
+	}
+	item.Size, item.Files, _ = measure(context.Background(), int(bin.Fd()), item.ID)
+
+	b.mu.Lock()
+	b.items = append(b.items, item)
+	err = b.save()
+	quota := b.settings.QuotaBytes
+	b.mu.Unlock()
+	if err != nil {
+		log.Printf("Error saving recycle bin: %v", err)
+	}
+	if quota > 0 {
+		go b.collect(time.Now(), item.ID)
+	}
+	out := *item
+	return &out, nil
+}
+
+// List returns the items in the bin of share, or of every share, newest
+// first.
+func (b *RecycleBin) List(share string) []RecycleItem {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	items := []RecycleItem{}
+	for i := len(b.items) - 1; i >= 0; i-- {
+		if share == "" || b.items[i].Share == share {
+			items = append(items, *b.items[i])
+		}
+	}
+	return items
+}
+
+// take removes an item from the list and returns it.
+func (b *RecycleBin) take(id string) (*RecycleItem, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for i, item := range b.items {
+		if item.ID == id {
+			b.items = append(b.items[:i], b.items[i+1:]...)
+			if err := b.save(); err != nil {
+				log.Printf("Error saving recycle bin: %v", err)
+			}
+			return item, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// put returns an item taken with take to the list.
+func (b *RecycleBin) put(item *RecycleItem) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.items = append(b.items, item)
+	sort.Slice(b.items, func(i, j int) bool { return b.items[i].Deleted.Before(b.items[j].Deleted) })
+	if err := b.save(); err != nil {
+		log.Printf("Error saving recycle bin: %v", err)
+	}
+}
+
+// Restore moves an item back to where it was deleted from, recreating
+// missing parent directories. If something exists there now, conflict
+// decides: rename (the default) restores next to it as "name (1)",
+// overwrite replaces it, merging directories. A file and a directory do
+// not replace each other (ErrTypeConflict).
+func (b *RecycleBin) Restore(id, conflict string) (*RecycleItem, error) {
+	if conflict == "" {
+		conflict = "rename"
+	}
+	if !RestorePolicies[conflict] {
+		return nil, fmt.Errorf("invalid conflict policy: %q", conflict)
+	}
+	item, err := b.take(id)
+	if err != nil {
+		return nil, err
+	}
+	restored := *item
+	if err := b.restore(&restored, conflict); err != nil {
+		b.put(item)
+		return nil, err
+	}
+	return &restored, nil
+}
+
+func (b *RecycleBin) restore(item *RecycleItem, conflict string) error {
+	root, err := b.storage.openRoot()
+	if err != nil {
+		return err
+	}
+	defer root.Close()
+	bin, err := openBeneath(root, filepath.Join(item.Share, recycleDir), unix.O_RDONLY|unix.O_DIRECTORY, 0)
+	if err != nil {
+		return jailError("open recycle bin", item.Share, err)
+	}
+	defer bin.Close()
+	if err := mkdirAllBeneath(root, filepath.Dir(item.Path), 0755); err != nil {
+		return jailError("mkdir", filepath.Dir(item.Path), err)
+	}
+	dir, name, err := openParent(root, item.Path)
+	if err != nil {
+		return jailError("restore", item.Path, err)
+	}
+	defer dir.Close()
+	// Pick the free name here rather than in entry so the item reports
+	// where it ended up.
+	var st unix.Stat_t
+	if conflict == "rename" && unix.Fstatat(int(dir.Fd()), name, &st, unix.AT_SYMLINK_NOFOLLOW) == nil {
+		name = freeName(int(dir.Fd()), name)
+		item.Path = filepath.Join(filepath.Dir(item.Path), name)
+		item.Name = name
+	}
+	t := &transfer{s: &TransferService{}, ctx: context.Background(), job: &TransferJob{}, move: true, conflict: conflict}
+	if err := t.entry(bin, item.ID, dir, name, item.Path); err != nil {
+		return fmt.Errorf("failed to restore %s: %v", item.Path, err)
+	}
+	return nil
+}
+
+// Purge deletes an item for good.
+func (b *RecycleBin) Purge(id string) error {
+	item, err := b.take(id)
+	if err != nil {
+		return err
+	}
+	if err := b.remove(item); err != nil {
+		b.put(item)
+		return err
+	}
+	return nil
+}
+
+// Empty purges every item in the bin of share, or in all bins.
+func (b *RecycleBin) Empty(share string) error {
+	for _, item := range b.List(share) {
+		if err := b.Purge(item.ID); err != nil && !errors.Is(err, ErrNotFound) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *RecycleBin) remove(item *RecycleItem) error {
+	root, err := b.storage.openRoot()
+	if err != nil {
+		return err
+	}
+	defer root.Close()
+	bin, err := openBeneath(root, filepath.Join(item.Share, recycleDir), unix.O_RDONLY|unix.O_DIRECTORY, 0)
+	if errors.Is(err, unix.ENOENT) {
+		return nil
+	}
+	if err != nil {
+		return jailError("open recycle bin", item.Share, err)
+	}
+	defer bin.Close()
+	if err := removeAllAt(int(bin.Fd()), item.ID); err != nil {
+		return fmt.Errorf("failed to purge %s: %v", item.Path, err)
+	}
+	return nil
+}
+
+// collect purges items past the retention period, then the oldest items of
+// each share until its bin is within the quota. The item with ID spare is
+// never purged, so a deletion that overflows the quota does not lose the
+// item it just moved into the bin.
+func (b *RecycleBin) collect(now time.Time, spare string) {
+	b.collecting.Lock()
+	defer b.collecting.Unlock()
+
+	b.mu.Lock()
+	settings := b.settings
+	var purge, kept []*RecycleItem
+	used := map[string]int64{}
+	for _, item := range b.items {
+		if settings.RetentionDays > 0 && item.ID != spare && now.Sub(item.Deleted) > time.Duration(settings.RetentionDays)*24*time.Hour {
+			purge = append(purge, item)
+			continue
+		}
+		kept = append(kept, item)
+		used[item.Share] += item.Size
+	}
+	// Items are kept oldest first.
+	for _, item := range kept {
+		if settings.QuotaBytes > 0 && used[item.Share] > settings.QuotaBytes && item.ID != spare {
+			purge = append(purge, item)
+			used[item.Share] -= item.Size
+		}
+	}
+	b.mu.Unlock()
+
+	for _, item := range purge {
+		log.Printf("Recycle bin: purging %s of share %s, deleted %s", item.Path, item.Share, item.Deleted.Format(time.RFC3339))
+		if err := b.Purge(item.ID); err != nil && !errors.Is(err, ErrNotFound) {
+			log.Printf("Recycle bin: %v", err)
+		}
+	}
+}
+
+func (b *RecycleBin) Settings() RecycleSettings {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.settings
+}
+
+func (b *RecycleBin) SetSettings(settings RecycleSettings) (*RecycleSettings, error) {
+	if settings.RetentionDays < 0 || settings.QuotaBytes < 0 {
+		return nil, errors.New("retention and quota cannot be negative")
+	}
+	b.mu.Lock()
+	b.settings = settings
+	err := b.save()
+	b.mu.Unlock()
+	if err != nil {
+		return nil, fmt.Errorf("failed to save settings: %v", err)
+	}
+	go b.collect(time.Now(), "")
+	return &settings, nil
+}
@@ -0,0 +1,102 @@
+package services
+
+import (
+	"errors"
+	"mime/multipart"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func recycleFiles(t *testing.T, sizes map[string]int) (*RecycleBin, map[string]string) {
+	t.Helper()
+	t.Setenv("A1NAS_DATA_DIR", t.TempDir())
+	base := t.TempDir()
+	if err := os.Mkdir(filepath.Join(base, "share"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	b := NewRecycleBin(NewStorageServiceWithRunner(base, nil))
+	ids := map[string]string{}
+	for _, name := range []string{"1", "2", "3"} {
+		size, ok := sizes[name]
+		if !ok {
+			continue
+		}
+		if err := os.WriteFile(filepath.Join(base, "share", name), make([]byte, size), 0644); err != nil {
+			t.Fatal(err)
+		}
+		item, err := b.Delete("share/"+name, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids[name] = item.ID
+	}
+	return b, ids
+}
+
+func recycledNames(b *RecycleBin) string {
+	var names []string
+	for _, item := range b.List("share") {
+		names = append(names, item.Name)
+	}
+	return strings.Join(names, ",")
+}
+
+func TestRecycleBinQuotaPurgesOldestFirst(t *testing.T) {
+	b, _ := recycleFiles(t, map[string]int{"1": 100, "2": 300, "3": 50})
+	b.settings.QuotaBytes = 200
+	b.collect(b.items[len(b.items)-1].Deleted, "")
+	if got := recycledNames(b); got != "3" {
+		t.Errorf("kept %q, want the newest item only", got)
+	}
+}
+
+func TestRecycleBinQuotaSparesDeletedItem(t *testing.T) {
+	b, ids := recycleFiles(t, map[string]int{"1": 100, "2": 100, "3": 500})
+	b.settings.QuotaBytes = 250
+	now := b.items[len(b.items)-1].Deleted
+	b.collect(now, ids["3"])
+	if got := recycledNames(b); got != "3" {
+		t.Errorf("kept %q, want the item just deleted", got)
+	}
+	b.collect(now, "")
+	if got := recycledNames(b); got != "" {
+		t.Errorf("kept %q over the quota", got)
+	}
+}
+
+func TestFileOperationsRefuseInternalPaths(t *testing.T) {
+	b, ids := recycleFiles(t, map[string]int{"1": 10})
+	s := b.storage
+	u := NewUploadService(s)
+	if err := os.MkdirAll(filepath.Join(s.basePath, "share", uploadStagingDir), 0700); err != nil {
+		t.Fatal(err)
+	}
+	for _, dir := range []string{"share/" + recycleDir, "/share/" + uploadStagingDir, "share/x/../" + recycleDir} {
+		if _, err := s.ListFiles(dir); !errors.Is(err, ErrInvalidPath) {
+			t.Errorf("ListFiles(%q): got %v", dir, err)
+		}
+		if _, _, err := s.OpenFile(dir + "/" + ids["1"]); !errors.Is(err, ErrInvalidPath) {
+			t.Errorf("OpenFile in %q: got %v", dir, err)
+		}
+		if err := s.DeleteItem(dir); !errors.Is(err, ErrInvalidPath) {
+			t.Errorf("DeleteItem(%q): got %v", dir, err)
+		}
+		if err := s.CreateDirectory(dir + "/new"); !errors.Is(err, ErrInvalidPath) {
+			t.Errorf("CreateDirectory in %q: got %v", dir, err)
+		}
+		if err := s.UploadFile(dir, &multipart.FileHeader{Filename: "f"}); !errors.Is(err, ErrInvalidPath) {
+			t.Errorf("UploadFile to %q: got %v", dir, err)
+		}
+		if _, err := u.Create(dir, "f", 1, nil); !errors.Is(err, ErrInvalidPath) {
+			t.Errorf("Create in %q: got %v", dir, err)
+		}
+	}
+	if got := recycledNames(b); got != "1" {
+		t.Errorf("recycle bin holds %q, want the deleted file", got)
+	}
+	if _, err := os.Stat(filepath.Join(s.basePath, "share", uploadStagingDir)); err != nil {
+		t.Errorf("staging area was touched: %v", err)
+	}
+}
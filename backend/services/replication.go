@@ -0,0 +1,805 @@
+package services
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ReplicationTarget is where a task sends its snapshots: another dataset on
+// this machine, or a dataset on a remote A1Nas reached through its peer API.
+type ReplicationTarget struct {
+	Type    string `json:"type"` // local or remote
+	Dataset string `json:"dataset"`
+	URL     string `json:"url,omitempty"`
+	Key     string `json:"key,omitempty"`
+}
+
+// ReplicationTask replicates a dataset with `zfs send`/`zfs receive`. Each
+// run takes a new snapshot and sends it incrementally from the newest
+// snapshot both sides have in common, or in full on the first run.
+type ReplicationTask struct {
+	ID             string            `json:"id"`
+	Name           string            `json:"name"`
+	Source         string            `json:"source"`
+	Target         ReplicationTarget `json:"target"`
+	Raw            bool              `json:"raw"`
+	BandwidthLimit int64             `json:"bandwidthLimit"` // bytes per second, 0 for unlimited
+	SnapshotPrefix string            `json:"snapshotPrefix"`
+	Created        time.Time         `json:"created"`
+}
+
+type ReplicationJob struct {
+	ID        string     `json:"id"`
+	TaskID    string     `json:"taskId"`
+	State     string     `json:"state"` // running, succeeded, failed, canceled
+	Mode      string     `json:"mode,omitempty"`
+	Snapshot  string     `json:"snapshot,omitempty"`
+	Base      string     `json:"base,omitempty"`
+	BytesSent int64      `json:"bytesSent"`
+	Started   time.Time  `json:"started"`
+	Finished  *time.Time `json:"finished,omitempty"`
+	Error     string     `json:"error,omitempty"`
+}
+
+// ReplicationState is what the receiving side reports about a target dataset.
+type ReplicationState struct {
+	Exists      bool     `json:"exists"`
+	Snapshots   []string `json:"snapshots"`
+	ResumeToken string   `json:"resumeToken,omitempty"`
+}
+
+// PeerKey authorizes a remote A1Nas to replicate into datasets under
+// Dataset. Only a hash of the secret is stored.
+type PeerKey struct {
+	ID      string    `json:"id"`
+	Name    string    `json:"name"`
+	Dataset string    `json:"dataset"`
+	Hash    string    `json:"hash,omitempty"`
+	Created time.Time `json:"created"`
+}
+
+const maxReplicationJobs = 200
+
+type ReplicationService struct {
+	storage *StorageService
+	path    string
+	client  *http.Client
+
+	mu      sync.Mutex
+	tasks   []*ReplicationTask
+	jobs    []*ReplicationJob
+	keys    []*PeerKey
+	cancels map[string]context.CancelFunc
+}
+
+func NewReplicationService(storage *StorageService) *ReplicationService {
+	s := &ReplicationService{
+		storage: storage,
+		path:    filepath.Join(DataDir(), "replication.json"),
+		client:  &http.Client{},
+		tasks:   []*ReplicationTask{},
+		jobs:    []*ReplicationJob{},
+		keys:    []*PeerKey{},
+		cancels: map[string]context.CancelFunc{},
+	}
+	var state struct {
+		Tasks []*ReplicationTask `json:"tasks"`
+		Jobs  []*ReplicationJob  `json:"jobs"`
+		Keys  []*PeerKey         `json:"keys"`
+	}
+	if err := loadJSON(s.path, &state); err != nil {
+		log.Printf("Error loading replication state: %v", err)
+	}
+	if state.Tasks != nil {
+		s.tasks = state.Tasks
+	}
+	if state.Keys != nil {
+		s.keys = state.Keys
+	}
+	for _, job := range state.Jobs {
+		// A job that was running when the daemon stopped can be picked up
+		// again from the receive resume token on the next run.
+		if job.State == "running" {
+			now := time.Now()
+			job.State, job.Error, job.Finished = "failed", "interrupted by daemon restart", &now
+		}
+		s.jobs = append(s.jobs, job)
+	}
+	return s
+}
+
+// trimJobs drops the oldest finished jobs beyond maxReplicationJobs. Running jobs
+// are kept however many there are. It must be called with s.mu held.
+func (s *ReplicationService) trimJobs() {
+	excess := len(s.jobs) - maxReplicationJobs
+	if excess <= 0 {
+		return
+	}
+	kept := make([]*ReplicationJob, 0, len(s.jobs))
+	for _, job := range s.jobs {
+		if excess > 0 && job.State != "running" {
+			excess--
+			continue
+		}
+		kept = append(kept, job)
+	}
+	s.jobs = kept
+}
+
+// save must be called with s.mu held.
+func (s *ReplicationService) save() error {
+	return saveJSON(s.path, map[string]interface{}{
+		"tasks": s.tasks,
+		"jobs":  s.jobs,
+		"keys":  s.keys,
+	})
+}
+
+func validateReplicationTask(t *ReplicationTask) error {
+	if err := validDatasetName(t.Source); err != nil {
+		return err
+	}
+	if err := validDatasetName(t.Target.Dataset); err != nil {
+		return err
+	}
+	if t.SnapshotPrefix == "" {
+		t.SnapshotPrefix = "repl"
+	}
+	if !snapshotPartRe.MatchString(t.SnapshotPrefix) {
+		return fmt.Errorf("invalid snapshot prefix: %q", t.SnapshotPrefix)
+	}
+	if t.BandwidthLimit < 0 {
+		return errors.New("bandwidth limit cannot be negative")
+	}
+	switch t.Target.Type {
+	case "local":
+		if DatasetWithin(t.Target.Dataset, t.Source) {
+			return errors.New("target cannot be the source dataset or one of its children")
+		}
+		t.Target.URL, t.Target.Key = "", ""
+	case "remote":
+		u, err := url.Parse(t.Target.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid remote URL: %q", t.Target.URL)
+		}
+		if t.Target.Key == "" {
+			return errors.New("a peer key is required for remote targets")
+		}
+	default:
+		return errors.New("target type must be local or remote")
+	}
+	return nil
+}
+
+// redacted hides the peer key of a remote target from API responses.
+func (t *ReplicationTask) redacted() ReplicationTask {
+	out := *t
+	if out.Target.Key != "" {
+		out.Target.Key = "********"
+	}
+	return out
+}
+
+func (s *ReplicationService) ListTasks() []ReplicationTask {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tasks := []ReplicationTask{}
+	for _, t := range s.tasks {
+		tasks = append(tasks, t.redacted())
+	}
+	return tasks
+}
+
+func (s *ReplicationService) GetTask(id string) (*ReplicationTask, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, t := range s.tasks {
+		if t.ID == id {
+			out := t.redacted()
+			return &out, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (s *ReplicationService) CreateTask(t ReplicationTask) (*ReplicationTask, error) {
+	if err := validateReplicationTask(&t); err != nil {
+		return nil, err
+	}
+	t.ID = newID()
+	t.Created = time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tasks = append(s.tasks, &t)
+	if err := s.save(); err != nil {
+		return nil, fmt.Errorf("failed to save task: %v", err)
+	}
+	out := t.redacted()
+	return &out, nil
+}
+
+// UpdateTask replaces a task's settings. An empty or redacted key keeps the
+// stored one.
+func (s *ReplicationService) UpdateTask(id string, update ReplicationTask) (*ReplicationTask, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, t := range s.tasks {
+		if t.ID != id {
+			continue
+		}
+		if update.Target.Key == "" || update.Target.Key == "********" {
+			update.Target.Key = t.Target.Key
+		}
+		if err := validateReplicationTask(&update); err != nil {
+			return nil, err
+		}
+		update.ID, update.Created = t.ID, t.Created
+		*t = update
+		if err := s.save(); err != nil {
+			return nil, fmt.Errorf("failed to save task: %v", err)
+		}
+		out := t.redacted()
+		return &out, nil
+	}
+	return nil, ErrNotFound
+}
+
+func (s *ReplicationService) DeleteTask(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, t := range s.tasks {
+		if t.ID == id {
+			s.tasks = append(s.tasks[:i], s.tasks[i+1:]...)
+			return s.save()
+		}
+	}
+	return ErrNotFound
+}
+
+// ListJobs returns replication jobs, newest first, optionally for one task.
+func (s *ReplicationService) ListJobs(taskID string) []ReplicationJob {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	jobs := []ReplicationJob{}
+	for i := len(s.jobs) - 1; i >= 0; i-- {
+		if taskID == "" || s.jobs[i].TaskID == taskID {
+			jobs = append(jobs, *s.jobs[i])
+		}
+	}
+	return jobs
+}
+
+func (s *ReplicationService) GetJob(id string) (*ReplicationJob, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, job := range s.jobs {
+		if job.ID == id {
+			out := *job
+			return &out, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (s *ReplicationService) CancelJob(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cancel, ok := s.cancels[id]
+	if !ok {
+		return ErrNotFound
+	}
+	cancel()
+	return nil
+}
+
+// RunTask starts a replication job in the background.
+func (s *ReplicationService) RunTask(id string) (*ReplicationJob, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var task *ReplicationTask
+	for _, t := range s.tasks {
+		if t.ID == id {
+			task = t
+		}
+	}
+	if task == nil {
+		return nil, ErrNotFound
+	}
+	for _, job := range s.jobs {
+		if job.TaskID == id && job.State == "running" {
+			return nil, errors.New("task is already running")
+		}
+	}
+
+	job := &ReplicationJob{ID: newID(), TaskID: id, State: "running", Started: time.Now()}
+	s.jobs = append(s.jobs, job)
+	s.trimJobs()
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancels[job.ID] = cancel
+
+	go func(t ReplicationTask) {
+		err := s.replicate(ctx, t, job)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		cancel()
+		delete(s.cancels, job.ID)
+		now := time.Now()
+		job.Finished = &now
+		switch {
+		case err == nil:
+			job.State = "succeeded"
+		case ctx.Err() != nil:
+			job.State, job.Error = "canceled", "canceled"
+		default:
+			job.State, job.Error = "failed", err.Error()
+			log.Printf("Replication task %s failed: %v", t.ID, err)
+		}
+		if err := s.save(); err != nil {
+			log.Printf("Error saving replication state: %v", err)
+		}
+	}(*task)
+
+	out := *job
+	return &out, nil
+}
+
+func (s *ReplicationService) setJob(job *ReplicationJob, update func(*ReplicationJob)) {
+	s.mu.Lock()
+	update(job)
+	s.mu.Unlock()
+}
+
+func (s *ReplicationService) replicate(ctx context.Context, t ReplicationTask, job *ReplicationJob) error {
+	state, err := s.targetState(ctx, t.Target)
+	if err != nil {
+		return err
+	}
+
+	// Finish an interrupted transfer first; its token encodes the stream.
+	if state.ResumeToken != "" {
+		s.setJob(job, func(j *ReplicationJob) { j.Mode = "resume" })
+		if err := s.transfer(ctx, t, job, []string{"send", "-t", state.ResumeToken}, false); err != nil {
+			return err
+		}
+		if state, err = s.targetState(ctx, t.Target); err != nil {
+			return err
+		}
+	}
+
+	snapName := t.SnapshotPrefix + "-" + time.Now().Format("20060102-150405")
+	if err := s.storage.CreateSnapshot(t.Source, snapName, false); err != nil {
+		return err
+	}
+	snapshot := t.Source + "@" + snapName
+
+	base := ""
+	if state.Exists {
+		base, err = s.commonSnapshot(t.Source, state.Snapshots)
+		if err != nil {
+			return err
+		}
+	}
+
+	args := []string{"send"}
+	if t.Raw {
+		args = append(args, "-w")
+	}
+	mode := "full"
+	if base != "" {
+		mode = "incremental"
+		args = append(args, "-i", t.Source+"@"+base)
+	}
+	args = append(args, snapshot)
+	s.setJob(job, func(j *ReplicationJob) {
+		j.Mode, j.Snapshot, j.Base, j.BytesSent = mode, snapshot, base, 0
+	})
+	if err := s.transfer(ctx, t, job, args, base != ""); err != nil {
+		return err
+	}
+
+	// The snapshot just sent is the base of the next run on both sides, so
+	// the older ones of this task can go. Failing to prune does not fail
+	// the run.
+	if err := s.pruneSource(t, snapName); err != nil {
+		log.Printf("Replication task %s: %v", t.ID, err)
+	}
+	if err := s.pruneTarget(ctx, t, snapName); err != nil {
+		log.Printf("Replication task %s: %v", t.ID, err)
+	}
+	return nil
+}
+
+// replicaSnapshot reports whether name is a snapshot taken by a task with
+// prefix, i.e. "<prefix>-YYYYMMDD-HHMMSS". The timestamp makes names of
+// one prefix sort by age.
+func replicaSnapshot(name, prefix string) bool {
+	stamp, ok := strings.CutPrefix(name, prefix+"-")
+	if !ok {
+		return false
+	}
+	_, err := time.Parse("20060102-150405", stamp)
+	return err == nil
+}
+
+// pruneSource destroys the source snapshots of the task's prefix older than
+// keep. Other tasks replicating the same source may share the prefix, so
+// the snapshot each of them sent last, and anything a running one uses, is
+// kept as well.
+func (s *ReplicationService) pruneSource(t ReplicationTask, keep string) error {
+	kept := map[string]bool{}
+	s.mu.Lock()
+	sharing := map[string]bool{}
+	for _, other := range s.tasks {
+		if other.ID != t.ID && other.Source == t.Source {
+			sharing[other.ID] = true
+		}
+	}
+	for i := len(s.jobs) - 1; i >= 0; i-- {
+		job := s.jobs[i]
+		if !sharing[job.TaskID] {
+			continue
+		}
+		switch job.State {
+		case "running":
+			kept[job.Base] = true
+			kept[strings.TrimPrefix(job.Snapshot, t.Source+"@")] = true
+		case "succeeded":
+			kept[strings.TrimPrefix(job.Snapshot, t.Source+"@")] = true
+			delete(sharing, job.TaskID)
+		}
+	}
+	s.mu.Unlock()
+
+	snapshots, err := s.storage.ListSnapshots(t.Source)
+	if err != nil {
+		return err
+	}
+	var failed []string
+	for _, snap := range snapshots {
+		if snap.Dataset != t.Source || !replicaSnapshot(snap.Snapshot, t.SnapshotPrefix) || snap.Snapshot >= keep || kept[snap.Snapshot] {
+			continue
+		}
+		if err := s.storage.DestroySnapshot(snap.Name, false); err != nil {
+			failed = append(failed, snap.Name)
+		}
+	}
+	if failed != nil {
+		return fmt.Errorf("failed to prune source snapshots: %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+func (s *ReplicationService) pruneTarget(ctx context.Context, t ReplicationTask, keep string) error {
+	if t.Target.Type == "local" {
+		return s.storage.PruneReplica(t.Target.Dataset, t.SnapshotPrefix, keep)
+	}
+
+	q := url.Values{"dataset": {t.Target.Dataset}, "prefix": {t.SnapshotPrefix}, "keep": {keep}}
+	endpoint := strings.TrimRight(t.Target.URL, "/") + "/api/peer/replication/prune?" + q.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+t.Target.Key)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to reach remote: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("remote prune failed: %s", remoteError(resp))
+	}
+	return nil
+}
+
+// commonSnapshot returns the newest source snapshot that also exists on the
+// target. A target that exists without one cannot be updated safely.
+func (s *ReplicationService) commonSnapshot(source string, target []string) (string, error) {
+	snapshots, err := s.storage.ListSnapshots(source)
+	if err != nil {
+		return "", err
+	}
+	have := map[string]bool{}
+	for _, name := range target {
+		have[name] = true
+	}
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].Created.After(snapshots[j].Created) })
+	for _, snap := range snapshots {
+		if snap.Dataset == source && have[snap.Snapshot] {
+			return snap.Snapshot, nil
+		}
+	}
+	return "", errors.New("target dataset exists but shares no snapshot with the source")
+}
+
+// transfer pipes `zfs send` into a local `zfs receive` or the remote peer.
+func (s *ReplicationService) transfer(ctx context.Context, t ReplicationTask, job *ReplicationJob, sendArgs []string, incremental bool) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	pr, pw := io.Pipe()
+	sendDone := make(chan error, 1)
+	go func() {
+		err := s.storage.runner.Stream(ctx, nil, pw, "zfs", sendArgs...)
+		pw.CloseWithError(err)
+		sendDone <- err
+	}()
+
+	stream := &throttledReader{ctx: ctx, r: pr, limit: t.BandwidthLimit, start: time.Now(), progress: func(n int64) {
+		s.setJob(job, func(j *ReplicationJob) { j.BytesSent += n })
+	}}
+
+	var recvErr error
+	if t.Target.Type == "local" {
+		recvErr = s.storage.receiveStream(ctx, t.Target.Dataset, incremental, stream)
+	} else {
+		recvErr = s.sendRemote(ctx, t.Target, incremental, stream)
+	}
+	if recvErr != nil {
+		// Stop zfs send rather than let it block on a pipe nobody reads.
+		cancel()
+		pr.CloseWithError(recvErr)
+		<-sendDone
+		return recvErr
+	}
+	if err := <-sendDone; err != nil {
+		return fmt.Errorf("zfs send failed: %v", err)
+	}
+	return nil
+}
+
+// receiveStream runs `zfs receive` on this machine. Receives are resumable
+// (-s) and left unmounted (-u) so a replica never mounts over live data;
+// incremental receives roll the target back to the common snapshot (-F).
+func (s *StorageService) receiveStream(ctx context.Context, dataset string, incremental bool, r io.Reader) error {
+	args := []string{"receive", "-s", "-u"}
+	if incremental {
+		args = append(args, "-F")
+	}
+	args = append(args, dataset)
+
+	if err := s.runner.Stream(ctx, r, nil, "zfs", args...); err != nil {
+		return fmt.Errorf("zfs receive failed: %v", err)
+	}
+	return nil
+}
+
+func (s *ReplicationService) sendRemote(ctx context.Context, target ReplicationTarget, incremental bool, r io.Reader) error {
+	q := url.Values{"dataset": {target.Dataset}}
+	if incremental {
+		q.Set("incremental", "true")
+	}
+	endpoint := strings.TrimRight(target.URL, "/") + "/api/peer/replication/receive?" + q.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, r)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+target.Key)
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to reach remote: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("remote receive failed: %s", remoteError(resp))
+	}
+	return nil
+}
+
+func (s *ReplicationService) targetState(ctx context.Context, target ReplicationTarget) (*ReplicationState, error) {
+	if target.Type == "local" {
+		return s.storage.ReplicationState(target.Dataset)
+	}
+
+	endpoint := strings.TrimRight(target.URL, "/") + "/api/peer/replication/state?" +
+		url.Values{"dataset": {target.Dataset}}.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+target.Key)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach remote: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("remote state request failed: %s", remoteError(resp))
+	}
+	var state ReplicationState
+	if err := json.NewDecoder(resp.Body).Decode(&state); err != nil {
+		return nil, fmt.Errorf("invalid remote state: %v", err)
+	}
+	return &state, nil
+}
+
+func remoteError(resp *http.Response) string {
+	var body struct {
+		Error string `json:"error"`
+	}
+	if json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&body) == nil && body.Error != "" {
+		return body.Error
+	}
+	return resp.Status
+}
+
+// ReplicationState reports the snapshots and resume token of a dataset on
+// this machine.
+func (s *StorageService) ReplicationState(dataset string) (*ReplicationState, error) {
+	if err := validDatasetName(dataset); err != nil {
+		return nil, err
+	}
+	state := &ReplicationState{Snapshots: []string{}}
+	output, err := s.run("zfs", "get", "-H", "-o", "value", "receive_resume_token", dataset)
+	if err != nil {
+		// The dataset does not exist yet; the first send will be a full one.
+		return state, nil
+	}
+	state.Exists = true
+	if token := strings.TrimSpace(string(output)); token != "-" {
+		state.ResumeToken = token
+	}
+
+	output, err = s.run("zfs", "list", "-H", "-t", "snapshot", "-o", "name", "-d", "1", dataset)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list target snapshots: %v", err)
+	}
+	for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		if parts := strings.SplitN(line, "@", 2); len(parts) == 2 {
+			state.Snapshots = append(state.Snapshots, parts[1])
+		}
+	}
+	return state, nil
+}
+
+// PruneReplica destroys the snapshots of a replica taken with prefix that
+// are older than keep, the newest one received.
+func (s *StorageService) PruneReplica(dataset, prefix, keep string) error {
+	if !replicaSnapshot(keep, prefix) {
+		return fmt.Errorf("invalid snapshot to keep: %q", keep)
+	}
+	state, err := s.ReplicationState(dataset)
+	if err != nil {
+		return err
+	}
+	var failed []string
+	for _, name := range state.Snapshots {
+		if !replicaSnapshot(name, prefix) || name >= keep {
+			continue
+		}
+		if err := s.DestroySnapshot(dataset+"@"+name, false); err != nil {
+			failed = append(failed, dataset+"@"+name)
+		}
+	}
+	if failed != nil {
+		return fmt.Errorf("failed to prune target snapshots: %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// ReceivePeerStream receives a stream sent by a remote A1Nas.
+func (s *StorageService) ReceivePeerStream(ctx context.Context, dataset string, incremental bool, r io.Reader) error {
+	if err := validDatasetName(dataset); err != nil {
+		return err
+	}
+	return s.receiveStream(ctx, dataset, incremental, r)
+}
+
+// CreatePeerKey creates a key that lets a remote A1Nas replicate into
+// dataset and its children. The secret is only returned here.
+func (s *ReplicationService) CreatePeerKey(name, dataset string) (*PeerKey, string, error) {
+	if err := validDatasetName(dataset); err != nil {
+		return nil, "", err
+	}
+	secret := newID() + newID() + newID() + newID()
+	sum := sha256.Sum256([]byte(secret))
+	key := &PeerKey{ID: newID(), Name: name, Dataset: dataset, Hash: hex.EncodeToString(sum[:]), Created: time.Now()}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys = append(s.keys, key)
+	if err := s.save(); err != nil {
+		return nil, "", fmt.Errorf("failed to save key: %v", err)
+	}
+	out := *key
+	out.Hash = ""
+	return &out, key.ID + "." + secret, nil
+}
+
+func (s *ReplicationService) ListPeerKeys() []PeerKey {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := []PeerKey{}
+	for _, k := range s.keys {
+		out := *k
+		out.Hash = ""
+		keys = append(keys, out)
+	}
+	return keys
+}
+
+func (s *ReplicationService) DeletePeerKey(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, k := range s.keys {
+		if k.ID == id {
+			s.keys = append(s.keys[:i], s.keys[i+1:]...)
+			return s.save()
+		}
+	}
+	return ErrNotFound
+}
+
+// ValidatePeerKey checks a "<id>.<secret>" key and returns the dataset it
+// is scoped to.
+func (s *ReplicationService) ValidatePeerKey(token string) (string, error) {
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) != 2 {
+		return "", errors.New("invalid peer key")
+	}
+	sum := sha256.Sum256([]byte(parts[1]))
+	hash := hex.EncodeToString(sum[:])
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, k := range s.keys {
+		if k.ID == parts[0] && subtle.ConstantTimeCompare([]byte(k.Hash), []byte(hash)) == 1 {
+			return k.Dataset, nil
+		}
+	}
+	return "", errors.New("invalid peer key")
+}
+
+// throttledReader limits the average read rate to limit bytes per second
+// and reports progress after each read. Waiting ends early when ctx is
+// canceled.
+type throttledReader struct {
+	ctx      context.Context
+	r        io.Reader
+	limit    int64
+	start    time.Time
+	total    int64
+	progress func(int64)
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	if t.limit > 0 && int64(len(p)) > t.limit {
+		p = p[:t.limit]
+	}
+	n, err := t.r.Read(p)
+	if n > 0 {
+		t.total += int64(n)
+		if t.progress != nil {
+			t.progress(int64(n))
+		}
+		if t.limit > 0 {
+			expected := time.Duration(float64(t.total) / float64(t.limit) * float64(time.Second))
+			if wait := expected - time.Since(t.start); wait > 0 {
+				select {
+				case <-t.ctx.Done():
+					return n, t.ctx.Err()
+				case <-time.After(wait):
+				}
+			}
+		}
+	}
+	return n, err
+}
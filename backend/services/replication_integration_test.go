@@ -0,0 +1,139 @@
+//go:build integration
+
+package services
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Run with `go test -tags integration ./services/` as root on a machine
+// with ZFS. The pools are backed by sparse files and destroyed afterwards.
+
+func filePool(t *testing.T, runner CommandRunner, name string) string {
+	t.Helper()
+	dir := t.TempDir()
+	file := filepath.Join(dir, name+".img")
+	ctx := context.Background()
+	if _, err := runner.Run(ctx, "truncate", "-s", "128M", file); err != nil {
+		t.Fatal(err)
+	}
+	altroot := filepath.Join(dir, "root")
+	if _, err := runner.Run(ctx, "zpool", "create", "-R", altroot, name, file); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if _, err := runner.Run(ctx, "zpool", "destroy", "-f", name); err != nil {
+			t.Errorf("failed to destroy pool %s: %v", name, err)
+		}
+	})
+	return altroot
+}
+
+func runReplication(t *testing.T, s *ReplicationService, taskID string) ReplicationJob {
+	t.Helper()
+	job, err := s.RunTask(taskID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Minute)
+	for time.Now().Before(deadline) {
+		current, err := s.GetJob(job.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if current.State != "running" {
+			if current.State != "succeeded" {
+				t.Fatalf("job %s: %s", current.State, current.Error)
+			}
+			return *current
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Fatal("replication did not finish within a minute")
+	return ReplicationJob{}
+}
+
+func prefixSnapshots(t *testing.T, s *StorageService, dataset string) []string {
+	t.Helper()
+	state, err := s.ReplicationState(dataset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, name := range state.Snapshots {
+		if replicaSnapshot(name, "repl") {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func TestReplicationBetweenFilePools(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("needs root")
+	}
+	if _, err := exec.LookPath("zpool"); err != nil {
+		t.Skip("zpool not installed")
+	}
+	t.Setenv("A1NAS_DATA_DIR", t.TempDir())
+	runner := &ExecRunner{Timeout: DefaultCommandTimeout}
+	storage := NewStorageServiceWithRunner(t.TempDir(), runner)
+	ctx := context.Background()
+
+	src := fmt.Sprintf("a1nassrc%d", os.Getpid())
+	dst := fmt.Sprintf("a1nasdst%d", os.Getpid())
+	srcRoot := filePool(t, runner, src)
+	dstRoot := filePool(t, runner, dst)
+	if _, err := runner.Run(ctx, "zfs", "create", src+"/data"); err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(srcRoot, src, "data", "file")
+	if err := os.WriteFile(file, []byte("first"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewReplicationService(storage)
+	task, err := s.CreateTask(ReplicationTask{Name: "test", Source: src + "/data",
+		Target: ReplicationTarget{Type: "local", Dataset: dst + "/data"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if job := runReplication(t, s, task.ID); job.Mode != "full" {
+		t.Errorf("first run was %s", job.Mode)
+	}
+
+	// Snapshot names have a resolution of one second.
+	time.Sleep(1100 * time.Millisecond)
+	if err := os.WriteFile(file, []byte("second"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	job := runReplication(t, s, task.ID)
+	if job.Mode != "incremental" {
+		t.Errorf("second run was %s", job.Mode)
+	}
+
+	// Only the snapshot just sent is left on either side.
+	want := strings.TrimPrefix(job.Snapshot, src+"/data@")
+	if got := prefixSnapshots(t, storage, src+"/data"); len(got) != 1 || got[0] != want {
+		t.Errorf("source snapshots %q, want %q", got, want)
+	}
+	if got := prefixSnapshots(t, storage, dst+"/data"); len(got) != 1 || got[0] != want {
+		t.Errorf("target snapshots %q, want %q", got, want)
+	}
+
+	if _, err := runner.Run(ctx, "zfs", "mount", dst+"/data"); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(dstRoot, dst, "data", "file"))
+	if err != nil || string(data) != "second" {
+		t.Errorf("replica holds %q, %v", data, err)
+	}
+}
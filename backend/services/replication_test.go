@@ -0,0 +1,120 @@
+package services
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestThrottledReaderStopsWaitingOnCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &throttledReader{ctx: ctx, r: strings.NewReader(strings.Repeat("x", 64)), limit: 8, start: time.Now()}
+	buf := make([]byte, 64)
+	// The first read is within the limit; the second would wait a second.
+	if n, err := r.Read(buf); n != 8 || err != nil {
+		t.Fatalf("got %d, %v", n, err)
+	}
+	time.AfterFunc(50*time.Millisecond, cancel)
+	started := time.Now()
+	if _, err := r.Read(buf); err != context.Canceled {
+		t.Errorf("got %v, want context.Canceled", err)
+	}
+	if waited := time.Since(started); waited > 500*time.Millisecond {
+		t.Errorf("canceled read waited %v", waited)
+	}
+}
+
+func TestReplicaSnapshot(t *testing.T) {
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"repl-20261018-103000", true},
+		{"repl-weekly-20261018-103000", false},
+		{"repl-2026", false},
+		{"auto-daily-20261018-0000", false},
+		{"repl", false},
+	}
+	for _, tt := range tests {
+		if got := replicaSnapshot(tt.name, "repl"); got != tt.want {
+			t.Errorf("replicaSnapshot(%q) = %v", tt.name, got)
+		}
+	}
+}
+
+func destroyCalls(fake *FakeRunner) []string {
+	var destroyed []string
+	for _, call := range fake.Calls() {
+		if name, ok := strings.CutPrefix(call, "zfs destroy "); ok {
+			destroyed = append(destroyed, name)
+		}
+	}
+	return destroyed
+}
+
+func TestPruneSourceKeepsBases(t *testing.T) {
+	t.Setenv("A1NAS_DATA_DIR", t.TempDir())
+	fake := NewFakeRunner()
+	s := NewReplicationService(NewStorageServiceWithRunner(t.TempDir(), fake))
+	task := ReplicationTask{ID: "a", Source: "tank/data", SnapshotPrefix: "repl"}
+	s.tasks = []*ReplicationTask{&task, {ID: "b", Source: "tank/data", SnapshotPrefix: "repl"}}
+	s.jobs = []*ReplicationJob{
+		{TaskID: "b", State: "succeeded", Snapshot: "tank/data@repl-20261001-000000"},
+		{TaskID: "b", State: "failed", Snapshot: "tank/data@repl-20261002-000000"},
+	}
+	fake.Add("zfs list -H -p -t snapshot -s creation -o name,used,refer,creation -r tank/data", FakeResponse{Stdout: "" +
+		"tank/data@repl-20261001-000000\t0\t0\t1790812800\n" +
+		"tank/data@repl-20261002-000000\t0\t0\t1790899200\n" +
+		"tank/data@repl-weekly-20261002-000000\t0\t0\t1790899200\n" +
+		"tank/data/child@repl-20261002-000000\t0\t0\t1790899200\n" +
+		"tank/data@auto-daily-20261002-0000\t0\t0\t1790899200\n" +
+		"tank/data@repl-20261003-000000\t0\t0\t1790985600\n"})
+	fake.Add("zfs destroy tank/data@repl-20261002-000000", FakeResponse{})
+
+	if err := s.pruneSource(task, "repl-20261003-000000"); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(destroyCalls(fake), ","); got != "tank/data@repl-20261002-000000" {
+		t.Errorf("destroyed %q", got)
+	}
+}
+
+func TestPruneReplica(t *testing.T) {
+	fake := NewFakeRunner()
+	s := NewStorageServiceWithRunner(t.TempDir(), fake)
+	fake.Add("zfs get -H -o value receive_resume_token backup/data", FakeResponse{Stdout: "-\n"})
+	fake.Add("zfs list -H -t snapshot -o name -d 1 backup/data", FakeResponse{Stdout: "" +
+		"backup/data@repl-20261001-000000\n" +
+		"backup/data@manual\n" +
+		"backup/data@repl-20261002-000000\n" +
+		"backup/data@repl-20261003-000000\n"})
+	fake.Add("zfs destroy backup/data@repl-20261001-000000", FakeResponse{})
+	fake.Add("zfs destroy backup/data@repl-20261002-000000", FakeResponse{})
+
+	if err := s.PruneReplica("backup/data", "repl", "repl-20261003-000000"); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(destroyCalls(fake), ","); got != "backup/data@repl-20261001-000000,backup/data@repl-20261002-000000" {
+		t.Errorf("destroyed %q", got)
+	}
+	if err := s.PruneReplica("backup/data", "repl", "manual"); err == nil {
+		t.Error("pruned up to a snapshot the task did not take")
+	}
+}
+
+func TestTrimJobsKeepsRunningJobs(t *testing.T) {
+	s := &ReplicationService{}
+	s.jobs = append(s.jobs, &ReplicationJob{ID: "long", State: "running"})
+	for i := 0; i < maxReplicationJobs; i++ {
+		s.jobs = append(s.jobs, &ReplicationJob{ID: "done", State: "succeeded"})
+	}
+	s.jobs = append(s.jobs, &ReplicationJob{ID: "new", State: "running"})
+	s.trimJobs()
+	if len(s.jobs) != maxReplicationJobs {
+		t.Errorf("kept %d jobs, want %d", len(s.jobs), maxReplicationJobs)
+	}
+	if s.jobs[0].ID != "long" || s.jobs[len(s.jobs)-1].ID != "new" {
+		t.Errorf("dropped a running job: first %s, last %s", s.jobs[0].ID, s.jobs[len(s.jobs)-1].ID)
+	}
+}
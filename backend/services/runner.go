@@ -0,0 +1,119 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// CommandRunner runs the external tools the storage service depends on
+// (zpool, zfs, smartctl, hdparm, lsblk, ...). Run collects stdout; Stream
+// connects stdin and stdout for long transfers such as zfs send/receive.
+type CommandRunner interface {
+	Run(ctx context.Context, name string, args ...string) ([]byte, error)
+	Stream(ctx context.Context, stdin io.Reader, stdout io.Writer, name string, args ...string) error
+}
+
+// CommandError is returned when a command exits unsuccessfully. It carries
+// the tool's stderr so API errors say what actually went wrong.
+type CommandError struct {
+	Name     string
+	Args     []string
+	ExitCode int
+	Stderr   string
+	Err      error
+}
+
+func (e *CommandError) Error() string {
+	msg := fmt.Sprintf("%s %s: %v", e.Name, strings.Join(e.Args, " "), e.Err)
+	if e.Stderr != "" {
+		msg += ": " + e.Stderr
+	}
+	return msg
+}
+
+func (e *CommandError) Unwrap() error {
+	return e.Err
+}
+
+// DefaultCommandTimeout bounds Run calls. Streams are only bounded by
+// their context.
+const DefaultCommandTimeout = 2 * time.Minute
+
+type stderrKey struct{}
+
+// withStderr makes Stream calls under ctx also copy the command's stderr to
+// w as it is written. badblocks and dd report their progress there.
+func withStderr(ctx context.Context, w io.Writer) context.Context {
+	return context.WithValue(ctx, stderrKey{}, w)
+}
+
+func stderrWatcher(ctx context.Context) io.Writer {
+	w, _ := ctx.Value(stderrKey{}).(io.Writer)
+	return w
+}
+
+// ExecRunner runs commands on the host with os/exec.
+type ExecRunner struct {
+	Timeout time.Duration
+}
+
+func (r *ExecRunner) Run(ctx context.Context, name string, args ...string) ([]byte, error) {
+	if r.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.Timeout)
+		defer cancel()
+	}
+	var stdout bytes.Buffer
+	err := r.Stream(ctx, nil, &stdout, name, args...)
+	return stdout.Bytes(), err
+}
+
+func (r *ExecRunner) Stream(ctx context.Context, stdin io.Reader, stdout io.Writer, name string, args ...string) error {
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stdin = stdin
+	cmd.Stdout = stdout
+	cmd.Stderr = &stderr
+	if w := stderrWatcher(ctx); w != nil {
+		cmd.Stderr = io.MultiWriter(&stderr, w)
+	}
+	if err := cmd.Run(); err != nil {
+		cmdErr := &CommandError{Name: name, Args: args, ExitCode: -1, Stderr: strings.TrimSpace(stderr.String()), Err: err}
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			cmdErr.ExitCode = exitErr.ExitCode()
+		}
+		if ctx.Err() == context.DeadlineExceeded {
+			cmdErr.Err = fmt.Errorf("timed out: %v", err)
+		}
+		return cmdErr
+	}
+	return nil
+}
+
+// NewCommandRunner returns the runner used by NewStorageService. When
+// A1NAS_COMMAND_FIXTURES names a fixture directory the API replays those
+// fixtures instead of touching the host, which is how the frontend can be
+// developed on a machine without ZFS.
+func NewCommandRunner() CommandRunner {
+	dir := os.Getenv("A1NAS_COMMAND_FIXTURES")
+	if dir == "" {
+		return &ExecRunner{Timeout: DefaultCommandTimeout}
+	}
+	runner, err := LoadFakeRunner(dir)
+	if err != nil {
+		// Never fall back to the host tools in fixture mode.
+		log.Printf("Error loading command fixtures from %s: %v", dir, err)
+		return NewFakeRunner()
+	}
+	log.Printf("Replaying storage commands from fixtures in %s", dir)
+	return runner
+}
@@ -0,0 +1,374 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+)
+
+var poolNameRe = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_.:-]*$`)
+
+func validPoolName(name string) error {
+	if !poolNameRe.MatchString(name) || len(name) > 255 {
+		return fmt.Errorf("invalid pool name: %q", name)
+	}
+	return nil
+}
+
+// StartScrub starts a scrub, or resumes a paused one.
+func (s *StorageService) StartScrub(pool string) error {
+	if err := validPoolName(pool); err != nil {
+		return err
+	}
+	if _, err := s.run("zpool", "scrub", pool); err != nil {
+		return fmt.Errorf("failed to start scrub: %v", err)
+	}
+	return nil
+}
+
+func (s *StorageService) PauseScrub(pool string) error {
+	if err := validPoolName(pool); err != nil {
+		return err
+	}
+	if _, err := s.run("zpool", "scrub", "-p", pool); err != nil {
+		return fmt.Errorf("failed to pause scrub: %v", err)
+	}
+	return nil
+}
+
+func (s *StorageService) CancelScrub(pool string) error {
+	if err := validPoolName(pool); err != nil {
+		return err
+	}
+	if _, err := s.run("zpool", "scrub", "-s", pool); err != nil {
+		return fmt.Errorf("failed to cancel scrub: %v", err)
+	}
+	return nil
+}
+
+// ScrubSchedule scrubs a pool once IntervalDays have passed since its last
+// scrub finished.
+type ScrubSchedule struct {
+	Pool         string     `json:"pool"`
+	IntervalDays int        `json:"intervalDays"`
+	Enabled      bool       `json:"enabled"`
+	NextScrub    *time.Time `json:"nextScrub,omitempty"`
+}
+
+// ScrubRecord is one scrub in a pool's history.
+type ScrubRecord struct {
+	Pool      string     `json:"pool"`
+	State     string     `json:"state"` // scanning, paused, finished, canceled
+	Scheduled bool       `json:"scheduled"`
+	Started   time.Time  `json:"started"`
+	Finished  *time.Time `json:"finished,omitempty"`
+	Scanned   uint64     `json:"scanned"`
+	Repaired  uint64     `json:"repaired"`
+	Errors    uint64     `json:"errors"`
+	Duration  string     `json:"duration,omitempty"`
+}
+
+const maxScrubRecords = 50
+
+// ScrubScheduler starts scheduled scrubs and records every scrub it sees,
+// including ones started outside the API, by polling `zpool status`.
+type ScrubScheduler struct {
+	storage *StorageService
+	path    string
+
+	mu        sync.Mutex
+	schedules []*ScrubSchedule
+	history   []*ScrubRecord
+	stop      chan struct{}
+}
+
+func NewScrubScheduler(storage *StorageService) *ScrubScheduler {
+	s := &ScrubScheduler{
+		storage:   storage,
+		path:      filepath.Join(DataDir(), "scrubs.json"),
+		schedules: []*ScrubSchedule{},
+		history:   []*ScrubRecord{},
+	}
+	var state struct {
+		Schedules []*ScrubSchedule `json:"schedules"`
+		History   []*ScrubRecord   `json:"history"`
+	}
+	if err := loadJSON(s.path, &state); err != nil {
+		log.Printf("Error loading scrub state: %v", err)
+	}
+	if state.Schedules != nil {
+		s.schedules = state.Schedules
+	}
+	if state.History != nil {
+		s.history = state.History
+	}
+	return s
+}
+
+// save must be called with s.mu held.
+func (s *ScrubScheduler) save() error {
+	return saveJSON(s.path, map[string]interface{}{
+		"schedules": s.schedules,
+		"history":   s.history,
+	})
+}
+
+// Start polls pool status once a minute until Stop is called.
+func (s *ScrubScheduler) Start() {
+	s.stop = make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		for {
+			s.poll(time.Now())
+			select {
+			case <-ticker.C:
+			case <-s.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (s *ScrubScheduler) Stop() {
+	if s.stop != nil {
+		close(s.stop)
+	}
+}
+
+func (s *ScrubScheduler) poll(now time.Time) {
+	pools, err := s.storage.ListPools()
+	if err != nil {
+		return
+	}
+	for _, pool := range pools {
+		if pool == "" {
+			continue
+		}
+		status, err := s.storage.GetPoolStatus(pool)
+		if err != nil {
+			continue
+		}
+		s.observe(pool, status.Scan, now)
+		if s.due(pool, status.Scan, now) {
+			if err := s.storage.StartScrub(pool); err != nil {
+				log.Printf("Scheduled scrub of %s failed to start: %v", pool, err)
+				continue
+			}
+			s.mu.Lock()
+			s.history = append(s.history, &ScrubRecord{Pool: pool, State: "scanning", Scheduled: true, Started: now})
+			s.trim(pool)
+			s.save()
+			s.mu.Unlock()
+		}
+	}
+}
+
+// active returns the pool's unfinished record, if any. Must be called with
+// s.mu held.
+func (s *ScrubScheduler) active(pool string) *ScrubRecord {
+	for i := len(s.history) - 1; i >= 0; i-- {
+		r := s.history[i]
+		if r.Pool == pool {
+			if r.Finished == nil {
+				return r
+			}
+			return nil
+		}
+	}
+	return nil
+}
+
+// observe updates the history from the scan line of `zpool status`.
+func (s *ScrubScheduler) observe(pool string, scan *ScanStatus, now time.Time) {
+	if scan == nil || scan.Function != "scrub" {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	record := s.active(pool)
+	switch scan.State {
+	case "scanning", "paused":
+		if record == nil {
+			record = &ScrubRecord{Pool: pool, Started: now}
+			if scan.Start != nil {
+				record.Started = *scan.Start
+			}
+			s.history = append(s.history, record)
+			s.trim(pool)
+		}
+		record.State = scan.State
+		if scan.Scanned > record.Scanned {
+			record.Scanned = scan.Scanned
+		}
+		record.Repaired = scan.Repaired
+	case "finished", "canceled":
+		if record == nil {
+			// Only record a finished scrub we never saw running if it is
+			// newer than the last one in the history.
+			if scan.End == nil || !s.newerThanHistory(pool, *scan.End) {
+				return
+			}
+			record = &ScrubRecord{Pool: pool, Started: *scan.End}
+			s.history = append(s.history, record)
+			s.trim(pool)
+		}
+		record.State = scan.State
+		end := now
+		if scan.End != nil {
+			end = *scan.End
+		}
+		record.Finished = &end
+		record.Duration = scan.Duration
+		if scan.State == "finished" {
+			record.Repaired = scan.Repaired
+			record.Errors = scan.Errors
+			if record.Scanned < scan.Total {
+				record.Scanned = scan.Total
+			}
+		}
+	default:
+		return
+	}
+	if err := s.save(); err != nil {
+		log.Printf("Error saving scrub state: %v", err)
+	}
+}
+
+// newerThanHistory must be called with s.mu held.
+func (s *ScrubScheduler) newerThanHistory(pool string, t time.Time) bool {
+	for _, r := range s.history {
+		if r.Pool == pool && r.Finished != nil && !r.Finished.Before(t) {
+			return false
+		}
+	}
+	return true
+}
+
+// trim drops the oldest records of a pool beyond maxScrubRecords. Must be
+// called with s.mu held.
+func (s *ScrubScheduler) trim(pool string) {
+	count := 0
+	for _, r := range s.history {
+		if r.Pool == pool {
+			count++
+		}
+	}
+	if count <= maxScrubRecords {
+		return
+	}
+	kept := make([]*ScrubRecord, 0, len(s.history))
+	for _, r := range s.history {
+		if r.Pool == pool && count > maxScrubRecords {
+			count--
+			continue
+		}
+		kept = append(kept, r)
+	}
+	s.history = kept
+}
+
+func (s *ScrubScheduler) due(pool string, scan *ScanStatus, now time.Time) bool {
+	if scan != nil && (scan.State == "scanning" || scan.State == "paused") {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, sched := range s.schedules {
+		if sched.Pool == pool && sched.Enabled {
+			next := s.nextScrub(sched)
+			return next != nil && !next.After(now)
+		}
+	}
+	return false
+}
+
+// nextScrub must be called with s.mu held.
+func (s *ScrubScheduler) nextScrub(sched *ScrubSchedule) *time.Time {
+	if !sched.Enabled || sched.IntervalDays <= 0 {
+		return nil
+	}
+	var last time.Time
+	for _, r := range s.history {
+		if r.Pool == sched.Pool && r.Started.After(last) {
+			last = r.Started
+		}
+	}
+	next := last.AddDate(0, 0, sched.IntervalDays)
+	if last.IsZero() {
+		next = time.Now()
+	}
+	return &next
+}
+
+func (s *ScrubScheduler) ListSchedules() []ScrubSchedule {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	schedules := []ScrubSchedule{}
+	for _, sched := range s.schedules {
+		out := *sched
+		out.NextScrub = s.nextScrub(sched)
+		schedules = append(schedules, out)
+	}
+	return schedules
+}
+
+// SetSchedule creates or replaces the scrub schedule of a pool.
+func (s *ScrubScheduler) SetSchedule(pool string, intervalDays int, enabled bool) (*ScrubSchedule, error) {
+	if err := validPoolName(pool); err != nil {
+		return nil, err
+	}
+	if intervalDays < 1 {
+		return nil, errors.New("interval must be at least one day")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var sched *ScrubSchedule
+	for _, existing := range s.schedules {
+		if existing.Pool == pool {
+			sched = existing
+		}
+	}
+	if sched == nil {
+		sched = &ScrubSchedule{Pool: pool}
+		s.schedules = append(s.schedules, sched)
+	}
+	sched.IntervalDays, sched.Enabled = intervalDays, enabled
+	if err := s.save(); err != nil {
+		return nil, fmt.Errorf("failed to save schedule: %v", err)
+	}
+	out := *sched
+	out.NextScrub = s.nextScrub(sched)
+	return &out, nil
+}
+
+func (s *ScrubScheduler) DeleteSchedule(pool string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, sched := range s.schedules {
+		if sched.Pool == pool {
+			s.schedules = append(s.schedules[:i], s.schedules[i+1:]...)
+			return s.save()
+		}
+	}
+	return ErrNotFound
+}
+
+// History returns the recorded scrubs of a pool, newest first.
+func (s *ScrubScheduler) History(pool string) []ScrubRecord {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	records := []ScrubRecord{}
+	for i := len(s.history) - 1; i >= 0; i-- {
+		if s.history[i].Pool == pool {
+			records = append(records, *s.history[i])
+		}
+	}
+	return records
+}
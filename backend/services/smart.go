@@ -0,0 +1,589 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// SmartData is the SMART state of a drive as reported by `smartctl --json`.
+// Only the section matching the drive's protocol is set: Attributes for
+// ATA, NVMeHealth for NVMe and SASErrors for SAS/SCSI.
+type SmartData struct {
+	Device       string   `json:"device"`
+	Protocol     string   `json:"protocol"` // ATA, NVMe or SCSI
+	Model        string   `json:"model,omitempty"`
+	Serial       string   `json:"serial,omitempty"`
+	WWN          string   `json:"wwn,omitempty"`
+	Firmware     string   `json:"firmware,omitempty"`
+	Capacity     uint64   `json:"capacity,omitempty"`
+	RotationRate int      `json:"rotationRate,omitempty"` // rpm, 0 for SSDs
+	Passed       *bool    `json:"passed,omitempty"`
+	Health       string   `json:"health"` // Healthy, Warning, Failed or Unknown
+	Warnings     []string `json:"warnings,omitempty"`
+	Temperature  *int     `json:"temperature,omitempty"`
+	PowerOnHours uint64   `json:"powerOnHours,omitempty"`
+	PowerCycles  uint64   `json:"powerCycles,omitempty"`
+
+	Attributes   []SmartAttribute    `json:"attributes,omitempty"`
+	NVMeHealth   *NVMeHealthLog      `json:"nvmeHealth,omitempty"`
+	SASErrors    *SASErrorCounterLog `json:"sasErrors,omitempty"`
+	GrownDefects *uint64             `json:"grownDefects,omitempty"`
+	SelfTest     *SelfTestProgress   `json:"selfTest,omitempty"`
+	SelfTests    []SelfTestLogEntry  `json:"selfTests"`
+}
+
+// SmartAttribute is one row of the ATA attribute table.
+type SmartAttribute struct {
+	ID         int    `json:"id"`
+	Name       string `json:"name"`
+	Value      int    `json:"value"`
+	Worst      int    `json:"worst"`
+	Threshold  int    `json:"threshold"`
+	Raw        uint64 `json:"raw"`
+	RawString  string `json:"rawString"`
+	Prefailure bool   `json:"prefailure"`
+	WhenFailed string `json:"whenFailed,omitempty"` // now, past or empty
+}
+
+// NVMeHealthLog is the NVMe SMART/health information log page.
+type NVMeHealthLog struct {
+	CriticalWarning         int    `json:"criticalWarning"`
+	Temperature             int    `json:"temperature"`
+	AvailableSpare          int    `json:"availableSpare"`
+	AvailableSpareThreshold int    `json:"availableSpareThreshold"`
+	PercentageUsed          int    `json:"percentageUsed"`
+	DataUnitsRead           uint64 `json:"dataUnitsRead"`
+	DataUnitsWritten        uint64 `json:"dataUnitsWritten"`
+	PowerCycles             uint64 `json:"powerCycles"`
+	PowerOnHours            uint64 `json:"powerOnHours"`
+	UnsafeShutdowns         uint64 `json:"unsafeShutdowns"`
+	MediaErrors             uint64 `json:"mediaErrors"`
+	ErrorLogEntries         uint64 `json:"errorLogEntries"`
+}
+
+// SASErrorCounter is one row (read, write or verify) of the SCSI error
+// counter log.
+type SASErrorCounter struct {
+	CorrectedByECCFast    uint64 `json:"correctedByEccFast"`
+	CorrectedByECCDelayed uint64 `json:"correctedByEccDelayed"`
+	CorrectedByRereads    uint64 `json:"correctedByRereads"`
+	TotalCorrected        uint64 `json:"totalCorrected"`
+	AlgorithmInvocations  uint64 `json:"algorithmInvocations"`
+	GigabytesProcessed    string `json:"gigabytesProcessed"`
+	TotalUncorrected      uint64 `json:"totalUncorrected"`
+}
+
+type SASErrorCounterLog struct {
+	Read   *SASErrorCounter `json:"read,omitempty"`
+	Write  *SASErrorCounter `json:"write,omitempty"`
+	Verify *SASErrorCounter `json:"verify,omitempty"`
+}
+
+// SelfTestProgress describes a self-test that is currently running.
+type SelfTestProgress struct {
+	Status           string `json:"status"`
+	RemainingPercent int    `json:"remainingPercent"`
+}
+
+// SelfTestLogEntry is one completed (or aborted) self-test, newest first.
+type SelfTestLogEntry struct {
+	Type          string  `json:"type"`
+	Status        string  `json:"status"`
+	Passed        bool    `json:"passed"`
+	PowerOnHours  uint64  `json:"powerOnHours"`
+	FirstErrorLBA *uint64 `json:"firstErrorLba,omitempty"`
+}
+
+// ATA attributes whose raw value should stay at zero on a healthy drive.
+var smartCriticalAttributes = map[int]string{
+	5:   "reallocated sectors",
+	187: "reported uncorrectable errors",
+	197: "pending sectors",
+	198: "offline uncorrectable sectors",
+}
+
+type smartctlValue struct {
+	Value  int    `json:"value"`
+	String string `json:"string"`
+}
+
+type smartctlCounter struct {
+	ECCFast     uint64 `json:"errors_corrected_by_eccfast"`
+	ECCDelayed  uint64 `json:"errors_corrected_by_eccdelayed"`
+	Rereads     uint64 `json:"errors_corrected_by_rereads_rewrites"`
+	Total       uint64 `json:"total_errors_corrected"`
+	Invocations uint64 `json:"correction_algorithm_invocations"`
+	Gigabytes   string `json:"gigabytes_processed"`
+	Uncorrected uint64 `json:"total_uncorrected_errors"`
+}
+
+// smartctlOutput mirrors the parts of `smartctl -a --json` that are used.
+type smartctlOutput struct {
+	Smartctl struct {
+		ExitStatus int `json:"exit_status"`
+		Messages   []struct {
+			String   string `json:"string"`
+			Severity string `json:"severity"`
+		} `json:"messages"`
+	} `json:"smartctl"`
+	Device struct {
+		Name     string `json:"name"`
+		Protocol string `json:"protocol"`
+	} `json:"device"`
+	ModelName    string `json:"model_name"`
+	ScsiModel    string `json:"scsi_model_name"`
+	SerialNumber string `json:"serial_number"`
+	WWN          *struct {
+		NAA uint64 `json:"naa"`
+		OUI uint64 `json:"oui"`
+		ID  uint64 `json:"id"`
+	} `json:"wwn"`
+	Firmware     string `json:"firmware_version"`
+	UserCapacity struct {
+		Bytes uint64 `json:"bytes"`
+	} `json:"user_capacity"`
+	NVMeCapacity uint64 `json:"nvme_total_capacity"`
+	RotationRate int    `json:"rotation_rate"`
+	SmartStatus  *struct {
+		Passed bool `json:"passed"`
+	} `json:"smart_status"`
+	Temperature *struct {
+		Current int `json:"current"`
+	} `json:"temperature"`
+	PowerOnTime struct {
+		Hours uint64 `json:"hours"`
+	} `json:"power_on_time"`
+	PowerCycleCount uint64 `json:"power_cycle_count"`
+
+	ATAAttributes *struct {
+		Table []struct {
+			ID         int    `json:"id"`
+			Name       string `json:"name"`
+			Value      int    `json:"value"`
+			Worst      int    `json:"worst"`
+			Thresh     int    `json:"thresh"`
+			WhenFailed string `json:"when_failed"`
+			Flags      struct {
+				Prefailure bool `json:"prefailure"`
+			} `json:"flags"`
+			Raw struct {
+				Value  uint64 `json:"value"`
+				String string `json:"string"`
+			} `json:"raw"`
+		} `json:"table"`
+	} `json:"ata_smart_attributes"`
+	ATASmartData *struct {
+		SelfTest struct {
+			Status struct {
+				Value            int    `json:"value"`
+				String           string `json:"string"`
+				RemainingPercent *int   `json:"remaining_percent"`
+			} `json:"status"`
+		} `json:"self_test"`
+	} `json:"ata_smart_data"`
+	ATASelfTestLog *struct {
+		Standard struct {
+			Table []struct {
+				Type   smartctlValue `json:"type"`
+				Status struct {
+					Value  int    `json:"value"`
+					String string `json:"string"`
+					Passed *bool  `json:"passed"`
+				} `json:"status"`
+				LifetimeHours uint64  `json:"lifetime_hours"`
+				LBA           *uint64 `json:"lba"`
+			} `json:"table"`
+		} `json:"standard"`
+	} `json:"ata_smart_self_test_log"`
+
+	NVMeHealth *struct {
+		CriticalWarning         int    `json:"critical_warning"`
+		Temperature             int    `json:"temperature"`
+		AvailableSpare          int    `json:"available_spare"`
+		AvailableSpareThreshold int    `json:"available_spare_threshold"`
+		PercentageUsed          int    `json:"percentage_used"`
+		DataUnitsRead           uint64 `json:"data_units_read"`
+		DataUnitsWritten        uint64 `json:"data_units_written"`
+		PowerCycles             uint64 `json:"power_cycles"`
+		PowerOnHours            uint64 `json:"power_on_hours"`
+		UnsafeShutdowns         uint64 `json:"unsafe_shutdowns"`
+		MediaErrors             uint64 `json:"media_errors"`
+		ErrorLogEntries         uint64 `json:"num_err_log_entries"`
+	} `json:"nvme_smart_health_information_log"`
+	NVMeSelfTestLog *struct {
+		CurrentOperation  smartctlValue `json:"current_self_test_operation"`
+		CurrentCompletion int           `json:"current_self_test_completion_percent"`
+		Table             []struct {
+			Code         smartctlValue `json:"self_test_code"`
+			Result       smartctlValue `json:"self_test_result"`
+			PowerOnHours uint64        `json:"power_on_hours"`
+			LBA          *uint64       `json:"lba"`
+		} `json:"table"`
+	} `json:"nvme_self_test_log"`
+
+	SCSIErrorCounterLog *struct {
+		Read   *smartctlCounter `json:"read"`
+		Write  *smartctlCounter `json:"write"`
+		Verify *smartctlCounter `json:"verify"`
+	} `json:"scsi_error_counter_log"`
+	SCSIGrownDefects *uint64 `json:"scsi_grown_defect_list"`
+}
+
+// scsiSelfTest is one of the numbered scsi_self_test_N entries.
+type scsiSelfTest struct {
+	Code        smartctlValue `json:"code"`
+	Result      smartctlValue `json:"result"`
+	PowerOnTime struct {
+		Hours uint64 `json:"hours"`
+	} `json:"power_on_time"`
+	FailedLBA *uint64 `json:"lba_first_failure"`
+}
+
+// ParseSmartctlJSON parses the output of `smartctl -a --json`.
+func ParseSmartctlJSON(data []byte) (*SmartData, error) {
+	var out smartctlOutput
+	if err := json.Unmarshal(data, &out); err != nil {
+		return nil, fmt.Errorf("invalid smartctl output: %v", err)
+	}
+	// Bits 0 and 1 of the exit status mean smartctl could not read the
+	// device at all; the higher bits report drive problems.
+	if out.Smartctl.ExitStatus&3 != 0 {
+		msg := "smartctl could not read the device"
+		for _, m := range out.Smartctl.Messages {
+			// With -n standby smartctl skips sleeping drives with a
+			// "Device is in STANDBY mode" message.
+			if strings.Contains(m.String, "STANDBY") || strings.Contains(m.String, "SLEEP") {
+				return nil, ErrDeviceStandby
+			}
+			if m.Severity == "error" {
+				msg = m.String
+			}
+		}
+		return nil, errors.New(msg)
+	}
+
+	d := &SmartData{
+		Device:       out.Device.Name,
+		Protocol:     out.Device.Protocol,
+		Model:        out.ModelName,
+		Serial:       out.SerialNumber,
+		Firmware:     out.Firmware,
+		Capacity:     out.UserCapacity.Bytes,
+		RotationRate: out.RotationRate,
+		PowerOnHours: out.PowerOnTime.Hours,
+		PowerCycles:  out.PowerCycleCount,
+		SelfTests:    []SelfTestLogEntry{},
+	}
+	if d.Model == "" {
+		d.Model = out.ScsiModel
+	}
+	if d.Capacity == 0 {
+		d.Capacity = out.NVMeCapacity
+	}
+	if out.WWN != nil {
+		d.WWN = fmt.Sprintf("0x%x%06x%09x", out.WWN.NAA, out.WWN.OUI, out.WWN.ID)
+	}
+	if out.SmartStatus != nil {
+		passed := out.SmartStatus.Passed
+		d.Passed = &passed
+	}
+	if out.Temperature != nil {
+		temp := out.Temperature.Current
+		d.Temperature = &temp
+	}
+
+	if out.ATAAttributes != nil {
+		for _, a := range out.ATAAttributes.Table {
+			d.Attributes = append(d.Attributes, SmartAttribute{
+				ID:         a.ID,
+				Name:       a.Name,
+				Value:      a.Value,
+				Worst:      a.Worst,
+				Threshold:  a.Thresh,
+				Raw:        a.Raw.Value,
+				RawString:  a.Raw.String,
+				Prefailure: a.Flags.Prefailure,
+				WhenFailed: a.WhenFailed,
+			})
+		}
+	}
+	if out.ATASmartData != nil {
+		st := out.ATASmartData.SelfTest.Status
+		// Status values 0xF0-0xFF mean a test is in progress.
+		if st.Value>>4 == 0xF {
+			progress := &SelfTestProgress{Status: st.String}
+			if st.RemainingPercent != nil {
+				progress.RemainingPercent = *st.RemainingPercent
+			}
+			d.SelfTest = progress
+		}
+	}
+	if out.ATASelfTestLog != nil {
+		for _, t := range out.ATASelfTestLog.Standard.Table {
+			passed := t.Status.Value == 0
+			if t.Status.Passed != nil {
+				passed = *t.Status.Passed
+			}
+			d.SelfTests = append(d.SelfTests, SelfTestLogEntry{
+				Type:          t.Type.String,
+				Status:        t.Status.String,
+				Passed:        passed,
+				PowerOnHours:  t.LifetimeHours,
+				FirstErrorLBA: t.LBA,
+			})
+		}
+	}
+
+	if h := out.NVMeHealth; h != nil {
+		d.NVMeHealth = &NVMeHealthLog{
+			CriticalWarning:         h.CriticalWarning,
+			Temperature:             h.Temperature,
+			AvailableSpare:          h.AvailableSpare,
+			AvailableSpareThreshold: h.AvailableSpareThreshold,
+			PercentageUsed:          h.PercentageUsed,
+			DataUnitsRead:           h.DataUnitsRead,
+			DataUnitsWritten:        h.DataUnitsWritten,
+			PowerCycles:             h.PowerCycles,
+			PowerOnHours:            h.PowerOnHours,
+			UnsafeShutdowns:         h.UnsafeShutdowns,
+			MediaErrors:             h.MediaErrors,
+			ErrorLogEntries:         h.ErrorLogEntries,
+		}
+		if d.Temperature == nil {
+			temp := h.Temperature
+			d.Temperature = &temp
+		}
+		if d.PowerOnHours == 0 {
+			d.PowerOnHours = h.PowerOnHours
+		}
+		if d.PowerCycles == 0 {
+			d.PowerCycles = h.PowerCycles
+		}
+	}
+	if l := out.NVMeSelfTestLog; l != nil {
+		if l.CurrentOperation.Value != 0 {
+			d.SelfTest = &SelfTestProgress{
+				Status:           l.CurrentOperation.String,
+				RemainingPercent: 100 - l.CurrentCompletion,
+			}
+		}
+		for _, t := range l.Table {
+			d.SelfTests = append(d.SelfTests, SelfTestLogEntry{
+				Type:          t.Code.String,
+				Status:        t.Result.String,
+				Passed:        t.Result.Value == 0,
+				PowerOnHours:  t.PowerOnHours,
+				FirstErrorLBA: t.LBA,
+			})
+		}
+	}
+
+	if l := out.SCSIErrorCounterLog; l != nil {
+		d.SASErrors = &SASErrorCounterLog{
+			Read:   convertSCSICounter(l.Read),
+			Write:  convertSCSICounter(l.Write),
+			Verify: convertSCSICounter(l.Verify),
+		}
+	}
+	d.GrownDefects = out.SCSIGrownDefects
+	if tests, err := parseSCSISelfTests(data); err == nil {
+		for i, t := range tests {
+			// Result 15 is a test in progress; it only appears as the newest entry.
+			if i == 0 && t.Result.Value == 15 {
+				d.SelfTest = &SelfTestProgress{Status: t.Result.String}
+				continue
+			}
+			d.SelfTests = append(d.SelfTests, SelfTestLogEntry{
+				Type:          t.Code.String,
+				Status:        t.Result.String,
+				Passed:        t.Result.Value == 0,
+				PowerOnHours:  t.PowerOnTime.Hours,
+				FirstErrorLBA: t.FailedLBA,
+			})
+		}
+	}
+
+	d.Health, d.Warnings = evaluateSmart(d)
+	return d, nil
+}
+
+func convertSCSICounter(c *smartctlCounter) *SASErrorCounter {
+	if c == nil {
+		return nil
+	}
+	return &SASErrorCounter{
+		CorrectedByECCFast:    c.ECCFast,
+		CorrectedByECCDelayed: c.ECCDelayed,
+		CorrectedByRereads:    c.Rereads,
+		TotalCorrected:        c.Total,
+		AlgorithmInvocations:  c.Invocations,
+		GigabytesProcessed:    c.Gigabytes,
+		TotalUncorrected:      c.Uncorrected,
+	}
+}
+
+// parseSCSISelfTests collects the scsi_self_test_0..N objects, which
+// smartctl emits as separate top-level keys rather than an array.
+func parseSCSISelfTests(data []byte) ([]scsiSelfTest, error) {
+	var top map[string]json.RawMessage
+	if err := json.Unmarshal(data, &top); err != nil {
+		return nil, err
+	}
+	var indexes []int
+	for key := range top {
+		if n, err := strconv.Atoi(strings.TrimPrefix(key, "scsi_self_test_")); err == nil && strings.HasPrefix(key, "scsi_self_test_") {
+			indexes = append(indexes, n)
+		}
+	}
+	sort.Ints(indexes)
+	var tests []scsiSelfTest
+	for _, n := range indexes {
+		var t scsiSelfTest
+		if err := json.Unmarshal(top["scsi_self_test_"+strconv.Itoa(n)], &t); err != nil {
+			return nil, err
+		}
+		tests = append(tests, t)
+	}
+	return tests, nil
+}
+
+// evaluateSmart turns the raw SMART data into an overall health and the
+// reasons for it.
+func evaluateSmart(d *SmartData) (string, []string) {
+	var failures, warnings []string
+	if d.Passed != nil && !*d.Passed {
+		failures = append(failures, "SMART overall health check failed")
+	}
+	for _, a := range d.Attributes {
+		if a.WhenFailed == "now" {
+			failures = append(failures, fmt.Sprintf("attribute %d %s is below its threshold", a.ID, a.Name))
+		}
+		if what, ok := smartCriticalAttributes[a.ID]; ok && a.Raw > 0 {
+			warnings = append(warnings, fmt.Sprintf("%d %s", a.Raw, what))
+		}
+	}
+	if h := d.NVMeHealth; h != nil {
+		if h.CriticalWarning != 0 {
+			failures = append(failures, fmt.Sprintf("NVMe critical warning 0x%02x", h.CriticalWarning))
+		}
+		if h.AvailableSpare < h.AvailableSpareThreshold {
+			failures = append(failures, fmt.Sprintf("available spare %d%% is below threshold %d%%", h.AvailableSpare, h.AvailableSpareThreshold))
+		}
+		if h.MediaErrors > 0 {
+			warnings = append(warnings, fmt.Sprintf("%d media errors", h.MediaErrors))
+		}
+		if h.PercentageUsed >= 100 {
+			warnings = append(warnings, fmt.Sprintf("endurance used %d%%", h.PercentageUsed))
+		}
+	}
+	if l := d.SASErrors; l != nil {
+		for name, c := range map[string]*SASErrorCounter{"read": l.Read, "write": l.Write, "verify": l.Verify} {
+			if c != nil && c.TotalUncorrected > 0 {
+				warnings = append(warnings, fmt.Sprintf("%d uncorrected %s errors", c.TotalUncorrected, name))
+			}
+		}
+	}
+	if d.GrownDefects != nil && *d.GrownDefects > 0 {
+		warnings = append(warnings, fmt.Sprintf("%d grown defects", *d.GrownDefects))
+	}
+	if len(d.SelfTests) > 0 && !d.SelfTests[0].Passed && !strings.Contains(strings.ToLower(d.SelfTests[0].Status), "abort") &&
+		!strings.Contains(strings.ToLower(d.SelfTests[0].Status), "interrupt") {
+		warnings = append(warnings, "last self-test failed: "+d.SelfTests[0].Status)
+	}
+	sort.Strings(warnings)
+
+	switch {
+	case len(failures) > 0:
+		return "Failed", append(failures, warnings...)
+	case len(warnings) > 0:
+		return "Warning", warnings
+	case d.Passed != nil:
+		return "Healthy", nil
+	default:
+		return "Unknown", nil
+	}
+}
+
+// devicePath accepts /dev/sda, sda or a /dev/disk/by-* path.
+func devicePath(dev string) (string, error) {
+	if err := validDevice(dev); err != nil {
+		return "", err
+	}
+	if !strings.HasPrefix(dev, "/dev/") {
+		dev = "/dev/" + dev
+	}
+	return dev, nil
+}
+
+// ErrDeviceStandby is returned by PeekSmartData for a drive in standby.
+var ErrDeviceStandby = errors.New("device is in standby")
+
+// GetSmartData reads the SMART data of a drive, waking it if necessary.
+func (s *StorageService) GetSmartData(dev string) (*SmartData, error) {
+	return s.readSmart(dev)
+}
+
+// PeekSmartData reads the SMART data of a drive unless it is in standby,
+// in which case it returns ErrDeviceStandby and leaves the drive asleep.
+func (s *StorageService) PeekSmartData(dev string) (*SmartData, error) {
+	return s.readSmart(dev, "-n", "standby")
+}
+
+func (s *StorageService) readSmart(dev string, opts ...string) (*SmartData, error) {
+	path, err := devicePath(dev)
+	if err != nil {
+		return nil, err
+	}
+	// smartctl sets exit status bits for failing drives too, so the JSON
+	// decides whether the read worked.
+	args := append(opts, "-a", "--json", path)
+	output, err := s.run("smartctl", args...)
+	if len(output) == 0 && err != nil {
+		return nil, fmt.Errorf("failed to read SMART data: %v", err)
+	}
+	data, perr := ParseSmartctlJSON(output)
+	if perr == ErrDeviceStandby {
+		return nil, perr
+	}
+	if perr != nil {
+		return nil, fmt.Errorf("failed to read SMART data of %s: %v", path, perr)
+	}
+	if data.Device == "" {
+		data.Device = path
+	}
+	return data, nil
+}
+
+// SelfTestTypes are the self-tests that can be started.
+var SelfTestTypes = map[string]bool{"short": true, "long": true}
+
+// StartSelfTest starts a short or long self-test. The drive runs it in the
+// background; progress and results appear in GetSmartData.
+func (s *StorageService) StartSelfTest(dev, testType string) error {
+	if !SelfTestTypes[testType] {
+		return fmt.Errorf("invalid self-test type: %q", testType)
+	}
+	path, err := devicePath(dev)
+	if err != nil {
+		return err
+	}
+	if _, err := s.run("smartctl", "-t", testType, path); err != nil {
+		return fmt.Errorf("failed to start self-test: %v", err)
+	}
+	return nil
+}
+
+func (s *StorageService) AbortSelfTest(dev string) error {
+	path, err := devicePath(dev)
+	if err != nil {
+		return err
+	}
+	if _, err := s.run("smartctl", "-X", path); err != nil {
+		return fmt.Errorf("failed to abort self-test: %v", err)
+	}
+	return nil
+}
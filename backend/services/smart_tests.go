@@ -0,0 +1,239 @@
+package services
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SmartTestSchedule starts SMART self-tests on a cron schedule. An empty
+// Devices list tests every disk.
+type SmartTestSchedule struct {
+	ID        string     `json:"id"`
+	Type      string     `json:"type"` // short or long
+	Schedule  string     `json:"schedule"`
+	Devices   []string   `json:"devices"`
+	Enabled   bool       `json:"enabled"`
+	Created   time.Time  `json:"created"`
+	LastRun   *time.Time `json:"lastRun,omitempty"`
+	LastError string     `json:"lastError,omitempty"`
+	NextRun   *time.Time `json:"nextRun,omitempty"`
+}
+
+// SmartTestScheduler starts scheduled self-tests. Results are not kept
+// here: drives record them in their own self-test log.
+type SmartTestScheduler struct {
+	storage *StorageService
+	path    string
+
+	mu        sync.Mutex
+	schedules []*SmartTestSchedule
+	stop      chan struct{}
+}
+
+func NewSmartTestScheduler(storage *StorageService) *SmartTestScheduler {
+	s := &SmartTestScheduler{
+		storage:   storage,
+		path:      filepath.Join(DataDir(), "smart-tests.json"),
+		schedules: []*SmartTestSchedule{},
+	}
+	var state struct {
+		Schedules []*SmartTestSchedule `json:"schedules"`
+	}
+	if err := loadJSON(s.path, &state); err != nil {
+		log.Printf("Error loading SMART test schedules: %v", err)
+	}
+	if state.Schedules != nil {
+		s.schedules = state.Schedules
+	}
+	return s
+}
+
+// save must be called with s.mu held.
+func (s *SmartTestScheduler) save() error {
+	return saveJSON(s.path, map[string]interface{}{"schedules": s.schedules})
+}
+
+// Start checks for due self-tests once a minute until Stop is called.
+func (s *SmartTestScheduler) Start() {
+	s.stop = make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		for {
+			s.runDue(time.Now())
+			select {
+			case <-ticker.C:
+			case <-s.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (s *SmartTestScheduler) Stop() {
+	if s.stop != nil {
+		close(s.stop)
+	}
+}
+
+// runDue starts due tests once, however many runs were missed.
+func (s *SmartTestScheduler) runDue(now time.Time) {
+	s.mu.Lock()
+	var due []SmartTestSchedule
+	for _, sched := range s.schedules {
+		if next := s.nextRun(sched); next != nil && !next.After(now) {
+			due = append(due, *sched)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, sched := range due {
+		errs := s.execute(sched)
+		s.mu.Lock()
+		for _, existing := range s.schedules {
+			if existing.ID == sched.ID {
+				started := now
+				existing.LastRun = &started
+				existing.LastError = strings.Join(errs, "; ")
+			}
+		}
+		if err := s.save(); err != nil {
+			log.Printf("Error saving SMART test schedules: %v", err)
+		}
+		s.mu.Unlock()
+	}
+}
+
+// execute starts the test on every device of the schedule, skipping drives
+// that are already running one.
+func (s *SmartTestScheduler) execute(sched SmartTestSchedule) []string {
+	devices := sched.Devices
+	if len(devices) == 0 {
+		var err error
+		if devices, err = s.storage.GetAvailableDevices(); err != nil {
+			return []string{err.Error()}
+		}
+	}
+	var errs []string
+	for _, dev := range devices {
+		if data, err := s.storage.GetSmartData(dev); err == nil && data.SelfTest != nil {
+			log.Printf("Skipping scheduled %s self-test of %s: a test is already running", sched.Type, dev)
+			continue
+		}
+		if err := s.storage.StartSelfTest(dev, sched.Type); err != nil {
+			log.Printf("Scheduled %s self-test of %s failed to start: %v", sched.Type, dev, err)
+			errs = append(errs, fmt.Sprintf("%s: %v", dev, err))
+		}
+	}
+	return errs
+}
+
+// nextRun must be called with s.mu held.
+func (s *SmartTestScheduler) nextRun(sched *SmartTestSchedule) *time.Time {
+	if !sched.Enabled {
+		return nil
+	}
+	cron, err := ParseSchedule(sched.Schedule)
+	if err != nil {
+		return nil
+	}
+	ref := sched.Created
+	if sched.LastRun != nil {
+		ref = *sched.LastRun
+	}
+	next := cron.Next(ref)
+	if next.IsZero() {
+		return nil
+	}
+	return &next
+}
+
+func validateSmartTestSchedule(sched *SmartTestSchedule) error {
+	if !SelfTestTypes[sched.Type] {
+		return fmt.Errorf("invalid self-test type: %q", sched.Type)
+	}
+	if _, err := ParseSchedule(sched.Schedule); err != nil {
+		return err
+	}
+	for _, dev := range sched.Devices {
+		if _, err := devicePath(dev); err != nil {
+			return err
+		}
+	}
+	if sched.Devices == nil {
+		sched.Devices = []string{}
+	}
+	return nil
+}
+
+func (s *SmartTestScheduler) ListSchedules() []SmartTestSchedule {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	schedules := []SmartTestSchedule{}
+	for _, sched := range s.schedules {
+		out := *sched
+		out.NextRun = s.nextRun(sched)
+		schedules = append(schedules, out)
+	}
+	return schedules
+}
+
+func (s *SmartTestScheduler) CreateSchedule(sched SmartTestSchedule) (*SmartTestSchedule, error) {
+	if err := validateSmartTestSchedule(&sched); err != nil {
+		return nil, err
+	}
+	sched.ID = newID()
+	sched.Created = time.Now()
+	sched.LastRun, sched.LastError, sched.NextRun = nil, "", nil
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.schedules = append(s.schedules, &sched)
+	if err := s.save(); err != nil {
+		return nil, fmt.Errorf("failed to save schedule: %v", err)
+	}
+	out := sched
+	out.NextRun = s.nextRun(&sched)
+	return &out, nil
+}
+
+func (s *SmartTestScheduler) UpdateSchedule(id string, update SmartTestSchedule) (*SmartTestSchedule, error) {
+	if err := validateSmartTestSchedule(&update); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, sched := range s.schedules {
+		if sched.ID != id {
+			continue
+		}
+		sched.Type = update.Type
+		sched.Schedule = update.Schedule
+		sched.Devices = update.Devices
+		sched.Enabled = update.Enabled
+		if err := s.save(); err != nil {
+			return nil, fmt.Errorf("failed to save schedule: %v", err)
+		}
+		out := *sched
+		out.NextRun = s.nextRun(sched)
+		return &out, nil
+	}
+	return nil, ErrNotFound
+}
+
+func (s *SmartTestScheduler) DeleteSchedule(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, sched := range s.schedules {
+		if sched.ID == id {
+			s.schedules = append(s.schedules[:i], s.schedules[i+1:]...)
+			return s.save()
+		}
+	}
+	return ErrNotFound
+}
@@ -0,0 +1,442 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// SnapshotRetention is the number of snapshots to keep per tier. A tier
+// with a count of zero is not snapshotted at all.
+type SnapshotRetention struct {
+	Hourly  int `json:"hourly"`
+	Daily   int `json:"daily"`
+	Weekly  int `json:"weekly"`
+	Monthly int `json:"monthly"`
+}
+
+// SnapshotPolicy takes and prunes snapshots of a dataset automatically.
+// Schedule is a cron expression that decides when the policy is evaluated;
+// each evaluation takes at most one snapshot per tier and period.
+type SnapshotPolicy struct {
+	ID        string            `json:"id"`
+	Dataset   string            `json:"dataset"`
+	Recursive bool              `json:"recursive"`
+	Prefix    string            `json:"prefix"`
+	Schedule  string            `json:"schedule"`
+	Retention SnapshotRetention `json:"retention"`
+	Enabled   bool              `json:"enabled"`
+	Created   time.Time         `json:"created"`
+	LastRun   *time.Time        `json:"lastRun,omitempty"`
+	NextRun   *time.Time        `json:"nextRun,omitempty"`
+}
+
+// SnapshotPolicyRun records the outcome of one policy evaluation. Missed
+// counts scheduled runs that were skipped, e.g. while the daemon was down.
+type SnapshotPolicyRun struct {
+	PolicyID string    `json:"policyId"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+	Created  []string  `json:"created,omitempty"`
+	Pruned   []string  `json:"pruned,omitempty"`
+	Missed   int       `json:"missed"`
+	Success  bool      `json:"success"`
+	Error    string    `json:"error,omitempty"`
+}
+
+const maxPolicyRuns = 100
+
+type snapshotTier struct {
+	name   string
+	keep   func(SnapshotRetention) int
+	period func(time.Time) string
+}
+
+var snapshotTiers = []snapshotTier{
+	{"hourly", func(r SnapshotRetention) int { return r.Hourly }, func(t time.Time) string { return t.Format("2006010215") }},
+	{"daily", func(r SnapshotRetention) int { return r.Daily }, func(t time.Time) string { return t.Format("20060102") }},
+	{"weekly", func(r SnapshotRetention) int { return r.Weekly }, func(t time.Time) string {
+		year, week := t.ISOWeek()
+		return fmt.Sprintf("%d-%02d", year, week)
+	}},
+	{"monthly", func(r SnapshotRetention) int { return r.Monthly }, func(t time.Time) string { return t.Format("200601") }},
+}
+
+type SnapshotScheduler struct {
+	storage *StorageService
+	path    string
+
+	mu       sync.Mutex
+	policies []*SnapshotPolicy
+	runs     []SnapshotPolicyRun
+	// running holds the policies being applied, by the scheduler or
+	// RunPolicy, so one policy is never applied twice at once; record
+	// clears it.
+	running map[string]bool
+	stop    chan struct{}
+}
+
+func NewSnapshotScheduler(storage *StorageService) *SnapshotScheduler {
+	s := &SnapshotScheduler{
+		storage:  storage,
+		path:     filepath.Join(DataDir(), "snapshot-policies.json"),
+		policies: []*SnapshotPolicy{},
+		running:  map[string]bool{},
+	}
+	var state struct {
+		Policies []*SnapshotPolicy   `json:"policies"`
+		Runs     []SnapshotPolicyRun `json:"runs"`
+	}
+	if err := loadJSON(s.path, &state); err != nil {
+		log.Printf("Error loading snapshot policies: %v", err)
+	}
+	if state.Policies != nil {
+		s.policies = state.Policies
+	}
+	s.runs = state.Runs
+	return s
+}
+
+// save must be called with s.mu held.
+func (s *SnapshotScheduler) save() error {
+	return saveJSON(s.path, map[string]interface{}{
+		"policies": s.policies,
+		"runs":     s.runs,
+	})
+}
+
+// Start evaluates due policies once a minute until Stop is called.
+func (s *SnapshotScheduler) Start() {
+	s.stop = make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		for {
+			s.runDue(time.Now())
+			select {
+			case <-ticker.C:
+			case <-s.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (s *SnapshotScheduler) Stop() {
+	if s.stop != nil {
+		close(s.stop)
+	}
+}
+
+func (s *SnapshotScheduler) runDue(now time.Time) {
+	s.mu.Lock()
+	var due []SnapshotPolicy
+	var missed []int
+	for _, p := range s.policies {
+		if !p.Enabled || s.running[p.ID] {
+			continue
+		}
+		sched, err := ParseSchedule(p.Schedule)
+		if err != nil {
+			continue
+		}
+		ref := p.Created
+		if p.LastRun != nil {
+			ref = *p.LastRun
+		}
+		next := sched.Next(ref)
+		if next.IsZero() || next.After(now) {
+			continue
+		}
+		n := 0
+		for t := sched.Next(next); !t.IsZero() && !t.After(now) && n < 10000; t = sched.Next(t) {
+			n++
+		}
+		s.running[p.ID] = true
+		due = append(due, *p)
+		missed = append(missed, n)
+	}
+	s.mu.Unlock()
+
+	for i, p := range due {
+		run := s.execute(p, now)
+		run.Missed = missed[i]
+		if run.Missed > 0 {
+			log.Printf("Snapshot policy %s missed %d scheduled runs", p.ID, run.Missed)
+		}
+		s.record(run)
+	}
+}
+
+func (s *SnapshotScheduler) execute(p SnapshotPolicy, now time.Time) SnapshotPolicyRun {
+	run := SnapshotPolicyRun{PolicyID: p.ID, Started: time.Now()}
+	created, pruned, err := s.apply(p, now)
+	run.Created, run.Pruned = created, pruned
+	run.Finished = time.Now()
+	if err != nil {
+		log.Printf("Snapshot policy %s on %s failed: %v", p.ID, p.Dataset, err)
+		run.Error = err.Error()
+	} else {
+		run.Success = true
+	}
+	return run
+}
+
+// apply takes the snapshots that are due for each tier and prunes the
+// oldest ones beyond the tier's retention count.
+func (s *SnapshotScheduler) apply(p SnapshotPolicy, now time.Time) ([]string, []string, error) {
+	existing, err := s.storage.ListSnapshots(p.Dataset)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var created, pruned []string
+	for _, tier := range snapshotTiers {
+		keep := tier.keep(p.Retention)
+		if keep <= 0 {
+			continue
+		}
+		prefix := p.Prefix + "-" + tier.name + "-"
+		var snaps []Snapshot
+		for _, snap := range existing {
+			if snap.Dataset == p.Dataset && len(snap.Snapshot) > len(prefix) && snap.Snapshot[:len(prefix)] == prefix {
+				snaps = append(snaps, snap)
+			}
+		}
+
+		taken := false
+		for _, snap := range snaps {
+			if tier.period(snap.Created) == tier.period(now) {
+				taken = true
+				break
+			}
+		}
+		if !taken {
+			name := prefix + now.Format("20060102-1504")
+			if err := s.storage.CreateSnapshot(p.Dataset, name, p.Recursive); err != nil {
+				return created, pruned, err
+			}
+			created = append(created, p.Dataset+"@"+name)
+			snaps = append(snaps, Snapshot{Name: p.Dataset + "@" + name, Created: now})
+		}
+
+		sort.Slice(snaps, func(i, j int) bool { return snaps[i].Created.Before(snaps[j].Created) })
+		for len(snaps) > keep {
+			if err := s.storage.DestroySnapshot(snaps[0].Name, p.Recursive); err != nil {
+				return created, pruned, err
+			}
+			pruned = append(pruned, snaps[0].Name)
+			snaps = snaps[1:]
+		}
+	}
+	return created, pruned, nil
+}
+
+func (s *SnapshotScheduler) record(run SnapshotPolicyRun) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.running, run.PolicyID)
+
+	for _, p := range s.policies {
+		if p.ID == run.PolicyID {
+			started := run.Started
+			p.LastRun = &started
+		}
+	}
+
+	// Trim the history per policy so a frequent schedule does not grow the
+	// state file without bound.
+	s.runs = append(s.runs, run)
+	count := 0
+	for _, r := range s.runs {
+		if r.PolicyID == run.PolicyID {
+			count++
+		}
+	}
+	if count > maxPolicyRuns {
+		kept := make([]SnapshotPolicyRun, 0, len(s.runs)-1)
+		dropped := false
+		for _, r := range s.runs {
+			if !dropped && r.PolicyID == run.PolicyID {
+				dropped = true
+				continue
+			}
+			kept = append(kept, r)
+		}
+		s.runs = kept
+	}
+
+	if err := s.save(); err != nil {
+		log.Printf("Error saving snapshot policies: %v", err)
+	}
+}
+
+func validateSnapshotPolicy(p *SnapshotPolicy) error {
+	if err := validDatasetName(p.Dataset); err != nil {
+		return err
+	}
+	if p.Prefix == "" {
+		p.Prefix = "auto"
+	}
+	if !snapshotPartRe.MatchString(p.Prefix) {
+		return fmt.Errorf("invalid prefix: %q", p.Prefix)
+	}
+	if _, err := ParseSchedule(p.Schedule); err != nil {
+		return err
+	}
+	r := p.Retention
+	if r.Hourly < 0 || r.Daily < 0 || r.Weekly < 0 || r.Monthly < 0 {
+		return errors.New("retention counts cannot be negative")
+	}
+	if r.Hourly+r.Daily+r.Weekly+r.Monthly == 0 {
+		return errors.New("at least one retention tier must keep snapshots")
+	}
+	return nil
+}
+
+func (s *SnapshotScheduler) withNextRun(p *SnapshotPolicy) SnapshotPolicy {
+	out := *p
+	if sched, err := ParseSchedule(p.Schedule); err == nil && p.Enabled {
+		ref := p.Created
+		if p.LastRun != nil {
+			ref = *p.LastRun
+		}
+		if next := sched.Next(ref); !next.IsZero() {
+			out.NextRun = &next
+		}
+	}
+	return out
+}
+
+func (s *SnapshotScheduler) ListPolicies() []SnapshotPolicy {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	policies := []SnapshotPolicy{}
+	for _, p := range s.policies {
+		policies = append(policies, s.withNextRun(p))
+	}
+	return policies
+}
+
+func (s *SnapshotScheduler) GetPolicy(id string) (*SnapshotPolicy, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, p := range s.policies {
+		if p.ID == id {
+			out := s.withNextRun(p)
+			return &out, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (s *SnapshotScheduler) CreatePolicy(p SnapshotPolicy) (*SnapshotPolicy, error) {
+	if err := validateSnapshotPolicy(&p); err != nil {
+		return nil, err
+	}
+	p.ID = newID()
+	p.Created = time.Now()
+	p.LastRun, p.NextRun = nil, nil
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.policies = append(s.policies, &p)
+	if err := s.save(); err != nil {
+		return nil, fmt.Errorf("failed to save policy: %v", err)
+	}
+	out := s.withNextRun(&p)
+	return &out, nil
+}
+
+func (s *SnapshotScheduler) UpdatePolicy(id string, update SnapshotPolicy) (*SnapshotPolicy, error) {
+	if err := validateSnapshotPolicy(&update); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, p := range s.policies {
+		if p.ID != id {
+			continue
+		}
+		p.Dataset = update.Dataset
+		p.Recursive = update.Recursive
+		p.Prefix = update.Prefix
+		p.Schedule = update.Schedule
+		p.Retention = update.Retention
+		p.Enabled = update.Enabled
+		if err := s.save(); err != nil {
+			return nil, fmt.Errorf("failed to save policy: %v", err)
+		}
+		out := s.withNextRun(p)
+		return &out, nil
+	}
+	return nil, ErrNotFound
+}
+
+// DeletePolicy removes a policy and its run history. Snapshots it created
+// are left in place.
+func (s *SnapshotScheduler) DeletePolicy(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, p := range s.policies {
+		if p.ID != id {
+			continue
+		}
+		s.policies = append(s.policies[:i], s.policies[i+1:]...)
+		runs := s.runs[:0]
+		for _, r := range s.runs {
+			if r.PolicyID != id {
+				runs = append(runs, r)
+			}
+		}
+		s.runs = runs
+		return s.save()
+	}
+	return ErrNotFound
+}
+
+// ListRuns returns a policy's run history, newest first.
+func (s *SnapshotScheduler) ListRuns(id string) ([]SnapshotPolicyRun, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	found := false
+	for _, p := range s.policies {
+		if p.ID == id {
+			found = true
+		}
+	}
+	if !found {
+		return nil, ErrNotFound
+	}
+	runs := []SnapshotPolicyRun{}
+	for i := len(s.runs) - 1; i >= 0; i-- {
+		if s.runs[i].PolicyID == id {
+			runs = append(runs, s.runs[i])
+		}
+	}
+	return runs, nil
+}
+
+// RunPolicy evaluates a policy immediately, regardless of its schedule. It
+// refuses a policy that is already being applied.
+func (s *SnapshotScheduler) RunPolicy(id string) (*SnapshotPolicyRun, error) {
+	p, err := s.GetPolicy(id)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	if s.running[id] {
+		s.mu.Unlock()
+		return nil, errors.New("policy is already running")
+	}
+	s.running[id] = true
+	s.mu.Unlock()
+	run := s.execute(*p, time.Now())
+	s.record(run)
+	return &run, nil
+}
@@ -0,0 +1,40 @@
+package services
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSnapshotPolicyRunsOneAtATime(t *testing.T) {
+	t.Setenv("A1NAS_DATA_DIR", t.TempDir())
+	storage, fake := fixtureStorage(t)
+	s := NewSnapshotScheduler(storage)
+	p, err := s.CreatePolicy(SnapshotPolicy{Dataset: "tank/home", Schedule: "* * * * *", Retention: SnapshotRetention{Daily: 7}, Enabled: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The policy is being applied, e.g. by a manual run.
+	s.mu.Lock()
+	s.running[p.ID] = true
+	s.mu.Unlock()
+	if _, err := s.RunPolicy(p.ID); err == nil {
+		t.Error("a second run of a running policy was started")
+	}
+	s.runDue(time.Now().Add(time.Hour))
+	if calls := fake.Calls(); len(calls) != 0 {
+		t.Fatalf("applied a running policy: %q", calls)
+	}
+
+	// Recording the run releases the policy.
+	s.record(SnapshotPolicyRun{PolicyID: p.ID, Started: time.Now()})
+	if _, err := s.RunPolicy(p.ID); err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.Calls()) == 0 {
+		t.Error("the released policy was not applied")
+	}
+	if s.running[p.ID] {
+		t.Error("policy still marked running after its run")
+	}
+}
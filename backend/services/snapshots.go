@@ -0,0 +1,229 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Snapshot is a ZFS snapshot as reported by `zfs list -t snapshot`.
+type Snapshot struct {
+	Name       string    `json:"name"`
+	Dataset    string    `json:"dataset"`
+	Snapshot   string    `json:"snapshot"`
+	Used       uint64    `json:"used"`
+	Referenced uint64    `json:"referenced"`
+	Created    time.Time `json:"created"`
+}
+
+// SnapshotDiff groups the changes reported by `zfs diff`.
+type SnapshotDiff struct {
+	Added    []string       `json:"added"`
+	Removed  []string       `json:"removed"`
+	Modified []string       `json:"modified"`
+	Renamed  []RenamedEntry `json:"renamed"`
+}
+
+type RenamedEntry struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+var (
+	snapshotPartRe = regexp.MustCompile(`^[A-Za-z0-9_.:-]+$`)
+	zfsEscapeRe    = regexp.MustCompile(`\\[0-7]{4}`)
+)
+
+// splitSnapshotName validates "dataset@snap" and returns both halves.
+func splitSnapshotName(name string) (string, string, error) {
+	parts := strings.SplitN(name, "@", 2)
+	if len(parts) != 2 || !snapshotPartRe.MatchString(parts[1]) {
+		return "", "", fmt.Errorf("invalid snapshot name: %q", name)
+	}
+	if err := validDatasetName(parts[0]); err != nil {
+		return "", "", err
+	}
+	return parts[0], parts[1], nil
+}
+
+// CreateSnapshot snapshots a dataset, and all of its children when recursive
+// is set.
+func (s *StorageService) CreateSnapshot(dataset, name string, recursive bool) error {
+	if _, _, err := splitSnapshotName(dataset + "@" + name); err != nil {
+		return err
+	}
+	args := []string{"snapshot"}
+	if recursive {
+		args = append(args, "-r")
+	}
+	args = append(args, dataset+"@"+name)
+	if _, err := s.run("zfs", args...); err != nil {
+		return fmt.Errorf("failed to create snapshot: %v", err)
+	}
+	return nil
+}
+
+// ListSnapshots lists snapshots of a dataset and its children, or of every
+// pool when dataset is empty. Snapshots are ordered oldest first.
+func (s *StorageService) ListSnapshots(dataset string) ([]Snapshot, error) {
+	args := []string{"list", "-H", "-p", "-t", "snapshot", "-s", "creation", "-o", "name,used,refer,creation"}
+	if dataset != "" {
+		if err := validDatasetName(dataset); err != nil {
+			return nil, err
+		}
+		args = append(args, "-r", dataset)
+	}
+	output, err := s.run("zfs", args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list snapshots: %v", err)
+	}
+
+	snapshots := []Snapshot{}
+	for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		fields := strings.Split(line, "\t")
+		if len(fields) < 4 {
+			continue
+		}
+		parts := strings.SplitN(fields[0], "@", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		snap := Snapshot{Name: fields[0], Dataset: parts[0], Snapshot: parts[1]}
+		snap.Used, _ = strconv.ParseUint(fields[1], 10, 64)
+		snap.Referenced, _ = strconv.ParseUint(fields[2], 10, 64)
+		if created, err := strconv.ParseInt(fields[3], 10, 64); err == nil {
+			snap.Created = time.Unix(created, 0)
+		}
+		snapshots = append(snapshots, snap)
+	}
+	return snapshots, nil
+}
+
+// DestroySnapshot destroys a snapshot, and the same-named snapshot of every
+// child dataset when recursive is set.
+func (s *StorageService) DestroySnapshot(name string, recursive bool) error {
+	if _, _, err := splitSnapshotName(name); err != nil {
+		return err
+	}
+	args := []string{"destroy"}
+	if recursive {
+		args = append(args, "-r")
+	}
+	args = append(args, name)
+	if _, err := s.run("zfs", args...); err != nil {
+		return fmt.Errorf("failed to destroy snapshot: %v", err)
+	}
+	return nil
+}
+
+// RollbackSnapshot rolls a dataset back to a snapshot. ZFS refuses to roll
+// back past newer snapshots unless destroyNewer is set, in which case they
+// are destroyed.
+func (s *StorageService) RollbackSnapshot(name string, destroyNewer bool) error {
+	if _, _, err := splitSnapshotName(name); err != nil {
+		return err
+	}
+	args := []string{"rollback"}
+	if destroyNewer {
+		args = append(args, "-r")
+	}
+	args = append(args, name)
+	if _, err := s.run("zfs", args...); err != nil {
+		return fmt.Errorf("failed to roll back snapshot: %v", err)
+	}
+	return nil
+}
+
+// CloneSnapshot creates a writable dataset from a snapshot.
+func (s *StorageService) CloneSnapshot(name, target string, props map[string]string) error {
+	dataset, _, err := splitSnapshotName(name)
+	if err != nil {
+		return err
+	}
+	if err := validDatasetName(target); err != nil {
+		return err
+	}
+	if poolOf(dataset) != poolOf(target) {
+		return errors.New("a clone must be in the same pool as its snapshot")
+	}
+	opts, err := propertyArgs(props)
+	if err != nil {
+		return err
+	}
+
+	args := append([]string{"clone", "-p"}, opts...)
+	args = append(args, name, target)
+	if _, err := s.run("zfs", args...); err != nil {
+		return fmt.Errorf("failed to clone snapshot: %v", err)
+	}
+	return nil
+}
+
+// DiffSnapshots reports the file changes between two snapshots of the same
+// dataset. When to is empty, from is compared with the live dataset.
+func (s *StorageService) DiffSnapshots(from, to string) (*SnapshotDiff, error) {
+	dataset, _, err := splitSnapshotName(from)
+	if err != nil {
+		return nil, err
+	}
+	args := []string{"diff", "-H", from}
+	if to != "" {
+		toDataset, _, err := splitSnapshotName(to)
+		if err != nil {
+			return nil, err
+		}
+		if toDataset != dataset {
+			return nil, errors.New("snapshots must belong to the same dataset")
+		}
+		args = append(args, to)
+	}
+	output, err := s.run("zfs", args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to diff snapshots: %v", err)
+	}
+	return parseZFSDiff(string(output)), nil
+}
+
+func parseZFSDiff(output string) *SnapshotDiff {
+	diff := &SnapshotDiff{
+		Added:    []string{},
+		Removed:  []string{},
+		Modified: []string{},
+		Renamed:  []RenamedEntry{},
+	}
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Split(line, "\t")
+		if len(fields) < 2 {
+			continue
+		}
+		path := unescapeZFSPath(fields[1])
+		switch fields[0] {
+		case "+":
+			diff.Added = append(diff.Added, path)
+		case "-":
+			diff.Removed = append(diff.Removed, path)
+		case "M":
+			diff.Modified = append(diff.Modified, path)
+		case "R":
+			if len(fields) >= 3 {
+				diff.Renamed = append(diff.Renamed, RenamedEntry{From: path, To: unescapeZFSPath(fields[2])})
+			}
+		}
+	}
+	return diff
+}
+
+// unescapeZFSPath decodes the \0ooo octal escapes `zfs diff` uses for
+// whitespace and non-printable bytes in file names.
+func unescapeZFSPath(path string) string {
+	return zfsEscapeRe.ReplaceAllStringFunc(path, func(esc string) string {
+		n, err := strconv.ParseUint(esc[1:], 8, 8)
+		if err != nil {
+			return esc
+		}
+		return string([]byte{byte(n)})
+	})
+}
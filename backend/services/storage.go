@@ -1,90 +1,103 @@
 package services
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"mime"
+	"mime/multipart"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
+
+	"golang.org/x/sys/unix"
 )
 
 type StorageService struct {
 	basePath string
+	runner   CommandRunner
+
+	// busy maps the path of each disk a wipe or burn-in is running on to
+	// what it is doing; see claimDisk.
+	busyMu sync.Mutex
+	busy   map[string]string
 }
 
 func NewStorageService() *StorageService {
+	return NewStorageServiceWithRunner("/mnt/a1nas", NewCommandRunner()) // Base path for all storage
+}
+
+// NewStorageServiceWithRunner creates a storage service that runs external
+// tools through runner, e.g. a FakeRunner in tests.
+func NewStorageServiceWithRunner(basePath string, runner CommandRunner) *StorageService {
 	return &StorageService{
-		basePath: "/mnt/a1nas", // Base path for all storage
+		basePath: basePath,
+		runner:   runner,
 	}
 }
 
+// run runs an external tool with the default timeout and returns its stdout.
+func (s *StorageService) run(name string, args ...string) ([]byte, error) {
+	return s.runner.Run(context.Background(), name, args...)
+}
+
+// runInput runs a tool with input on stdin, e.g. a passphrase for zfs.
+func (s *StorageService) runInput(input string, name string, args ...string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultCommandTimeout)
+	defer cancel()
+	var stdout strings.Builder
+	err := s.runner.Stream(ctx, strings.NewReader(input), &stdout, name, args...)
+	return []byte(stdout.String()), err
+}
+
 // ZFS Pool Management
 func (s *StorageService) ListPools() ([]string, error) {
-	cmd := exec.Command("zpool", "list", "-H", "-o", "name")
-	output, err := cmd.Output()
+	output, err := s.run("zpool", "list", "-H", "-o", "name")
 	if err != nil {
 		return nil, fmt.Errorf("failed to list pools: %v", err)
 	}
 	return strings.Split(strings.TrimSpace(string(output)), "\n"), nil
 }
 
+// CreatePool creates a pool with a single data vdev of all devices. See
+// PlanPool for layouts with several vdevs and auxiliary devices.
 func (s *StorageService) CreatePool(name string, devices []string, raidType string) error {
-	if len(devices) < 2 {
-		return errors.New("at least 2 devices are required")
-	}
-
-	args := []string{"create", name}
-	switch raidType {
-	case "mirror":
-		args = append(args, "mirror")
-	case "raidz":
-		args = append(args, "raidz")
-	case "raidz2":
-		args = append(args, "raidz2")
-	case "raidz3":
-		args = append(args, "raidz3")
-	default:
-		return errors.New("invalid RAID type")
-	}
-	args = append(args, devices...)
-
-	cmd := exec.Command("zpool", args...)
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to create pool: %v", err)
+	plan := PoolPlan{Name: name, Layout: raidType, Devices: devices}
+	result, err := s.PlanPool(plan)
+	if err != nil {
+		return err
 	}
-	return nil
+	_, err = s.CreatePlannedPool(plan, result.CommandLine)
+	return err
 }
 
-func (s *StorageService) GetPoolStatus(name string) (map[string]interface{}, error) {
-	cmd := exec.Command("zpool", "status", name)
-	output, err := cmd.Output()
+func (s *StorageService) GetPoolStatus(name string) (*PoolStatus, error) {
+	output, err := s.run("zpool", "status", "-v", name)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get pool status: %v", err)
 	}
 
-	// Parse the output into a structured format
-	status := map[string]interface{}{
-		"raw": string(output),
-		"status": "healthy", // TODO: Parse actual status
+	status, err := ParseZpoolStatus(string(output))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse pool status: %v", err)
 	}
 	return status, nil
 }
 
 func (s *StorageService) DestroyPool(name string) error {
-	cmd := exec.Command("zpool", "destroy", name)
-	if err := cmd.Run(); err != nil {
+	if _, err := s.run("zpool", "destroy", name); err != nil {
 		return fmt.Errorf("failed to destroy pool: %v", err)
 	}
 	return nil
 }
 
 func (s *StorageService) GetAvailableDevices() ([]string, error) {
-	cmd := exec.Command("lsblk", "-o", "NAME,SIZE,TYPE", "-n")
-	output, err := cmd.Output()
+	output, err := s.run("lsblk", "-o", "NAME,SIZE,TYPE", "-n")
 	if err != nil {
 		return nil, fmt.Errorf("failed to list devices: %v", err)
 	}
@@ -93,7 +106,7 @@ func (s *StorageService) GetAvailableDevices() ([]string, error) {
 	lines := strings.Split(string(output), "\n")
 	for _, line := range lines {
 		fields := strings.Fields(line)
-		if len(fields) >= 2 && fields[2] == "disk" {
+		if len(fields) >= 3 && fields[2] == "disk" {
 			devices = append(devices, "/dev/"+fields[0])
 		}
 	}
@@ -109,47 +122,85 @@ type FileInfo struct {
 	Modified time.Time `json:"modified"`
 }
 
+// ListFiles lists a directory beneath basePath. See jail.go for how paths
+// are resolved; like every file operation it refuses the recycle bins and
+// upload staging areas (see internalPath).
 func (s *StorageService) ListFiles(path string) ([]FileInfo, error) {
-	fullPath := filepath.Join(s.basePath, path)
-	entries, err := os.ReadDir(fullPath)
+	if internalPath(splitPath(path)) {
+		return nil, ErrInvalidPath
+	}
+	root, err := s.openRoot()
+	if err != nil {
+		return nil, err
+	}
+	defer root.Close()
+	dir, err := openBeneath(root, path, unix.O_RDONLY|unix.O_DIRECTORY, 0)
+	if err != nil {
+		return nil, jailError("read directory", path, err)
+	}
+	defer dir.Close()
+	names, err := dir.Readdirnames(-1)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read directory: %v", err)
 	}
+	sort.Strings(names)
 
 	var files []FileInfo
-	for _, entry := range entries {
-		info, err := entry.Info()
-		if err != nil {
+	for _, name := range names {
+		if name == uploadStagingDir || name == recycleDir {
+			continue
+		}
+		// Stat relative to the open directory; the entries' own Info
+		// would look them up by path again.
+		var st unix.Stat_t
+		if err := unix.Fstatat(int(dir.Fd()), name, &st, unix.AT_SYMLINK_NOFOLLOW); err != nil {
 			continue
 		}
 
 		fileType := "file"
-		if entry.IsDir() {
+		switch st.Mode & unix.S_IFMT {
+		case unix.S_IFDIR:
 			fileType = "directory"
+		case unix.S_IFLNK:
+			fileType = "symlink"
 		}
 
 		files = append(files, FileInfo{
-			Name:     entry.Name(),
-			Path:     filepath.Join(path, entry.Name()),
+			Name:     name,
+			Path:     filepath.Join(path, name),
 			Type:     fileType,
-			Size:     info.Size(),
-			Modified: info.ModTime(),
+			Size:     st.Size,
+			Modified: statModTime(&st),
 		})
 	}
 	return files, nil
 }
 
+// validFileName reports whether name is a single path component that can
+// be created.
+func validFileName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, "/\\\x00")
+}
+
 func (s *StorageService) UploadFile(path string, file *multipart.FileHeader) error {
-	fullPath := filepath.Join(s.basePath, path, file.Filename)
+	name := file.Filename
+	if !validFileName(name) || internalPath(splitPath(path)) {
+		return ErrInvalidPath
+	}
 	src, err := file.Open()
 	if err != nil {
 		return fmt.Errorf("failed to open uploaded file: %v", err)
 	}
 	defer src.Close()
 
-	dst, err := os.Create(fullPath)
+	root, err := s.openRoot()
+	if err != nil {
+		return err
+	}
+	defer root.Close()
+	dst, err := openBeneath(root, filepath.Join(path, name), unix.O_WRONLY|unix.O_CREAT|unix.O_TRUNC, 0666)
 	if err != nil {
-		return fmt.Errorf("failed to create destination file: %v", err)
+		return jailError("create", filepath.Join(path, name), err)
 	}
 	defer dst.Close()
 
@@ -159,59 +210,137 @@ func (s *StorageService) UploadFile(path string, file *multipart.FileHeader) err
 	return nil
 }
 
-func (s *StorageService) DownloadFile(path string) ([]byte, error) {
-	fullPath := filepath.Join(s.basePath, path)
-	return os.ReadFile(fullPath)
-}
+// ErrNotRegularFile is returned when downloading a directory or device.
+var ErrNotRegularFile = errors.New("not a regular file")
 
-func (s *StorageService) DeleteItem(path string) error {
-	fullPath := filepath.Join(s.basePath, path)
-	return os.RemoveAll(fullPath)
+// OpenFile opens a regular file beneath basePath for reading. The caller
+// streams it and closes it.
+func (s *StorageService) OpenFile(path string) (*os.File, os.FileInfo, error) {
+	if internalPath(splitPath(path)) {
+		return nil, nil, ErrInvalidPath
+	}
+	root, err := s.openRoot()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer root.Close()
+	// O_NONBLOCK keeps a FIFO from blocking the open; it is refused below.
+	f, err := openBeneath(root, path, unix.O_RDONLY|unix.O_NONBLOCK, 0)
+	if err != nil {
+		return nil, nil, jailError("open", path, err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, fmt.Errorf("failed to stat file: %v", err)
+	}
+	if !info.Mode().IsRegular() {
+		f.Close()
+		return nil, nil, ErrNotRegularFile
+	}
+	return f, info, nil
 }
 
-func (s *StorageService) CreateDirectory(path string) error {
-	fullPath := filepath.Join(s.basePath, path)
-	return os.MkdirAll(fullPath, 0755)
+// FileETag is a strong validator for a file: it changes whenever the file
+// is replaced (inode), resized or written (mtime).
+func FileETag(info os.FileInfo) string {
+	var ino uint64
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		ino = uint64(st.Ino)
+	}
+	return fmt.Sprintf(`"%x-%x-%x"`, ino, info.Size(), info.ModTime().UnixNano())
 }
 
-func (s *StorageService) MoveItem(source, destination string) error {
-	srcPath := filepath.Join(s.basePath, source)
-	dstPath := filepath.Join(s.basePath, destination)
-	return os.Rename(srcPath, dstPath)
+// mediaTypes covers files common on a NAS that Go's built-in table lacks,
+// so they are not left to content sniffing.
+var mediaTypes = map[string]string{
+	".mp4":  "video/mp4",
+	".m4v":  "video/mp4",
+	".mkv":  "video/x-matroska",
+	".mov":  "video/quicktime",
+	".avi":  "video/x-msvideo",
+	".webm": "video/webm",
+	".mp3":  "audio/mpeg",
+	".m4a":  "audio/mp4",
+	".flac": "audio/flac",
+	".ogg":  "audio/ogg",
+	".opus": "audio/ogg",
+	".wav":  "audio/wav",
+	".txt":  "text/plain; charset=utf-8",
+	".md":   "text/markdown; charset=utf-8",
+	".log":  "text/plain; charset=utf-8",
+	".iso":  "application/x-iso9660-image",
+	".img":  "application/octet-stream",
+	".zip":  "application/zip",
+	".gz":   "application/gzip",
+	".tar":  "application/x-tar",
 }
 
-func (s *StorageService) CopyItem(source, destination string) error {
-	srcPath := filepath.Join(s.basePath, source)
-	dstPath := filepath.Join(s.basePath, destination)
+// ContentType returns the media type for a file name from its extension,
+// or "" to detect it from the content.
+func ContentType(name string) string {
+	ext := strings.ToLower(filepath.Ext(name))
+	if t, ok := mediaTypes[ext]; ok {
+		return t
+	}
+	return mime.TypeByExtension(ext)
+}
 
-	src, err := os.Open(srcPath)
+// DeleteItem removes a file or directory tree. Symlinks are removed, not
+// followed, and basePath, shares and mounted datasets are refused.
+func (s *StorageService) DeleteItem(path string) error {
+	if internalPath(splitPath(path)) {
+		return ErrInvalidPath
+	}
+	root, err := s.openRoot()
 	if err != nil {
-		return fmt.Errorf("failed to open source file: %v", err)
+		return err
 	}
-	defer src.Close()
-
-	dst, err := os.Create(dstPath)
+	defer root.Close()
+	dir, name, err := openParent(root, path)
 	if err != nil {
-		return fmt.Errorf("failed to create destination file: %v", err)
+		return jailError("remove", path, err)
 	}
-	defer dst.Close()
+	defer dir.Close()
+	if err := checkNotShareRoot(root, dir, name); err != nil {
+		return jailError("remove", path, err)
+	}
+	if err := removeAllAt(int(dir.Fd()), name); err != nil {
+		return jailError("remove", path, err)
+	}
+	return nil
+}
 
-	if _, err = io.Copy(dst, src); err != nil {
-		return fmt.Errorf("failed to copy file: %v", err)
+func (s *StorageService) CreateDirectory(path string) error {
+	if internalPath(splitPath(path)) {
+		return ErrInvalidPath
+	}
+	root, err := s.openRoot()
+	if err != nil {
+		return err
+	}
+	defer root.Close()
+	if err := mkdirAllBeneath(root, path, 0755); err != nil {
+		return jailError("mkdir", path, err)
 	}
 	return nil
 }
 
-// Spin down all disks (Unraid/TrueNAS style)
+// Spin down all disks (Unraid/TrueNAS style). SSDs, disks already in
+// standby and protected disks (see ProtectedDisks) are left alone.
 func (s *StorageService) SpinDownDisks() error {
-	devices, err := s.GetAvailableDevices()
+	disks, err := s.listDisks()
 	if err != nil {
 		return err
 	}
-	for _, dev := range devices {
+	protected := s.ProtectedDisks()
+	for _, disk := range disks {
+		dev := "/dev/" + disk.Name
+		if !disk.Rotational || protected[dev] != "" || s.PowerState(dev) == "standby" {
+			continue
+		}
 		// Use hdparm to spin down (standby) the disk
-		cmd := exec.Command("hdparm", "-y", dev)
-		if err := cmd.Run(); err != nil {
+		if _, err := s.run("hdparm", "-y", dev); err != nil {
 			return fmt.Errorf("failed to spin down %s: %v", dev, err)
 		}
 	}
@@ -220,81 +349,54 @@ func (s *StorageService) SpinDownDisks() error {
 
 // Spin up all disks (wake from standby)
 func (s *StorageService) SpinUpDisks() error {
-	devices, err := s.GetAvailableDevices()
+	disks, err := s.listDisks()
 	if err != nil {
 		return err
 	}
-	for _, dev := range devices {
-		// Try to wake up the disk by reading a small block
-		cmd := exec.Command("dd", "if="+dev, "of=/dev/null", "bs=512", "count=1")
-		if err := cmd.Run(); err != nil {
+	for _, disk := range disks {
+		dev := "/dev/" + disk.Name
+		if !disk.Rotational || s.PowerState(dev) != "standby" {
+			continue
+		}
+		// Wake the disk by reading a block, bypassing the page cache
+		if _, err := s.run("dd", "if="+dev, "of=/dev/null", "bs=4096", "count=1", "iflag=direct"); err != nil {
 			return fmt.Errorf("failed to spin up %s: %v", dev, err)
 		}
 	}
 	return nil
 }
 
+// DeviceInfo is the size and SMART summary of a disk.
+type DeviceInfo struct {
+	Device string     `json:"device"`
+	Size   string     `json:"size,omitempty"`
+	Model  string     `json:"model,omitempty"`
+	Serial string     `json:"serial,omitempty"`
+	Temp   *int       `json:"temp,omitempty"`
+	Health string     `json:"health"`
+	Smart  *SmartData `json:"smart,omitempty"`
+}
+
 // Get SMART, size, health, serial, and temperature info for each device
-func (s *StorageService) GetDeviceInfo() ([]map[string]interface{}, error) {
+func (s *StorageService) GetDeviceInfo() ([]DeviceInfo, error) {
 	devices, err := s.GetAvailableDevices()
 	if err != nil {
 		return nil, err
 	}
-	var infos []map[string]interface{}
+	infos := []DeviceInfo{}
 	for _, dev := range devices {
-		info := map[string]interface{}{"device": dev}
+		info := DeviceInfo{Device: dev, Health: "Unknown"}
 		// Get size
-		sizeCmd := exec.Command("lsblk", "-bno", "SIZE", dev)
-		sizeOut, err := sizeCmd.Output()
+		sizeOut, err := s.run("lsblk", "-bno", "SIZE", dev)
 		if err == nil {
-			info["size"] = strings.TrimSpace(string(sizeOut))
+			info.Size = strings.TrimSpace(string(sizeOut))
 		}
-		// Get SMART health, serial, temp
-		smartCmd := exec.Command("smartctl", "-a", dev)
-		smartOut, err := smartCmd.Output()
-		if err == nil {
-			out := string(smartOut)
-			if strings.Contains(out, "PASSED") {
-				info["health"] = "Healthy"
-			} else if strings.Contains(out, "FAILED") {
-				info["health"] = "Failed"
-			} else {
-				info["health"] = "Unknown"
-			}
-			// Serial
-			for _, line := range strings.Split(out, "\n") {
-				if strings.Contains(line, "Serial Number") {
-					info["serial"] = strings.TrimSpace(strings.SplitN(line, ":", 2)[1])
-				}
-				if strings.Contains(line, "Temperature_Celsius") {
-					fields := strings.Fields(line)
-					if len(fields) > 9 {
-						info["temp"] = fields[9]
-					}
-				}
-				if strings.Contains(line, "Current Drive Temperature") {
-					// For NVMe/other drives
-					fields := strings.Fields(line)
-					if len(fields) > 4 {
-						info["temp"] = fields[4]
-					}
-				}
-			}
-		} else {
-			info["health"] = "Unknown"
+		if smart, err := s.GetSmartData(dev); err == nil {
+			info.Model, info.Serial, info.Temp = smart.Model, smart.Serial, smart.Temperature
+			info.Health = smart.Health
+			info.Smart = smart
 		}
 		infos = append(infos, info)
 	}
 	return infos, nil
 }
-
-// Blink drive LED (if supported)
-func (s *StorageService) BlinkDrive(dev string) error {
-	// Try smartctl --set=sctled,identify,1 (SCT LED control)
-	cmd := exec.Command("smartctl", "-l", "sctled,identify,1", dev)
-	if err := cmd.Run(); err == nil {
-		return nil
-	}
-	// Try sg_ses or ledctl as fallback (not implemented here)
-	return fmt.Errorf("blink not supported or failed for %s", dev)
-} 
\ No newline at end of file
@@ -0,0 +1,56 @@
+package services
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+// ErrNotFound is returned when a stored record does not exist.
+var ErrNotFound = errors.New("not found")
+
+// DataDir returns the directory where the daemon persists its state.
+func DataDir() string {
+	if dir := os.Getenv("A1NAS_DATA_DIR"); dir != "" {
+		return dir
+	}
+	return "/var/lib/a1nas"
+}
+
+// loadJSON reads a JSON state file into v. A missing file leaves v untouched.
+func loadJSON(path string, v interface{}) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// saveJSON atomically replaces a JSON state file so a crash never leaves a
+// truncated file behind.
+func saveJSON(path string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func newID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
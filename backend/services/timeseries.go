@@ -0,0 +1,128 @@
+package services
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// timeSeries keeps samples as JSON lines in dir, one file per key (a pool
+// or a drive serial), in the order they were taken. Every sample records
+// its time as "t", which compact relies on. The capacity monitor and the
+// disk history recorder each keep one.
+type timeSeries struct {
+	dir  string
+	name string // prefixes log messages, e.g. "Capacity"
+
+	mu          sync.Mutex
+	lastSample  time.Time
+	lastCompact time.Time
+}
+
+func newTimeSeries(dir, name string) *timeSeries {
+	return &timeSeries{dir: dir, name: name}
+}
+
+// due reports whether a sample is due at now, taken every interval, and
+// whether the daily compaction is, and counts both as done.
+func (ts *timeSeries) due(now time.Time, interval time.Duration) (sample, compact bool) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	sample = now.Sub(ts.lastSample) >= interval-time.Second
+	if sample {
+		ts.lastSample = now
+	}
+	compact = now.Sub(ts.lastCompact) >= 24*time.Hour
+	if compact {
+		ts.lastCompact = now
+	}
+	return sample, compact
+}
+
+func (ts *timeSeries) file(key string) string {
+	return filepath.Join(ts.dir, key+".jsonl")
+}
+
+// append adds a sample to the file of key.
+func (ts *timeSeries) append(key string, sample interface{}) error {
+	line, err := json.Marshal(sample)
+	if err != nil {
+		return err
+	}
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if err := os.MkdirAll(ts.dir, 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(ts.file(key), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// read calls fn for each sample of key in file order, which is
+// chronological. It returns ErrNotFound when key has no samples.
+func (ts *timeSeries) read(key string, fn func(line []byte)) error {
+	f, err := os.Open(ts.file(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fn(scanner.Bytes())
+	}
+	return scanner.Err()
+}
+
+// compact drops the samples taken before cutoff and lines that do not
+// parse.
+func (ts *timeSeries) compact(cutoff time.Time) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	files, _ := filepath.Glob(filepath.Join(ts.dir, "*.jsonl"))
+	for _, file := range files {
+		key := strings.TrimSuffix(filepath.Base(file), ".jsonl")
+		var kept []byte
+		dropped := 0
+		err := ts.read(key, func(line []byte) {
+			var sample struct {
+				Time time.Time `json:"t"`
+			}
+			if json.Unmarshal(line, &sample) != nil || sample.Time.Before(cutoff) {
+				dropped++
+				return
+			}
+			kept = append(append(kept, line...), '\n')
+		})
+		if err != nil || dropped == 0 {
+			continue
+		}
+		if len(kept) == 0 {
+			os.Remove(file)
+			continue
+		}
+		tmp := file + ".tmp"
+		if err := os.WriteFile(tmp, kept, 0600); err != nil {
+			log.Printf("%s: failed to compact %s: %v", ts.name, key, err)
+			continue
+		}
+		if err := os.Rename(tmp, file); err != nil {
+			log.Printf("%s: failed to compact %s: %v", ts.name, key, err)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package services
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTimeSeriesCompact(t *testing.T) {
+	ts := newTimeSeries(t.TempDir(), "Test")
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 4; i++ {
+		if err := ts.append("kept", DiskSample{Time: start.AddDate(0, 0, i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ts.append("expired", DiskSample{Time: start}); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(ts.file("kept"), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("{truncated\n")
+	f.Close()
+
+	ts.compact(start.AddDate(0, 0, 2))
+	var times []string
+	if err := ts.read("kept", func(line []byte) { times = append(times, string(line)) }); err != nil {
+		t.Fatal(err)
+	}
+	if len(times) != 2 || !strings.Contains(times[0], "2026-01-03") || !strings.Contains(times[1], "2026-01-04") {
+		t.Errorf("kept %q", times)
+	}
+	if err := ts.read("expired", func([]byte) {}); err != ErrNotFound {
+		t.Errorf("got %v reading a series with every sample expired", err)
+	}
+	if tmp, _ := filepath.Glob(filepath.Join(ts.dir, "*.tmp")); len(tmp) != 0 {
+		t.Errorf("left %q behind", tmp)
+	}
+}
+
+func TestTimeSeriesDue(t *testing.T) {
+	ts := newTimeSeries(t.TempDir(), "Test")
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, tt := range []struct {
+		after           time.Duration
+		sample, compact bool
+	}{
+		{0, true, true},
+		{time.Minute, false, false},
+		{10*time.Minute - time.Second, true, false},
+		{15 * time.Minute, false, false},
+		{25 * time.Hour, true, true},
+	} {
+		sample, compact := ts.due(now.Add(tt.after), 10*time.Minute)
+		if sample != tt.sample || compact != tt.compact {
+			t.Errorf("after %v: got sample %v, compact %v", tt.after, sample, compact)
+		}
+	}
+}
@@ -0,0 +1,647 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// ConflictPolicies decide what happens when a file already exists at the
+// destination: skip keeps it, overwrite replaces it and rename copies to
+// "name (1).ext" instead. Directories that exist on both sides are merged
+// unless the policy is rename. Overwrite never replaces a directory with a
+// file or a file with a directory; see ErrTypeConflict.
+var ConflictPolicies = map[string]bool{"skip": true, "overwrite": true, "rename": true}
+
+// TransferJob is a recursive copy or move. Totals are counted before the
+// transfer starts; skipped files are not part of the done counters.
+type TransferJob struct {
+	ID           string     `json:"id"`
+	Operation    string     `json:"operation"` // copy or move
+	Source       string     `json:"source"`
+	Destination  string     `json:"destination"`
+	Conflict     string     `json:"conflict"`
+	State        string     `json:"state"` // running, completed, failed, canceled
+	Current      string     `json:"current,omitempty"`
+	TotalBytes   int64      `json:"totalBytes"`
+	TotalFiles   int64      `json:"totalFiles"`
+	BytesDone    int64      `json:"bytesDone"`
+	FilesDone    int64      `json:"filesDone"`
+	BytesSkipped int64      `json:"bytesSkipped"`
+	FilesSkipped int64      `json:"filesSkipped"`
+	Progress     float64    `json:"progress"`
+	Throughput   float64    `json:"throughput,omitempty"` // bytes per second
+	Started      time.Time  `json:"started"`
+	Finished     *time.Time `json:"finished,omitempty"`
+	Error        string     `json:"error,omitempty"`
+}
+
+// ErrTypeConflict refuses an overwrite that would replace a directory with
+// a file or the other way round, which would delete the whole replaced
+// tree without going through the recycle bin.
+var ErrTypeConflict = errors.New("cannot overwrite a directory with a file or a file with a directory")
+
+const maxTransferJobs = 100
+
+// transferChunk is how much is copied between checks for cancellation.
+const transferChunk = 8 << 20
+
+type TransferService struct {
+	storage *StorageService
+	path    string
+
+	mu      sync.Mutex
+	jobs    []*TransferJob
+	cancels map[string]context.CancelFunc
+}
+
+func NewTransferService(storage *StorageService) *TransferService {
+	s := &TransferService{
+		storage: storage,
+		path:    filepath.Join(DataDir(), "transfers.json"),
+		jobs:    []*TransferJob{},
+		cancels: map[string]context.CancelFunc{},
+	}
+	var state struct {
+		Jobs []*TransferJob `json:"jobs"`
+	}
+	if err := loadJSON(s.path, &state); err != nil {
+		log.Printf("Error loading transfer jobs: %v", err)
+	}
+	for _, job := range state.Jobs {
+		if job.State == "running" {
+			now := time.Now()
+			job.State, job.Error, job.Finished = "failed", "interrupted by daemon restart", &now
+		}
+		s.jobs = append(s.jobs, job)
+	}
+	return s
+}
+
+// trimJobs drops the oldest finished jobs beyond maxTransferJobs. Running jobs
+// are kept however many there are. It must be called with s.mu held.
+func (s *TransferService) trimJobs() {
+	excess := len(s.jobs) - maxTransferJobs
+	if excess <= 0 {
+		return
+	}
+	kept := make([]*TransferJob, 0, len(s.jobs))
+	for _, job := range s.jobs {
+		if excess > 0 && job.State != "running" {
+			excess--
+			continue
+		}
+		kept = append(kept, job)
+	}
+	s.jobs = kept
+}
+
+// save must be called with s.mu held.
+func (s *TransferService) save() error {
+	return saveJSON(s.path, map[string]interface{}{"jobs": s.jobs})
+}
+
+// Start copies or moves source to destination, the full path the item gets,
+// in the background. Shares cannot be moved, and a directory cannot be
+// copied or moved into itself.
+func (s *TransferService) Start(operation, source, destination, conflict string) (*TransferJob, error) {
+	if operation != "copy" && operation != "move" {
+		return nil, fmt.Errorf("invalid operation: %q", operation)
+	}
+	if conflict == "" {
+		conflict = "skip"
+	}
+	if !ConflictPolicies[conflict] {
+		return nil, fmt.Errorf("invalid conflict policy: %q", conflict)
+	}
+	if internalPath(splitPath(source)) || internalPath(splitPath(destination)) {
+		return nil, ErrInvalidPath
+	}
+
+	// Check what can be checked before answering; the job opens the paths
+	// again when it runs.
+	root, err := s.storage.openRoot()
+	if err != nil {
+		return nil, err
+	}
+	defer root.Close()
+	srcDir, srcName, err := openParent(root, source)
+	if err != nil {
+		return nil, jailError("open", source, err)
+	}
+	defer srcDir.Close()
+	var st unix.Stat_t
+	if err := unix.Fstatat(int(srcDir.Fd()), srcName, &st, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		return nil, jailError("stat", source, err)
+	}
+	if operation == "move" {
+		if err := checkNotShareRoot(root, srcDir, srcName); err != nil {
+			return nil, err
+		}
+	}
+	dstDir, dstName, err := openParent(root, destination)
+	if errors.Is(err, ErrShareRoot) {
+		err = ErrInvalidPath
+	}
+	if err != nil {
+		return nil, jailError("open", destination, err)
+	}
+	defer dstDir.Close()
+	// Nothing is written next to or over the shares themselves, nor over
+	// a dataset mounted inside one.
+	if err := checkNotShareRoot(root, dstDir, dstName); err != nil && !errors.Is(err, unix.ENOENT) {
+		return nil, err
+	}
+	var existing unix.Stat_t
+	if unix.Fstatat(int(dstDir.Fd()), dstName, &existing, unix.AT_SYMLINK_NOFOLLOW) == nil {
+		if existing.Dev == st.Dev && existing.Ino == st.Ino && conflict != "rename" {
+			return nil, errors.New("source and destination are the same")
+		}
+		if conflict == "overwrite" && (existing.Mode&unix.S_IFMT == unix.S_IFDIR) != (st.Mode&unix.S_IFMT == unix.S_IFDIR) {
+			return nil, ErrTypeConflict
+		}
+	}
+	if st.Mode&unix.S_IFMT == unix.S_IFDIR {
+		inside, err := within(root, dstDir, &st)
+		if err != nil {
+			return nil, err
+		}
+		if inside {
+			return nil, errors.New("cannot copy or move a directory into itself")
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job := &TransferJob{
+		ID:          newID(),
+		Operation:   operation,
+		Source:      "/" + strings.Join(splitPath(source), "/"),
+		Destination: "/" + strings.Join(splitPath(destination), "/"),
+		Conflict:    conflict,
+		State:       "running",
+		Started:     time.Now(),
+	}
+	s.jobs = append(s.jobs, job)
+	s.trimJobs()
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancels[job.ID] = cancel
+	if err := s.save(); err != nil {
+		log.Printf("Error saving transfer jobs: %v", err)
+	}
+
+	go func() {
+		err := s.run(ctx, job)
+		canceled := ctx.Err() != nil
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		cancel()
+		delete(s.cancels, job.ID)
+		now := time.Now()
+		job.Finished = &now
+		job.Current = ""
+		switch {
+		case err == nil:
+			job.State, job.Progress = "completed", 100
+		case canceled:
+			job.State, job.Error = "canceled", "canceled"
+		default:
+			job.State, job.Error = "failed", err.Error()
+			log.Printf("Transfer %s of %s to %s failed: %v", job.Operation, job.Source, job.Destination, err)
+		}
+		if err := s.save(); err != nil {
+			log.Printf("Error saving transfer jobs: %v", err)
+		}
+	}()
+
+	out := *job
+	return &out, nil
+}
+
+// within reports whether dir is the directory described by st or below it,
+// by walking up from dir to root.
+func within(root, dir *os.File, st *unix.Stat_t) (bool, error) {
+	var rootSt unix.Stat_t
+	if err := unix.Fstat(int(root.Fd()), &rootSt); err != nil {
+		return false, err
+	}
+	fd, err := unix.Dup(int(dir.Fd()))
+	if err != nil {
+		return false, err
+	}
+	defer func() { unix.Close(fd) }()
+	for {
+		var cur unix.Stat_t
+		if err := unix.Fstat(fd, &cur); err != nil {
+			return false, err
+		}
+		if cur.Dev == st.Dev && cur.Ino == st.Ino {
+			return true, nil
+		}
+		if cur.Dev == rootSt.Dev && cur.Ino == rootSt.Ino {
+			return false, nil
+		}
+		parent, err := unix.Openat(fd, "..", unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+		if err != nil {
+			return false, err
+		}
+		var parentSt unix.Stat_t
+		if err := unix.Fstat(parent, &parentSt); err != nil || (parentSt.Dev == cur.Dev && parentSt.Ino == cur.Ino) {
+			// Reached / without passing root; cannot happen beneath it.
+			unix.Close(parent)
+			return false, err
+		}
+		unix.Close(fd)
+		fd = parent
+	}
+}
+
+func (s *TransferService) setJob(job *TransferJob, update func(*TransferJob)) {
+	s.mu.Lock()
+	update(job)
+	if job.TotalBytes > 0 {
+		job.Progress = float64(job.BytesDone+job.BytesSkipped) / float64(job.TotalBytes) * 100
+	}
+	if elapsed := time.Since(job.Started).Seconds(); elapsed > 0 {
+		job.Throughput = float64(job.BytesDone) / elapsed
+	}
+	s.mu.Unlock()
+}
+
+// transfer is the state of one running job.
+type transfer struct {
+	s        *TransferService
+	ctx      context.Context
+	job      *TransferJob
+	move     bool
+	conflict string
+}
+
+func (s *TransferService) run(ctx context.Context, job *TransferJob) error {
+	root, err := s.storage.openRoot()
+	if err != nil {
+		return err
+	}
+	defer root.Close()
+	srcDir, srcName, err := openParent(root, job.Source)
+	if err != nil {
+		return jailError("open", job.Source, err)
+	}
+	defer srcDir.Close()
+	dstDir, dstName, err := openParent(root, job.Destination)
+	if err != nil {
+		return jailError("open", job.Destination, err)
+	}
+	defer dstDir.Close()
+
+	bytes, files, err := measure(ctx, int(srcDir.Fd()), srcName)
+	if err != nil {
+		return err
+	}
+	s.setJob(job, func(j *TransferJob) { j.TotalBytes, j.TotalFiles = bytes, files })
+
+	t := &transfer{s: s, ctx: ctx, job: job, move: job.Operation == "move", conflict: job.Conflict}
+	return t.entry(srcDir, srcName, dstDir, dstName, job.Destination)
+}
+
+// measure counts the bytes and files (anything but directories) of name in
+// dir and below it.
+func measure(ctx context.Context, dir int, name string) (int64, int64, error) {
+	var st unix.Stat_t
+	if err := unix.Fstatat(dir, name, &st, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		return 0, 0, err
+	}
+	if st.Mode&unix.S_IFMT != unix.S_IFDIR {
+		if st.Mode&unix.S_IFMT == unix.S_IFREG {
+			return st.Size, 1, nil
+		}
+		return 0, 1, nil
+	}
+	if err := ctx.Err(); err != nil {
+		return 0, 0, err
+	}
+	child, err := openDirAt(dir, name)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer child.Close()
+	names, err := child.Readdirnames(-1)
+	if err != nil {
+		return 0, 0, err
+	}
+	var bytes, files int64
+	for _, n := range names {
+		b, f, err := measure(ctx, int(child.Fd()), n)
+		if err != nil {
+			return 0, 0, err
+		}
+		bytes += b
+		files += f
+	}
+	return bytes, files, nil
+}
+
+func openDirAt(dir int, name string) (*os.File, error) {
+	fd, err := unix.Openat(dir, name, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+	return os.NewFile(uintptr(fd), name), nil
+}
+
+// entry transfers name in src to target in dst; path is the target's user
+// path for progress reporting.
+func (t *transfer) entry(src *os.File, name string, dst *os.File, target, path string) error {
+	if err := t.ctx.Err(); err != nil {
+		return err
+	}
+	var st, existing unix.Stat_t
+	if err := unix.Fstatat(int(src.Fd()), name, &st, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		return err
+	}
+	isDir := st.Mode&unix.S_IFMT == unix.S_IFDIR
+	if unix.Fstatat(int(dst.Fd()), target, &existing, unix.AT_SYMLINK_NOFOLLOW) == nil {
+		existingDir := existing.Mode&unix.S_IFMT == unix.S_IFDIR
+		switch {
+		case t.conflict == "rename":
+			target = freeName(int(dst.Fd()), target)
+			path = filepath.Join(filepath.Dir(path), target)
+		case isDir && existingDir:
+			return t.merge(src, name, dst, target, path)
+		case t.conflict == "skip":
+			bytes, files, err := measure(t.ctx, int(src.Fd()), name)
+			if err != nil {
+				return err
+			}
+			t.s.setJob(t.job, func(j *TransferJob) { j.BytesSkipped += bytes; j.FilesSkipped += files })
+			return nil
+		case isDir || existingDir:
+			return jailError("overwrite", path, ErrTypeConflict)
+		}
+		// A file replaces a file atomically below.
+	}
+
+	t.s.setJob(t.job, func(j *TransferJob) { j.Current = path })
+	if t.move {
+		err := unix.Renameat(int(src.Fd()), name, int(dst.Fd()), target)
+		if err == nil {
+			bytes, files, _ := measure(t.ctx, int(dst.Fd()), target)
+			t.s.setJob(t.job, func(j *TransferJob) { j.BytesDone += bytes; j.FilesDone += files })
+			return nil
+		}
+		if !errors.Is(err, unix.EXDEV) {
+			return err
+		}
+		// Across datasets: copy, then delete what was copied.
+	}
+	if err := t.copy(src, name, &st, dst, target, path); err != nil {
+		return err
+	}
+	if t.move {
+		return removeMoved(int(src.Fd()), name)
+	}
+	return nil
+}
+
+// removeMoved removes name in dir once copy has copied it. The special
+// files copy skips are kept, and so are the directories holding them;
+// like removeAllAt, it stops at mount points.
+func removeMoved(dir int, name string) error {
+	var dirSt, st unix.Stat_t
+	if err := unix.Fstat(dir, &dirSt); err != nil {
+		return err
+	}
+	if err := unix.Fstatat(dir, name, &st, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		return err
+	}
+	switch st.Mode & unix.S_IFMT {
+	case unix.S_IFREG, unix.S_IFLNK:
+		return unix.Unlinkat(dir, name, 0)
+	case unix.S_IFDIR:
+	default:
+		return nil
+	}
+	if st.Dev != dirSt.Dev {
+		return ErrShareRoot
+	}
+	child, err := openDirAt(dir, name)
+	if err != nil {
+		return err
+	}
+	defer child.Close()
+	names, err := child.Readdirnames(-1)
+	if err != nil {
+		return err
+	}
+	for _, n := range names {
+		if err := removeMoved(int(child.Fd()), n); err != nil {
+			return err
+		}
+	}
+	if err := unix.Unlinkat(dir, name, unix.AT_REMOVEDIR); err != nil && !errors.Is(err, unix.ENOTEMPTY) && !errors.Is(err, unix.EEXIST) {
+		return err
+	}
+	return nil
+}
+
+// merge transfers the entries of directory name into the existing
+// directory target. A moved directory is removed once empty; skipped
+// entries keep it.
+func (t *transfer) merge(src *os.File, name string, dst *os.File, target, path string) error {
+	from, err := openDirAt(int(src.Fd()), name)
+	if err != nil {
+		return err
+	}
+	defer from.Close()
+	to, err := openDirAt(int(dst.Fd()), target)
+	if err != nil {
+		return err
+	}
+	defer to.Close()
+	names, err := from.Readdirnames(-1)
+	if err != nil {
+		return err
+	}
+	for _, n := range names {
+		if err := t.entry(from, n, to, n, filepath.Join(path, n)); err != nil {
+			return err
+		}
+	}
+	if t.move {
+		if err := unix.Unlinkat(int(src.Fd()), name, unix.AT_REMOVEDIR); err != nil && !errors.Is(err, unix.ENOTEMPTY) && !errors.Is(err, unix.EEXIST) {
+			return err
+		}
+	}
+	return nil
+}
+
+// copy copies name, which does not exist as target or is a file to be
+// replaced, with its permissions, owner, timestamps and xattrs. Symlinks
+// are copied as links; devices, FIFOs and sockets are skipped.
+func (t *transfer) copy(src *os.File, name string, st *unix.Stat_t, dst *os.File, target, path string) error {
+	switch st.Mode & unix.S_IFMT {
+	case unix.S_IFDIR:
+		if err := unix.Mkdirat(int(dst.Fd()), target, 0700); err != nil {
+			return err
+		}
+		from, err := openDirAt(int(src.Fd()), name)
+		if err != nil {
+			return err
+		}
+		defer from.Close()
+		to, err := openDirAt(int(dst.Fd()), target)
+		if err != nil {
+			return err
+		}
+		defer to.Close()
+		names, err := from.Readdirnames(-1)
+		if err != nil {
+			return err
+		}
+		for _, n := range names {
+			if err := t.entry(from, n, to, n, filepath.Join(path, n)); err != nil {
+				return err
+			}
+		}
+		// Last, so copying the entries does not change the times.
+		return copyMetadata(int(from.Fd()), int(to.Fd()), int(dst.Fd()), target, st)
+
+	case unix.S_IFLNK:
+		link, err := readlinkat(int(src.Fd()), name)
+		if err != nil {
+			return err
+		}
+		if err := unix.Symlinkat(link, int(dst.Fd()), target); err != nil {
+			return err
+		}
+		unix.Fchownat(int(dst.Fd()), target, int(st.Uid), int(st.Gid), unix.AT_SYMLINK_NOFOLLOW)
+		unix.UtimesNanoAt(int(dst.Fd()), target, statTimes(st), unix.AT_SYMLINK_NOFOLLOW)
+		t.s.setJob(t.job, func(j *TransferJob) { j.FilesDone++ })
+		return nil
+
+	case unix.S_IFREG:
+		return t.copyFile(src, name, st, dst, target)
+	}
+
+	log.Printf("Transfer: skipping special file %s", path)
+	t.s.setJob(t.job, func(j *TransferJob) { j.FilesSkipped++ })
+	return nil
+}
+
+// copyFile copies to a temporary name and renames it into place, so an
+// interrupted copy never leaves a partial file under the real name.
+func (t *transfer) copyFile(src *os.File, name string, st *unix.Stat_t, dst *os.File, target string) error {
+	fd, err := unix.Openat(int(src.Fd()), name, unix.O_RDONLY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	in := os.NewFile(uintptr(fd), name)
+	defer in.Close()
+	tmp := ".a1nas-" + newID() + ".tmp"
+	fd, err = unix.Openat(int(dst.Fd()), tmp, unix.O_WRONLY|unix.O_CREAT|unix.O_EXCL|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0600)
+	if err != nil {
+		return err
+	}
+	out := os.NewFile(uintptr(fd), tmp)
+
+	// io.CopyN lets the kernel copy (copy_file_range) between files.
+	for err == nil {
+		if err = t.ctx.Err(); err != nil {
+			break
+		}
+		var n int64
+		n, err = io.CopyN(out, in, transferChunk)
+		t.s.setJob(t.job, func(j *TransferJob) { j.BytesDone += n })
+	}
+	if errors.Is(err, io.EOF) {
+		err = copyMetadata(int(in.Fd()), int(out.Fd()), int(dst.Fd()), tmp, st)
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = unix.Renameat(int(dst.Fd()), tmp, int(dst.Fd()), target)
+	}
+	if err != nil {
+		unix.Unlinkat(int(dst.Fd()), tmp, 0)
+		return err
+	}
+	t.s.setJob(t.job, func(j *TransferJob) { j.FilesDone++ })
+	return nil
+}
+
+// copyMetadata applies the owner, mode, xattrs and times of st (the source
+// from) to the copy to, which is name in dir. The owner is set first as
+// chown clears setuid bits. Xattrs the target filesystem does not support
+// are dropped.
+func copyMetadata(from, to, dir int, name string, st *unix.Stat_t) error {
+	if err := unix.Fchown(to, int(st.Uid), int(st.Gid)); err != nil && !errors.Is(err, unix.EPERM) {
+		return err
+	}
+	if err := unix.Fchmod(to, uint32(st.Mode&07777)); err != nil {
+		return err
+	}
+	copyXattrs(from, to)
+	return unix.UtimesNanoAt(dir, name, statTimes(st), unix.AT_SYMLINK_NOFOLLOW)
+}
+
+// freeName returns "name (n).ext" for the lowest n not taken in dir.
+func freeName(dir int, name string) string {
+	ext := filepath.Ext(name)
+	if ext == name {
+		ext = ""
+	}
+	base := strings.TrimSuffix(name, ext)
+	for n := 1; ; n++ {
+		candidate := fmt.Sprintf("%s (%d)%s", base, n, ext)
+		var st unix.Stat_t
+		if unix.Fstatat(dir, candidate, &st, unix.AT_SYMLINK_NOFOLLOW) != nil {
+			return candidate
+		}
+	}
+}
+
+// ListJobs returns transfer jobs, newest first.
+func (s *TransferService) ListJobs() []TransferJob {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	jobs := []TransferJob{}
+	for i := len(s.jobs) - 1; i >= 0; i-- {
+		jobs = append(jobs, *s.jobs[i])
+	}
+	return jobs
+}
+
+func (s *TransferService) GetJob(id string) (*TransferJob, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, job := range s.jobs {
+		if job.ID == id {
+			out := *job
+			return &out, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// CancelJob stops a running transfer after the current chunk. Entries
+// already transferred stay where they are.
+func (s *TransferService) CancelJob(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cancel, ok := s.cancels[id]
+	if !ok {
+		return ErrNotFound
+	}
+	cancel()
+	return nil
+}
@@ -0,0 +1,156 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestTransferRefusesInternalPaths(t *testing.T) {
+	t.Setenv("A1NAS_DATA_DIR", t.TempDir())
+	base := t.TempDir()
+	for _, dir := range []string{"share/" + recycleDir + "/item", "share/" + uploadStagingDir, "share/dir"} {
+		if err := os.MkdirAll(filepath.Join(base, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := NewTransferService(NewStorageServiceWithRunner(base, nil))
+
+	for _, tt := range []struct{ source, destination string }{
+		{"share/" + recycleDir + "/item", "share/restored"},
+		{"/share/" + recycleDir, "share/bin"},
+		{"share/dir", "share/" + recycleDir + "/dir"},
+		{"share/dir", "share/" + uploadStagingDir + "/dir"},
+		{"share/dir", "share/dir/../../other/dir"},
+	} {
+		for _, operation := range []string{"copy", "move"} {
+			if _, err := s.Start(operation, tt.source, tt.destination, ""); !errors.Is(err, ErrInvalidPath) {
+				t.Errorf("%s %s to %s: got %v, want ErrInvalidPath", operation, tt.source, tt.destination, err)
+			}
+		}
+	}
+	if jobs := s.ListJobs(); len(jobs) != 0 {
+		t.Errorf("started %d jobs", len(jobs))
+	}
+}
+
+func TestMoveAcrossFilesystemsKeepsSpecialFiles(t *testing.T) {
+	dst := t.TempDir()
+	src, err := os.MkdirTemp("/dev/shm", "a1nas-test")
+	if err != nil {
+		t.Skip("no tmpfs at /dev/shm")
+	}
+	defer os.RemoveAll(src)
+	var srcSt, dstSt unix.Stat_t
+	if unix.Stat(src, &srcSt) != nil || unix.Stat(dst, &dstSt) != nil || srcSt.Dev == dstSt.Dev {
+		t.Skip("/dev/shm is on the same filesystem as the test directory")
+	}
+	for _, dir := range []string{"d/fifos", "d/files"} {
+		if err := os.MkdirAll(filepath.Join(src, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, file := range []string{"d/file", "d/files/file"} {
+		if err := os.WriteFile(filepath.Join(src, file), []byte("data"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, fifo := range []string{"d/fifo", "d/fifos/fifo"} {
+		if err := unix.Mkfifo(filepath.Join(src, fifo), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	from, err := os.Open(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer from.Close()
+	to, err := os.Open(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer to.Close()
+
+	job := &TransferJob{}
+	tr := &transfer{s: &TransferService{}, ctx: context.Background(), job: job, move: true, conflict: "skip"}
+	if err := tr.entry(from, "d", to, "d", "/share/d"); err != nil {
+		t.Fatal(err)
+	}
+	if job.FilesDone != 2 || job.FilesSkipped != 2 {
+		t.Errorf("done %d, skipped %d files", job.FilesDone, job.FilesSkipped)
+	}
+	for _, file := range []string{"d/file", "d/files/file"} {
+		if data, err := os.ReadFile(filepath.Join(dst, file)); err != nil || string(data) != "data" {
+			t.Errorf("%s: got %q, %v", file, data, err)
+		}
+		if _, err := os.Lstat(filepath.Join(src, file)); !os.IsNotExist(err) {
+			t.Errorf("%s is left in the source", file)
+		}
+	}
+	for _, fifo := range []string{"d/fifo", "d/fifos/fifo"} {
+		if _, err := os.Lstat(filepath.Join(src, fifo)); err != nil {
+			t.Errorf("skipped %s was removed: %v", fifo, err)
+		}
+	}
+	if _, err := os.Lstat(filepath.Join(src, "d/files")); !os.IsNotExist(err) {
+		t.Error("the emptied directory is left in the source")
+	}
+}
+
+func TestTransferOverwriteNeverReplacesShares(t *testing.T) {
+	t.Setenv("A1NAS_DATA_DIR", t.TempDir())
+	base := t.TempDir()
+	for _, dir := range []string{"docs/sub/keep", "media/album", "docs/tree/x"} {
+		if err := os.MkdirAll(filepath.Join(base, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, file := range []string{"docs/note.txt", "media/album/song", "docs/files/x"} {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(base, file)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(base, file), []byte("data"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := NewTransferService(NewStorageServiceWithRunner(base, nil))
+
+	for _, operation := range []string{"copy", "move"} {
+		if _, err := s.Start(operation, "docs/note.txt", "media", "overwrite"); !errors.Is(err, ErrShareRoot) {
+			t.Errorf("%s onto a share: got %v, want ErrShareRoot", operation, err)
+		}
+		if _, err := s.Start(operation, "docs/note.txt", "newshare", ""); !errors.Is(err, ErrShareRoot) {
+			t.Errorf("%s to a new share: got %v, want ErrShareRoot", operation, err)
+		}
+		if _, err := s.Start(operation, "docs/note.txt", "docs/sub", "overwrite"); !errors.Is(err, ErrTypeConflict) {
+			t.Errorf("%s a file onto a directory: got %v, want ErrTypeConflict", operation, err)
+		}
+	}
+
+	// Below the top level the job fails instead of deleting docs/tree/x.
+	job, err := s.Start("copy", "docs/files", "docs/tree", "overwrite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for job.State == "running" {
+		time.Sleep(10 * time.Millisecond)
+		if job, err = s.GetJob(job.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if job.State != "failed" || !strings.Contains(job.Error, ErrTypeConflict.Error()) {
+		t.Errorf("job %s: %s", job.State, job.Error)
+	}
+
+	for _, path := range []string{"media/album/song", "docs/sub/keep", "docs/tree/x", "docs/note.txt"} {
+		if _, err := os.Stat(filepath.Join(base, path)); err != nil {
+			t.Errorf("%s: %v", path, err)
+		}
+	}
+}
@@ -0,0 +1,43 @@
+//go:build linux
+
+package services
+
+import (
+	"errors"
+	"syscall"
+)
+
+// ueventSocket is a netlink socket subscribed to kernel uevents.
+type ueventSocket struct {
+	fd int
+}
+
+func openUevents() (ueventSource, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_KOBJECT_UEVENT)
+	if err != nil {
+		return nil, err
+	}
+	// Group 1 carries the kernel's own events; udev rebroadcasts on group 2.
+	if err := syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK, Groups: 1}); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	timeout := syscall.Timeval{Sec: 1}
+	if err := syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &timeout); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	return &ueventSocket{fd: fd}, nil
+}
+
+func (u *ueventSocket) Receive(buf []byte) (int, error) {
+	n, _, err := syscall.Recvfrom(u.fd, buf, 0)
+	if errors.Is(err, syscall.EAGAIN) || errors.Is(err, syscall.EINTR) {
+		return 0, errUeventTimeout
+	}
+	return n, err
+}
+
+func (u *ueventSocket) Close() error {
+	return syscall.Close(u.fd)
+}
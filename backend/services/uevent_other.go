@@ -0,0 +1,9 @@
+//go:build !linux
+
+package services
+
+import "errors"
+
+func openUevents() (ueventSource, error) {
+	return nil, errors.New("kernel uevents are only available on Linux")
+}
@@ -0,0 +1,561 @@
+package services
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Resumable uploads implement tus 1.0 (https://tus.io/protocols/resumable-upload)
+// with the creation, termination, checksum and expiration extensions. Data
+// is staged in a hidden directory of the destination share, so completing
+// an upload is a rename on the same pool.
+
+// Upload is a resumable upload. Offset is the size of the staged data;
+// Dir and Filename are where the file goes once Offset reaches Length.
+type Upload struct {
+	ID        string            `json:"id"`
+	Share     string            `json:"share"`
+	Dir       string            `json:"dir"`
+	Filename  string            `json:"filename"`
+	Length    int64             `json:"length"`
+	Offset    int64             `json:"offset"`
+	Metadata  map[string]string `json:"metadata,omitempty"`
+	Completed bool              `json:"completed"`
+	Created   time.Time         `json:"created"`
+	Updated   time.Time         `json:"updated"`
+}
+
+// Expires is when an upload without further data is garbage-collected.
+func (u *Upload) Expires() time.Time {
+	return u.Updated.Add(uploadExpiry)
+}
+
+// uploadStagingDir holds the partial uploads of a share. ListFiles hides it.
+const uploadStagingDir = ".a1nas-uploads"
+
+// uploadExpiry is how long an upload is kept after its last chunk. Completed
+// uploads are kept as long so a client that missed the final response can
+// still see the upload finished.
+const uploadExpiry = 24 * time.Hour
+
+// uploadMode is the mode of a completed upload: what creating the file
+// directly would give. Parts are staged 0600 so nobody reads them half
+// written. The umask is read once at startup, as reading it means setting
+// it.
+var uploadMode = func() uint32 {
+	umask := unix.Umask(0)
+	unix.Umask(umask)
+	return 0666 &^ uint32(umask)
+}()
+
+// UploadChecksumAlgorithms are the Upload-Checksum algorithms accepted.
+var UploadChecksumAlgorithms = map[string]func() hash.Hash{
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"md5":    md5.New,
+}
+
+var (
+	ErrUploadOffset       = errors.New("Upload-Offset does not match the upload's offset")
+	ErrUploadBusy         = errors.New("another request is writing to this upload")
+	ErrUploadTooLarge     = errors.New("upload exceeds the declared length or the free space")
+	ErrChecksumMismatch   = errors.New("checksum mismatch")
+	ErrUnknownChecksum    = errors.New("unsupported checksum algorithm")
+	ErrUploadOutsideShare = errors.New("uploads must go into a share")
+)
+
+type UploadService struct {
+	storage *StorageService
+	path    string
+
+	mu      sync.Mutex
+	uploads map[string]*Upload
+	busy    map[string]bool
+	stop    chan struct{}
+}
+
+func NewUploadService(storage *StorageService) *UploadService {
+	s := &UploadService{
+		storage: storage,
+		path:    filepath.Join(DataDir(), "uploads.json"),
+		uploads: map[string]*Upload{},
+		busy:    map[string]bool{},
+	}
+	var uploads []*Upload
+	if err := loadJSON(s.path, &uploads); err != nil {
+		log.Printf("Error loading uploads: %v", err)
+	}
+	for _, u := range uploads {
+		s.uploads[u.ID] = u
+	}
+	return s
+}
+
+// save must be called with s.mu held.
+func (s *UploadService) save() error {
+	uploads := []*Upload{}
+	for _, u := range s.uploads {
+		uploads = append(uploads, u)
+	}
+	sort.Slice(uploads, func(i, j int) bool { return uploads[i].Created.Before(uploads[j].Created) })
+	return saveJSON(s.path, uploads)
+}
+
+// Start garbage-collects expired uploads hourly until Stop is called.
+func (s *UploadService) Start() {
+	s.stop = make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(time.Hour)
+		defer ticker.Stop()
+		for {
+			s.collect(time.Now())
+			select {
+			case <-ticker.C:
+			case <-s.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (s *UploadService) Stop() {
+	if s.stop != nil {
+		close(s.stop)
+	}
+}
+
+// ParseUploadMetadata decodes an Upload-Metadata header: comma-separated
+// keys, each followed by a space and its base64 value unless it is empty.
+func ParseUploadMetadata(header string) (map[string]string, error) {
+	metadata := map[string]string{}
+	for _, pair := range strings.Split(header, ",") {
+		fields := strings.Fields(pair)
+		switch len(fields) {
+		case 0:
+			continue
+		case 1:
+			metadata[fields[0]] = ""
+		case 2:
+			value, err := base64.StdEncoding.DecodeString(fields[1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid Upload-Metadata value for %s", fields[0])
+			}
+			metadata[fields[0]] = string(value)
+		default:
+			return nil, fmt.Errorf("invalid Upload-Metadata pair: %q", pair)
+		}
+	}
+	return metadata, nil
+}
+
+func (u *Upload) partName() string {
+	return u.ID + ".part"
+}
+
+// openStaging opens the staging directory of a share, creating it if
+// needed.
+func (s *UploadService) openStaging(root *os.File, share string) (*os.File, error) {
+	staging := filepath.Join(share, uploadStagingDir)
+	if err := mkdirAllBeneath(root, staging, 0700); err != nil {
+		return nil, err
+	}
+	return openBeneath(root, staging, unix.O_RDONLY|unix.O_DIRECTORY, 0)
+}
+
+// Create starts an upload of length bytes to filename in dir. The
+// destination must be an existing directory inside a share with enough
+// free space for the whole file.
+func (s *UploadService) Create(dir, filename string, length int64, metadata map[string]string) (*Upload, error) {
+	if !validFileName(filename) {
+		return nil, ErrInvalidPath
+	}
+	if length < 0 {
+		return nil, errors.New("invalid Upload-Length")
+	}
+	parts := splitPath(dir)
+	if len(parts) == 0 || parts[0] == ".." {
+		return nil, ErrUploadOutsideShare
+	}
+	if internalPath(parts) {
+		return nil, ErrInvalidPath
+	}
+
+	root, err := s.storage.openRoot()
+	if err != nil {
+		return nil, err
+	}
+	defer root.Close()
+	target, err := openBeneath(root, dir, unix.O_RDONLY|unix.O_DIRECTORY, 0)
+	if err != nil {
+		return nil, jailError("open", dir, err)
+	}
+	target.Close()
+	staging, err := s.openStaging(root, parts[0])
+	if err != nil {
+		return nil, jailError("create staging area", parts[0], err)
+	}
+	defer staging.Close()
+	var fs unix.Statfs_t
+	if err := unix.Fstatfs(int(staging.Fd()), &fs); err == nil && uint64(length) > uint64(fs.Bavail)*uint64(fs.Bsize) {
+		return nil, ErrUploadTooLarge
+	}
+
+	now := time.Now()
+	upload := &Upload{
+		ID:       newID(),
+		Share:    parts[0],
+		Dir:      strings.Join(parts, "/"),
+		Filename: filename,
+		Length:   length,
+		Metadata: metadata,
+		Created:  now,
+		Updated:  now,
+	}
+	fd, err := unix.Openat(int(staging.Fd()), upload.partName(), unix.O_WRONLY|unix.O_CREAT|unix.O_EXCL|unix.O_CLOEXEC, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create upload: %v", err)
+	}
+	unix.Close(fd)
+
+	s.mu.Lock()
+	s.uploads[upload.ID] = upload
+	err = s.save()
+	s.mu.Unlock()
+	if err != nil {
+		return nil, fmt.Errorf("failed to save upload: %v", err)
+	}
+	if length == 0 {
+		return s.complete(upload)
+	}
+	result := *upload
+	return &result, nil
+}
+
+// Get returns an upload. The offset is read from the staged data, which is
+// the truth after a crash in the middle of a chunk.
+func (s *UploadService) Get(id string) (*Upload, error) {
+	s.mu.Lock()
+	upload, ok := s.uploads[id]
+	if !ok {
+		s.mu.Unlock()
+		return nil, ErrNotFound
+	}
+	result := *upload
+	s.mu.Unlock()
+	if result.Completed {
+		return &result, nil
+	}
+
+	root, err := s.storage.openRoot()
+	if err != nil {
+		return nil, err
+	}
+	defer root.Close()
+	part, err := openBeneath(root, filepath.Join(result.Share, uploadStagingDir, result.partName()), unix.O_RDONLY, 0)
+	if err != nil {
+		return nil, jailError("open", result.partName(), err)
+	}
+	defer part.Close()
+	info, err := part.Stat()
+	if err != nil {
+		return nil, err
+	}
+	result.Offset = info.Size()
+	return &result, nil
+}
+
+// Write appends the data of a PATCH request at offset, which must be the
+// current offset. With a checksum ("sha1 <base64>") the chunk is discarded
+// unless it matches. The upload is moved into place once complete.
+func (s *UploadService) Write(id string, offset int64, body io.Reader, checksum string) (*Upload, error) {
+	var sum hash.Hash
+	var want []byte
+	if checksum != "" {
+		fields := strings.Fields(checksum)
+		if len(fields) != 2 {
+			return nil, ErrUnknownChecksum
+		}
+		newHash, ok := UploadChecksumAlgorithms[fields[0]]
+		if !ok {
+			return nil, ErrUnknownChecksum
+		}
+		var err error
+		if want, err = base64.StdEncoding.DecodeString(fields[1]); err != nil {
+			return nil, ErrUnknownChecksum
+		}
+		sum = newHash()
+	}
+
+	s.mu.Lock()
+	if s.busy[id] {
+		s.mu.Unlock()
+		return nil, ErrUploadBusy
+	}
+	s.busy[id] = true
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.busy, id)
+		s.mu.Unlock()
+	}()
+
+	upload, err := s.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	if upload.Completed || offset != upload.Offset {
+		return upload, ErrUploadOffset
+	}
+
+	root, err := s.storage.openRoot()
+	if err != nil {
+		return nil, err
+	}
+	defer root.Close()
+	part, err := openBeneath(root, filepath.Join(upload.Share, uploadStagingDir, upload.partName()), unix.O_WRONLY, 0)
+	if err != nil {
+		return nil, jailError("open", upload.partName(), err)
+	}
+	defer part.Close()
+	if _, err := part.Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	// Read one byte past the declared length to notice a client sending
+	// too much.
+	remaining := upload.Length - offset
+	var w io.Writer = part
+	if sum != nil {
+		w = io.MultiWriter(part, sum)
+	}
+	n, copyErr := io.Copy(w, io.LimitReader(body, remaining+1))
+	switch {
+	case n > remaining:
+		copyErr = ErrUploadTooLarge
+	case copyErr == nil && sum != nil && string(sum.Sum(nil)) != string(want):
+		copyErr = ErrChecksumMismatch
+	}
+	if copyErr != nil && (sum != nil || n > remaining) {
+		// Partial data can't be verified; start the chunk over.
+		part.Truncate(offset)
+		n = 0
+	}
+	upload.Offset = offset + n
+
+	s.mu.Lock()
+	if stored, ok := s.uploads[id]; ok {
+		stored.Updated = time.Now()
+		stored.Offset = upload.Offset
+		upload.Updated = stored.Updated
+	}
+	s.save()
+	s.mu.Unlock()
+
+	if copyErr != nil {
+		return upload, copyErr
+	}
+	if upload.Offset == upload.Length {
+		if err := part.Sync(); err != nil {
+			return upload, fmt.Errorf("failed to sync upload: %v", err)
+		}
+		return s.complete(upload)
+	}
+	return upload, nil
+}
+
+// complete moves the staged data to its destination, replacing a file of
+// the same name.
+func (s *UploadService) complete(upload *Upload) (*Upload, error) {
+	root, err := s.storage.openRoot()
+	if err != nil {
+		return nil, err
+	}
+	defer root.Close()
+	staging, err := openBeneath(root, filepath.Join(upload.Share, uploadStagingDir), unix.O_RDONLY|unix.O_DIRECTORY, 0)
+	if err != nil {
+		return nil, jailError("open", uploadStagingDir, err)
+	}
+	defer staging.Close()
+	dir, err := openBeneath(root, upload.Dir, unix.O_RDONLY|unix.O_DIRECTORY, 0)
+	if err != nil {
+		return nil, jailError("open", upload.Dir, err)
+	}
+	defer dir.Close()
+
+	fd, err := unix.Openat(int(staging.Fd()), upload.partName(), unix.O_RDONLY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open upload: %v", err)
+	}
+	err = unix.Fchmod(fd, uploadMode)
+	unix.Close(fd)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set upload permissions: %v", err)
+	}
+
+	err = unix.Renameat(int(staging.Fd()), upload.partName(), int(dir.Fd()), upload.Filename)
+	if errors.Is(err, unix.EXDEV) {
+		// The directory is on a dataset mounted inside the share.
+		err = copyAcross(staging, upload.partName(), dir, upload.Filename)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to move upload into place: %v", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if stored, ok := s.uploads[upload.ID]; ok {
+		stored.Completed = true
+		stored.Offset = stored.Length
+		stored.Updated = time.Now()
+		result := *stored
+		upload = &result
+	}
+	if err := s.save(); err != nil {
+		log.Printf("Error saving uploads: %v", err)
+	}
+	return upload, nil
+}
+
+// copyAcross copies name in src to a temporary file in dst, renames it over
+// target and removes the source.
+func copyAcross(src *os.File, name string, dst *os.File, target string) error {
+	fd, err := unix.Openat(int(src.Fd()), name, unix.O_RDONLY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	in := os.NewFile(uintptr(fd), name)
+	defer in.Close()
+	tmp := "." + target + "." + newID() + ".tmp"
+	fd, err = unix.Openat(int(dst.Fd()), tmp, unix.O_WRONLY|unix.O_CREAT|unix.O_EXCL|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0666)
+	if err != nil {
+		return err
+	}
+	out := os.NewFile(uintptr(fd), tmp)
+	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = unix.Renameat(int(dst.Fd()), tmp, int(dst.Fd()), target)
+	}
+	if err != nil {
+		unix.Unlinkat(int(dst.Fd()), tmp, 0)
+		return err
+	}
+	return unix.Unlinkat(int(src.Fd()), name, 0)
+}
+
+// Terminate cancels an upload and removes its data.
+func (s *UploadService) Terminate(id string) error {
+	s.mu.Lock()
+	upload, ok := s.uploads[id]
+	if !ok {
+		s.mu.Unlock()
+		return ErrNotFound
+	}
+	if s.busy[id] {
+		s.mu.Unlock()
+		return ErrUploadBusy
+	}
+	delete(s.uploads, id)
+	err := s.save()
+	s.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("failed to save uploads: %v", err)
+	}
+	if !upload.Completed {
+		s.removePart(upload.Share, upload.partName())
+	}
+	return nil
+}
+
+func (s *UploadService) removePart(share, name string) {
+	root, err := s.storage.openRoot()
+	if err != nil {
+		return
+	}
+	defer root.Close()
+	staging, err := openBeneath(root, filepath.Join(share, uploadStagingDir), unix.O_RDONLY|unix.O_DIRECTORY, 0)
+	if err != nil {
+		return
+	}
+	defer staging.Close()
+	if err := unix.Unlinkat(int(staging.Fd()), name, 0); err != nil && !errors.Is(err, unix.ENOENT) {
+		log.Printf("Uploads: failed to remove %s/%s: %v", share, name, err)
+	}
+}
+
+// collect removes expired uploads, and staged files of every share that no
+// upload refers to, e.g. after the upload list was lost.
+func (s *UploadService) collect(now time.Time) {
+	s.mu.Lock()
+	var expired []*Upload
+	known := map[string]bool{}
+	for id, upload := range s.uploads {
+		if now.After(upload.Expires()) && !s.busy[id] {
+			expired = append(expired, upload)
+			delete(s.uploads, id)
+			continue
+		}
+		known[upload.partName()] = true
+	}
+	if len(expired) > 0 {
+		if err := s.save(); err != nil {
+			log.Printf("Error saving uploads: %v", err)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, upload := range expired {
+		if !upload.Completed {
+			log.Printf("Uploads: removing abandoned upload %s of %s", upload.ID, filepath.Join(upload.Dir, upload.Filename))
+			s.removePart(upload.Share, upload.partName())
+		}
+	}
+
+	root, err := s.storage.openRoot()
+	if err != nil {
+		return
+	}
+	defer root.Close()
+	shares, err := root.Readdirnames(-1)
+	if err != nil {
+		return
+	}
+	for _, share := range shares {
+		staging, err := openBeneath(root, filepath.Join(share, uploadStagingDir), unix.O_RDONLY|unix.O_DIRECTORY, 0)
+		if err != nil {
+			continue
+		}
+		names, _ := staging.Readdirnames(-1)
+		for _, name := range names {
+			var st unix.Stat_t
+			if known[name] || unix.Fstatat(int(staging.Fd()), name, &st, unix.AT_SYMLINK_NOFOLLOW) != nil {
+				continue
+			}
+			if now.Sub(statModTime(&st)) > uploadExpiry {
+				log.Printf("Uploads: removing orphaned %s/%s", share, name)
+				unix.Unlinkat(int(staging.Fd()), name, 0)
+			}
+		}
+		staging.Close()
+	}
+}
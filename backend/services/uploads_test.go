@@ -0,0 +1,46 @@
+package services
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testUpload(t *testing.T, length int64) (*UploadService, *Upload, string) {
+	t.Helper()
+	t.Setenv("A1NAS_DATA_DIR", t.TempDir())
+	base := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(base, "share"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	u := NewUploadService(NewStorageServiceWithRunner(base, nil))
+	upload, err := u.Create("share", "file", length, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u, upload, base
+}
+
+func TestUploadRefusesMalformedChecksums(t *testing.T) {
+	u, upload, _ := testUpload(t, 4)
+	for _, checksum := range []string{" ", "sha1", "sha1 AAAA extra", "md4 AAAA", "sha1 !!!!"} {
+		if _, err := u.Write(upload.ID, 0, strings.NewReader("data"), checksum); err != ErrUnknownChecksum {
+			t.Errorf("%q: got %v, want ErrUnknownChecksum", checksum, err)
+		}
+	}
+}
+
+func TestCompletedUploadGetsDefaultMode(t *testing.T) {
+	u, upload, base := testUpload(t, 4)
+	if _, err := u.Write(upload.ID, 0, strings.NewReader("data"), ""); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(filepath.Join(base, "share", "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := uint32(info.Mode().Perm()); mode != uploadMode {
+		t.Errorf("mode %o, want %o", mode, uploadMode)
+	}
+}
@@ -0,0 +1,370 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Minimum number of devices zpool accepts for each vdev layout.
+var vdevMinDevices = map[string]int{
+	"stripe": 1,
+	"mirror": 2,
+	"raidz":  2,
+	"raidz1": 2,
+	"raidz2": 3,
+	"raidz3": 4,
+}
+
+var (
+	devicePathRe  = regexp.MustCompile(`^/dev/[A-Za-z0-9_./:+-]+$`)
+	deviceNameRe  = regexp.MustCompile(`^[A-Za-z0-9_.:+-]+$`)
+	groupVdevRe   = regexp.MustCompile(`^(mirror|raidz[123]?|draid[123]?[^-]*|replacing|spare)-[0-9]+$`)
+	raidzVdevRe   = regexp.MustCompile(`^raidz[123]?-[0-9]+$`)
+	vdevLayoutArg = map[string]string{"stripe": "", "mirror": "mirror", "raidz": "raidz", "raidz1": "raidz1", "raidz2": "raidz2", "raidz3": "raidz3"}
+)
+
+func validDevice(dev string) error {
+	if strings.HasPrefix(dev, "-") || (!devicePathRe.MatchString(dev) && !deviceNameRe.MatchString(dev)) || strings.Contains(dev, "..") {
+		return fmt.Errorf("invalid device: %q", dev)
+	}
+	return nil
+}
+
+// vdevRef locates a vdev in a pool's status tree.
+type vdevRef struct {
+	vdev   *VdevStatus
+	parent *VdevStatus // nil for top-level vdevs of an auxiliary class
+	class  string      // data, logs, cache, spares, special or dedup
+}
+
+// sameDevice compares a device as given by the user (/dev/sdb,
+// /dev/disk/by-id/ata-X, sdb) with a name from `zpool status`.
+func sameDevice(given, listed string) bool {
+	if given == listed {
+		return true
+	}
+	return filepath.Base(given) == filepath.Base(listed)
+}
+
+func findVdev(status *PoolStatus, name string) *vdevRef {
+	var walk func(v, parent *VdevStatus, class string) *vdevRef
+	walk = func(v, parent *VdevStatus, class string) *vdevRef {
+		if v != status.Config && sameDevice(name, v.Name) {
+			return &vdevRef{vdev: v, parent: parent, class: class}
+		}
+		for _, child := range v.Children {
+			if ref := walk(child, v, class); ref != nil {
+				return ref
+			}
+		}
+		return nil
+	}
+
+	if status.Config != nil {
+		if ref := walk(status.Config, nil, "data"); ref != nil {
+			return ref
+		}
+	}
+	classes := []struct {
+		name  string
+		vdevs []*VdevStatus
+	}{
+		{"logs", status.Logs}, {"cache", status.Cache}, {"spares", status.Spares},
+		{"special", status.Special}, {"dedup", status.Dedup},
+	}
+	for _, class := range classes {
+		for _, v := range class.vdevs {
+			if ref := walk(v, nil, class.name); ref != nil {
+				return ref
+			}
+		}
+	}
+	return nil
+}
+
+// leafDevice finds a physical device (not a mirror/raidz group) in a pool.
+func leafDevice(status *PoolStatus, dev string) (*vdevRef, error) {
+	ref := findVdev(status, dev)
+	if ref == nil {
+		return nil, fmt.Errorf("device %s is not part of pool %s", dev, status.Name)
+	}
+	if len(ref.vdev.Children) > 0 || groupVdevRe.MatchString(ref.vdev.Name) {
+		return nil, fmt.Errorf("%s is a vdev group, not a device", ref.vdev.Name)
+	}
+	return ref, nil
+}
+
+// ensureNotInPool rejects devices that already belong to the pool.
+func ensureNotInPool(status *PoolStatus, devices ...string) error {
+	for _, dev := range devices {
+		if err := validDevice(dev); err != nil {
+			return err
+		}
+		if findVdev(status, dev) != nil {
+			return fmt.Errorf("device %s is already part of pool %s", dev, status.Name)
+		}
+	}
+	return nil
+}
+
+func (s *StorageService) poolTopology(pool string) (*PoolStatus, error) {
+	if err := validPoolName(pool); err != nil {
+		return nil, err
+	}
+	return s.GetPoolStatus(pool)
+}
+
+func (s *StorageService) runZpool(action string, args ...string) error {
+	if _, err := s.run("zpool", args...); err != nil {
+		return fmt.Errorf("failed to %s: %v", action, err)
+	}
+	return nil
+}
+
+// ReplaceDevice replaces a device with newDevice and starts a resilver.
+// An empty newDevice replaces the device with a new disk at the same path.
+// Progress is reported by GetPoolStatus.
+func (s *StorageService) ReplaceDevice(pool, device, newDevice string) error {
+	status, err := s.poolTopology(pool)
+	if err != nil {
+		return err
+	}
+	ref, err := leafDevice(status, device)
+	if err != nil {
+		return err
+	}
+	if ref.class == "cache" || ref.class == "spares" {
+		return fmt.Errorf("%s devices cannot be replaced; remove and add them instead", ref.class)
+	}
+	if ref.parent != nil && strings.HasPrefix(ref.parent.Name, "replacing-") {
+		return fmt.Errorf("%s is already being replaced", device)
+	}
+
+	args := []string{"replace", pool, ref.vdev.Name}
+	if newDevice != "" {
+		// An available hot spare of the same pool may stand in for the device.
+		spare := findVdev(status, newDevice)
+		if spare == nil || spare.class != "spares" || spare.vdev.State != "AVAIL" {
+			if err := ensureNotInPool(status, newDevice); err != nil {
+				return err
+			}
+			stable, err := s.stableDevices([]string{newDevice})
+			if err != nil {
+				return err
+			}
+			newDevice = stable[0]
+		}
+		args = append(args, newDevice)
+	}
+	return s.runZpool("replace device", args...)
+}
+
+// AttachDevice mirrors newDevice onto an existing device, turning a single
+// disk into a mirror or widening a mirror. Attaching to a raidz vdev
+// expands it by one disk (OpenZFS 2.3 and later).
+func (s *StorageService) AttachDevice(pool, device, newDevice string) error {
+	status, err := s.poolTopology(pool)
+	if err != nil {
+		return err
+	}
+	if err := ensureNotInPool(status, newDevice); err != nil {
+		return err
+	}
+	ref := findVdev(status, device)
+	if ref == nil {
+		return fmt.Errorf("device %s is not part of pool %s", device, pool)
+	}
+
+	switch {
+	case raidzVdevRe.MatchString(ref.vdev.Name):
+		if ref.class != "data" {
+			return errors.New("only data raidz vdevs can be expanded")
+		}
+	case len(ref.vdev.Children) > 0 || groupVdevRe.MatchString(ref.vdev.Name):
+		return fmt.Errorf("cannot attach to %s; name one of its devices instead", ref.vdev.Name)
+	case ref.class == "cache" || ref.class == "spares":
+		return fmt.Errorf("cannot attach to %s devices", ref.class)
+	case ref.parent != nil && raidzVdevRe.MatchString(ref.parent.Name):
+		return fmt.Errorf("cannot mirror a raidz member; attach to %s to expand it", ref.parent.Name)
+	case ref.parent != nil && strings.HasPrefix(ref.parent.Name, "replacing-"):
+		return fmt.Errorf("%s is being replaced", device)
+	}
+	stable, err := s.stableDevices([]string{newDevice})
+	if err != nil {
+		return err
+	}
+	return s.runZpool("attach device", "attach", pool, ref.vdev.Name, stable[0])
+}
+
+// DetachDevice removes a device from a mirror, or cancels a replacement by
+// detaching one side of a replacing vdev.
+func (s *StorageService) DetachDevice(pool, device string) error {
+	status, err := s.poolTopology(pool)
+	if err != nil {
+		return err
+	}
+	ref, err := leafDevice(status, device)
+	if err != nil {
+		return err
+	}
+	if ref.parent == nil || ref.parent == status.Config {
+		return fmt.Errorf("%s is not part of a mirror; detaching it would remove data", device)
+	}
+	name := ref.parent.Name
+	if !strings.HasPrefix(name, "mirror-") && !strings.HasPrefix(name, "replacing-") && !strings.HasPrefix(name, "spare-") {
+		return fmt.Errorf("devices can only be detached from mirrors, not from %s", name)
+	}
+	return s.runZpool("detach device", "detach", pool, ref.vdev.Name)
+}
+
+// AddVdev adds a new vdev to a pool. class is data, log, cache, spare,
+// special or dedup; layout is stripe, mirror or raidz1-3.
+func (s *StorageService) AddVdev(pool, class, layout string, devices []string) error {
+	status, err := s.poolTopology(pool)
+	if err != nil {
+		return err
+	}
+	if layout == "" {
+		layout = "stripe"
+	}
+	arg, ok := vdevLayoutArg[layout]
+	if !ok {
+		return fmt.Errorf("invalid vdev layout: %q", layout)
+	}
+	if len(devices) < vdevMinDevices[layout] {
+		return fmt.Errorf("%s vdevs need at least %d devices", layout, vdevMinDevices[layout])
+	}
+	if err := ensureNotInPool(status, devices...); err != nil {
+		return err
+	}
+	seen := map[string]bool{}
+	for _, dev := range devices {
+		if seen[filepath.Base(dev)] {
+			return fmt.Errorf("device %s is listed twice", dev)
+		}
+		seen[filepath.Base(dev)] = true
+	}
+
+	args := []string{"add", pool}
+	switch class {
+	case "data", "":
+		if existing := dataLayout(status); existing != "" && existing != normalizeLayout(layout) {
+			return fmt.Errorf("pool %s uses %s data vdevs; adding a %s vdev would mix redundancy levels", pool, existing, layout)
+		}
+	case "log", "special", "dedup":
+		if class != "log" && dataLayout(status) != "stripe" && layout == "stripe" {
+			return fmt.Errorf("%s vdevs should be mirrored to match the pool's redundancy", class)
+		}
+		if strings.HasPrefix(layout, "raidz") {
+			return fmt.Errorf("%s vdevs can only be single disks or mirrors", class)
+		}
+		args = append(args, class)
+	case "cache", "spare":
+		if layout != "stripe" {
+			return fmt.Errorf("%s devices cannot be grouped into a %s", class, layout)
+		}
+		args = append(args, class)
+	default:
+		return fmt.Errorf("invalid vdev class: %q", class)
+	}
+	if arg != "" {
+		args = append(args, arg)
+	}
+	if devices, err = s.stableDevices(devices); err != nil {
+		return err
+	}
+	args = append(args, devices...)
+	return s.runZpool("add vdev", args...)
+}
+
+func normalizeLayout(layout string) string {
+	if layout == "raidz" {
+		return "raidz1"
+	}
+	return layout
+}
+
+// dataLayout returns the layout of the pool's first data vdev.
+func dataLayout(status *PoolStatus) string {
+	if status.Config == nil || len(status.Config.Children) == 0 {
+		return ""
+	}
+	name := status.Config.Children[0].Name
+	switch {
+	case strings.HasPrefix(name, "mirror-"):
+		return "mirror"
+	case strings.HasPrefix(name, "raidz1-"), strings.HasPrefix(name, "raidz-"):
+		return "raidz1"
+	case strings.HasPrefix(name, "raidz2-"):
+		return "raidz2"
+	case strings.HasPrefix(name, "raidz3-"):
+		return "raidz3"
+	case strings.HasPrefix(name, "draid"):
+		return "draid"
+	}
+	return "stripe"
+}
+
+// OfflineDevice takes a device offline. A temporary offline is reverted at
+// the next reboot.
+func (s *StorageService) OfflineDevice(pool, device string, temporary bool) error {
+	status, err := s.poolTopology(pool)
+	if err != nil {
+		return err
+	}
+	ref, err := leafDevice(status, device)
+	if err != nil {
+		return err
+	}
+	if ref.vdev.State == "OFFLINE" {
+		return fmt.Errorf("%s is already offline", device)
+	}
+	if ref.parent == status.Config && ref.class == "data" {
+		return fmt.Errorf("%s has no redundancy; taking it offline would suspend the pool", device)
+	}
+	args := []string{"offline"}
+	if temporary {
+		args = append(args, "-t")
+	}
+	args = append(args, pool, ref.vdev.Name)
+	return s.runZpool("offline device", args...)
+}
+
+// OnlineDevice brings a device back online. With expand, the device is
+// grown to use all of its space, e.g. after replacing with larger disks.
+func (s *StorageService) OnlineDevice(pool, device string, expand bool) error {
+	status, err := s.poolTopology(pool)
+	if err != nil {
+		return err
+	}
+	ref, err := leafDevice(status, device)
+	if err != nil {
+		return err
+	}
+	args := []string{"online"}
+	if expand {
+		args = append(args, "-e")
+	}
+	args = append(args, pool, ref.vdev.Name)
+	return s.runZpool("online device", args...)
+}
+
+// ClearErrors resets the error counters of a pool, or of one device.
+func (s *StorageService) ClearErrors(pool, device string) error {
+	status, err := s.poolTopology(pool)
+	if err != nil {
+		return err
+	}
+	args := []string{"clear", pool}
+	if device != "" {
+		ref := findVdev(status, device)
+		if ref == nil {
+			return fmt.Errorf("device %s is not part of pool %s", device, pool)
+		}
+		args = append(args, ref.vdev.Name)
+	}
+	return s.runZpool("clear errors", args...)
+}
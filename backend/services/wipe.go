@@ -0,0 +1,524 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WipeModes are the ways a disk can be wiped:
+//   - quick clears ZFS labels, filesystem and partition table signatures and
+//     zeroes the first and last MiB, which is what a stale disk needs before
+//     it can join a new pool;
+//   - full overwrites the whole disk with zeros;
+//   - secure-erase asks the drive to erase itself (ATA Security Erase or NVMe
+//     Format with user data erase), which also reaches remapped sectors.
+var WipeModes = map[string]bool{"quick": true, "full": true, "secure-erase": true}
+
+// WipeToken confirms a wipe. It is bound to one disk and mode, can be used
+// once and expires after wipeTokenTTL.
+type WipeToken struct {
+	Token      string    `json:"token"`
+	Disk       string    `json:"disk"`
+	Serial     string    `json:"serial"`
+	Model      string    `json:"model,omitempty"`
+	Size       uint64    `json:"size"`
+	Mode       string    `json:"mode"`
+	Signatures []string  `json:"signatures"`
+	Expires    time.Time `json:"expires"`
+}
+
+const wipeTokenTTL = 5 * time.Minute
+
+type WipeJob struct {
+	ID           string     `json:"id"`
+	Disk         string     `json:"disk"`
+	Serial       string     `json:"serial"`
+	Mode         string     `json:"mode"`
+	Size         uint64     `json:"size"`
+	State        string     `json:"state"` // running, completed, failed, canceled
+	Progress     float64    `json:"progress"`
+	BytesWritten uint64     `json:"bytesWritten,omitempty"`
+	Throughput   float64    `json:"throughput,omitempty"` // bytes per second
+	Started      time.Time  `json:"started"`
+	Finished     *time.Time `json:"finished,omitempty"`
+	Error        string     `json:"error,omitempty"`
+}
+
+const maxWipeJobs = 100
+
+var (
+	ddProgressRe       = regexp.MustCompile(`^(\d+) bytes`)
+	ataEraseTimeRe     = regexp.MustCompile(`(\d+)min for (ENHANCED )?SECURITY ERASE UNIT`)
+	ataEnhancedEraseRe = regexp.MustCompile(`(?m)^\s*supported: enhanced erase`)
+)
+
+// ataErasePassword is set just before the erase, which clears it again.
+const ataErasePassword = "a1nas-erase"
+
+type WipeService struct {
+	storage *StorageService
+	path    string
+
+	mu      sync.Mutex
+	tokens  map[string]*WipeToken
+	jobs    []*WipeJob
+	cancels map[string]context.CancelFunc
+}
+
+func NewWipeService(storage *StorageService) *WipeService {
+	s := &WipeService{
+		storage: storage,
+		path:    filepath.Join(DataDir(), "wipe.json"),
+		tokens:  map[string]*WipeToken{},
+		jobs:    []*WipeJob{},
+		cancels: map[string]context.CancelFunc{},
+	}
+	var state struct {
+		Jobs []*WipeJob `json:"jobs"`
+	}
+	if err := loadJSON(s.path, &state); err != nil {
+		log.Printf("Error loading wipe jobs: %v", err)
+	}
+	for _, job := range state.Jobs {
+		if job.State == "running" {
+			now := time.Now()
+			job.State, job.Error, job.Finished = "failed", "interrupted by daemon restart", &now
+		}
+		s.jobs = append(s.jobs, job)
+	}
+	return s
+}
+
+// trimJobs drops the oldest finished jobs beyond maxWipeJobs. Running jobs
+// are kept however many there are. It must be called with s.mu held.
+func (s *WipeService) trimJobs() {
+	excess := len(s.jobs) - maxWipeJobs
+	if excess <= 0 {
+		return
+	}
+	kept := make([]*WipeJob, 0, len(s.jobs))
+	for _, job := range s.jobs {
+		if excess > 0 && job.State != "running" {
+			excess--
+			continue
+		}
+		kept = append(kept, job)
+	}
+	s.jobs = kept
+}
+
+// save must be called with s.mu held.
+func (s *WipeService) save() error {
+	return saveJSON(s.path, map[string]interface{}{"jobs": s.jobs})
+}
+
+// RequestToken checks that disk can be wiped in mode and returns the token
+// that Start requires, together with what is about to be destroyed.
+func (s *WipeService) RequestToken(disk, mode string) (*WipeToken, error) {
+	if !WipeModes[mode] {
+		return nil, fmt.Errorf("invalid wipe mode: %q", mode)
+	}
+	d, err := s.storage.unusedDisk(disk)
+	if err != nil {
+		return nil, err
+	}
+	if mode == "secure-erase" {
+		if _, err := s.storage.secureEraseMethod(d); err != nil {
+			return nil, err
+		}
+	}
+	signatures, err := s.storage.diskSignatures(d)
+	if err != nil {
+		return nil, err
+	}
+	if signatures == nil {
+		signatures = []string{}
+	}
+	token := &WipeToken{
+		Token:      newID() + newID(),
+		Disk:       d.Path,
+		Serial:     d.Serial,
+		Model:      d.Model,
+		Size:       d.Size,
+		Mode:       mode,
+		Signatures: signatures,
+		Expires:    time.Now().Add(wipeTokenTTL),
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, t := range s.tokens {
+		if time.Now().After(t.Expires) {
+			delete(s.tokens, key)
+		}
+	}
+	s.tokens[token.Token] = token
+	out := *token
+	return &out, nil
+}
+
+// Start wipes a disk in the background. token must come from RequestToken
+// for the same disk and mode.
+func (s *WipeService) Start(disk, mode, token string) (*WipeJob, error) {
+	d, err := s.storage.unusedDisk(disk)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.tokens[token]
+	if !ok || time.Now().After(t.Expires) {
+		return nil, errors.New("invalid or expired confirmation token")
+	}
+	if t.Disk != d.Path || t.Serial != d.Serial || t.Mode != mode {
+		return nil, errors.New("confirmation token was issued for a different disk or mode")
+	}
+	delete(s.tokens, token)
+	release, err := s.storage.claimDisk(d, "a wipe")
+	if err != nil {
+		return nil, err
+	}
+
+	job := &WipeJob{
+		ID:      newID(),
+		Disk:    d.Path,
+		Serial:  d.Serial,
+		Mode:    mode,
+		Size:    d.Size,
+		State:   "running",
+		Started: time.Now(),
+	}
+	s.jobs = append(s.jobs, job)
+	s.trimJobs()
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancels[job.ID] = cancel
+	if err := s.save(); err != nil {
+		log.Printf("Error saving wipe jobs: %v", err)
+	}
+
+	go func(disk Disk) {
+		err := s.wipe(ctx, job, &disk)
+		release()
+		canceled := ctx.Err() != nil
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		cancel()
+		delete(s.cancels, job.ID)
+		now := time.Now()
+		job.Finished = &now
+		switch {
+		case err == nil:
+			job.State, job.Progress = "completed", 100
+		case canceled:
+			job.State, job.Error = "canceled", "canceled"
+		default:
+			job.State, job.Error = "failed", err.Error()
+			log.Printf("Wipe of %s failed: %v", job.Disk, err)
+		}
+		if err := s.save(); err != nil {
+			log.Printf("Error saving wipe jobs: %v", err)
+		}
+	}(*d)
+
+	out := *job
+	return &out, nil
+}
+
+func (s *WipeService) setJob(job *WipeJob, update func(*WipeJob)) {
+	s.mu.Lock()
+	update(job)
+	s.mu.Unlock()
+}
+
+// ListJobs returns wipe jobs, newest first.
+func (s *WipeService) ListJobs() []WipeJob {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	jobs := []WipeJob{}
+	for i := len(s.jobs) - 1; i >= 0; i-- {
+		jobs = append(jobs, *s.jobs[i])
+	}
+	return jobs
+}
+
+func (s *WipeService) GetJob(id string) (*WipeJob, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, job := range s.jobs {
+		if job.ID == id {
+			out := *job
+			return &out, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// CancelJob stops a running wipe. A secure erase runs inside the drive and
+// cannot be stopped.
+func (s *WipeService) CancelJob(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cancel, ok := s.cancels[id]
+	if !ok {
+		return ErrNotFound
+	}
+	for _, job := range s.jobs {
+		if job.ID == id && job.Mode == "secure-erase" {
+			return errors.New("a secure erase cannot be interrupted")
+		}
+	}
+	cancel()
+	return nil
+}
+
+func (s *WipeService) wipe(ctx context.Context, job *WipeJob, d *Disk) error {
+	var err error
+	switch job.Mode {
+	case "quick":
+		err = s.storage.quickWipe(ctx, d)
+	case "full":
+		err = s.zeroFill(ctx, job, d)
+	case "secure-erase":
+		err = s.secureErase(ctx, job, d)
+	}
+	if err != nil {
+		return err
+	}
+	// Make the kernel drop the partitions that no longer exist.
+	if _, err := s.storage.run("blockdev", "--rereadpt", d.Path); err != nil {
+		log.Printf("Error re-reading partition table of %s: %v", d.Path, err)
+	}
+	return nil
+}
+
+// quickWipe removes everything that makes a disk look in use: ZFS labels
+// (kept at both ends of the device), filesystem and RAID signatures and
+// the partition table.
+func (s *StorageService) quickWipe(ctx context.Context, d *Disk) error {
+	devices := []string{}
+	for _, p := range d.Partitions {
+		devices = append(devices, p.Path)
+	}
+	devices = append(devices, d.Path)
+	for _, dev := range devices {
+		// labelclear fails when there is no label, which is fine.
+		if _, err := s.run("zpool", "labelclear", "-f", dev); err != nil {
+			log.Printf("No ZFS label cleared on %s: %v", dev, err)
+		}
+		// Without --force wipefs refuses a device the kernel reports
+		// busy, a last guard behind unusedDisk.
+		if _, err := s.run("wipefs", "--all", dev); err != nil {
+			return fmt.Errorf("failed to wipe signatures: %v", err)
+		}
+	}
+
+	// Byte offsets in 1 MiB blocks suit disks with 512-byte and 4096-byte
+	// logical sectors alike; O_DIRECT needs whole sectors.
+	const mib = 1 << 20
+	if d.Size < 2*mib {
+		return s.zeroRange(ctx, d.Path, 0, d.Size)
+	}
+	if err := s.zeroRange(ctx, d.Path, 0, mib); err != nil {
+		return err
+	}
+	return s.zeroRange(ctx, d.Path, d.Size-mib, mib)
+}
+
+// zeroRange zeroes length bytes starting at byte offset.
+func (s *StorageService) zeroRange(ctx context.Context, dev string, offset, length uint64) error {
+	err := s.runner.Stream(ctx, nil, nil, "dd", "if=/dev/zero", "of="+dev, "bs=1M",
+		"seek="+strconv.FormatUint(offset, 10), "count="+strconv.FormatUint(length, 10),
+		"iflag=count_bytes", "oflag=direct,seek_bytes", "conv=fsync")
+	if err != nil {
+		return fmt.Errorf("failed to zero %s: %v", dev, err)
+	}
+	return nil
+}
+
+// zeroFill overwrites the whole disk, reading progress from dd's stderr.
+func (s *WipeService) zeroFill(ctx context.Context, job *WipeJob, d *Disk) error {
+	start := time.Now()
+	progress := &lineWatcher{onLine: func(line string) {
+		m := ddProgressRe.FindStringSubmatch(line)
+		if m == nil {
+			return
+		}
+		written, _ := strconv.ParseUint(m[1], 10, 64)
+		elapsed := time.Since(start).Seconds()
+		s.setJob(job, func(j *WipeJob) {
+			j.BytesWritten = written
+			if j.Size > 0 {
+				j.Progress = float64(written) / float64(j.Size) * 100
+			}
+			if elapsed > 0 {
+				j.Throughput = float64(written) / elapsed
+			}
+		})
+	}}
+	err := s.storage.runner.Stream(withStderr(ctx, progress), nil, nil, "dd", "if=/dev/zero", "of="+d.Path, "bs=4M",
+		"count="+strconv.FormatUint(d.Size, 10), "iflag=count_bytes", "oflag=direct", "conv=fsync", "status=progress")
+	if err != nil {
+		return fmt.Errorf("failed to zero %s: %v", d.Path, err)
+	}
+	return nil
+}
+
+// lineWatcher calls onLine for every line written to it, treating carriage
+// returns as line ends since progress output overwrites itself with them.
+type lineWatcher struct {
+	buf    []byte
+	onLine func(string)
+}
+
+func (w *lineWatcher) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexAny(w.buf, "\r\n")
+		if i < 0 {
+			break
+		}
+		w.onLine(strings.TrimSpace(string(w.buf[:i])))
+		w.buf = w.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+type secureEraseMethod struct {
+	kind     string // ata or nvme
+	enhanced bool
+	estimate time.Duration
+}
+
+// secureEraseMethod reports how the drive can erase itself. ATA drives must
+// support the security feature set and not be frozen by the BIOS.
+func (s *StorageService) secureEraseMethod(d *Disk) (*secureEraseMethod, error) {
+	if d.Type == "nvme" {
+		out, err := s.run("nvme", "id-ctrl", d.Path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to identify %s: %v", d.Path, err)
+		}
+		// Bit 1 of OACS: Format NVM supported.
+		for _, line := range strings.Split(string(out), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) == 3 && fields[0] == "oacs" && fields[1] == ":" {
+				if oacs, err := strconv.ParseUint(fields[2], 0, 16); err == nil && oacs&0x2 != 0 {
+					return &secureEraseMethod{kind: "nvme"}, nil
+				}
+			}
+		}
+		return nil, fmt.Errorf("%s does not support NVMe Format", d.Path)
+	}
+	if d.Transport != "sata" && d.Transport != "ata" {
+		return nil, fmt.Errorf("secure erase is not supported for %s disks", d.Transport)
+	}
+
+	out, err := s.run("hdparm", "-I", d.Path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to identify %s: %v", d.Path, err)
+	}
+	// The indented lines under "Security:" hold the flags, e.g.
+	// "\tnot\tfrozen" and "\t\tsupported: enhanced erase".
+	var section []string
+	inSection := false
+	for _, line := range strings.Split(string(out), "\n") {
+		if strings.HasPrefix(line, "Security:") {
+			inSection = true
+			continue
+		}
+		if inSection && line != "" && line[0] != '\t' && line[0] != ' ' {
+			break
+		}
+		if inSection {
+			section = append(section, line)
+		}
+	}
+	security := strings.Join(section, "\n")
+	flags := map[string]bool{}
+	for _, line := range section {
+		flags[strings.Join(strings.Fields(line), " ")] = true
+	}
+	switch {
+	case !flags["supported"]:
+		return nil, fmt.Errorf("%s does not support ATA security erase", d.Path)
+	case !flags["not frozen"]:
+		return nil, fmt.Errorf("%s is security frozen; suspend and resume the system or hot-plug the disk, then retry", d.Path)
+	case !flags["not enabled"]:
+		return nil, fmt.Errorf("%s has an ATA password set", d.Path)
+	}
+	method := &secureEraseMethod{kind: "ata", enhanced: ataEnhancedEraseRe.MatchString(security)}
+	for _, m := range ataEraseTimeRe.FindAllStringSubmatch(security, -1) {
+		if (m[2] != "") == method.enhanced {
+			minutes, _ := strconv.Atoi(m[1])
+			method.estimate = time.Duration(minutes) * time.Minute
+		}
+	}
+	return method, nil
+}
+
+// secureErase runs the drive's own erase. The drive reports no progress,
+// so for ATA it is estimated from the time the drive quotes.
+func (s *WipeService) secureErase(ctx context.Context, job *WipeJob, d *Disk) error {
+	method, err := s.storage.secureEraseMethod(d)
+	if err != nil {
+		return err
+	}
+	if method.kind == "nvme" {
+		if err := s.storage.runner.Stream(ctx, nil, nil, "nvme", "format", d.Path, "--ses=1", "--force"); err != nil {
+			return fmt.Errorf("NVMe format failed: %v", err)
+		}
+		return nil
+	}
+
+	if _, err := s.storage.run("hdparm", "--user-master", "u", "--security-set-pass", ataErasePassword, d.Path); err != nil {
+		return s.storage.clearErasePassword(d, fmt.Errorf("failed to set ATA password: %v", err))
+	}
+	done := make(chan struct{})
+	defer close(done)
+	if method.estimate > 0 {
+		go func() {
+			start := time.Now()
+			ticker := time.NewTicker(10 * time.Second)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-done:
+					return
+				case <-ticker.C:
+					percent := time.Since(start).Seconds() / method.estimate.Seconds() * 100
+					if percent > 99 {
+						percent = 99
+					}
+					s.setJob(job, func(j *WipeJob) { j.Progress = percent })
+				}
+			}
+		}()
+	}
+	erase := "--security-erase"
+	if method.enhanced {
+		erase = "--security-erase-enhanced"
+	}
+	if err := s.storage.runner.Stream(ctx, nil, nil, "hdparm", "--user-master", "u", erase, ataErasePassword, d.Path); err != nil {
+		return s.storage.clearErasePassword(d, fmt.Errorf("ATA secure erase failed: %v", err))
+	}
+	return nil
+}
+
+// clearErasePassword removes the password secureErase set after the erase
+// failed or was stopped; a drive left with it comes back locked after a
+// power cycle. It returns cause, with the password if it is still set.
+func (s *StorageService) clearErasePassword(d *Disk, cause error) error {
+	if _, err := s.run("hdparm", "--user-master", "u", "--security-disable", ataErasePassword, d.Path); err != nil {
+		return fmt.Errorf("%v; clearing the ATA password failed too (%v), unlock the drive with user password %q", cause, err, ataErasePassword)
+	}
+	return cause
+}
@@ -0,0 +1,151 @@
+package services
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSecureEraseClearsPasswordOnFailure(t *testing.T) {
+	t.Setenv("A1NAS_DATA_DIR", t.TempDir())
+	s, fake := fixtureStorage(t)
+	w := NewWipeService(s)
+	disk, err := s.GetDisk("sdw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	disable := "hdparm --user-master u --security-disable " + ataErasePassword + " /dev/sdw"
+	fake.Add("hdparm --user-master u --security-set-pass "+ataErasePassword+" /dev/sdw", FakeResponse{})
+	fake.Add("hdparm --user-master u --security-erase-enhanced "+ataErasePassword+" /dev/sdw", FakeResponse{ExitCode: 5, Stderr: "SECURITY_ERASE: Input/output error"})
+	fake.Add(disable, FakeResponse{})
+
+	err = w.secureErase(context.Background(), &WipeJob{}, disk)
+	if err == nil || !strings.Contains(err.Error(), "ATA secure erase failed") || strings.Contains(err.Error(), "unlock") {
+		t.Errorf("got %v", err)
+	}
+	var disabled bool
+	for _, call := range fake.Calls() {
+		disabled = disabled || call == disable
+	}
+	if !disabled {
+		t.Error("the ATA password was not cleared")
+	}
+
+	fake.Add(disable, FakeResponse{ExitCode: 5, Stderr: "SECURITY_DISABLE: Input/output error"})
+	err = w.secureErase(context.Background(), &WipeJob{}, disk)
+	if err == nil || !strings.Contains(err.Error(), "unlock the drive with user password") {
+		t.Errorf("got %v when the password could not be cleared", err)
+	}
+}
+
+func TestQuickWipeZeroesWholeMiBs(t *testing.T) {
+	s, fake := fixtureStorage(t)
+	disk, err := s.GetDisk("sdv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Offsets are in bytes so 4Kn disks accept the direct writes.
+	zero := []string{
+		"dd if=/dev/zero of=/dev/sdv bs=1M seek=0 count=1048576 iflag=count_bytes oflag=direct,seek_bytes conv=fsync",
+		"dd if=/dev/zero of=/dev/sdv bs=1M seek=15681191936 count=1048576 iflag=count_bytes oflag=direct,seek_bytes conv=fsync",
+	}
+	for _, command := range append([]string{"zpool labelclear -f /dev/sdv", "wipefs --all /dev/sdv"}, zero...) {
+		fake.Add(command, FakeResponse{})
+	}
+	if err := s.quickWipe(context.Background(), disk); err != nil {
+		t.Fatal(err)
+	}
+	var ran []string
+	for _, call := range fake.Calls() {
+		if strings.HasPrefix(call, "dd ") {
+			ran = append(ran, call)
+		}
+	}
+	if strings.Join(ran, "\n") != strings.Join(zero, "\n") {
+		t.Errorf("ran %q", ran)
+	}
+}
+
+func TestSecureEraseMethod(t *testing.T) {
+	_, fixture, err := parseFixture("testdata/commands/hdparm-I-sdw.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ata := &Disk{Path: "/dev/sdw", Type: "disk", Transport: "sata"}
+	nvme := &Disk{Path: "/dev/nvme1n1", Type: "nvme", Transport: "nvme"}
+	tests := []struct {
+		name     string
+		disk     *Disk
+		command  string
+		output   string
+		want     *secureEraseMethod
+		errorHas string
+	}{
+		{"enhanced", ata, "hdparm -I /dev/sdw", fixture.Stdout, &secureEraseMethod{kind: "ata", enhanced: true, estimate: 4 * time.Minute}, ""},
+		{"normal", ata, "hdparm -I /dev/sdw", strings.Replace(fixture.Stdout, "\t\tsupported: enhanced erase", "\tnot\tsupported: enhanced erase", 1),
+			&secureEraseMethod{kind: "ata", estimate: 2 * time.Minute}, ""},
+		{"frozen", ata, "hdparm -I /dev/sdw", strings.Replace(fixture.Stdout, "\tnot\tfrozen", "\t\tfrozen", 1), nil, "security frozen"},
+		{"password set", ata, "hdparm -I /dev/sdw", strings.Replace(fixture.Stdout, "\tnot\tenabled", "\t\tenabled", 1), nil, "ATA password set"},
+		{"unsupported", ata, "hdparm -I /dev/sdw", strings.Replace(fixture.Stdout, "\t\tsupported\n", "\tnot\tsupported\n", 1), nil, "does not support ATA security erase"},
+		{"no security section", ata, "hdparm -I /dev/sdw", "ATA device\nCommands/features:\n\t\tsupported\n", nil, "does not support ATA security erase"},
+		{"usb", &Disk{Path: "/dev/sdv", Transport: "usb"}, "", "", nil, "not supported for usb disks"},
+		{"nvme format", nvme, "nvme id-ctrl /dev/nvme1n1", "vid       : 0x144d\noacs      : 0x17\nacl       : 7\n", &secureEraseMethod{kind: "nvme"}, ""},
+		{"nvme without format", nvme, "nvme id-ctrl /dev/nvme1n1", "vid       : 0x144d\noacs      : 0x5\n", nil, "does not support NVMe Format"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := NewFakeRunner()
+			if tt.command != "" {
+				fake.Add(tt.command, FakeResponse{Stdout: tt.output})
+			}
+			got, err := NewStorageServiceWithRunner(t.TempDir(), fake).secureEraseMethod(tt.disk)
+			if tt.errorHas != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.errorHas) {
+					t.Errorf("got %+v, %v, want an error containing %q", got, err, tt.errorHas)
+				}
+				return
+			}
+			if err != nil || *got != *tt.want {
+				t.Errorf("got %+v, %v, want %+v", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestBusyDiskIsRefusedEverywhere(t *testing.T) {
+	t.Setenv("A1NAS_DATA_DIR", t.TempDir())
+	s, _ := fixtureStorage(t)
+	disk, err := s.GetDisk("sdw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	release, err := s.claimDisk(disk, "a burn-in")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.claimDisk(disk, "a wipe"); err == nil || !strings.Contains(err.Error(), "busy with a burn-in") {
+		t.Errorf("got %v claiming a busy disk", err)
+	}
+	if _, err := NewWipeService(s).RequestToken("sdw", "quick"); err == nil || !strings.Contains(err.Error(), "busy with a burn-in") {
+		t.Errorf("got %v requesting a wipe of a busy disk", err)
+	}
+	if _, err := NewBurnInService(s).Start("sdw"); err == nil || !strings.Contains(err.Error(), "busy with a burn-in") {
+		t.Errorf("got %v starting a second burn-in", err)
+	}
+	if _, err := s.stableDevices([]string{"sdw"}); err == nil || !strings.Contains(err.Error(), "busy") {
+		t.Errorf("got %v adding a busy disk to a pool", err)
+	}
+	result, err := s.PlanPool(PoolPlan{Name: "new", Layout: "mirror", Devices: []string{"sdw", "sdu"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Valid || !strings.Contains(strings.Join(result.Errors, "\n"), "busy with a burn-in") {
+		t.Errorf("planned a pool on a busy disk: %q", result.Errors)
+	}
+
+	release()
+	if _, err := s.unusedDisk("sdw"); err != nil {
+		t.Errorf("got %v once the burn-in released the disk", err)
+	}
+}
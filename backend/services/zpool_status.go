@@ -0,0 +1,405 @@
+package services
+
+import (
+	"bufio"
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PoolStatus is the parsed form of `zpool status <pool>`.
+type PoolStatus struct {
+	Name    string `json:"name"`
+	ID      string `json:"id,omitempty"`
+	State   string `json:"state"`
+	Healthy bool   `json:"healthy"`
+	// Status, Action and See carry the free-text "status:", "action:" and
+	// "see:" paragraphs that ZFS prints when the pool needs attention.
+	Status string      `json:"status,omitempty"`
+	Action string      `json:"action,omitempty"`
+	See    string      `json:"see,omitempty"`
+	Errata string      `json:"errata,omitempty"`
+	Scan   *ScanStatus `json:"scan,omitempty"`
+	// Config is the root vdev (named after the pool) with the data vdevs
+	// as children. Auxiliary vdev classes are listed separately.
+	Config  *VdevStatus   `json:"config,omitempty"`
+	Logs    []*VdevStatus `json:"logs,omitempty"`
+	Cache   []*VdevStatus `json:"cache,omitempty"`
+	Spares  []*VdevStatus `json:"spares,omitempty"`
+	Special []*VdevStatus `json:"special,omitempty"`
+	Dedup   []*VdevStatus `json:"dedup,omitempty"`
+	// Errors is the summary after "errors:"; ErrorFiles lists the paths or
+	// object ids of permanent data errors when `zpool status -v` is used.
+	Errors     string   `json:"errors"`
+	ErrorFiles []string `json:"errorFiles,omitempty"`
+	Raw        string   `json:"raw"`
+}
+
+// VdevStatus is one row of the config tree: a disk, a grouping vdev such as
+// mirror-0/raidz2-1/replacing-0, or the pool itself.
+type VdevStatus struct {
+	Name     string        `json:"name"`
+	State    string        `json:"state"`
+	Read     uint64        `json:"read"`
+	Write    uint64        `json:"write"`
+	Cksum    uint64        `json:"cksum"`
+	Note     string        `json:"note,omitempty"`
+	Children []*VdevStatus `json:"children,omitempty"`
+}
+
+// ScanStatus describes the last or current scrub/resilver.
+type ScanStatus struct {
+	Function string     `json:"function"` // scrub, resilver or none
+	State    string     `json:"state"`    // none, scanning, paused, finished, canceled
+	Start    *time.Time `json:"start,omitempty"`
+	End      *time.Time `json:"end,omitempty"`
+	Scanned  uint64     `json:"scanned"`
+	Issued   uint64     `json:"issued"`
+	Total    uint64     `json:"total"`
+	// Repaired is the amount repaired by a scrub or resilvered by a resilver.
+	Repaired   uint64  `json:"repaired"`
+	ScanRate   uint64  `json:"scanRate"`
+	IssueRate  uint64  `json:"issueRate"`
+	Percent    float64 `json:"percent"`
+	ETA        string  `json:"eta,omitempty"`
+	ETASeconds int64   `json:"etaSeconds,omitempty"`
+	Duration   string  `json:"duration,omitempty"`
+	Errors     uint64  `json:"errors"`
+	Raw        string  `json:"raw"`
+}
+
+const zpoolTimeLayout = "Mon Jan _2 15:04:05 2006"
+
+var (
+	vdevClasses = map[string]bool{"logs": true, "cache": true, "spares": true, "special": true, "dedup": true}
+
+	scanProgressRe = regexp.MustCompile(`^(scrub|resilver|error scrub) in progress since (.+)$`)
+	scanPausedRe   = regexp.MustCompile(`^(scrub|error scrub) paused since (.+)$`)
+	scanCanceledRe = regexp.MustCompile(`^(scrub|resilver|error scrub) canceled on (.+)$`)
+	scanFinishedRe = regexp.MustCompile(`^(?:(scrub) repaired|(resilver)ed) (\S+) in (.+) with (\d+) errors on (.+)$`)
+
+	scanScannedRe  = regexp.MustCompile(`(\S+)(?: / \S+)? scanned(?: at (\S+)/s)?`)
+	scanIssuedRe   = regexp.MustCompile(`(\S+)(?: / (\S+))? issued(?: at (\S+)/s)?`)
+	scanTotalRe    = regexp.MustCompile(`(\S+) total`)
+	scanRepairedRe = regexp.MustCompile(`(\S+) (?:repaired|resilvered),`)
+	scanPercentRe  = regexp.MustCompile(`([\d.]+)% done`)
+	scanETARe      = regexp.MustCompile(`([^,]+) to go`)
+	etaRe          = regexp.MustCompile(`^(?:(\d+) days? )?(\d+):(\d+):(\d+)$`)
+)
+
+// ParseZpoolStatus parses the output of `zpool status` for a single pool.
+func ParseZpoolStatus(output string) (*PoolStatus, error) {
+	status := &PoolStatus{Raw: output}
+
+	// Split the output into "key: value" sections. Continuation lines are
+	// indented with a tab and belong to the preceding key.
+	var order []string
+	sections := map[string][]string{}
+	current := ""
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if key, value, ok := splitStatusKey(line); ok {
+			current = key
+			order = append(order, key)
+			sections[key] = []string{value}
+			continue
+		}
+		if current != "" {
+			sections[current] = append(sections[current], line)
+		}
+	}
+	if len(order) == 0 || order[0] != "pool" {
+		return nil, errors.New("unrecognized zpool status output")
+	}
+
+	status.Name = strings.TrimSpace(sections["pool"][0])
+	if id, ok := sections["id"]; ok {
+		status.ID = strings.TrimSpace(id[0])
+	}
+	if state, ok := sections["state"]; ok {
+		status.State = strings.TrimSpace(state[0])
+	}
+	status.Healthy = status.State == "ONLINE"
+	status.Status = joinParagraph(sections["status"])
+	status.Action = joinParagraph(sections["action"])
+	status.See = joinParagraph(sections["see"])
+	status.Errata = joinParagraph(sections["errata"])
+	if lines, ok := sections["scan"]; ok {
+		status.Scan = parseScan(lines)
+	}
+	if lines, ok := sections["config"]; ok {
+		if err := parseConfig(status, lines); err != nil {
+			return nil, err
+		}
+	}
+	if lines, ok := sections["errors"]; ok {
+		status.Errors = strings.TrimSpace(lines[0])
+		for _, l := range lines[1:] {
+			if l = strings.TrimSpace(l); l != "" {
+				status.ErrorFiles = append(status.ErrorFiles, l)
+			}
+		}
+	}
+	return status, nil
+}
+
+// splitStatusKey recognizes the right-aligned "  pool: tank" style headers.
+func splitStatusKey(line string) (string, string, bool) {
+	if line == "" || line[0] == '\t' {
+		return "", "", false
+	}
+	trimmed := strings.TrimLeft(line, " ")
+	idx := strings.Index(trimmed, ":")
+	if idx <= 0 {
+		return "", "", false
+	}
+	key := trimmed[:idx]
+	switch key {
+	case "pool", "id", "state", "status", "action", "see", "scan", "config", "errors", "errata", "remove", "checkpoint", "comment":
+		return key, strings.TrimSpace(trimmed[idx+1:]), true
+	}
+	return "", "", false
+}
+
+func joinParagraph(lines []string) string {
+	var parts []string
+	for _, l := range lines {
+		if l = strings.TrimSpace(l); l != "" {
+			parts = append(parts, l)
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+func parseScan(lines []string) *ScanStatus {
+	scan := &ScanStatus{Function: "none", State: "none"}
+	var raw []string
+	for _, l := range lines {
+		if l = strings.TrimSpace(l); l != "" {
+			raw = append(raw, l)
+		}
+	}
+	scan.Raw = strings.Join(raw, "\n")
+	if len(raw) == 0 || raw[0] == "none requested" {
+		return scan
+	}
+
+	first := raw[0]
+	switch {
+	case scanProgressRe.MatchString(first):
+		m := scanProgressRe.FindStringSubmatch(first)
+		scan.Function, scan.State = scanFunction(m[1]), "scanning"
+		scan.Start = parseZpoolTime(m[2])
+	case scanPausedRe.MatchString(first):
+		m := scanPausedRe.FindStringSubmatch(first)
+		scan.Function, scan.State = scanFunction(m[1]), "paused"
+		scan.Start = parseZpoolTime(m[2])
+	case scanCanceledRe.MatchString(first):
+		m := scanCanceledRe.FindStringSubmatch(first)
+		scan.Function, scan.State = scanFunction(m[1]), "canceled"
+		scan.End = parseZpoolTime(m[2])
+	case scanFinishedRe.MatchString(first):
+		m := scanFinishedRe.FindStringSubmatch(first)
+		scan.Function, scan.State = "scrub", "finished"
+		if m[2] != "" {
+			scan.Function = "resilver"
+		}
+		scan.Repaired, _ = parseZFSSize(m[3])
+		scan.Duration = m[4]
+		scan.Errors, _ = strconv.ParseUint(m[5], 10, 64)
+		scan.End = parseZpoolTime(m[6])
+		scan.Percent = 100
+		return scan
+	}
+
+	// Progress details follow on the continuation lines.
+	details := strings.Join(raw[1:], ", ")
+	if m := scanScannedRe.FindStringSubmatch(details); m != nil {
+		scan.Scanned, _ = parseZFSSize(m[1])
+		scan.ScanRate, _ = parseZFSSize(m[2])
+	}
+	if m := scanIssuedRe.FindStringSubmatch(details); m != nil {
+		scan.Issued, _ = parseZFSSize(m[1])
+		if m[2] != "" {
+			scan.Total, _ = parseZFSSize(m[2])
+		}
+		scan.IssueRate, _ = parseZFSSize(m[3])
+	}
+	if m := scanTotalRe.FindStringSubmatch(details); m != nil {
+		scan.Total, _ = parseZFSSize(m[1])
+	}
+	if m := scanRepairedRe.FindStringSubmatch(details); m != nil {
+		scan.Repaired, _ = parseZFSSize(m[1])
+	}
+	if m := scanPercentRe.FindStringSubmatch(details); m != nil {
+		scan.Percent, _ = strconv.ParseFloat(m[1], 64)
+	}
+	if m := scanETARe.FindStringSubmatch(details); m != nil {
+		scan.ETA = strings.TrimSpace(m[1])
+		scan.ETASeconds = parseETA(m[1])
+	}
+	return scan
+}
+
+func scanFunction(s string) string {
+	if s == "error scrub" {
+		return "errorscrub"
+	}
+	return s
+}
+
+func parseZpoolTime(s string) *time.Time {
+	t, err := time.ParseInLocation(zpoolTimeLayout, strings.TrimSpace(s), time.Local)
+	if err != nil {
+		return nil
+	}
+	return &t
+}
+
+// parseETA converts "00:03:10" or "1 days 02:03:04" into seconds.
+func parseETA(s string) int64 {
+	m := etaRe.FindStringSubmatch(strings.TrimSpace(s))
+	if m == nil {
+		return 0
+	}
+	var total int64
+	if m[1] != "" {
+		days, _ := strconv.ParseInt(m[1], 10, 64)
+		total += days * 86400
+	}
+	h, _ := strconv.ParseInt(m[2], 10, 64)
+	min, _ := strconv.ParseInt(m[3], 10, 64)
+	sec, _ := strconv.ParseInt(m[4], 10, 64)
+	return total + h*3600 + min*60 + sec
+}
+
+// parseConfig builds the vdev tree from the indented NAME/STATE table.
+// `zpool import` prints the same table without the header and counters.
+func parseConfig(status *PoolStatus, lines []string) error {
+	type frame struct {
+		indent int
+		vdev   *VdevStatus
+	}
+	var stack []frame
+	var class string
+
+	for _, line := range lines {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		body := strings.TrimPrefix(line, "\t")
+		indent := len(body) - len(strings.TrimLeft(body, " "))
+		fields := strings.Fields(body)
+		if indent == 0 && fields[0] == "NAME" && len(fields) > 1 && fields[1] == "STATE" {
+			continue
+		}
+
+		if indent == 0 {
+			stack = stack[:0]
+			if vdevClasses[fields[0]] && len(fields) == 1 {
+				class = fields[0]
+				continue
+			}
+			class = ""
+			if fields[0] != status.Name {
+				continue
+			}
+			status.Config = parseVdevLine(fields)
+			stack = append(stack, frame{indent: 0, vdev: status.Config})
+			continue
+		}
+
+		vdev := parseVdevLine(fields)
+		for len(stack) > 0 && stack[len(stack)-1].indent >= indent {
+			stack = stack[:len(stack)-1]
+		}
+		switch {
+		case len(stack) > 0:
+			parent := stack[len(stack)-1].vdev
+			parent.Children = append(parent.Children, vdev)
+		case class == "logs":
+			status.Logs = append(status.Logs, vdev)
+		case class == "cache":
+			status.Cache = append(status.Cache, vdev)
+		case class == "spares":
+			status.Spares = append(status.Spares, vdev)
+		case class == "special":
+			status.Special = append(status.Special, vdev)
+		case class == "dedup":
+			status.Dedup = append(status.Dedup, vdev)
+		}
+		stack = append(stack, frame{indent: indent, vdev: vdev})
+	}
+	if status.Config == nil {
+		return errors.New("zpool status output has no config table")
+	}
+	return nil
+}
+
+func parseVdevLine(fields []string) *VdevStatus {
+	vdev := &VdevStatus{Name: fields[0]}
+	if len(fields) > 1 {
+		vdev.State = fields[1]
+	}
+	if len(fields) <= 2 {
+		return vdev
+	}
+	// Spares and some unavailable devices omit the error counters.
+	rest := fields[2:]
+	if len(fields) >= 5 {
+		read, errR := parseZFSCount(fields[2])
+		write, errW := parseZFSCount(fields[3])
+		cksum, errC := parseZFSCount(fields[4])
+		if errR == nil && errW == nil && errC == nil {
+			vdev.Read, vdev.Write, vdev.Cksum = read, write, cksum
+			rest = fields[5:]
+		}
+	}
+	vdev.Note = strings.Join(rest, " ")
+	return vdev
+}
+
+// parseZFSCount parses error counters, which ZFS abbreviates as e.g. "1.2K".
+func parseZFSCount(s string) (uint64, error) {
+	if n, err := strconv.ParseUint(s, 10, 64); err == nil {
+		return n, nil
+	}
+	n, ok := parseZFSSize(s)
+	if !ok {
+		return 0, errors.New("invalid counter")
+	}
+	return n, nil
+}
+
+// parseZFSSize parses human-readable ZFS sizes such as "1.23G" or "0B".
+func parseZFSSize(s string) (uint64, bool) {
+	s = strings.TrimSpace(s)
+	if s == "" || s == "-" {
+		return 0, false
+	}
+	mult := 1.0
+	switch s[len(s)-1] {
+	case 'B':
+		s = s[:len(s)-1]
+	case 'K':
+		mult, s = 1<<10, s[:len(s)-1]
+	case 'M':
+		mult, s = 1<<20, s[:len(s)-1]
+	case 'G':
+		mult, s = 1<<30, s[:len(s)-1]
+	case 'T':
+		mult, s = 1<<40, s[:len(s)-1]
+	case 'P':
+		mult, s = 1<<50, s[:len(s)-1]
+	case 'E':
+		mult, s = 1<<60, s[:len(s)-1]
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, false
+	}
+	return uint64(f * mult), true
+}
@@ -0,0 +1,214 @@
+package services
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fixtureStatus parses the recorded `zpool status -v <pool>` output.
+func fixtureStatus(t *testing.T, pool string) *PoolStatus {
+	t.Helper()
+	_, resp, err := parseFixture(filepath.Join("testdata", "commands", "zpool-status-"+pool+".txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, err := ParseZpoolStatus(resp.Stdout)
+	if err != nil {
+		t.Fatalf("%s: %v", pool, err)
+	}
+	return status
+}
+
+func vdevNames(vdevs []*VdevStatus) string {
+	var names []string
+	for _, v := range vdevs {
+		names = append(names, v.Name)
+	}
+	return strings.Join(names, ",")
+}
+
+// zfsBytes converts a fractional size as ZFS prints it, e.g. 1.23 GiB.
+func zfsBytes(f float64, shift uint) uint64 {
+	return uint64(f * float64(uint64(1)<<shift))
+}
+
+func TestParseZpoolStatusLayouts(t *testing.T) {
+	tests := []struct {
+		pool    string
+		state   string
+		healthy bool
+		vdev    string
+		disks   string
+		scan    string // function/state
+	}{
+		{"tank", "DEGRADED", false, "mirror-0", "sda,replacing-1", "resilver/scanning"},
+		{"media", "ONLINE", true, "raidz1-0", "sdg,sdh,sdi", "scrub/scanning"},
+		{"vault", "ONLINE", true, "raidz2-0", "sdj,sdk,sdl,sdm", "scrub/finished"},
+		{"archive", "ONLINE", true, "raidz3-0", "sdn,sdo,sdp,sdq,sdr", "scrub/finished"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pool, func(t *testing.T) {
+			status := fixtureStatus(t, tt.pool)
+			if status.Name != tt.pool || status.State != tt.state || status.Healthy != tt.healthy {
+				t.Errorf("got name %q state %q healthy %v", status.Name, status.State, status.Healthy)
+			}
+			if status.Config == nil || status.Config.Name != tt.pool || len(status.Config.Children) != 1 {
+				t.Fatalf("unexpected config %+v", status.Config)
+			}
+			vdev := status.Config.Children[0]
+			if vdev.Name != tt.vdev || vdevNames(vdev.Children) != tt.disks {
+				t.Errorf("got vdev %s with %s, want %s with %s", vdev.Name, vdevNames(vdev.Children), tt.vdev, tt.disks)
+			}
+			if got := status.Scan.Function + "/" + status.Scan.State; got != tt.scan {
+				t.Errorf("got scan %s, want %s", got, tt.scan)
+			}
+			if status.Errors != "No known data errors" {
+				t.Errorf("got errors %q", status.Errors)
+			}
+		})
+	}
+}
+
+func TestParseZpoolStatusDegraded(t *testing.T) {
+	status := fixtureStatus(t, "tank")
+	if !strings.HasPrefix(status.Status, "One or more devices is currently being resilvered.") || status.Action != "Wait for the resilver to complete." {
+		t.Errorf("got status %q action %q", status.Status, status.Action)
+	}
+	replacing := status.Config.Children[0].Children[1]
+	if replacing.State != "DEGRADED" || len(replacing.Children) != 2 {
+		t.Fatalf("unexpected replacing vdev %+v", replacing)
+	}
+	old, resilvering := replacing.Children[0], replacing.Children[1]
+	if old.State != "UNAVAIL" || old.Cksum != 1228 || old.Note != "cannot open" {
+		t.Errorf("got %+v", old)
+	}
+	if resilvering.Note != "(resilvering)" {
+		t.Errorf("got note %q", resilvering.Note)
+	}
+	if vdevNames(status.Logs) != "sdd" || vdevNames(status.Cache) != "sde" || vdevNames(status.Spares) != "sdf" {
+		t.Errorf("got logs %s cache %s spares %s", vdevNames(status.Logs), vdevNames(status.Cache), vdevNames(status.Spares))
+	}
+	if status.Spares[0].State != "AVAIL" {
+		t.Errorf("got spare state %q", status.Spares[0].State)
+	}
+
+	scan := status.Scan
+	if scan.Scanned != zfsBytes(1.23, 30) || scan.ScanRate != 100<<20 || scan.Issued != 500<<20 || scan.IssueRate != 50<<20 {
+		t.Errorf("got scanned %d at %d, issued %d at %d", scan.Scanned, scan.ScanRate, scan.Issued, scan.IssueRate)
+	}
+	if scan.Total != 10<<30 || scan.Repaired != 480<<20 || scan.Percent != 5 || scan.ETA != "00:03:10" || scan.ETASeconds != 190 {
+		t.Errorf("got total %d repaired %d percent %v eta %q (%d)", scan.Total, scan.Repaired, scan.Percent, scan.ETA, scan.ETASeconds)
+	}
+	if scan.Start == nil || scan.Start.Format("2006-01-02 15:04:05") != "2026-10-18 10:00:00" {
+		t.Errorf("got start %v", scan.Start)
+	}
+}
+
+func TestParseZpoolStatusArchive(t *testing.T) {
+	status := fixtureStatus(t, "archive")
+	if status.See != "https://openzfs.github.io/openzfs-docs/msg/ZFS-8000-9P" {
+		t.Errorf("got see %q", status.See)
+	}
+	if sdo := status.Config.Children[0].Children[1]; sdo.Cksum != 2 {
+		t.Errorf("got %+v", sdo)
+	}
+	if scan := status.Scan; scan.Repaired != 64<<10 || scan.Duration != "05:12:40" || scan.Percent != 100 || scan.End == nil {
+		t.Errorf("got %+v", scan)
+	}
+}
+
+func TestParseZpoolStatusErrorFiles(t *testing.T) {
+	output := `  pool: tank
+ state: ONLINE
+config:
+
+	NAME        STATE     READ WRITE CKSUM
+	tank        ONLINE       0     0     0
+	  sda       ONLINE       0     0     0
+
+errors: Permanent errors have been detected in the following files:
+
+        tank/data:<0x0>
+        /tank/file.txt
+`
+	status, err := ParseZpoolStatus(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Scan != nil {
+		t.Errorf("got scan %+v without a scan line", status.Scan)
+	}
+	if strings.Join(status.ErrorFiles, ",") != "tank/data:<0x0>,/tank/file.txt" {
+		t.Errorf("got error files %q", status.ErrorFiles)
+	}
+	if _, err := ParseZpoolStatus("cannot open 'tank': no such pool\n"); err == nil {
+		t.Error("expected an error for output without a pool")
+	}
+}
+
+func TestParseScan(t *testing.T) {
+	tests := []struct {
+		lines    []string
+		function string
+		state    string
+		percent  float64
+		eta      int64
+	}{
+		{[]string{"none requested"}, "none", "none", 0, 0},
+		{[]string{"scrub in progress since Sun Oct 18 10:00:00 2026",
+			"\t15.1T / 21.7T scanned at 1.48G/s, 14.8T / 21.7T issued at 1.45G/s",
+			"\t0B repaired, 68.25% done, 1 days 01:21:47 to go"}, "scrub", "scanning", 68.25, 86400 + 4907},
+		{[]string{"scrub paused since Sun Oct 18 10:00:00 2026",
+			"\t1.00T scanned, 512G issued, 2.00T total",
+			"\t0B repaired, 25.00% done"}, "scrub", "paused", 25, 0},
+		{[]string{"scrub canceled on Sun Oct 18 10:00:00 2026"}, "scrub", "canceled", 0, 0},
+		{[]string{"error scrub in progress since Sun Oct 18 10:00:00 2026"}, "errorscrub", "scanning", 0, 0},
+		{[]string{"resilvered 480M in 00:10:00 with 0 errors on Sun Oct 18 10:00:00 2026"}, "resilver", "finished", 100, 0},
+		{[]string{"scrub repaired 0B in 0 days 01:02:03 with 3 errors on Sun Oct 18 10:00:00 2026"}, "scrub", "finished", 100, 0},
+	}
+	for _, tt := range tests {
+		scan := parseScan(tt.lines)
+		if scan.Function != tt.function || scan.State != tt.state || scan.Percent != tt.percent || scan.ETASeconds != tt.eta {
+			t.Errorf("%q: got %s/%s %v%% eta %d, want %s/%s %v%% eta %d", tt.lines[0],
+				scan.Function, scan.State, scan.Percent, scan.ETASeconds, tt.function, tt.state, tt.percent, tt.eta)
+		}
+	}
+
+	scan := parseScan(tests[1].lines)
+	if scan.Scanned != zfsBytes(15.1, 40) || scan.Total != zfsBytes(21.7, 40) || scan.IssueRate != zfsBytes(1.45, 30) {
+		t.Errorf("got scanned %d total %d issue rate %d", scan.Scanned, scan.Total, scan.IssueRate)
+	}
+	if scan := parseScan(tests[6].lines); scan.Errors != 3 || scan.Duration != "0 days 01:02:03" {
+		t.Errorf("got errors %d duration %q", scan.Errors, scan.Duration)
+	}
+}
+
+func TestParseZFSSize(t *testing.T) {
+	tests := []struct {
+		in   string
+		want uint64
+		ok   bool
+	}{
+		{"0B", 0, true},
+		{"512", 512, true},
+		{"1.5K", 1536, true},
+		{"480M", 480 << 20, true},
+		{"1.23G", zfsBytes(1.23, 30), true},
+		{"2T", 2 << 40, true},
+		{"1P", 1 << 50, true},
+		{"1E", 1 << 60, true},
+		{"-", 0, false},
+		{"", 0, false},
+		{"abc", 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := parseZFSSize(tt.in)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("parseZFSSize(%q) = %d, %v, want %d, %v", tt.in, got, ok, tt.want, tt.ok)
+		}
+	}
+	if n, err := parseZFSCount("1.2K"); err != nil || n != 1228 {
+		t.Errorf("parseZFSCount(1.2K) = %d, %v", n, err)
+	}
+}
@@ -56,7 +56,7 @@ export const storageApi = {
       },
     });
   },
-  downloadFile: (path) => api.get(`/storage/files/${path}/download`, { responseType: 'blob' }),
+  downloadFile: (path) => api.get(`/storage/download/${path}`, { responseType: 'blob' }),
   deleteItem: (path) => api.delete(`/storage/files/${path}`),
   createDirectory: (path) => api.post(`/storage/directories/${path}`),
   moveItem: (source, destination) => api.post('/storage/move', { source, destination }),